@@ -30,9 +30,11 @@ import (
 	"github.com/ngaut/unistore/config"
 	"github.com/ngaut/unistore/pd"
 	"github.com/ngaut/unistore/server"
+	"github.com/ngaut/unistore/tikv"
 	"github.com/pingcap/badger"
 	"github.com/pingcap/badger/y"
 	"github.com/pingcap/kvproto/pkg/deadlock"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/kvproto/pkg/tikvpb"
 	"github.com/pingcap/log"
 	"github.com/zhangjinpeng1987/raft"
@@ -144,6 +146,7 @@ func main() {
 		grpc.MaxRecvMsgSize(10*1024*1024),
 	)
 	tikvpb.RegisterTikvServer(grpcServer, tikvServer)
+	import_sstpb.RegisterImportSSTServer(grpcServer, tikv.NewImportSSTServer(tikvServer))
 	listenAddr := conf.Server.StoreAddr[strings.IndexByte(conf.Server.StoreAddr, ':'):]
 	l, err := net.Listen("tcp", listenAddr)
 	deadlock.RegisterDeadlockServer(grpcServer, tikvServer)
@@ -156,6 +159,8 @@ func main() {
 		http.HandleFunc("/status", func(writer http.ResponseWriter, request *http.Request) {
 			writer.WriteHeader(http.StatusOK)
 		})
+		http.HandleFunc("/deadlock/wait_for_entries", tikvServer.HandleWaitForEntries)
+		http.HandleFunc("/deadlock/history", tikvServer.HandleDeadlockHistory)
 		err := http.ListenAndServe(conf.Server.StatusAddr, nil)
 		if err != nil {
 			log.S().Fatal(err)
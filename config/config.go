@@ -45,6 +45,7 @@ type RaftStore struct {
 	RaftBaseTickInterval     string `toml:"raft-base-tick-interval"`     // raft-base-tick-interval in milliseconds
 	RaftHeartbeatTicks       int    `toml:"raft-heartbeat-ticks"`        // raft-heartbeat-ticks times
 	RaftElectionTimeoutTicks int    `toml:"raft-election-timeout-ticks"` // raft-election-timeout-ticks times
+	ConsistencyCheckInterval string `toml:"consistency-check-interval"`  // consistency-check-interval in seconds, 0 disables the check
 	CustomRaftLog            bool   `toml:"custom-raft-log"`
 }
 
@@ -86,6 +87,18 @@ type PessimisticTxn struct {
 
 	// The duration between waking up lock waiter, in milliseconds
 	WakeUpDelayDuration int64 `toml:"wake-up-delay-duration"`
+
+	// The order to wake up the waiters on a key, "fifo" wakes up the smallest start ts first,
+	// "priority" wakes up the highest priority in the request context first.
+	WaitQueuePolicy string `toml:"wait-queue-policy"`
+
+	// The priority policy promotes a waiter by one priority level for every duration it waits, in milliseconds.
+	// 0 means no promotion.
+	WaitQueueAgingDuration int64 `toml:"wait-queue-aging-duration"`
+
+	// The max number of waiters on a key, the requests exceeding it return the server is busy error without waiting.
+	// 0 means no limit.
+	MaxWaitersPerKey int `toml:"max-waiters-per-key"`
 }
 
 func ParseCompression(s string) options.CompressionType {
@@ -118,6 +131,7 @@ var DefaultConf = Config{
 		RaftBaseTickInterval:     "1s",
 		RaftHeartbeatTicks:       2,
 		RaftElectionTimeoutTicks: 10,
+		ConsistencyCheckInterval: "24h",
 		CustomRaftLog:            true,
 	},
 	Engine: Engine{
@@ -142,8 +156,11 @@ var DefaultConf = Config{
 		RegionSplitKeys: 960000,
 	},
 	PessimisticTxn: PessimisticTxn{
-		WaitForLockTimeout:  1000, // 1000ms same with tikv default value
-		WakeUpDelayDuration: 100,  // 100ms same with tikv default value
+		WaitForLockTimeout:     1000, // 1000ms same with tikv default value
+		WakeUpDelayDuration:    100,  // 100ms same with tikv default value
+		WaitQueuePolicy:        "fifo",
+		WaitQueueAgingDuration: 200,
+		MaxWaitersPerKey:       0,
 	},
 }
 
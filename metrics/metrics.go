@@ -21,8 +21,10 @@ import (
 )
 
 const (
-	namespace = "unistore"
-	raft      = "raft"
+	namespace  = "unistore"
+	raft       = "raft"
+	deadlock   = "deadlock"
+	lockWaiter = "lock_waiter"
 )
 
 var (
@@ -97,6 +99,44 @@ var (
 			Name:      "batch_size",
 			Buckets:   prometheus.ExponentialBuckets(1, 1.5, 20),
 		})
+
+	DetectorIsLeader = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: deadlock,
+			Name:      "detector_is_leader",
+		})
+	DetectorRPCFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: deadlock,
+			Name:      "detector_rpc_failures",
+		}, []string{"type"})
+
+	LockWaiterWaits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: lockWaiter,
+			Name:      "waits",
+		})
+	LockWaiterQueueFull = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: lockWaiter,
+			Name:      "queue_full",
+		})
+	LockWaiterTimeouts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: lockWaiter,
+			Name:      "timeouts",
+		})
+	LockWaiterWakeUps = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: lockWaiter,
+			Name:      "wake_ups",
+		}, []string{"type"})
 )
 
 func init() {
@@ -110,5 +150,11 @@ func init() {
 	prometheus.MustRegister(LockUpdate)
 	prometheus.MustRegister(RaftBatchSize)
 	prometheus.MustRegister(LatchWait)
+	prometheus.MustRegister(DetectorIsLeader)
+	prometheus.MustRegister(DetectorRPCFailures)
+	prometheus.MustRegister(LockWaiterWaits)
+	prometheus.MustRegister(LockWaiterQueueFull)
+	prometheus.MustRegister(LockWaiterTimeouts)
+	prometheus.MustRegister(LockWaiterWakeUps)
 	http.Handle("/metrics", promhttp.Handler())
 }
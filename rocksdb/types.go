@@ -140,4 +140,14 @@ type CompactedEvent struct {
 	TotalOutputBytes int
 	StartKey         []byte
 	EndKey           []byte
+	// Ranges are the sizes of the sub ranges of [StartKey, EndKey) before and after the compaction.
+	Ranges []CompactedRange
+}
+
+// CompactedRange is the size of the keys in [StartKey, EndKey) before and after a compaction.
+type CompactedRange struct {
+	StartKey    []byte
+	EndKey      []byte
+	InputBytes  uint64
+	OutputBytes uint64
 }
@@ -17,8 +17,9 @@ import (
 )
 
 const (
-	subPathRaft = "raft"
-	subPathKV   = "kv"
+	subPathRaft    = "raft"
+	subPathKV      = "kv"
+	subPathLockWAL = "lockwal"
 )
 
 func NewMock(conf *config.Config, clusterID uint64) (*tikv.Server, *tikv.MockRegionManager, *tikv.MockPD, error) {
@@ -26,7 +27,7 @@ func NewMock(conf *config.Config, clusterID uint64) (*tikv.Server, *tikv.MockReg
 	ts := uint64(physical)<<18 + uint64(logical)
 
 	safePoint := &tikv.SafePoint{}
-	db, err := createDB(subPathKV, safePoint, &conf.Engine)
+	db, err := createDB(subPathKV, safePoint, nil, &conf.Engine)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -60,7 +61,11 @@ func New(conf *config.Config, pdClient pd.Client) (*tikv.Server, error) {
 	ts := uint64(physical)<<18 + uint64(logical)
 
 	safePoint := &tikv.SafePoint{}
-	db, err := createDB(subPathKV, safePoint, &conf.Engine)
+	var compactionListener *raftstore.CompactionListener
+	if conf.Server.Raft {
+		compactionListener = raftstore.NewCompactionListener()
+	}
+	db, err := createDB(subPathKV, safePoint, compactionListener, &conf.Engine)
 	if err != nil {
 		return nil, err
 	}
@@ -70,7 +75,7 @@ func New(conf *config.Config, pdClient pd.Client) (*tikv.Server, error) {
 		StateTS:   ts,
 	}
 	if conf.Server.Raft {
-		return setupRaftServer(bundle, safePoint, pdClient, conf)
+		return setupRaftServer(bundle, safePoint, compactionListener, pdClient, conf)
 	}
 
 	rm := tikv.NewStandAloneRegionManager(bundle, getRegionOptions(conf), pdClient)
@@ -85,7 +90,8 @@ func getRegionOptions(conf *config.Config) tikv.RegionOptions {
 	}
 }
 
-func setupRaftServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, pdClient pd.Client, conf *config.Config) (*tikv.Server, error) {
+func setupRaftServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, compactionListener *raftstore.CompactionListener,
+	pdClient pd.Client, conf *config.Config) (*tikv.Server, error) {
 	dbPath := conf.Engine.DBPath
 	kvPath := filepath.Join(dbPath, "kv")
 	raftPath := filepath.Join(dbPath, "raft")
@@ -99,7 +105,7 @@ func setupRaftServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, pdClient
 	raftConf.SnapPath = snapPath
 	setupRaftStoreConf(raftConf, conf)
 
-	raftDB, err := createDB(subPathRaft, nil, &conf.Engine)
+	raftDB, err := createDB(subPathRaft, nil, nil, &conf.Engine)
 	if err != nil {
 		return nil, err
 	}
@@ -117,14 +123,17 @@ func setupRaftServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, pdClient
 	}
 
 	engines := raftstore.NewEngines(bundle, raftDB, kvPath, raftPath)
+	engines.SetCompactionListener(compactionListener)
 
 	innerServer := raftstore.NewRaftInnerServer(conf, engines, raftConf)
 	innerServer.Setup(pdClient)
 	router := innerServer.GetRaftstoreRouter()
 	storeMeta := innerServer.GetStoreMeta()
-	store := tikv.NewMVCCStore(conf, bundle, dbPath, safePoint, raftstore.NewDBWriter(conf, router), pdClient)
+	store := tikv.NewMVCCStore(conf, bundle, dbPath, safePoint, raftstore.NewDBWriter(conf, bundle, router), pdClient)
 	rm := tikv.NewRaftRegionManager(storeMeta, router, store.DeadlockDetectSvr)
 	innerServer.SetPeerEventObserver(rm)
+	innerServer.SetReadIndexObserver(store)
+	rm.StartResolvedTSWorker(store)
 
 	if err := innerServer.Start(pdClient); err != nil {
 		return nil, err
@@ -136,9 +145,13 @@ func setupRaftServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, pdClient
 }
 
 func setupStandAlongInnerServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, rm tikv.RegionManager, pdClient pd.Client, conf *config.Config) (*tikv.Server, error) {
+	lockWAL, err := tikv.OpenLockWAL(filepath.Join(conf.Engine.DBPath, subPathLockWAL), bundle.LockStore)
+	if err != nil {
+		return nil, err
+	}
 	innerServer := tikv.NewStandAlongInnerServer(bundle)
 	innerServer.Setup(pdClient)
-	store := tikv.NewMVCCStore(conf, bundle, conf.Engine.DBPath, safePoint, tikv.NewDBWriter(bundle), pdClient)
+	store := tikv.NewMVCCStore(conf, bundle, conf.Engine.DBPath, safePoint, tikv.NewDBWriter(bundle, lockWAL), pdClient)
 	store.DeadlockDetectSvr.ChangeRole(tikv.Leader)
 
 	if err := innerServer.Start(pdClient); err != nil {
@@ -159,13 +172,15 @@ func setupRaftStoreConf(raftConf *raftstore.Config, conf *config.Config) {
 	raftConf.RaftBaseTickInterval = config.ParseDuration(conf.RaftStore.RaftBaseTickInterval)
 	raftConf.RaftHeartbeatTicks = conf.RaftStore.RaftHeartbeatTicks
 	raftConf.RaftElectionTimeoutTicks = conf.RaftStore.RaftElectionTimeoutTicks
+	raftConf.ConsistencyCheckInterval = config.ParseDuration(conf.RaftStore.ConsistencyCheckInterval)
 
 	// coprocessor block
 	raftConf.SplitCheck.RegionMaxKeys = uint64(conf.Coprocessor.RegionMaxKeys)
 	raftConf.SplitCheck.RegionSplitKeys = uint64(conf.Coprocessor.RegionSplitKeys)
 }
 
-func createDB(subPath string, safePoint *tikv.SafePoint, conf *config.Engine) (*badger.DB, error) {
+func createDB(subPath string, safePoint *tikv.SafePoint, compactionListener *raftstore.CompactionListener,
+	conf *config.Engine) (*badger.DB, error) {
 	opts := badger.DefaultOptions
 	opts.NumCompactors = conf.NumCompactors
 	opts.ValueThreshold = conf.ValueThreshold
@@ -198,6 +213,9 @@ func createDB(subPath string, safePoint *tikv.SafePoint, conf *config.Engine) (*
 	opts.TableBuilderOptions.SuRFStartLevel = conf.SurfStartLevel
 	if safePoint != nil {
 		opts.CompactionFilterFactory = safePoint.CreateCompactionFilter
+		if compactionListener != nil {
+			opts.CompactionFilterFactory = compactionListener.WrapFilterFactory(safePoint.CreateCompactionFilter)
+		}
 	}
 	opts.CompactL0WhenClose = conf.CompactL0WhenClose
 	opts.VolatileMode = conf.VolatileMode
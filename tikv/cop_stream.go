@@ -0,0 +1,144 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bytes"
+
+	"github.com/ngaut/unistore/tikv/dbreader"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+// copStreamBatchKeys is the max number of keys covered by each response of the streaming coprocessor.
+const copStreamBatchKeys = 1024
+
+// copRangeSplitter splits the ranges into sub ranges that contain at most batchKeys keys, so each sub range
+// can be handled and sent separately to bound the memory. The sub ranges are split lazily while they are
+// handled, in descending order for the descending scans.
+type copRangeSplitter struct {
+	txn       *badger.Txn
+	ranges    []*coprocessor.KeyRange
+	batchKeys int
+	desc      bool
+	// cur is the remaining part of the range being split.
+	cur *coprocessor.KeyRange
+}
+
+func newCopRangeSplitter(txn *badger.Txn, ranges []*coprocessor.KeyRange, batchKeys int, desc bool) *copRangeSplitter {
+	return &copRangeSplitter{txn: txn, ranges: ranges, batchKeys: batchKeys, desc: desc}
+}
+
+// next returns the next sub range, nil is returned if all the ranges are split.
+func (s *copRangeSplitter) next() *coprocessor.KeyRange {
+	if s.cur == nil {
+		if len(s.ranges) == 0 {
+			return nil
+		}
+		if s.desc {
+			s.cur = s.ranges[len(s.ranges)-1]
+			s.ranges = s.ranges[:len(s.ranges)-1]
+		} else {
+			s.cur = s.ranges[0]
+			s.ranges = s.ranges[1:]
+		}
+	}
+	ran := s.cur
+	var splitKey []byte
+	if s.desc {
+		splitKey = s.reverseSplitKey(ran)
+	} else {
+		splitKey = s.splitKey(ran)
+	}
+	if splitKey == nil {
+		s.cur = nil
+		return ran
+	}
+	if s.desc {
+		s.cur = &coprocessor.KeyRange{Start: ran.Start, End: splitKey}
+		return &coprocessor.KeyRange{Start: splitKey, End: ran.End}
+	}
+	s.cur = &coprocessor.KeyRange{Start: splitKey, End: ran.End}
+	return &coprocessor.KeyRange{Start: ran.Start, End: splitKey}
+}
+
+// splitKey returns the key next to the first batchKeys keys of the range, nil is returned if the range
+// doesn't contain more keys.
+func (s *copRangeSplitter) splitKey(ran *coprocessor.KeyRange) []byte {
+	it := dbreader.NewIterator(s.txn, false, ran.Start, ran.End)
+	defer it.Close()
+	cnt := 0
+	for it.Seek(ran.Start); it.Valid(); it.Next() {
+		key := it.Item().Key()
+		if exceedEndKey(key, ran.End) {
+			break
+		}
+		if cnt == s.batchKeys {
+			return safeCopy(key)
+		}
+		cnt++
+	}
+	return nil
+}
+
+// reverseSplitKey returns the first key of the last batchKeys keys of the range, nil is returned if the range
+// doesn't contain more keys.
+func (s *copRangeSplitter) reverseSplitKey(ran *coprocessor.KeyRange) []byte {
+	it := dbreader.NewIterator(s.txn, true, ran.Start, ran.End)
+	defer it.Close()
+	if len(ran.End) == 0 {
+		it.Rewind()
+	} else {
+		it.Seek(ran.End)
+	}
+	cnt := 0
+	for ; it.Valid(); it.Next() {
+		key := it.Item().Key()
+		if bytes.Compare(key, ran.Start) < 0 {
+			break
+		}
+		if bytes.Equal(key, ran.End) {
+			continue
+		}
+		cnt++
+		if cnt == s.batchKeys {
+			// The range is split only if there are more keys before the key.
+			splitKey := safeCopy(key)
+			it.Next()
+			if it.Valid() && bytes.Compare(it.Item().Key(), ran.Start) >= 0 {
+				return splitKey
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// isDescCopRequest returns true if the DAG request scans in descending order, its sub ranges must be
+// handled from the last one.
+func isDescCopRequest(data []byte) bool {
+	dag := new(tipb.DAGRequest)
+	if err := dag.Unmarshal(data); err != nil || len(dag.Executors) == 0 {
+		return false
+	}
+	scan := dag.Executors[0]
+	switch {
+	case scan.TblScan != nil:
+		return scan.TblScan.Desc
+	case scan.IdxScan != nil:
+		return scan.IdxScan.Desc
+	}
+	return false
+}
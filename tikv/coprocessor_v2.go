@@ -0,0 +1,173 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ngaut/unistore/tikv/dbreader"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// CoprocessorV2Handler handles the raw payload of a CoprocessorV2 request, the reader only reads the data
+// in the region of the request.
+type CoprocessorV2Handler func(ctx context.Context, reader *dbreader.DBReader, data []byte) ([]byte, error)
+
+// callCoprocessorV2 calls the plugin handler, the panic of a plugin is returned as an error instead of
+// crashing the server.
+func callCoprocessorV2(ctx context.Context, handler CoprocessorV2Handler, reader *dbreader.DBReader, data []byte) (result []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("coprocessor v2 plugin panicked", zap.Reflect("panic", r), zap.Stack("stack"))
+			err = errors.Errorf("coprocessor plugin panicked: %v", r)
+		}
+	}()
+	return handler(ctx, reader, data)
+}
+
+// coprVersion is a semantic version in the form of major.minor.patch.
+type coprVersion [3]uint64
+
+func parseCoprVersion(s string) (coprVersion, error) {
+	var v coprVersion
+	parts := strings.Split(strings.TrimPrefix(strings.TrimSpace(s), "v"), ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return v, errors.Errorf("invalid coprocessor version %q", s)
+	}
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return v, errors.Errorf("invalid coprocessor version %q", s)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+func (v coprVersion) compare(o coprVersion) int {
+	for i := range v {
+		if v[i] < o[i] {
+			return -1
+		}
+		if v[i] > o[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+func (v coprVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+// matchCoprVersion checks the version against the requirement, the requirement is a comma separated list
+// of constraints like "=1.0.0", ">=1.2", "<2", "^1.2" (the same major version) or "*", an empty requirement
+// matches any version.
+func matchCoprVersion(v coprVersion, req string) (bool, error) {
+	for _, constraint := range strings.Split(req, ",") {
+		constraint = strings.TrimSpace(constraint)
+		if constraint == "" || constraint == "*" {
+			continue
+		}
+		op := strings.TrimRight(constraint, "v0123456789. ")
+		target, err := parseCoprVersion(constraint[len(op):])
+		if err != nil {
+			return false, err
+		}
+		cmp := v.compare(target)
+		var ok bool
+		switch op {
+		case "", "=":
+			ok = cmp == 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		case "^":
+			ok = cmp >= 0 && v[0] == target[0]
+		default:
+			return false, errors.Errorf("invalid coprocessor version requirement %q", req)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+type coprocessorV2Plugin struct {
+	version coprVersion
+	handler CoprocessorV2Handler
+}
+
+// CoprocessorV2Registry keeps the CoprocessorV2 plugins by name, a plugin may have multiple versions.
+type CoprocessorV2Registry struct {
+	mu      sync.RWMutex
+	plugins map[string][]coprocessorV2Plugin
+}
+
+func NewCoprocessorV2Registry() *CoprocessorV2Registry {
+	return &CoprocessorV2Registry{plugins: make(map[string][]coprocessorV2Plugin)}
+}
+
+// Register registers the handler with the name and version, a version can only be registered once.
+func (r *CoprocessorV2Registry) Register(name, version string, handler CoprocessorV2Handler) error {
+	v, err := parseCoprVersion(version)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, plugin := range r.plugins[name] {
+		if plugin.version == v {
+			return errors.Errorf("coprocessor %s %s has been registered", name, v)
+		}
+	}
+	r.plugins[name] = append(r.plugins[name], coprocessorV2Plugin{version: v, handler: handler})
+	return nil
+}
+
+// Get returns the handler of the greatest version that matches the requirement.
+func (r *CoprocessorV2Registry) Get(name, versionReq string) (CoprocessorV2Handler, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	plugins, ok := r.plugins[name]
+	if !ok {
+		return nil, errors.Errorf("coprocessor %s is not registered", name)
+	}
+	var matched *coprocessorV2Plugin
+	for i := range plugins {
+		ok, err := matchCoprVersion(plugins[i].version, versionReq)
+		if err != nil {
+			return nil, err
+		}
+		if ok && (matched == nil || plugins[i].version.compare(matched.version) > 0) {
+			matched = &plugins[i]
+		}
+	}
+	if matched == nil {
+		return nil, errors.Errorf("no version of coprocessor %s matches %q", name, versionReq)
+	}
+	return matched.handler, nil
+}
@@ -16,12 +16,14 @@ package tikv
 import (
 	"context"
 	"errors"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 
+	"github.com/ngaut/unistore/metrics"
 	"github.com/ngaut/unistore/pd"
 	"github.com/ngaut/unistore/util/lockwaiter"
 	deadlockPb "github.com/pingcap/kvproto/pkg/deadlock"
@@ -34,15 +36,25 @@ const (
 	Leader
 )
 
+const (
+	detectorMinBackoff = 100 * time.Millisecond
+	detectorMaxBackoff = 3 * time.Second
+)
+
 type DetectorServer struct {
 	Detector *Detector
 	role     int32
+	mu       sync.Mutex
+	// stepDownCh is closed when the leader steps down, the detection streams are closed then so the
+	// followers connect to the new leader and register their waiters again.
+	stepDownCh chan struct{}
 }
 
 func (ds *DetectorServer) Detect(req *deadlockPb.DeadlockRequest) *deadlockPb.DeadlockResponse {
 	switch req.Tp {
 	case deadlockPb.DeadlockRequestType_Detect:
-		err := ds.Detector.Detect(req.Entry.Txn, req.Entry.WaitForTxn, req.Entry.KeyHash)
+		diagCtx := diagnosticContext{key: req.Entry.Key, resourceGroupTag: req.Entry.ResourceGroupTag}
+		err := ds.Detector.Detect(req.Entry.Txn, req.Entry.WaitForTxn, req.Entry.KeyHash, diagCtx)
 		if err != nil {
 			resp := convertErrToResp(err, req.Entry.Txn, req.Entry.WaitForTxn, req.Entry.KeyHash)
 			return resp
@@ -63,6 +75,8 @@ type DetectorClient struct {
 	streamCli    deadlockPb.Deadlock_DetectClient
 	streamCancel context.CancelFunc
 	streamConn   *grpc.ClientConn
+	// streamBroken is closed by the recv loop of the stream when it fails.
+	streamBroken chan struct{}
 }
 
 // getLeaderAddr will send request to pd to find out the
@@ -111,10 +125,38 @@ func (dt *DetectorClient) rebuildStreamClient() error {
 	log.Info("build stream client successfully", zap.String("leader addr", leaderAddr))
 	dt.streamCli = stream
 	dt.streamCancel = cancel
-	go dt.recvLoop(dt.streamCli)
+	dt.streamBroken = make(chan struct{})
+	go dt.recvLoop(dt.streamCli, dt.streamBroken)
 	return nil
 }
 
+// connect builds the stream to the detector leader and registers all the waiters to it, the leader may have
+// changed and lost the wait-for graph.
+func (dt *DetectorClient) connect() error {
+	if err := dt.rebuildStreamClient(); err != nil {
+		metrics.DetectorRPCFailures.WithLabelValues("connect").Inc()
+		return err
+	}
+	entries := dt.waitMgr.GetWaitForEntries()
+	for _, entry := range entries {
+		req := &deadlockPb.DeadlockRequest{Tp: deadlockPb.DeadlockRequestType_Detect, Entry: entry}
+		if err := dt.streamCli.Send(req); err != nil {
+			metrics.DetectorRPCFailures.WithLabelValues("send").Inc()
+			dt.invalidateStream()
+			return err
+		}
+	}
+	if len(entries) > 0 {
+		log.Info("registered waiters to deadlock detector", zap.Int("count", len(entries)))
+	}
+	return nil
+}
+
+func (dt *DetectorClient) invalidateStream() {
+	dt.streamCancel()
+	dt.streamCli = nil
+}
+
 // NewDeadlockDetector will create a new detector util, entryTTL is used for
 // recycling the lock wait edge in detector wait wap. chSize is the pending
 // detection sending task size(used on non leader node)
@@ -128,75 +170,100 @@ func NewDetectorClient(waiterMgr *lockwaiter.Manager, pdClient pd.Client) *Detec
 	return newDetector
 }
 
+// detectorBackoff sleeps exponentially longer on the consecutive failures of the detection stream.
+type detectorBackoff struct {
+	next     time.Duration
+	lastWait time.Time
+}
+
+func (b *detectorBackoff) wait() {
+	// The failure after a long time of success starts from the min backoff.
+	if time.Since(b.lastWait) > 2*detectorMaxBackoff {
+		b.next = detectorMinBackoff
+	}
+	time.Sleep(b.next)
+	b.lastWait = time.Now()
+	b.next *= 2
+	if b.next > detectorMaxBackoff {
+		b.next = detectorMaxBackoff
+	}
+}
+
 // sendReqLoop will send detection request to leader, stream connection will be rebuilt and
 // a new recv goroutine using the same stream client will be created
 func (dt *DetectorClient) sendReqLoop() {
-	var (
-		err        error
-		rebuildErr error
-		req        *deadlockPb.DeadlockRequest
-	)
+	var bo detectorBackoff
 	for {
 		if dt.streamCli == nil {
-			rebuildErr = dt.rebuildStreamClient()
-			if rebuildErr != nil {
-				log.Error("rebuild connection to first region failed", zap.Error(rebuildErr))
-				time.Sleep(3 * time.Second)
+			if err := dt.connect(); err != nil {
+				log.Error("rebuild connection to first region failed", zap.Error(err))
+				bo.wait()
 				continue
 			}
 		}
-		req = <-dt.sendCh
-		err = dt.streamCli.Send(req)
-		if err != nil {
-			log.Warn("send failed, invalid current stream and try to rebuild connection", zap.Error(err))
-			dt.streamCancel()
-			dt.streamCli = nil
+		select {
+		case req := <-dt.sendCh:
+			if err := dt.streamCli.Send(req); err != nil {
+				metrics.DetectorRPCFailures.WithLabelValues("send").Inc()
+				log.Warn("send failed, invalid current stream and try to rebuild connection", zap.Error(err))
+				dt.invalidateStream()
+				bo.wait()
+			}
+		case <-dt.streamBroken:
+			dt.invalidateStream()
+			bo.wait()
 		}
 	}
 }
 
 // recvLoop tries to recv response(current only deadlock error) from leader, break loop if errors happen
-func (dt *DetectorClient) recvLoop(streamCli deadlockPb.Deadlock_DetectClient) {
-	var (
-		err  error
-		resp *deadlockPb.DeadlockResponse
-	)
+func (dt *DetectorClient) recvLoop(streamCli deadlockPb.Deadlock_DetectClient, broken chan struct{}) {
+	defer close(broken)
 	for {
-		resp, err = streamCli.Recv()
+		resp, err := streamCli.Recv()
 		if err != nil {
-			log.Warn("recv from failed, stop receive", zap.Error(err))
-			break
+			// The stream canceled by the send loop is not a failure.
+			if streamCli.Context().Err() == nil {
+				metrics.DetectorRPCFailures.WithLabelValues("recv").Inc()
+				log.Warn("recv from failed, stop receive", zap.Error(err))
+			}
+			return
 		}
 		// here only detection request will get response from leader
 		dt.waitMgr.WakeUpForDeadlock(resp)
 	}
 }
 
-func (dt *DetectorClient) handleRemoteTask(requestType deadlockPb.DeadlockRequestType,
-	txnTs uint64, waitForTxnTs uint64, keyHash uint64) {
+func (dt *DetectorClient) handleRemoteTask(requestType deadlockPb.DeadlockRequestType, entry deadlockPb.WaitForEntry) {
 	detectReq := &deadlockPb.DeadlockRequest{}
 	detectReq.Tp = requestType
-	detectReq.Entry.Txn = txnTs
-	detectReq.Entry.WaitForTxn = waitForTxnTs
-	detectReq.Entry.KeyHash = keyHash
+	detectReq.Entry = entry
 	dt.sendCh <- detectReq
 }
 
 // user interfaces
 // Cleanup processes cleaup task on local detector
 func (dt *DetectorClient) CleanUp(startTs uint64) {
-	dt.handleRemoteTask(deadlockPb.DeadlockRequestType_CleanUp, startTs, 0, 0)
+	dt.handleRemoteTask(deadlockPb.DeadlockRequestType_CleanUp, deadlockPb.WaitForEntry{Txn: startTs})
 }
 
 // CleanUpWaitFor cleans up the specific wait edge in detector's wait map
 func (dt *DetectorClient) CleanUpWaitFor(txnTs, waitForTxn, keyHash uint64) {
-	dt.handleRemoteTask(deadlockPb.DeadlockRequestType_CleanUpWaitFor, txnTs, waitForTxn, keyHash)
+	dt.handleRemoteTask(deadlockPb.DeadlockRequestType_CleanUpWaitFor,
+		deadlockPb.WaitForEntry{Txn: txnTs, WaitForTxn: waitForTxn, KeyHash: keyHash})
 }
 
 // DetectRemote post the detection request to local deadlock detector or remote first region leader,
-// the caller should use `waiter.ch` to receive possible deadlock response
-func (dt *DetectorClient) Detect(txnTs uint64, waitForTxnTs uint64, keyHash uint64) {
-	dt.handleRemoteTask(deadlockPb.DeadlockRequestType_Detect, txnTs, waitForTxnTs, keyHash)
+// the caller should use `waiter.ch` to receive possible deadlock response. The key and the resource group tag
+// are only used to diagnose the deadlock.
+func (dt *DetectorClient) Detect(txnTs uint64, waitForTxnTs uint64, keyHash uint64, key, resourceGroupTag []byte) {
+	dt.handleRemoteTask(deadlockPb.DeadlockRequestType_Detect, deadlockPb.WaitForEntry{
+		Txn:              txnTs,
+		WaitForTxn:       waitForTxnTs,
+		KeyHash:          keyHash,
+		Key:              key,
+		ResourceGroupTag: resourceGroupTag,
+	})
 }
 
 // convertErrToResp converts `ErrDeadlock` to `DeadlockResponse` proto type
@@ -208,6 +275,7 @@ func convertErrToResp(errDeadlock *ErrDeadlock, txnTs, waitForTxnTs, keyHash uin
 	resp := &deadlockPb.DeadlockResponse{}
 	resp.Entry = entry
 	resp.DeadlockKeyHash = errDeadlock.DeadlockKeyHash
+	resp.WaitChain = errDeadlock.WaitChain
 	return resp
 }
 
@@ -226,6 +294,35 @@ func (ds *DetectorServer) IsLeader() bool {
 	return atomic.LoadInt32(&ds.role) == Leader
 }
 
+// ChangeRole changes the role of the detector, the wait-for graph is cleared on role changes because the graph
+// of the previous leader is stale, the new leader rebuilds it from the waiters registered by the followers.
 func (ds *DetectorServer) ChangeRole(newRole int32) {
-	atomic.StoreInt32(&ds.role, newRole)
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if newRole == Leader {
+		metrics.DetectorIsLeader.Set(1)
+	} else {
+		metrics.DetectorIsLeader.Set(0)
+	}
+	oldRole := atomic.SwapInt32(&ds.role, newRole)
+	if oldRole == newRole {
+		return
+	}
+	ds.Detector.Reset()
+	if oldRole == Leader {
+		close(ds.stepDownCh)
+	}
+	if newRole == Leader {
+		ds.stepDownCh = make(chan struct{})
+	}
+}
+
+// leaderStepDownCh returns the channel closed when the leader steps down, nil if the detector is not the leader.
+func (ds *DetectorServer) leaderStepDownCh() <-chan struct{} {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if atomic.LoadInt32(&ds.role) != Leader {
+		return nil
+	}
+	return ds.stepDownCh
 }
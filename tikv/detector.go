@@ -30,6 +30,7 @@ import (
 	"sync"
 	"time"
 
+	deadlockPb "github.com/pingcap/kvproto/pkg/deadlock"
 	"github.com/pingcap/log"
 	"go.uber.org/zap"
 )
@@ -43,6 +44,24 @@ type Detector struct {
 	lastActiveExpire time.Time
 	urgentSize       uint64
 	expireInterval   time.Duration
+	// history keeps the latest deadlocks in a ring buffer.
+	history     [deadlockHistorySize]*DeadlockRecord
+	historyNext int
+}
+
+const deadlockHistorySize = 128
+
+// diagnosticContext is the information of a wait to diagnose the deadlocks.
+type diagnosticContext struct {
+	key              []byte
+	resourceGroupTag []byte
+}
+
+// DeadlockRecord is a deadlock detected by the detector, the last entry of the wait chain is the wait which
+// forms the cycle.
+type DeadlockRecord struct {
+	Time      time.Time                  `json:"time"`
+	WaitChain []*deadlockPb.WaitForEntry `json:"wait_chain"`
 }
 
 type txnList struct {
@@ -54,6 +73,18 @@ type txnKeyHashPair struct {
 	txn          uint64
 	keyHash      uint64
 	registerTime time.Time
+	diagCtx      diagnosticContext
+}
+
+func (p *txnKeyHashPair) toWaitForEntry(txn uint64, nowTime time.Time) *deadlockPb.WaitForEntry {
+	return &deadlockPb.WaitForEntry{
+		Txn:              txn,
+		WaitForTxn:       p.txn,
+		KeyHash:          p.keyHash,
+		Key:              p.diagCtx.key,
+		ResourceGroupTag: p.diagCtx.resourceGroupTag,
+		WaitTime:         uint64(nowTime.Sub(p.registerTime) / time.Millisecond),
+	}
 }
 
 func (p *txnKeyHashPair) isExpired(ttl time.Duration, nowTime time.Time) bool {
@@ -75,13 +106,24 @@ func NewDetector(ttl time.Duration, urgentSize uint64, expireInterval time.Durat
 }
 
 // Detect detects deadlock for the sourceTxn on a locked key.
-func (d *Detector) Detect(sourceTxn, waitForTxn, keyHash uint64) *ErrDeadlock {
+// The wait chain of the deadlock starts from the waitForTxn and ends with the wait of the sourceTxn.
+func (d *Detector) Detect(sourceTxn, waitForTxn, keyHash uint64, diagCtx diagnosticContext) *ErrDeadlock {
 	d.lock.Lock()
 	nowTime := time.Now()
 	d.activeExpire(nowTime)
 	err := d.doDetect(nowTime, sourceTxn, waitForTxn)
 	if err == nil {
-		d.register(sourceTxn, waitForTxn, keyHash)
+		d.register(sourceTxn, waitForTxn, keyHash, diagCtx)
+	} else {
+		// The chain is collected from the end of the cycle.
+		chain := err.WaitChain
+		for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+			chain[i], chain[j] = chain[j], chain[i]
+		}
+		pair := txnKeyHashPair{txn: waitForTxn, keyHash: keyHash, registerTime: nowTime, diagCtx: diagCtx}
+		err.WaitChain = append(chain, pair.toWaitForEntry(sourceTxn, nowTime))
+		d.history[d.historyNext] = &DeadlockRecord{Time: nowTime, WaitChain: err.WaitChain}
+		d.historyNext = (d.historyNext + 1) % deadlockHistorySize
 	}
 	d.lock.Unlock()
 	return err
@@ -103,9 +145,13 @@ func (d *Detector) doDetect(nowTime time.Time, sourceTxn, waitForTxn uint64) *Er
 			continue
 		}
 		if keyHashPair.txn == sourceTxn {
-			return &ErrDeadlock{DeadlockKeyHash: keyHashPair.keyHash}
+			return &ErrDeadlock{
+				DeadlockKeyHash: keyHashPair.keyHash,
+				WaitChain:       []*deadlockPb.WaitForEntry{keyHashPair.toWaitForEntry(waitForTxn, nowTime)},
+			}
 		}
 		if err := d.doDetect(nowTime, sourceTxn, keyHashPair.txn); err != nil {
+			err.WaitChain = append(err.WaitChain, keyHashPair.toWaitForEntry(waitForTxn, nowTime))
 			return err
 		}
 	}
@@ -115,9 +161,9 @@ func (d *Detector) doDetect(nowTime time.Time, sourceTxn, waitForTxn uint64) *Er
 	return nil
 }
 
-func (d *Detector) register(sourceTxn, waitForTxn, keyHash uint64) {
+func (d *Detector) register(sourceTxn, waitForTxn, keyHash uint64, diagCtx diagnosticContext) {
 	val := d.waitForMap[sourceTxn]
-	pair := txnKeyHashPair{txn: waitForTxn, keyHash: keyHash, registerTime: time.Now()}
+	pair := txnKeyHashPair{txn: waitForTxn, keyHash: keyHash, registerTime: time.Now(), diagCtx: diagCtx}
 	if val == nil {
 		newList := &txnList{txns: list.New()}
 		newList.txns.PushBack(&pair)
@@ -168,6 +214,45 @@ func (d *Detector) CleanUpWaitFor(txn, waitForTxn, keyHash uint64) {
 
 }
 
+// Reset removes all the wait for entries.
+func (d *Detector) Reset() {
+	d.lock.Lock()
+	d.waitForMap = map[uint64]*txnList{}
+	d.totalSize = 0
+	d.lock.Unlock()
+}
+
+// GetWaitForEntries returns the edges of the wait-for graph which are not expired, the wait time is in milliseconds.
+func (d *Detector) GetWaitForEntries() []deadlockPb.WaitForEntry {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	nowTime := time.Now()
+	entries := make([]deadlockPb.WaitForEntry, 0, d.totalSize)
+	for txn, l := range d.waitForMap {
+		for cur := l.txns.Front(); cur != nil; cur = cur.Next() {
+			valuePair := cur.Value.(*txnKeyHashPair)
+			if valuePair.isExpired(d.entryTTL, nowTime) {
+				continue
+			}
+			entries = append(entries, *valuePair.toWaitForEntry(txn, nowTime))
+		}
+	}
+	return entries
+}
+
+// GetDeadlockHistory returns the latest deadlocks from the oldest to the newest.
+func (d *Detector) GetDeadlockHistory() []*DeadlockRecord {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	records := make([]*DeadlockRecord, 0, deadlockHistorySize)
+	for i := 0; i < deadlockHistorySize; i++ {
+		if record := d.history[(d.historyNext+i)%deadlockHistorySize]; record != nil {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
 // activeExpire removes expired entries, should be called under d.lock protection
 func (d *Detector) activeExpire(nowTime time.Time) {
 	if nowTime.Sub(d.lastActiveExpire) > d.expireInterval &&
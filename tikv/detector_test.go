@@ -46,13 +46,13 @@ func (s *testDeadlockSuite) TestDeadlock(c *C) {
 	expireInterval := time.Duration(100 * time.Millisecond)
 	urgentSize := uint64(1)
 	detector := NewDetector(ttl, urgentSize, expireInterval)
-	err := detector.Detect(1, 2, 100)
+	err := detector.Detect(1, 2, 100, diagnosticContext{})
 	c.Assert(err, IsNil)
 	c.Assert(detector.totalSize, Equals, uint64(1))
-	err = detector.Detect(2, 3, 200)
+	err = detector.Detect(2, 3, 200, diagnosticContext{})
 	c.Assert(err, IsNil)
 	c.Assert(detector.totalSize, Equals, uint64(2))
-	err = detector.Detect(3, 1, 300)
+	err = detector.Detect(3, 1, 300, diagnosticContext{})
 	c.Assert(err, NotNil)
 	c.Assert(err.Error(), Equals, fmt.Sprintf("deadlock"))
 	c.Assert(detector.totalSize, Equals, uint64(2))
@@ -62,20 +62,20 @@ func (s *testDeadlockSuite) TestDeadlock(c *C) {
 	c.Assert(detector.totalSize, Equals, uint64(1))
 
 	// After cycle is broken, no deadlock now.
-	err = detector.Detect(3, 1, 300)
+	err = detector.Detect(3, 1, 300, diagnosticContext{})
 	c.Assert(err, IsNil)
 	list3 := detector.waitForMap[3]
 	c.Assert(list3.txns.Len(), Equals, 1)
 	c.Assert(detector.totalSize, Equals, uint64(2))
 
 	// Different keyHash grows the list.
-	err = detector.Detect(3, 1, 400)
+	err = detector.Detect(3, 1, 400, diagnosticContext{})
 	c.Assert(err, IsNil)
 	c.Assert(list3.txns.Len(), Equals, 2)
 	c.Assert(detector.totalSize, Equals, uint64(3))
 
 	// Same waitFor and key hash doesn't grow the list.
-	err = detector.Detect(3, 1, 400)
+	err = detector.Detect(3, 1, 400, diagnosticContext{})
 	c.Assert(err, IsNil)
 	c.Assert(list3.txns.Len(), Equals, 2)
 	c.Assert(detector.totalSize, Equals, uint64(3))
@@ -90,7 +90,7 @@ func (s *testDeadlockSuite) TestDeadlock(c *C) {
 
 	// after 100ms, all entries expired, detect non exist edges
 	time.Sleep(100 * time.Millisecond)
-	err = detector.Detect(100, 200, 100)
+	err = detector.Detect(100, 200, 100, diagnosticContext{})
 	c.Assert(err, IsNil)
 	c.Assert(detector.totalSize, Equals, uint64(1))
 	c.Assert(len(detector.waitForMap), Equals, 1)
@@ -98,8 +98,89 @@ func (s *testDeadlockSuite) TestDeadlock(c *C) {
 	// expired entry should not report deadlock, detect will remove this entry
 	// not dependent on expire check interval
 	time.Sleep(60 * time.Millisecond)
-	err = detector.Detect(200, 100, 200)
+	err = detector.Detect(200, 100, 200, diagnosticContext{})
 	c.Assert(err, IsNil)
 	c.Assert(detector.totalSize, Equals, uint64(1))
 	c.Assert(len(detector.waitForMap), Equals, 1)
 }
+
+func (s *testDeadlockSuite) TestGetWaitForEntries(c *C) {
+	detector := NewDetector(50*time.Millisecond, 100, time.Hour)
+	c.Assert(detector.Detect(1, 2, 100, diagnosticContext{}), IsNil)
+	c.Assert(detector.Detect(1, 3, 200, diagnosticContext{}), IsNil)
+	c.Assert(detector.Detect(2, 3, 300, diagnosticContext{}), IsNil)
+	entries := detector.GetWaitForEntries()
+	c.Assert(entries, HasLen, 3)
+	edges := map[[3]uint64]bool{}
+	for _, e := range entries {
+		edges[[3]uint64{e.Txn, e.WaitForTxn, e.KeyHash}] = true
+		c.Assert(e.WaitTime < 50, IsTrue)
+	}
+	c.Assert(edges[[3]uint64{1, 2, 100}], IsTrue)
+	c.Assert(edges[[3]uint64{1, 3, 200}], IsTrue)
+	c.Assert(edges[[3]uint64{2, 3, 300}], IsTrue)
+
+	// The expired entries are not returned.
+	time.Sleep(60 * time.Millisecond)
+	c.Assert(detector.GetWaitForEntries(), HasLen, 0)
+}
+
+func (s *testDeadlockSuite) TestDetectorChangeRole(c *C) {
+	ds := NewDetectorServer()
+	c.Assert(ds.leaderStepDownCh(), IsNil)
+	ds.ChangeRole(Leader)
+	stepDownCh := ds.leaderStepDownCh()
+	c.Assert(stepDownCh, NotNil)
+	c.Assert(ds.Detector.Detect(1, 2, 100, diagnosticContext{}), IsNil)
+
+	// The same role doesn't close the streams.
+	ds.ChangeRole(Leader)
+	c.Assert(ds.leaderStepDownCh(), Equals, stepDownCh)
+	c.Assert(ds.Detector.GetWaitForEntries(), HasLen, 1)
+
+	ds.ChangeRole(Follower)
+	c.Assert(ds.leaderStepDownCh(), IsNil)
+	select {
+	case <-stepDownCh:
+	default:
+		c.Fatal("the streams are not closed on step down")
+	}
+	c.Assert(ds.Detector.GetWaitForEntries(), HasLen, 0)
+	c.Assert(ds.Detector.totalSize, Equals, uint64(0))
+}
+
+func (s *testDeadlockSuite) TestDeadlockWaitChain(c *C) {
+	detector := NewDetector(time.Second, 100, time.Hour)
+	diagCtx := func(key string) diagnosticContext {
+		return diagnosticContext{key: []byte(key), resourceGroupTag: []byte("tag-" + key)}
+	}
+	c.Assert(detector.Detect(1, 2, 100, diagCtx("k1")), IsNil)
+	c.Assert(detector.Detect(2, 3, 200, diagCtx("k2")), IsNil)
+	c.Assert(detector.Detect(2, 4, 250, diagCtx("k4")), IsNil)
+	err := detector.Detect(3, 1, 300, diagCtx("k3"))
+	c.Assert(err, NotNil)
+	c.Assert(err.DeadlockKeyHash, Equals, uint64(200))
+
+	// The chain starts from the wait for txn and ends with the wait of the source txn.
+	expected := [][3]uint64{{1, 2, 100}, {2, 3, 200}, {3, 1, 300}}
+	c.Assert(err.WaitChain, HasLen, len(expected))
+	for i, e := range err.WaitChain {
+		c.Assert([3]uint64{e.Txn, e.WaitForTxn, e.KeyHash}, Equals, expected[i])
+	}
+	c.Assert(err.WaitChain[1].Key, BytesEquals, []byte("k2"))
+	c.Assert(err.WaitChain[1].ResourceGroupTag, BytesEquals, []byte("tag-k2"))
+	c.Assert(err.WaitChain[2].Key, BytesEquals, []byte("k3"))
+
+	history := detector.GetDeadlockHistory()
+	c.Assert(history, HasLen, 1)
+	c.Assert(history[0].WaitChain, DeepEquals, err.WaitChain)
+
+	// The history is bounded and ordered from the oldest.
+	for i := 0; i < deadlockHistorySize; i++ {
+		c.Assert(detector.Detect(3, 1, uint64(1000+i), diagnosticContext{}), NotNil)
+	}
+	history = detector.GetDeadlockHistory()
+	c.Assert(history, HasLen, deadlockHistorySize)
+	c.Assert(history[0].WaitChain[2].KeyHash, Equals, uint64(1000))
+	c.Assert(history[deadlockHistorySize-1].WaitChain[2].KeyHash, Equals, uint64(1000+deadlockHistorySize-1))
+}
@@ -17,6 +17,7 @@ import (
 	"fmt"
 
 	"github.com/ngaut/unistore/tikv/mvcc"
+	deadlockPb "github.com/pingcap/kvproto/pkg/deadlock"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 )
 
@@ -36,6 +37,25 @@ func BuildLockErr(key []byte, lock *mvcc.MvccLock) *ErrLocked {
 	return errLocked
 }
 
+// buildLockErrFromInfo generates the ErrLocked of the lock returned by another store.
+func buildLockErrFromInfo(info *kvrpcpb.LockInfo) *ErrLocked {
+	lock := &mvcc.MvccLock{
+		MvccLockHdr: mvcc.MvccLockHdr{
+			StartTS:        info.LockVersion,
+			ForUpdateTS:    info.LockForUpdateTs,
+			MinCommitTS:    info.MinCommitTs,
+			TTL:            uint32(info.LockTtl),
+			Op:             uint8(info.LockType),
+			PrimaryLen:     uint16(len(info.PrimaryLock)),
+			UseAsyncCommit: info.UseAsyncCommit,
+			SecondaryNum:   uint32(len(info.Secondaries)),
+		},
+		Primary:     info.PrimaryLock,
+		Secondaries: info.Secondaries,
+	}
+	return BuildLockErr(info.Key, lock)
+}
+
 // Error formats the lock to a string.
 func (e *ErrLocked) Error() string {
 	lock := e.Lock
@@ -87,6 +107,7 @@ type ErrDeadlock struct {
 	LockKey         []byte
 	LockTS          uint64
 	DeadlockKeyHash uint64
+	WaitChain       []*deadlockPb.WaitForEntry
 }
 
 func (e ErrDeadlock) Error() string {
@@ -116,6 +137,16 @@ func (e *ErrCommitExpire) Error() string {
 	return "commit expired"
 }
 
+// ErrLockWaitQueueFull is returned when the lock wait queue of the key is full, it is converted to a
+// ServerIsBusy region error, so the client backs off before retrying instead of resolving the lock.
+type ErrLockWaitQueueFull struct {
+	Key []byte
+}
+
+func (e *ErrLockWaitQueueFull) Error() string {
+	return fmt.Sprintf("lock wait queue is full, key: %q", e.Key)
+}
+
 // ErrTxnNotFound is returned if the required txn info not found on storage
 type ErrTxnNotFound struct {
 	StartTS    uint64
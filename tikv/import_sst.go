@@ -0,0 +1,101 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"context"
+	"io"
+
+	"github.com/ngaut/unistore/tikv/raftstore"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+)
+
+// ImportSSTServer serves the uploading and the ingestion of the SST files in the snapshot CF layout. The
+// files are uploaded to the leader, the leader replicates them to the stores of the other peers before
+// the ingestion is proposed.
+type ImportSSTServer struct {
+	import_sstpb.UnimplementedImportSSTServer
+	svr *Server
+}
+
+func NewImportSSTServer(svr *Server) *ImportSSTServer {
+	return &ImportSSTServer{svr: svr}
+}
+
+func (s *ImportSSTServer) importer() (*raftstore.SSTImporter, error) {
+	ris, ok := s.svr.innerServer.(*raftstore.RaftInnerServer)
+	if !ok {
+		return nil, errors.New("sst import is not supported without raft")
+	}
+	return ris.GetSSTImporter(), nil
+}
+
+// Upload receives an SST file, the first request has the meta of the file and the others have the data.
+func (s *ImportSSTServer) Upload(stream import_sstpb.ImportSST_UploadServer) error {
+	importer, err := s.importer()
+	if err != nil {
+		return err
+	}
+	head, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if head.GetMeta() == nil {
+		return errors.New("no sst meta in the first upload request")
+	}
+	file, err := importer.CreateUploadFile(head.GetMeta())
+	if err != nil {
+		return err
+	}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = file.Write(req.GetData())
+		}
+		if err != nil {
+			file.Abort()
+			return err
+		}
+	}
+	if err = file.Finish(); err != nil {
+		return err
+	}
+	return stream.SendAndClose(&import_sstpb.UploadResponse{})
+}
+
+// Ingest ingests the uploaded SST file into the region of the request.
+func (s *ImportSSTServer) Ingest(_ context.Context, req *import_sstpb.IngestRequest) (*import_sstpb.IngestResponse, error) {
+	reqCtx, err := newRequestCtx(s.svr, req.Context, "Ingest")
+	if err != nil {
+		return &import_sstpb.IngestResponse{Error: &errorpb.Error{Message: err.Error()}}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &import_sstpb.IngestResponse{Error: reqCtx.regErr}, nil
+	}
+	err = s.svr.mvccStore.Ingest(reqCtx, []*import_sstpb.SSTMeta{req.Sst})
+	if err != nil {
+		msg, regErr := convertToRawError(err)
+		if regErr == nil {
+			regErr = &errorpb.Error{Message: msg}
+		}
+		return &import_sstpb.IngestResponse{Error: regErr}, nil
+	}
+	return &import_sstpb.IngestResponse{}, nil
+}
@@ -0,0 +1,278 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ngaut/unistore/lockstore"
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	lockCheckpointFileName = "checkpoint"
+	lockWALFileSuffix      = ".wal"
+	lockWALCheckpointSize  = 64 << 20
+
+	lockWALRecordHdrSize = 8
+	lockWALOpPut         = 0
+	lockWALOpDelete      = 1
+)
+
+// LockWAL is the redo log of the lock store in standalone mode.
+// The lock worker appends the entries of a batch group and syncs the log before applying them to the lock store,
+// so the locks of the acknowledged requests survive a crash. The lock store is checkpointed when the log grows
+// large, the checkpoint records the number of the first log file to replay on recovery.
+//
+// A record of the log is the crc32 and the length of the payload followed by the payload, the payload is the
+// entries of the op byte, the key and the value, the key and the value are prefixed with their uint32 length.
+type LockWAL struct {
+	dir       string
+	lockStore *lockstore.MemStore
+	fileNum   uint64
+	file      *os.File
+	size      int64
+	buf       []byte
+}
+
+// OpenLockWAL recovers the lock store from the checkpoint and the logs in the dir, then checkpoints the
+// recovered lock store and starts a new log.
+func OpenLockWAL(dir string, lockStore *lockstore.MemStore) (*LockWAL, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	meta, err := lockStore.LoadFromFile(filepath.Join(dir, lockCheckpointFileName))
+	if err != nil {
+		return nil, err
+	}
+	var startNum uint64
+	if meta != nil {
+		startNum = binary.LittleEndian.Uint64(meta)
+	}
+	fileNums, err := lockWALFileNums(dir)
+	if err != nil {
+		return nil, err
+	}
+	w := &LockWAL{dir: dir, lockStore: lockStore, fileNum: startNum}
+	var cnt int
+	for _, num := range fileNums {
+		if num > w.fileNum {
+			w.fileNum = num
+		}
+		if num < startNum {
+			continue
+		}
+		n, err := w.replay(num)
+		if err != nil {
+			return nil, err
+		}
+		cnt += n
+	}
+	log.Info("recovered lock store from wal", zap.Uint64("checkpoint", startNum), zap.Int("entries", cnt))
+	if err = w.Checkpoint(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *LockWAL) filePath(num uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%016x%s", num, lockWALFileSuffix))
+}
+
+func lockWALFileNums(dir string) ([]uint64, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var nums []uint64
+	for _, fi := range fis {
+		if !strings.HasSuffix(fi.Name(), lockWALFileSuffix) {
+			continue
+		}
+		num, err := strconv.ParseUint(strings.TrimSuffix(fi.Name(), lockWALFileSuffix), 16, 64)
+		if err != nil {
+			continue
+		}
+		nums = append(nums, num)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums, nil
+}
+
+// replay applies the records of the log file to the lock store, a torn record at the end of the file is
+// written by a crash and ignored.
+func (w *LockWAL) replay(num uint64) (int, error) {
+	f, err := os.Open(w.filePath(num))
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	hdr := make([]byte, lockWALRecordHdrSize)
+	var payload []byte
+	var cnt int
+	for {
+		if _, err = io.ReadFull(reader, hdr); err != nil {
+			break
+		}
+		checksum, length := binary.LittleEndian.Uint32(hdr), binary.LittleEndian.Uint32(hdr[4:])
+		if cap(payload) < int(length) {
+			payload = make([]byte, length)
+		}
+		payload = payload[:length]
+		if _, err = io.ReadFull(reader, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			err = errors.New("checksum mismatch")
+			break
+		}
+		n, applyErr := w.applyRecord(payload)
+		if applyErr != nil {
+			return cnt, errors.Annotatef(applyErr, "lock wal %s", w.filePath(num))
+		}
+		cnt += n
+	}
+	if errors.Cause(err) != io.EOF {
+		log.Warn("ignore the torn tail of lock wal", zap.String("file", w.filePath(num)), zap.Error(err))
+	}
+	return cnt, nil
+}
+
+func (w *LockWAL) applyRecord(payload []byte) (int, error) {
+	var cnt int
+	for len(payload) > 0 {
+		if len(payload) < 5 {
+			return cnt, errors.New("corrupted record")
+		}
+		op := payload[0]
+		key, rest, err := readLockWALItem(payload[1:])
+		if err != nil {
+			return cnt, err
+		}
+		val, rest, err := readLockWALItem(rest)
+		if err != nil {
+			return cnt, err
+		}
+		payload = rest
+		switch op {
+		case lockWALOpPut:
+			w.lockStore.Put(key, val)
+		case lockWALOpDelete:
+			w.lockStore.Delete(key)
+		default:
+			return cnt, errors.Errorf("invalid op %d", op)
+		}
+		cnt++
+	}
+	return cnt, nil
+}
+
+func readLockWALItem(data []byte) (item, rest []byte, err error) {
+	if len(data) < 4 {
+		return nil, nil, errors.New("corrupted record")
+	}
+	l := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+	if uint32(len(data)) < l {
+		return nil, nil, errors.New("corrupted record")
+	}
+	return data[:l], data[l:], nil
+}
+
+func appendLockWALItem(buf, item []byte) []byte {
+	var lenBuf [4]byte
+	binary.LittleEndian.PutUint32(lenBuf[:], uint32(len(item)))
+	buf = append(buf, lenBuf[:]...)
+	return append(buf, item...)
+}
+
+// Append writes the entries as a record and syncs the log.
+func (w *LockWAL) Append(entries []*badger.Entry) error {
+	buf := append(w.buf[:0], make([]byte, lockWALRecordHdrSize)...)
+	for _, entry := range entries {
+		op := byte(lockWALOpPut)
+		if entry.UserMeta[0] == mvcc.LockUserMetaDeleteByte {
+			op = lockWALOpDelete
+		}
+		buf = append(buf, op)
+		buf = appendLockWALItem(buf, entry.Key.UserKey)
+		buf = appendLockWALItem(buf, entry.Value)
+	}
+	w.buf = buf
+	payload := buf[lockWALRecordHdrSize:]
+	binary.LittleEndian.PutUint32(buf, crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(payload)))
+	n, err := w.file.Write(buf)
+	w.size += int64(n)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(w.file.Sync())
+}
+
+// NeedCheckpoint returns true if the log is large enough to be replaced by a checkpoint.
+func (w *LockWAL) NeedCheckpoint() bool {
+	return w.size >= lockWALCheckpointSize
+}
+
+// Checkpoint dumps the lock store and switches to a new log, the older logs are removed.
+// The lock store must not be modified during the checkpoint.
+func (w *LockWAL) Checkpoint() error {
+	nextNum := w.fileNum + 1
+	meta := make([]byte, 8)
+	binary.LittleEndian.PutUint64(meta, nextNum)
+	if err := w.lockStore.DumpToFile(filepath.Join(w.dir, lockCheckpointFileName), meta); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(w.filePath(nextNum), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.file, w.fileNum, w.size = file, nextNum, 0
+	fileNums, err := lockWALFileNums(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, num := range fileNums {
+		if num < nextNum {
+			os.Remove(w.filePath(num))
+		}
+	}
+	return nil
+}
+
+// Close checkpoints the lock store so the next recovery doesn't replay the log.
+func (w *LockWAL) Close() error {
+	err := w.Checkpoint()
+	w.file.Close()
+	return err
+}
@@ -0,0 +1,181 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bytes"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dgryski/go-farm"
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+)
+
+const memLockSlots = 256
+
+// memLockTable keeps the locks of the async commit and 1PC transactions being prewritten, the locks are
+// put into the table before the min commit ts is calculated and removed after the prewrite is written.
+// Readers update the max ts before checking the table, and the min commit ts of a lock is calculated
+// from the max ts under the slot lock, so a reader either sees the lock or reads at a ts less than the
+// commit ts of the transaction.
+type memLockTable struct {
+	maxTS uint64
+	slots [memLockSlots]memLockSlot
+}
+
+type memLockSlot struct {
+	mu    sync.Mutex
+	locks map[string]*mvcc.MvccLock
+}
+
+func newMemLockTable() *memLockTable {
+	t := &memLockTable{}
+	for i := range t.slots {
+		t.slots[i].locks = make(map[string]*mvcc.MvccLock)
+	}
+	return t
+}
+
+func (t *memLockTable) slot(key []byte) *memLockSlot {
+	return &t.slots[farm.Fingerprint64(key)%memLockSlots]
+}
+
+// updateMaxTS records the ts of a read, the reads at maxSystemTS are not recorded because no commit ts
+// can be greater than it.
+func (t *memLockTable) updateMaxTS(ts uint64) {
+	if ts == maxSystemTS {
+		return
+	}
+	for {
+		old := atomic.LoadUint64(&t.maxTS)
+		if old >= ts || atomic.CompareAndSwapUint64(&t.maxTS, old, ts) {
+			return
+		}
+	}
+}
+
+func (t *memLockTable) getMaxTS() uint64 {
+	return atomic.LoadUint64(&t.maxTS)
+}
+
+// lockKeys puts the locks of the keys into the table and returns the greatest min commit ts of them.
+// The min commit ts of each lock is the greater one of minCommitTS and max ts + 1, the locks must not
+// be modified once they are in the table.
+func (t *memLockTable) lockKeys(keys [][]byte, locks []*mvcc.MvccLock, minCommitTS uint64) uint64 {
+	result := minCommitTS
+	for i, key := range keys {
+		s := t.slot(key)
+		s.mu.Lock()
+		lock := locks[i]
+		lock.MinCommitTS = minCommitTS
+		if maxTS := t.getMaxTS(); maxTS >= lock.MinCommitTS {
+			lock.MinCommitTS = maxTS + 1
+		}
+		s.locks[string(key)] = lock
+		s.mu.Unlock()
+		if lock.MinCommitTS > result {
+			result = lock.MinCommitTS
+		}
+	}
+	return result
+}
+
+// unlockKeys removes the locks of the transaction from the table.
+func (t *memLockTable) unlockKeys(keys [][]byte, startTS uint64) {
+	for _, key := range keys {
+		s := t.slot(key)
+		s.mu.Lock()
+		if lock, ok := s.locks[string(key)]; ok && lock.StartTS == startTS {
+			delete(s.locks, string(key))
+		}
+		s.mu.Unlock()
+	}
+}
+
+// checkKeys updates the max ts with the read ts and checks the locks of the keys.
+func (t *memLockTable) checkKeys(startTS uint64, resolved []uint64, keys ...[]byte) error {
+	t.updateMaxTS(startTS)
+	for _, key := range keys {
+		s := t.slot(key)
+		s.mu.Lock()
+		lock, ok := s.locks[string(key)]
+		s.mu.Unlock()
+		if !ok {
+			continue
+		}
+		if err := checkLock(*lock, key, startTS, resolved); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRange updates the max ts with the read ts and calls f with the errors of the locks in the range.
+func (t *memLockTable) checkRange(startTS uint64, startKey, endKey []byte, resolved []uint64, f func(key []byte, err error)) {
+	t.updateMaxTS(startTS)
+	for i := range t.slots {
+		s := &t.slots[i]
+		s.mu.Lock()
+		for key, lock := range s.locks {
+			k := []byte(key)
+			if bytes.Compare(k, startKey) < 0 || exceedEndKey(k, endKey) {
+				continue
+			}
+			if err := checkLock(*lock, k, startTS, resolved); err != nil {
+				f(k, err)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// minLockTS returns the min start ts of the locks in the key range, or math.MaxUint64 if there is no lock.
+func (t *memLockTable) minLockTS(startKey, endKey []byte) uint64 {
+	var minTS uint64 = math.MaxUint64
+	for i := range t.slots {
+		s := &t.slots[i]
+		s.mu.Lock()
+		for key, lock := range s.locks {
+			k := []byte(key)
+			if bytes.Compare(k, startKey) < 0 || exceedEndKey(k, endKey) {
+				continue
+			}
+			if lock.StartTS < minTS {
+				minTS = lock.StartTS
+			}
+		}
+		s.mu.Unlock()
+	}
+	return minTS
+}
+
+// checkCopRanges updates the max ts with the start ts of the coprocessor request and returns the error of
+// the first lock in its ranges.
+func (t *memLockTable) checkCopRanges(req *coprocessor.Request) error {
+	t.updateMaxTS(req.StartTs)
+	var lockErr error
+	for _, ran := range req.Ranges {
+		t.checkRange(req.StartTs, ran.Start, ran.End, req.Context.GetResolvedLocks(), func(_ []byte, err error) {
+			if lockErr == nil {
+				lockErr = err
+			}
+		})
+		if lockErr != nil {
+			return lockErr
+		}
+	}
+	return nil
+}
@@ -19,18 +19,12 @@ import (
 	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/pdpb"
 	"github.com/pingcap/tidb/kv"
-	"github.com/pingcap/tidb/store/mockstore/unistore/cophandler"
 	"github.com/pingcap/tidb/tablecodec"
 	"github.com/pingcap/tidb/util/codec"
 	pdclient "github.com/tikv/pd/client"
 	"golang.org/x/net/context"
 )
 
-type MPPTaskHandlerMap struct {
-	mu           sync.RWMutex
-	taskHandlers map[int64]*cophandler.MPPTaskHandler
-}
-
 type MockRegionManager struct {
 	regionManager
 
@@ -386,6 +380,14 @@ func (rm *MockRegionManager) SplitRegion(req *kvrpcpb.SplitRegionRequest) *kvrpc
 	return &kvrpcpb.SplitRegionResponse{Regions: ret}
 }
 
+// ReadIndex returns an empty response, the mock store has only one replica.
+func (rm *MockRegionManager) ReadIndex(req *kvrpcpb.ReadIndexRequest) *kvrpcpb.ReadIndexResponse {
+	if _, err := rm.GetRegionFromCtx(req.Context); err != nil {
+		return &kvrpcpb.ReadIndexResponse{RegionError: err}
+	}
+	return &kvrpcpb.ReadIndexResponse{}
+}
+
 func (rm *MockRegionManager) calculateSplitKeys(start, end []byte, count int) [][]byte {
 	var keys [][]byte
 	txn := rm.bundle.DB.NewTransaction(false)
@@ -603,9 +605,7 @@ func (rm *MockRegionManager) AddStore(storeID uint64, addr string, labels ...*me
 		Address: addr,
 		Labels:  labels,
 	}
-	rm.mppTaskSet[storeID] = &MPPTaskHandlerMap{
-		taskHandlers: make(map[int64]*cophandler.MPPTaskHandler),
-	}
+	rm.mppTaskSet[storeID] = NewMPPTaskHandlerMap()
 }
 
 func (rm *MockRegionManager) getMPPTaskSet(storeID uint64) *MPPTaskHandlerMap {
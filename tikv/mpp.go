@@ -0,0 +1,154 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/mpp"
+	"github.com/pingcap/tidb/store/mockstore/unistore/client"
+	"github.com/pingcap/tidb/store/mockstore/unistore/cophandler"
+)
+
+// mppTask is a registered MPP task, cancelCh is closed when the task is cancelled.
+type mppTask struct {
+	handler  *cophandler.MPPTaskHandler
+	cancelCh chan struct{}
+
+	// mu guards err and the tunnels of the handler, so no tunnel is established after the task is
+	// cancelled and all the tunnels of a cancelled task are drained.
+	mu  sync.Mutex
+	err error
+}
+
+func (t *mppTask) cancelled() bool {
+	select {
+	case <-t.cancelCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// setErr sets the error of the task if it has no error, the cancel error is kept after the task is cancelled.
+func (t *mppTask) setErr(err error) {
+	t.mu.Lock()
+	if t.err == nil {
+		t.err = err
+	}
+	t.mu.Unlock()
+}
+
+func (t *mppTask) getErr() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// establishConn establishes the tunnel of the connection, it fails if the task is cancelled.
+func (t *mppTask) establishConn(ctx context.Context, req *mpp.EstablishMPPConnectionRequest) (*cophandler.ExchangerTunnel, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cancelled() {
+		return nil, t.err
+	}
+	return t.handler.HandleEstablishConn(ctx, req)
+}
+
+// cancel cancels the task and drains its tunnels, so the exchange senders are not blocked and the executor
+// can finish. It returns false if the task has been cancelled.
+func (t *mppTask) cancel(reason string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cancelled() {
+		return false
+	}
+	close(t.cancelCh)
+	t.err = errors.Errorf("mpp task %d is cancelled: %s", t.handler.Meta.TaskId, reason)
+	for _, tunnel := range t.handler.TunnelSet {
+		go drainTunnel(tunnel)
+	}
+	return true
+}
+
+// MPPTaskHandlerMap is the registry of the MPP tasks running on a store.
+type MPPTaskHandlerMap struct {
+	mu    sync.RWMutex
+	tasks map[int64]*mppTask
+}
+
+func NewMPPTaskHandlerMap() *MPPTaskHandlerMap {
+	return &MPPTaskHandlerMap{tasks: make(map[int64]*mppTask)}
+}
+
+func (m *MPPTaskHandlerMap) create(meta *mpp.TaskMeta, rpcClient client.Client) (*mppTask, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if task, ok := m.tasks[meta.TaskId]; ok {
+		return task, errors.Errorf("Task %d has been created", meta.TaskId)
+	}
+	handler := &cophandler.MPPTaskHandler{
+		TunnelSet: make(map[int64]*cophandler.ExchangerTunnel),
+		Meta:      meta,
+		RPCClient: rpcClient,
+	}
+	task := &mppTask{handler: handler, cancelCh: make(chan struct{})}
+	m.tasks[meta.TaskId] = task
+	return task, nil
+}
+
+func (m *MPPTaskHandlerMap) get(taskID int64) *mppTask {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.tasks[taskID]
+}
+
+func (m *MPPTaskHandlerMap) remove(taskID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.tasks[taskID]; ok {
+		delete(m.tasks, taskID)
+		return nil
+	}
+	return errors.New("cannot find mpp task")
+}
+
+// cancel cancels all the tasks of the query with the start ts and returns the number of cancelled tasks.
+// The tasks are removed from the registry, so no connection can be established to them anymore.
+func (m *MPPTaskHandlerMap) cancel(startTS uint64, reason string) int {
+	m.mu.Lock()
+	var tasks []*mppTask
+	for taskID, task := range m.tasks {
+		if task.handler.Meta.StartTs == startTS {
+			delete(m.tasks, taskID)
+			tasks = append(tasks, task)
+		}
+	}
+	m.mu.Unlock()
+	var cnt int
+	for _, task := range tasks {
+		if task.cancel(reason) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// drainTunnel discards the chunks in the tunnel until the sender closes it.
+func drainTunnel(tunnel *cophandler.ExchangerTunnel) {
+	for range tunnel.DataCh {
+	}
+}
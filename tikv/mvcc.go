@@ -14,17 +14,14 @@
 package tikv
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/binary"
 	"fmt"
 	"math"
-	"os"
 	"sort"
 	"sync/atomic"
 	"time"
-	"unsafe"
 
 	"github.com/dgryski/go-farm"
 	"github.com/ngaut/unistore/config"
@@ -35,7 +32,9 @@ import (
 	"github.com/ngaut/unistore/util/lockwaiter"
 	"github.com/pingcap/badger"
 	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
 	"github.com/pingcap/log"
 	"github.com/pingcap/tidb/sessionctx/stmtctx"
 	"github.com/pingcap/tidb/store/tikv/oracle"
@@ -50,6 +49,7 @@ type MVCCStore struct {
 	dir       string
 	db        *badger.DB
 	lockStore *lockstore.MemStore
+	observer  *mvcc.LockObserver
 	dbWriter  mvcc.DBWriter
 	safePoint *SafePoint
 	pdClient  pd.Client
@@ -57,7 +57,11 @@ type MVCCStore struct {
 
 	conf *config.Config
 
-	latestTS          uint64
+	latestTS uint64
+	memLocks *memLockTable
+	// maxTSSynced is set after the max ts is synced with PD once, the reads served before the store
+	// started are not recorded in the max ts.
+	maxTSSynced       int32
 	lockWaiterManager *lockwaiter.Manager
 	DeadlockDetectCli *DetectorClient
 	DeadlockDetectSvr *DetectorServer
@@ -70,11 +74,13 @@ func NewMVCCStore(conf *config.Config, bundle *mvcc.DBBundle, dataDir string, sa
 		db:                bundle.DB,
 		dir:               dataDir,
 		lockStore:         bundle.LockStore,
+		observer:          &bundle.LockObserver,
 		safePoint:         safePoint,
 		pdClient:          pdClient,
 		closeCh:           make(chan bool),
 		dbWriter:          writer,
 		conf:              conf,
+		memLocks:          newMemLockTable(),
 		lockWaiterManager: lockwaiter.NewManager(conf),
 	}
 	store.DeadlockDetectSvr = NewDetectorServer()
@@ -83,6 +89,10 @@ func NewMVCCStore(conf *config.Config, bundle *mvcc.DBBundle, dataDir string, sa
 	if pdClient != nil {
 		// pdClient is nil in unit test.
 		go store.runUpdateSafePointLoop()
+		if err := store.fetchMaxTS(); err != nil {
+			// The max ts is synced by the first async commit or 1PC prewrite.
+			log.Warn("sync max ts failed", zap.Error(err))
+		}
 	}
 	return store
 }
@@ -106,50 +116,9 @@ func (store *MVCCStore) getLatestTS() uint64 {
 func (store *MVCCStore) Close() error {
 	store.dbWriter.Close()
 	close(store.closeCh)
-
-	err := store.dumpMemLocks()
-	if err != nil {
-		log.Fatal("dump mem locks failed", zap.Error(err))
-	}
 	return nil
 }
 
-type lockEntryHdr struct {
-	keyLen uint32
-	valLen uint32
-}
-
-func (store *MVCCStore) dumpMemLocks() error {
-	tmpFileName := store.dir + "/lock_store.tmp"
-	f, err := os.OpenFile(tmpFileName, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
-	if err != nil {
-		return errors.Trace(err)
-	}
-	writer := bufio.NewWriter(f)
-	cnt := 0
-	it := store.lockStore.NewIterator()
-	hdrBuf := make([]byte, 8)
-	hdr := (*lockEntryHdr)(unsafe.Pointer(&hdrBuf[0]))
-	for it.SeekToFirst(); it.Valid(); it.Next() {
-		hdr.keyLen = uint32(len(it.Key()))
-		hdr.valLen = uint32(len(it.Value()))
-		writer.Write(hdrBuf)
-		writer.Write(it.Key())
-		writer.Write(it.Value())
-		cnt++
-	}
-	err = writer.Flush()
-	if err != nil {
-		return errors.Trace(err)
-	}
-	err = f.Sync()
-	if err != nil {
-		return errors.Trace(err)
-	}
-	f.Close()
-	return os.Rename(tmpFileName, store.dir+"/lock_store")
-}
-
 func (store *MVCCStore) getDBItems(reqCtx *requestCtx, mutations []*kvrpcpb.Mutation) (items []*badger.Item, err error) {
 	txn := reqCtx.getDBReader().GetTxn()
 	keys := make([][]byte, len(mutations))
@@ -226,7 +195,7 @@ func (store *MVCCStore) PessimisticLock(reqCtx *requestCtx, req *kvrpcpb.Pessimi
 	for _, m := range mutations {
 		lock, err := store.checkConflictInLockStore(reqCtx, m, startTS)
 		if err != nil {
-			return store.handleCheckPessimisticErr(startTS, err, req.IsFirstLock, req.WaitTimeout)
+			return store.handleCheckPessimisticErr(startTS, err, req.IsFirstLock, req.WaitTimeout, req.Context)
 		}
 		if lock != nil {
 			if lock.Op != uint8(kvrpcpb.Op_PessimisticLock) {
@@ -521,16 +490,21 @@ func (store *MVCCStore) normalizeWaitTime(lockWaitTime int64) time.Duration {
 	return time.Duration(lockWaitTime) * time.Millisecond
 }
 
-func (store *MVCCStore) handleCheckPessimisticErr(startTS uint64, err error, isFirstLock bool, lockWaitTime int64) (*lockwaiter.Waiter, error) {
+func (store *MVCCStore) handleCheckPessimisticErr(startTS uint64, err error, isFirstLock bool, lockWaitTime int64,
+	rpcCtx *kvrpcpb.Context) (*lockwaiter.Waiter, error) {
 	if locked, ok := err.(*ErrLocked); ok {
 		if lockWaitTime != lockwaiter.LockNoWait {
 			keyHash := farm.Fingerprint64(locked.Key)
 			waitTimeDuration := store.normalizeWaitTime(lockWaitTime)
 			lock := locked.Lock
 			log.S().Debugf("%d blocked by %d on key %d", startTS, lock.StartTS, keyHash)
-			waiter := store.lockWaiterManager.NewWaiter(startTS, lock.StartTS, keyHash, waitTimeDuration)
+			waiter := store.lockWaiterManager.NewWaiter(startTS, lock.StartTS, keyHash, rpcCtx.GetPriority(), waitTimeDuration)
+			if waiter == nil {
+				log.S().Debugf("%d doesn't wait for %d because the wait queue of key %d is full", startTS, lock.StartTS, keyHash)
+				return nil, &ErrLockWaitQueueFull{Key: locked.Key}
+			}
 			if !isFirstLock {
-				store.DeadlockDetectCli.Detect(startTS, lock.StartTS, keyHash)
+				store.DeadlockDetectCli.Detect(startTS, lock.StartTS, keyHash, locked.Key, rpcCtx.GetResourceGroupTag())
 			}
 			return waiter, err
 		}
@@ -652,7 +626,6 @@ func (store *MVCCStore) prewriteOptimistic(reqCtx *requestCtx, mutations []*kvrp
 			}
 			continue
 		}
-		// TODO add memory lock for async commit protocol.
 	}
 	return store.prewriteMutations(reqCtx, mutations, req, items)
 }
@@ -694,7 +667,6 @@ func (store *MVCCStore) prewritePessimistic(reqCtx *requestCtx, mutations []*kvr
 				return nil
 			}
 		}
-		// TODO add memory lock for async commit protocol.
 	}
 	items, err := store.getDBItems(reqCtx, mutations)
 	if err != nil {
@@ -707,12 +679,19 @@ func (store *MVCCStore) prewriteMutations(reqCtx *requestCtx, mutations []*kvrpc
 	req *kvrpcpb.PrewriteRequest, items []*badger.Item) error {
 	var minCommitTS uint64
 	if req.UseAsyncCommit || req.TryOnePc {
-		// Get minCommitTS for async commit protocol. After all keys are locked in memory lock.
-		physical, logical, tsErr := store.pdClient.GetTS(context.Background())
-		if tsErr != nil {
-			return tsErr
+		if err := store.syncMaxTS(reqCtx.regCtx); err != nil {
+			return err
+		}
+		// minCommitTS = max(max_ts+1, start_ts+1, for_update_ts). The keys are locked in memory when
+		// the max ts is read, the concurrent readers either see the memory locks or read at a ts less
+		// than minCommitTS.
+		minCommitTS = req.StartVersion + 1
+		if req.ForUpdateTs > minCommitTS {
+			minCommitTS = req.ForUpdateTs
 		}
-		minCommitTS = uint64(physical)<<18 + uint64(logical)
+		keys, locks := memLocksForPrewrite(mutations, req)
+		minCommitTS = store.memLocks.lockKeys(keys, locks, minCommitTS)
+		defer store.memLocks.unlockKeys(keys, req.StartVersion)
 		if req.MaxCommitTs > 0 && minCommitTS > req.MaxCommitTs {
 			req.UseAsyncCommit = false
 			req.TryOnePc = false
@@ -753,6 +732,62 @@ func (store *MVCCStore) prewriteMutations(reqCtx *requestCtx, mutations []*kvrpc
 	return store.dbWriter.Write(batch)
 }
 
+// syncMaxTS updates the max ts with a ts from PD if the store has not synced it since it started or the
+// region may have served reads on other replicas since the last sync, e.g. after the leader changes.
+func (store *MVCCStore) syncMaxTS(regCtx *regionCtx) error {
+	epoch, synced := regCtx.getMaxTSEpoch()
+	if synced && atomic.LoadInt32(&store.maxTSSynced) == 1 {
+		return nil
+	}
+	if err := store.fetchMaxTS(); err != nil {
+		return err
+	}
+	regCtx.setMaxTSSynced(epoch)
+	return nil
+}
+
+// fetchMaxTS updates the max ts with a ts from PD.
+func (store *MVCCStore) fetchMaxTS() error {
+	physical, logical, err := store.pdClient.GetTS(context.Background())
+	if err != nil {
+		return err
+	}
+	store.memLocks.updateMaxTS(uint64(physical)<<18 + uint64(logical))
+	atomic.StoreInt32(&store.maxTSSynced, 1)
+	return nil
+}
+
+// memLocksForPrewrite returns the keys to be locked in memory and their locks, the locks only carry the
+// information to build the lock errors.
+func memLocksForPrewrite(mutations []*kvrpcpb.Mutation, req *kvrpcpb.PrewriteRequest) ([][]byte, []*mvcc.MvccLock) {
+	keys := make([][]byte, 0, len(mutations))
+	locks := make([]*mvcc.MvccLock, 0, len(mutations))
+	for _, m := range mutations {
+		if m.Op == kvrpcpb.Op_CheckNotExists {
+			continue
+		}
+		op := m.Op
+		if op == kvrpcpb.Op_Insert {
+			op = kvrpcpb.Op_Put
+		}
+		keys = append(keys, m.Key)
+		locks = append(locks, &mvcc.MvccLock{
+			MvccLockHdr: mvcc.MvccLockHdr{
+				StartTS:        req.StartVersion,
+				ForUpdateTS:    req.ForUpdateTs,
+				TTL:            uint32(req.LockTtl),
+				Op:             uint8(op),
+				PrimaryLen:     uint16(len(req.PrimaryLock)),
+				UseAsyncCommit: req.UseAsyncCommit,
+				SecondaryNum:   uint32(len(req.Secondaries)),
+			},
+			Primary:     req.PrimaryLock,
+			Secondaries: req.Secondaries,
+		})
+	}
+	return keys, locks
+}
+
 func (store *MVCCStore) tryOnePC(reqCtx *requestCtx, mutations []*kvrpcpb.Mutation,
 	req *kvrpcpb.PrewriteRequest, items []*badger.Item, minCommitTS uint64, maxCommitTS uint64) (bool, error) {
 	if maxCommitTS != 0 && minCommitTS > maxCommitTS {
@@ -1092,6 +1127,9 @@ func checkLock(lock mvcc.MvccLock, key []byte, startTS uint64, resolved []uint64
 }
 
 func (store *MVCCStore) CheckKeysLock(startTS uint64, resolved []uint64, keys ...[]byte) error {
+	if err := store.memLocks.checkKeys(startTS, resolved, keys...); err != nil {
+		return err
+	}
 	var buf []byte
 	for _, key := range keys {
 		buf = store.lockStore.Get(key, buf)
@@ -1108,6 +1146,15 @@ func (store *MVCCStore) CheckKeysLock(startTS uint64, resolved []uint64, keys ..
 }
 
 func (store *MVCCStore) CheckRangeLock(startTS uint64, startKey, endKey []byte, resolved []uint64) error {
+	var memLockErr error
+	store.memLocks.checkRange(startTS, startKey, endKey, resolved, func(_ []byte, err error) {
+		if memLockErr == nil {
+			memLockErr = err
+		}
+	})
+	if memLockErr != nil {
+		return memLockErr
+	}
 	it := store.lockStore.NewIterator()
 	for it.Seek(startKey); it.Valid(); it.Next() {
 		if exceedEndKey(it.Key(), endKey) {
@@ -1122,6 +1169,25 @@ func (store *MVCCStore) CheckRangeLock(startTS uint64, startKey, endKey []byte,
 	return nil
 }
 
+// OnReadIndex implements raftstore.ReadIndexObserver, it's called by the leader for the read index of replica
+// reads. The max ts is updated with the start ts and the first memory lock in the ranges is returned, the
+// locks already written are replicated and checked by the replica itself.
+func (store *MVCCStore) OnReadIndex(req *raft_cmdpb.ReadIndexRequest) *kvrpcpb.LockInfo {
+	store.memLocks.updateMaxTS(req.StartTs)
+	var locked *ErrLocked
+	for _, ran := range req.KeyRanges {
+		store.memLocks.checkRange(req.StartTs, ran.StartKey, ran.EndKey, nil, func(_ []byte, err error) {
+			if x, ok := err.(*ErrLocked); ok && locked == nil {
+				locked = x
+			}
+		})
+		if locked != nil {
+			return locked.Lock.ToLockInfo(locked.Key)
+		}
+	}
+	return nil
+}
+
 func (store *MVCCStore) Cleanup(reqCtx *requestCtx, key []byte, startTS, currentTs uint64) error {
 	hashVals := keysToHashVals(key)
 	regCtx := reqCtx.regCtx
@@ -1349,6 +1415,27 @@ func (store *MVCCStore) MvccGetByStartTs(reqCtx *requestCtx, startTs uint64) (*k
 	return res, rawKey, nil
 }
 
+// Import writes the mutations committed at commitTS bypassing transactions, the keys must be in the region
+// of the request.
+func (store *MVCCStore) Import(reqCtx *requestCtx, mutations []*kvrpcpb.Mutation, commitTS uint64) error {
+	keys := make([][]byte, len(mutations))
+	for i, m := range mutations {
+		keys[i] = m.Key
+	}
+	hashVals := keysToHashVals(keys...)
+	regCtx := reqCtx.regCtx
+	regCtx.AcquireLatches(hashVals)
+	defer regCtx.ReleaseLatches(hashVals)
+	store.updateLatestTS(commitTS)
+	return store.dbWriter.Import(mutations, commitTS, reqCtx.regCtx.meta, reqCtx.rpcCtx)
+}
+
+// Ingest ingests the uploaded SST files into the region of the request, the files are checked against the
+// region before they are replicated.
+func (store *MVCCStore) Ingest(reqCtx *requestCtx, metas []*import_sstpb.SSTMeta) error {
+	return store.dbWriter.Ingest(metas, reqCtx.regCtx.meta, reqCtx.rpcCtx)
+}
+
 func (store *MVCCStore) DeleteFileInRange(start, end []byte) {
 	store.db.DeleteFilesInRange(start, end)
 	start[0]++
@@ -1382,6 +1469,12 @@ func (store *MVCCStore) BatchGet(reqCtx *requestCtx, keys [][]byte, version uint
 
 func (store *MVCCStore) collectRangeLock(startTS uint64, startKey, endKey []byte, resolved []uint64) []*kvrpcpb.KvPair {
 	var pairs []*kvrpcpb.KvPair
+	store.memLocks.checkRange(startTS, startKey, endKey, resolved, func(key []byte, err error) {
+		pairs = append(pairs, &kvrpcpb.KvPair{
+			Error: convertToKeyError(err),
+			Key:   key,
+		})
+	})
 	it := store.lockStore.NewIterator()
 	for it.Seek(startKey); it.Valid(); it.Next() {
 		if exceedEndKey(it.Key(), endKey) {
@@ -1545,6 +1638,7 @@ func (sp *SafePoint) CreateCompactionFilter(targetLevel int, startKey, endKey []
 	return &GCCompactionFilter{
 		targetLevel: targetLevel,
 		safePoint:   atomic.LoadUint64(&sp.timestamp),
+		rawFilter:   NewRawTTLCompactionFilter(uint64(time.Now().Unix())),
 	}
 }
 
@@ -1552,6 +1646,7 @@ func (sp *SafePoint) CreateCompactionFilter(targetLevel int, startKey, endKey []
 type GCCompactionFilter struct {
 	targetLevel int
 	safePoint   uint64
+	rawFilter   *RawTTLCompactionFilter
 }
 
 const (
@@ -1561,6 +1656,7 @@ const (
 	tablePrefix     byte = 't'
 	// 't' + 1 = 'u
 	tableExtraPrefix byte = 'u'
+	internalPrefix   byte = 0xff
 )
 
 // Filter implements the badger.CompactionFilter interface.
@@ -1578,11 +1674,37 @@ func (f *GCCompactionFilter) Filter(key, value, userMeta []byte) badger.Decision
 		if mvcc.DBUserMeta(userMeta).StartTS() < f.safePoint {
 			return badger.DecisionDrop
 		}
+	case internalPrefix:
+		return f.rawFilter.Filter(key, value, userMeta)
 	}
 	// Older version are discarded automatically, we need to keep the first valid version.
 	return badger.DecisionKeep
 }
 
+// RawTTLCompactionFilter implements the badger.CompactionFilter interface.
+// It removes raw keys which are expired.
+type RawTTLCompactionFilter struct {
+	now uint64
+}
+
+// NewRawTTLCompactionFilter creates a RawTTLCompactionFilter, now is in unix seconds.
+func NewRawTTLCompactionFilter(now uint64) *RawTTLCompactionFilter {
+	return &RawTTLCompactionFilter{now: now}
+}
+
+// Filter implements the badger.CompactionFilter interface.
+// The expired key is marked as tombstone instead of dropped, otherwise an older version in lower levels becomes visible.
+func (f *RawTTLCompactionFilter) Filter(key, value, userMeta []byte) badger.Decision {
+	if bytes.HasPrefix(key, mvcc.RawKeyPrefix) && mvcc.RawUserMeta(userMeta).IsExpired(f.now) {
+		return badger.DecisionMarkTombstone
+	}
+	return badger.DecisionKeep
+}
+
+func (f *RawTTLCompactionFilter) Guards() []badger.Guard {
+	return nil
+}
+
 var (
 	baseGuard       = badger.Guard{MatchLen: 64, MinSize: 64 * 1024}
 	raftGuard       = badger.Guard{Prefix: []byte{0}, MatchLen: 1, MinSize: 64 * 1024}
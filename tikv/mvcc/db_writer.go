@@ -18,7 +18,9 @@ import (
 
 	"github.com/ngaut/unistore/lockstore"
 	"github.com/pingcap/badger"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
 )
 
 // DBWriter is the interface to persistent data.
@@ -26,8 +28,13 @@ type DBWriter interface {
 	Open()
 	Close()
 	Write(batch WriteBatch) error
-	DeleteRange(start, end []byte, latchHandle LatchHandle) error
+	// DeleteRange deletes the keys in [start, end) of the key space, the range must be limited in the region.
+	DeleteRange(space KeySpace, start, end []byte, latchHandle LatchHandle, ctx *kvrpcpb.Context) error
 	NewWriteBatch(startTS, commitTS uint64, ctx *kvrpcpb.Context) WriteBatch
+	// Import writes the mutations as committed at commitTS without transactions.
+	Import(mutations []*kvrpcpb.Mutation, commitTS uint64, region *metapb.Region, ctx *kvrpcpb.Context) error
+	// Ingest ingests the uploaded SST files into the region.
+	Ingest(metas []*import_sstpb.SSTMeta, region *metapb.Region, ctx *kvrpcpb.Context) error
 }
 
 type LatchHandle interface {
@@ -41,13 +48,18 @@ type WriteBatch interface {
 	Rollback(key []byte, deleleLock bool)
 	PessimisticLock(key []byte, lock *MvccLock)
 	PessimisticRollback(key []byte)
+	RawPut(key, value []byte, expireTS uint64)
+	RawDelete(key []byte)
+	VerPut(key, value []byte, version uint64)
+	VerDelete(key []byte, version uint64)
 }
 
 type DBBundle struct {
-	DB         *badger.DB
-	LockStore  *lockstore.MemStore
-	MemStoreMu sync.Mutex
-	StateTS    uint64
+	DB           *badger.DB
+	LockStore    *lockstore.MemStore
+	MemStoreMu   sync.Mutex
+	StateTS      uint64
+	LockObserver LockObserver
 }
 
 type DBSnapshot struct {
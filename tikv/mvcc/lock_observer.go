@@ -0,0 +1,100 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mvcc
+
+import (
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+)
+
+// maxObservedLocks is the max number of locks kept by the LockObserver, the observer becomes dirty
+// if more locks are written.
+const maxObservedLocks = 1024
+
+// LockObserver collects the locks written during the green GC. GC registers the observer with the
+// safe point as max ts before the physical scan, then the locks with start ts not greater than
+// max ts written during the scan can be found by checking the observer.
+// The zero value is an unregistered observer.
+type LockObserver struct {
+	mu    sync.Mutex
+	maxTS uint64
+	dirty bool
+	locks map[string]*kvrpcpb.LockInfo
+}
+
+// Register starts to collect locks with start ts not greater than maxTS. The collected locks are
+// cleared if maxTS is greater than the registered one.
+func (o *LockObserver) Register(maxTS uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if maxTS < o.maxTS {
+		return errors.Errorf("lock observer is already registered with a greater max ts %d", o.maxTS)
+	}
+	if maxTS > o.maxTS {
+		o.maxTS = maxTS
+		o.dirty = false
+		o.locks = make(map[string]*kvrpcpb.LockInfo)
+	}
+	return nil
+}
+
+// Check returns the collected locks, isClean is false if some locks are not collected.
+func (o *LockObserver) Check(maxTS uint64) (locks []*kvrpcpb.LockInfo, isClean bool, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if maxTS != o.maxTS {
+		return nil, false, errors.Errorf("lock observer is not registered with max ts %d, current max ts %d", maxTS, o.maxTS)
+	}
+	locks = make([]*kvrpcpb.LockInfo, 0, len(o.locks))
+	for _, lock := range o.locks {
+		locks = append(locks, lock)
+	}
+	return locks, !o.dirty, nil
+}
+
+// Remove stops collecting locks.
+func (o *LockObserver) Remove(maxTS uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if maxTS != o.maxTS {
+		return errors.Errorf("lock observer is not registered with max ts %d, current max ts %d", maxTS, o.maxTS)
+	}
+	o.maxTS = 0
+	o.dirty = false
+	o.locks = nil
+	return nil
+}
+
+// Observe records the lock if its start ts is not greater than the registered max ts.
+// A nil observer observes nothing.
+func (o *LockObserver) Observe(key []byte, lock *MvccLock) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.maxTS == 0 || lock.StartTS > o.maxTS || o.dirty {
+		return
+	}
+	if len(o.locks) >= maxObservedLocks {
+		if _, ok := o.locks[string(key)]; !ok {
+			o.dirty = true
+			o.locks = make(map[string]*kvrpcpb.LockInfo)
+			return
+		}
+	}
+	o.locks[string(key)] = lock.ToLockInfo(append([]byte{}, key...))
+}
@@ -17,6 +17,7 @@ import (
 	"encoding/binary"
 	"unsafe"
 
+	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 
 	"github.com/pingcap/tidb/util/codec"
@@ -174,3 +175,132 @@ func DecodeExtraTxnStatusKey(extraKey []byte) (key []byte) {
 	key[0]--
 	return
 }
+
+// RawKeyPrefix is the prefix of keys written by the RawKV API.
+// It is placed in the internal key space (0xff), so transactional reads and region split never see raw data,
+// raft snapshots include the raw keys of a region separately.
+var RawKeyPrefix = []byte{0xff, 'r', 'a', 'w'}
+
+// RawKeyEndPrefix is the exclusive upper bound of all encoded raw keys.
+var RawKeyEndPrefix = []byte{0xff, 'r', 'a', 'x'}
+
+// RawUserMeta is the user meta used by raw keys, it holds the expire time in unix seconds.
+type RawUserMeta []byte
+
+const rawUserMetaLen = 8
+
+// NewRawUserMeta creates a new RawUserMeta, expireTS 0 means the key never expires.
+func NewRawUserMeta(expireTS uint64) RawUserMeta {
+	m := make(RawUserMeta, rawUserMetaLen)
+	defaultEndian.PutUint64(m, expireTS)
+	return m
+}
+
+// ExpireTS reads the expire time from the RawUserMeta.
+func (m RawUserMeta) ExpireTS() uint64 {
+	if len(m) < rawUserMetaLen {
+		return 0
+	}
+	return defaultEndian.Uint64(m)
+}
+
+// IsExpired returns true if the key is expired at now.
+func (m RawUserMeta) IsExpired(now uint64) bool {
+	expireTS := m.ExpireTS()
+	return expireTS != 0 && expireTS <= now
+}
+
+// RawExpireTS converts a TTL in seconds to the expire time, 0 means no TTL.
+func RawExpireTS(ttl uint64, now uint64) uint64 {
+	if ttl == 0 {
+		return 0
+	}
+	return now + ttl
+}
+
+// EncodeRawKey encodes a raw key to the key stored in DB.
+func EncodeRawKey(key []byte) []byte {
+	b := make([]byte, 0, len(RawKeyPrefix)+len(key))
+	b = append(b, RawKeyPrefix...)
+	return append(b, key...)
+}
+
+// DecodeRawKey decodes the key stored in DB to the raw key, the returned key shares memory with encodedKey.
+func DecodeRawKey(encodedKey []byte) []byte {
+	return encodedKey[len(RawKeyPrefix):]
+}
+
+// VerKeyPrefix is the prefix of keys written by the versioned KV API. The version given by the client is
+// encoded in the key, so every version is a separate DB key that GC never discards, the badger version is
+// only used to order the writes like raw keys.
+var VerKeyPrefix = []byte{0xff, 'v', 'e', 'r'}
+
+// VerKeyEndPrefix is the exclusive upper bound of all encoded versioned keys.
+var VerKeyEndPrefix = []byte{0xff, 'v', 'e', 's'}
+
+// VerUserMeta is the user meta of versioned values.
+var VerUserMeta = []byte{0}
+
+// VerDeleteUserMeta is the user meta of versioned deletes, a delete hides the older versions of the key.
+var VerDeleteUserMeta = []byte{1}
+
+// EncodeVerKey encodes a versioned key with the version to the key stored in DB, the versions of a key
+// are in descending order.
+func EncodeVerKey(key []byte, version uint64) []byte {
+	return codec.EncodeUintDesc(EncodeVerKeyPrefix(key), version)
+}
+
+// EncodeVerKeyPrefix encodes a versioned key without the version, it is the common prefix of all the
+// versions of the key and sorts in the same order as the key.
+func EncodeVerKeyPrefix(key []byte) []byte {
+	b := make([]byte, 0, len(VerKeyPrefix)+codec.EncodedBytesLength(len(key))+8)
+	b = append(b, VerKeyPrefix...)
+	return codec.EncodeBytes(b, key)
+}
+
+// DecodeVerKey decodes the key stored in DB to the versioned key and the version.
+func DecodeVerKey(encodedKey []byte) (key []byte, version uint64, err error) {
+	if len(encodedKey) < len(VerKeyPrefix) {
+		return nil, 0, errors.New("invalid versioned key")
+	}
+	remain, key, err := codec.DecodeBytes(encodedKey[len(VerKeyPrefix):], nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	_, version, err = codec.DecodeUintDesc(remain)
+	return key, version, err
+}
+
+// KeySpace is the key space of a key range.
+type KeySpace byte
+
+const (
+	// KeySpaceTxn is the space of the transactional keys.
+	KeySpaceTxn KeySpace = iota
+	// KeySpaceRaw is the space of the keys written by the RawKV API.
+	KeySpaceRaw
+	// KeySpaceVer is the space of the keys written by the versioned KV API.
+	KeySpaceVer
+)
+
+// EncodeRange encodes the range [startKey, endKey) in the key space to the range of the keys stored in DB,
+// an empty endKey means the end of the key space.
+func (s KeySpace) EncodeRange(startKey, endKey []byte) (start, end []byte) {
+	switch s {
+	case KeySpaceRaw:
+		if len(endKey) == 0 {
+			return EncodeRawKey(startKey), RawKeyEndPrefix
+		}
+		return EncodeRawKey(startKey), EncodeRawKey(endKey)
+	case KeySpaceVer:
+		if len(endKey) == 0 {
+			return EncodeVerKeyPrefix(startKey), VerKeyEndPrefix
+		}
+		return EncodeVerKeyPrefix(startKey), EncodeVerKeyPrefix(endKey)
+	default:
+		if len(endKey) == 0 {
+			return startKey, []byte{0xff}
+		}
+		return startKey, endKey
+	}
+}
@@ -15,23 +15,30 @@ package tikv
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 
 	"github.com/ngaut/unistore/config"
 	"github.com/ngaut/unistore/lockstore"
+	"github.com/ngaut/unistore/tikv/dbreader"
 	"github.com/ngaut/unistore/tikv/mvcc"
 	"github.com/ngaut/unistore/tikv/raftstore"
 	"github.com/ngaut/unistore/util/lockwaiter"
 	"github.com/pingcap/badger"
 	"github.com/pingcap/badger/y"
 	. "github.com/pingcap/check"
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+	"github.com/pingcap/kvproto/pkg/errorpb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/mpp"
+	"github.com/zhangjinpeng1987/raft"
 )
 
 var _ = Suite(&testMvccSuite{})
@@ -1554,6 +1561,32 @@ func (s *testMvccSuite) TestOpCheckNotExist(c *C) {
 	MustPrewriteOpCheckExistOk(k, k, 8, store)
 }
 
+func (s *testMvccSuite) TestLockWaitQueueFull(c *C) {
+	store, err := NewTestStore("TestLockWaitQueueFull", "TestLockWaitQueueFull", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	conf := config.DefaultConf
+	conf.PessimisticTxn.MaxWaitersPerKey = 1
+	store.MvccStore.lockWaiterManager = lockwaiter.NewManager(&conf)
+
+	k := []byte("key")
+	MustAcquirePessimisticLock(k, k, 1, 1, store)
+	waiter, err := PessimisticLock(k, k, 2, lockTTL, 2, true, false, store)
+	c.Assert(waiter, NotNil)
+	defer store.MvccStore.lockWaiterManager.CleanUp(waiter)
+	_, ok := err.(*ErrLocked)
+	c.Assert(ok, IsTrue)
+
+	// The queue of the key is full, the client backs off with the server is busy error.
+	waiter, err = PessimisticLock(k, k, 3, lockTTL, 3, true, false, store)
+	c.Assert(waiter, IsNil)
+	_, ok = err.(*ErrLockWaitQueueFull)
+	c.Assert(ok, IsTrue)
+	keyErrs, regErr := convertToPBErrors(err)
+	c.Assert(keyErrs, IsNil)
+	c.Assert(regErr.GetServerIsBusy(), NotNil)
+}
+
 func (s *testMvccSuite) TestPessimisticLockForce(c *C) {
 	store, err := NewTestStore("TestPessimisticLockForce", "TestPessimisticLockForce", c)
 	c.Assert(err, IsNil)
@@ -1635,3 +1668,730 @@ func (s *testMvccSuite) TestAsyncCommitPrewrite(c *C) {
 	store.c.Assert(secLock.MinCommitTS, Greater, uint64(0))
 	store.c.Assert(bytes.Compare(secLock.Value, secVal2), Equals, 0)
 }
+
+func (s *testMvccSuite) TestRawKV(c *C) {
+	store, err := NewTestStore("TestRawKV", "TestRawKV", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	reqCtx := store.newReqCtx()
+	var pairs []*kvrpcpb.KvPair
+	for i := 0; i < 5; i++ {
+		key := []byte(fmt.Sprintf("t%d", i))
+		pairs = append(pairs, &kvrpcpb.KvPair{Key: key, Value: append([]byte("v"), key...)})
+	}
+	c.Assert(store.MvccStore.RawPut(reqCtx, pairs, 0), IsNil)
+
+	val, err := store.MvccStore.RawGet(reqCtx, []byte("t1"))
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("vt1"))
+	// Raw data is invisible to transactional reads.
+	MustGetNone([]byte("t1"), maxTs, store)
+
+	got, err := store.MvccStore.RawBatchGet(reqCtx, [][]byte{[]byte("t0"), []byte("t9"), []byte("t4")})
+	c.Assert(err, IsNil)
+	c.Assert(len(got), Equals, 2)
+	c.Assert(got[0].Key, BytesEquals, []byte("t0"))
+	c.Assert(got[1].Key, BytesEquals, []byte("t4"))
+
+	got, err = store.MvccStore.RawScan(reqCtx, []byte("t1"), []byte("t4"), 10, false, false)
+	c.Assert(err, IsNil)
+	c.Assert(len(got), Equals, 3)
+	c.Assert(got[0].Key, BytesEquals, []byte("t1"))
+	c.Assert(got[2].Value, BytesEquals, []byte("vt3"))
+
+	got, err = store.MvccStore.RawScan(reqCtx, []byte("t4"), []byte("t1"), 2, true, true)
+	c.Assert(err, IsNil)
+	c.Assert(len(got), Equals, 2)
+	c.Assert(got[0].Key, BytesEquals, []byte("t3"))
+	c.Assert(got[1].Key, BytesEquals, []byte("t2"))
+	c.Assert(got[0].Value, HasLen, 0)
+
+	c.Assert(store.MvccStore.RawDelete(reqCtx, [][]byte{[]byte("t1")}), IsNil)
+	val, err = store.MvccStore.RawGet(reqCtx, []byte("t1"))
+	c.Assert(err, IsNil)
+	c.Assert(val, HasLen, 0)
+
+	c.Assert(store.MvccStore.RawDeleteRange(reqCtx, []byte("t2"), nil), IsNil)
+	got, err = store.MvccStore.RawScan(reqCtx, nil, nil, 10, false, false)
+	c.Assert(err, IsNil)
+	c.Assert(len(got), Equals, 1)
+	c.Assert(got[0].Key, BytesEquals, []byte("t0"))
+}
+
+func (s *testMvccSuite) TestRawKVTTL(c *C) {
+	store, err := NewTestStore("TestRawKVTTL", "TestRawKVTTL", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	reqCtx := store.newReqCtx()
+	c.Assert(store.MvccStore.RawPut(reqCtx, []*kvrpcpb.KvPair{{Key: []byte("t1"), Value: []byte("v1")}}, 100), IsNil)
+	c.Assert(store.MvccStore.RawPut(reqCtx, []*kvrpcpb.KvPair{{Key: []byte("t2"), Value: []byte("v2")}}, 0), IsNil)
+	ttl, notFound, err := store.MvccStore.RawGetKeyTTL(reqCtx, []byte("t1"))
+	c.Assert(err, IsNil)
+	c.Assert(notFound, IsFalse)
+	c.Assert(ttl > 0 && ttl <= 100, IsTrue)
+	ttl, notFound, err = store.MvccStore.RawGetKeyTTL(reqCtx, []byte("t2"))
+	c.Assert(err, IsNil)
+	c.Assert(notFound, IsFalse)
+	c.Assert(ttl, Equals, uint64(0))
+	_, notFound, err = store.MvccStore.RawGetKeyTTL(reqCtx, []byte("t3"))
+	c.Assert(err, IsNil)
+	c.Assert(notFound, IsTrue)
+
+	// Expired keys are invisible.
+	reader := reqCtx.newRawReader(nil, nil)
+	reader.now += 200
+	val, err := reader.get([]byte("t1"))
+	c.Assert(err, IsNil)
+	c.Assert(val, IsNil)
+	pairs, err := reader.scan(10, false, false)
+	c.Assert(err, IsNil)
+	c.Assert(len(pairs), Equals, 1)
+	c.Assert(pairs[0].Key, BytesEquals, []byte("t2"))
+	reader.close()
+
+	filter := NewRawTTLCompactionFilter(200)
+	key := mvcc.EncodeRawKey([]byte("t1"))
+	c.Assert(filter.Filter(key, nil, mvcc.NewRawUserMeta(100)), Equals, badger.DecisionMarkTombstone)
+	c.Assert(filter.Filter(key, nil, mvcc.NewRawUserMeta(300)), Equals, badger.DecisionKeep)
+	c.Assert(filter.Filter(key, nil, mvcc.NewRawUserMeta(0)), Equals, badger.DecisionKeep)
+}
+
+func (s *testMvccSuite) TestRawCompareAndSwap(c *C) {
+	store, err := NewTestStore("TestRawCompareAndSwap", "TestRawCompareAndSwap", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	reqCtx := store.newReqCtx()
+	key := []byte("tkey")
+	resp, err := store.MvccStore.RawCompareAndSwap(reqCtx, &kvrpcpb.RawCASRequest{
+		Key: key, Value: []byte("v1"), PreviousNotExist: true,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Succeed, IsTrue)
+	c.Assert(resp.PreviousNotExist, IsTrue)
+
+	// The previous value doesn't match.
+	resp, err = store.MvccStore.RawCompareAndSwap(reqCtx, &kvrpcpb.RawCASRequest{
+		Key: key, Value: []byte("v2"), PreviousValue: []byte("v0"),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Succeed, IsFalse)
+	c.Assert(resp.PreviousNotExist, IsFalse)
+	c.Assert(resp.PreviousValue, BytesEquals, []byte("v1"))
+
+	resp, err = store.MvccStore.RawCompareAndSwap(reqCtx, &kvrpcpb.RawCASRequest{
+		Key: key, Value: []byte("v2"), PreviousValue: []byte("v1"),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Succeed, IsTrue)
+	val, err := store.MvccStore.RawGet(reqCtx, key)
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("v2"))
+
+	// An empty value is rejected, the key is kept.
+	_, err = store.MvccStore.RawCompareAndSwap(reqCtx, &kvrpcpb.RawCASRequest{
+		Key: key, PreviousValue: []byte("v2"),
+	})
+	c.Assert(err, Equals, errRawEmptyValue)
+	val, err = store.MvccStore.RawGet(reqCtx, key)
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("v2"))
+}
+
+func (s *testMvccSuite) TestRawPutEmptyValue(c *C) {
+	store, err := NewTestStore("TestRawPutEmptyValue", "TestRawPutEmptyValue", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	reqCtx := store.newReqCtx()
+	key := []byte("tkey")
+	c.Assert(store.MvccStore.RawPut(reqCtx, []*kvrpcpb.KvPair{{Key: key}}, 0), Equals, errRawEmptyValue)
+	// No pair of the batch is written if any value is empty.
+	pairs := []*kvrpcpb.KvPair{{Key: key, Value: []byte("v")}, {Key: []byte("tkey2")}}
+	c.Assert(store.MvccStore.RawPut(reqCtx, pairs, 0), Equals, errRawEmptyValue)
+	val, err := store.MvccStore.RawGet(reqCtx, key)
+	c.Assert(err, IsNil)
+	c.Assert(val, IsNil)
+}
+
+type dummyLeaderChecker struct{}
+
+func (c *dummyLeaderChecker) IsLeader(ctx *kvrpcpb.Context, router *raftstore.RaftstoreRouter) *errorpb.Error {
+	return nil
+}
+
+func (c *dummyLeaderChecker) AgreeLeader(info *kvrpcpb.LeaderInfo) bool {
+	return true
+}
+
+func (s *testMvccSuite) TestCheckSafeTS(c *C) {
+	store, err := NewTestStore("TestCheckSafeTS", "TestCheckSafeTS", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	reqCtx := store.newReqCtx()
+	// Regions without leader checker have only one replica.
+	c.Assert(reqCtx.checkSafeTS(100), IsNil)
+
+	reqCtx.regCtx.leaderChecker = &dummyLeaderChecker{}
+	c.Assert(reqCtx.checkSafeTS(100), NotNil)
+	reqCtx.regCtx.updateSafeTS(100)
+	c.Assert(reqCtx.checkSafeTS(100), IsNil)
+	c.Assert(reqCtx.checkSafeTS(101), NotNil)
+	// The safe ts never goes backward.
+	reqCtx.regCtx.updateSafeTS(50)
+	c.Assert(reqCtx.regCtx.getSafeTS(), Equals, uint64(100))
+}
+
+func (s *testMvccSuite) TestFollowerReadFlags(c *C) {
+	store, err := NewTestStore("TestFollowerReadFlags", "TestFollowerReadFlags", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	bundle := &mvcc.DBBundle{DB: store.MvccStore.db, LockStore: store.MvccStore.lockStore}
+	rm, err := NewMockRegionManager(bundle, 1, RegionOptions{RegionSize: 96 * 1024 * 1024})
+	c.Assert(err, IsNil)
+	store.Svr.regionManager = rm
+
+	for _, rpcCtx := range []*kvrpcpb.Context{{RegionId: 1, ReplicaRead: true}, {RegionId: 1, StaleRead: true}} {
+		// The region doesn't exist, the reads check it as usual.
+		getResp, err := store.Svr.KvGet(context.Background(), &kvrpcpb.GetRequest{Context: rpcCtx, Key: []byte("a")})
+		c.Assert(err, IsNil)
+		c.Assert(getResp.RegionError.GetRegionNotFound(), NotNil)
+
+		prewriteResp, err := store.Svr.KvPrewrite(context.Background(), &kvrpcpb.PrewriteRequest{Context: rpcCtx})
+		c.Assert(err, IsNil)
+		c.Assert(prewriteResp.RegionError, NotNil)
+		c.Assert(prewriteResp.RegionError.GetRegionNotFound(), IsNil)
+		rawResp, err := store.Svr.RawPut(context.Background(), &kvrpcpb.RawPutRequest{Context: rpcCtx, Key: []byte("a")})
+		c.Assert(err, IsNil)
+		c.Assert(rawResp.RegionError, NotNil)
+		c.Assert(rawResp.RegionError.GetRegionNotFound(), IsNil)
+	}
+}
+
+func (s *testMvccSuite) TestReadIndexUpdatesMaxTS(c *C) {
+	store, err := NewTestStore("TestReadIndexUpdatesMaxTS", "TestReadIndexUpdatesMaxTS", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	bundle := &mvcc.DBBundle{DB: store.MvccStore.db, LockStore: store.MvccStore.lockStore}
+	rm, err := NewMockRegionManager(bundle, 1, RegionOptions{RegionSize: 96 * 1024 * 1024})
+	c.Assert(err, IsNil)
+	region := &metapb.Region{Id: 1, RegionEpoch: &metapb.RegionEpoch{}, Peers: []*metapb.Peer{{Id: 2, StoreId: 1}}}
+	c.Assert(rm.Bootstrap([]*metapb.Store{{Id: 1, Address: "127.0.0.1:10086"}}, region), IsNil)
+	store.Svr.regionManager = rm
+	rpcCtx := &kvrpcpb.Context{RegionId: 1, RegionEpoch: &metapb.RegionEpoch{ConfVer: 1, Version: 1}}
+
+	pk, val := []byte("tpk"), []byte("val")
+	readTS := store.MvccStore.memLocks.getMaxTS() + 100
+	resp, err := store.Svr.ReadIndex(context.Background(), &kvrpcpb.ReadIndexRequest{
+		Context: rpcCtx,
+		StartTs: readTS,
+		Ranges:  pointKeyRanges(pk),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(resp.RegionError, IsNil)
+	c.Assert(resp.Locked, IsNil)
+	// An async commit transaction prewritten after the read index can not commit before the read ts.
+	MustPrewriteOptimisticAsyncCommit(pk, pk, val, readTS-50, 100, 0, [][]byte{}, store)
+	lock := store.MvccStore.getLock(store.newReqCtx(), pk)
+	c.Assert(lock.MinCommitTS, Greater, readTS)
+
+	// The transaction being prewritten blocks the read index of the range.
+	key := []byte("tkey")
+	memLock := &mvcc.MvccLock{
+		MvccLockHdr: mvcc.MvccLockHdr{
+			StartTS:        readTS + 10,
+			Op:             uint8(kvrpcpb.Op_Put),
+			PrimaryLen:     uint16(len(key)),
+			UseAsyncCommit: true,
+		},
+		Primary: key,
+	}
+	store.MvccStore.memLocks.lockKeys([][]byte{key}, []*mvcc.MvccLock{memLock}, readTS+11)
+	resp, err = store.Svr.ReadIndex(context.Background(), &kvrpcpb.ReadIndexRequest{
+		Context: rpcCtx,
+		StartTs: memLock.MinCommitTS + 10,
+		Ranges:  []*kvrpcpb.KeyRange{{StartKey: []byte("t"), EndKey: []byte("u")}},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Locked, NotNil)
+	c.Assert(resp.Locked.Key, BytesEquals, key)
+	c.Assert(resp.Locked.LockVersion, Equals, readTS+10)
+	store.MvccStore.memLocks.unlockKeys([][]byte{key}, readTS+10)
+}
+
+func (s *testMvccSuite) TestResolveTS(c *C) {
+	store, err := NewTestStore("TestResolveTS", "TestResolveTS", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	startKey, endKey := []byte("ta"), []byte("tz")
+	c.Assert(store.MvccStore.resolveTS(startKey, endKey, 100), Equals, uint64(100))
+
+	// Pessimistic locks don't block reads.
+	MustAcquirePessimisticLock([]byte("tb"), []byte("tb"), 10, 10, store)
+	c.Assert(store.MvccStore.resolveTS(startKey, endKey, 100), Equals, uint64(100))
+
+	MustPrewritePut([]byte("tc"), []byte("tc"), []byte("v"), 20, store)
+	MustPrewritePut([]byte("td"), []byte("td"), []byte("v"), 30, store)
+	c.Assert(store.MvccStore.resolveTS(startKey, endKey, 100), Equals, uint64(19))
+	c.Assert(store.MvccStore.resolveTS(startKey, endKey, 15), Equals, uint64(15))
+	// Locks out of the range are ignored.
+	c.Assert(store.MvccStore.resolveTS([]byte("td"), endKey, 100), Equals, uint64(29))
+}
+
+func (s *testMvccSuite) TestLockObserver(c *C) {
+	store, err := NewTestStore("TestLockObserver", "TestLockObserver", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	observer := store.MvccStore.observer
+	// Locks are not collected before the observer is registered.
+	MustPrewritePut([]byte("ta"), []byte("ta"), []byte("v"), 5, store)
+	_, _, err = observer.Check(10)
+	c.Assert(err, NotNil)
+
+	c.Assert(observer.Register(10), IsNil)
+	MustPrewritePut([]byte("tb"), []byte("tb"), []byte("v"), 8, store)
+	MustPrewritePut([]byte("tc"), []byte("tc"), []byte("v"), 20, store)
+	locks, isClean, err := observer.Check(10)
+	c.Assert(err, IsNil)
+	c.Assert(isClean, IsTrue)
+	c.Assert(locks, HasLen, 1)
+	c.Assert(locks[0].Key, BytesEquals, []byte("tb"))
+	c.Assert(locks[0].LockVersion, Equals, uint64(8))
+
+	// Registering with a smaller max ts fails, a greater one clears the collected locks.
+	c.Assert(observer.Register(5), NotNil)
+	c.Assert(observer.Register(30), IsNil)
+	locks, _, err = observer.Check(30)
+	c.Assert(err, IsNil)
+	c.Assert(locks, HasLen, 0)
+
+	c.Assert(observer.Remove(10), NotNil)
+	c.Assert(observer.Remove(30), IsNil)
+	_, _, err = observer.Check(30)
+	c.Assert(err, NotNil)
+}
+
+func (s *testMvccSuite) TestMPPTaskHandlerMap(c *C) {
+	set := NewMPPTaskHandlerMap()
+	for i, startTS := range []uint64{10, 10, 20} {
+		_, err := set.create(&mpp.TaskMeta{StartTs: startTS, TaskId: int64(i + 1)}, nil)
+		c.Assert(err, IsNil)
+	}
+	_, err := set.create(&mpp.TaskMeta{StartTs: 10, TaskId: 1}, nil)
+	c.Assert(err, NotNil)
+
+	task := set.get(1)
+	c.Assert(task, NotNil)
+	c.Assert(set.cancel(10, "test"), Equals, 2)
+	c.Assert(task.cancelled(), IsTrue)
+	c.Assert(task.getErr(), NotNil)
+	// No tunnel is established after the task is cancelled.
+	_, err = task.establishConn(context.Background(), &mpp.EstablishMPPConnectionRequest{})
+	c.Assert(err, NotNil)
+	task.setErr(fmt.Errorf("other"))
+	c.Assert(task.getErr().Error(), Matches, ".*cancelled: test")
+	c.Assert(set.get(1), IsNil)
+	c.Assert(set.get(2), IsNil)
+	c.Assert(set.get(3), NotNil)
+	c.Assert(set.cancel(10, "test"), Equals, 0)
+
+	c.Assert(set.remove(3), IsNil)
+	c.Assert(set.remove(3), NotNil)
+}
+
+func (s *testMvccSuite) TestSplitCopRanges(c *C) {
+	store, err := NewTestStore("TestSplitCopRanges", "TestSplitCopRanges", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	for i := 0; i < 5; i++ {
+		key := []byte(fmt.Sprintf("t%d", i))
+		MustPrewritePut(key, key, []byte("v"), 10, store)
+		MustCommit(key, 10, 11, store)
+	}
+	txn := store.MvccStore.db.NewTransaction(false)
+	defer txn.Discard()
+	splitAll := func(desc bool) []*coprocessor.KeyRange {
+		splitter := newCopRangeSplitter(txn, []*coprocessor.KeyRange{
+			{Start: []byte("t0"), End: []byte("t4")},
+			{Start: []byte("t4"), End: []byte("t9")},
+		}, 2, desc)
+		var ranges []*coprocessor.KeyRange
+		for ran := splitter.next(); ran != nil; ran = splitter.next() {
+			ranges = append(ranges, ran)
+		}
+		return ranges
+	}
+	ranges := splitAll(false)
+	c.Assert(ranges, HasLen, 3)
+	c.Assert(ranges[0].Start, BytesEquals, []byte("t0"))
+	c.Assert(ranges[0].End, BytesEquals, []byte("t2"))
+	c.Assert(ranges[1].Start, BytesEquals, []byte("t2"))
+	c.Assert(ranges[1].End, BytesEquals, []byte("t4"))
+	c.Assert(ranges[2].Start, BytesEquals, []byte("t4"))
+	c.Assert(ranges[2].End, BytesEquals, []byte("t9"))
+
+	// The descending scans get the sub ranges from the last one.
+	ranges = splitAll(true)
+	c.Assert(ranges, HasLen, 3)
+	c.Assert(ranges[0].Start, BytesEquals, []byte("t4"))
+	c.Assert(ranges[0].End, BytesEquals, []byte("t9"))
+	c.Assert(ranges[1].Start, BytesEquals, []byte("t2"))
+	c.Assert(ranges[1].End, BytesEquals, []byte("t4"))
+	c.Assert(ranges[2].Start, BytesEquals, []byte("t0"))
+	c.Assert(ranges[2].End, BytesEquals, []byte("t2"))
+}
+
+func (s *testMvccSuite) TestDispatchMPPTaskFailed(c *C) {
+	store, err := NewTestStore("TestDispatchMPPTaskFailed", "TestDispatchMPPTaskFailed", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	bundle := &mvcc.DBBundle{DB: store.MvccStore.db, LockStore: store.MvccStore.lockStore}
+	rm, err := NewMockRegionManager(bundle, 1, RegionOptions{RegionSize: 96 * 1024 * 1024})
+	c.Assert(err, IsNil)
+	store.Svr.regionManager = rm
+	meta := &mpp.TaskMeta{StartTs: 100, TaskId: 1}
+
+	// The address of the store is unknown, no task is left.
+	rm.mppTaskSet[2] = NewMPPTaskHandlerMap()
+	_, err = store.Svr.DispatchMPPTaskWithStoreId(context.Background(), &mpp.DispatchTaskRequest{Meta: meta}, 2)
+	c.Assert(err, NotNil)
+	c.Assert(rm.getMPPTaskSet(2).get(meta.TaskId), IsNil)
+
+	// The read is blocked by a memory lock, the task is removed and cancelled.
+	rm.AddStore(1, "127.0.0.1:10086")
+	key := []byte("tkey")
+	memLock := &mvcc.MvccLock{
+		MvccLockHdr: mvcc.MvccLockHdr{
+			StartTS:        50,
+			Op:             uint8(kvrpcpb.Op_Put),
+			PrimaryLen:     uint16(len(key)),
+			UseAsyncCommit: true,
+		},
+		Primary: key,
+	}
+	store.MvccStore.memLocks.lockKeys([][]byte{key}, []*mvcc.MvccLock{memLock}, 51)
+	defer store.MvccStore.memLocks.unlockKeys([][]byte{key}, 50)
+	resp, err := store.Svr.DispatchMPPTaskWithStoreId(context.Background(), &mpp.DispatchTaskRequest{
+		Meta: meta,
+		Regions: []*coprocessor.RegionInfo{{
+			RegionId:    1,
+			RegionEpoch: &metapb.RegionEpoch{},
+			Ranges:      []*coprocessor.KeyRange{{Start: []byte("t"), End: []byte("u")}},
+		}},
+	}, 1)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Error, NotNil)
+	c.Assert(rm.getMPPTaskSet(1).get(meta.TaskId), IsNil)
+}
+
+func (s *testMvccSuite) TestCoprocessorV2Registry(c *C) {
+	registry := NewCoprocessorV2Registry()
+	newHandler := func(version string) CoprocessorV2Handler {
+		return func(_ context.Context, _ *dbreader.DBReader, _ []byte) ([]byte, error) {
+			return []byte(version), nil
+		}
+	}
+	for _, version := range []string{"1.0.0", "1.2.0", "2.0.1"} {
+		c.Assert(registry.Register("sum", version, newHandler(version)), IsNil)
+	}
+	c.Assert(registry.Register("sum", "1.2", newHandler("1.2")), NotNil)
+	c.Assert(registry.Register("sum", "x", newHandler("x")), NotNil)
+
+	tbl := []struct {
+		req     string
+		version string
+	}{
+		{"", "2.0.1"},
+		{"*", "2.0.1"},
+		{"1.0.0", "1.0.0"},
+		{"=1.2", "1.2.0"},
+		{"^1.0", "1.2.0"},
+		{">=1.0, <1.2", "1.0.0"},
+		{"<=2.0.1, >1.2.0", "2.0.1"},
+		{"^3", ""},
+		{"~1", ""},
+	}
+	for _, t := range tbl {
+		handler, err := registry.Get("sum", t.req)
+		if t.version == "" {
+			c.Assert(err, NotNil)
+			continue
+		}
+		c.Assert(err, IsNil)
+		data, err := handler(context.Background(), nil, nil)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, t.version)
+	}
+	_, err := registry.Get("count", "")
+	c.Assert(err, NotNil)
+}
+
+func (s *testMvccSuite) TestCoprocessorV2Panic(c *C) {
+	handler := func(_ context.Context, _ *dbreader.DBReader, _ []byte) ([]byte, error) {
+		panic("plugin bug")
+	}
+	data, err := callCoprocessorV2(context.Background(), handler, nil, nil)
+	c.Assert(data, IsNil)
+	c.Assert(err, ErrorMatches, ".*plugin bug.*")
+}
+
+func (s *testMvccSuite) TestVerKV(c *C) {
+	store, err := NewTestStore("TestVerKV", "TestVerKV", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	reqCtx := store.newReqCtx()
+	put := func(key, val string, version uint64) {
+		mut := &kvrpcpb.VerMutation{Op: kvrpcpb.VerOp_VerPut, Key: []byte(key), Value: []byte(val)}
+		c.Assert(store.MvccStore.VerMut(reqCtx, []*kvrpcpb.VerMutation{mut}, version), IsNil)
+	}
+	put("t1", "v10", 10)
+	put("t1", "v20", 20)
+	put("t2", "v15", 15)
+
+	val, err := store.MvccStore.VerGet(reqCtx, []byte("t1"), 15)
+	c.Assert(err, IsNil)
+	c.Assert(val.Value, BytesEquals, []byte("v10"))
+	c.Assert(val.Version, Equals, uint64(10))
+	val, err = store.MvccStore.VerGet(reqCtx, []byte("t1"), 0)
+	c.Assert(err, IsNil)
+	c.Assert(val.Version, Equals, uint64(20))
+	val, err = store.MvccStore.VerGet(reqCtx, []byte("t1"), 5)
+	c.Assert(err, IsNil)
+	c.Assert(val, IsNil)
+	// Versioned data is invisible to raw reads.
+	rawVal, err := store.MvccStore.RawGet(reqCtx, []byte("t1"))
+	c.Assert(err, IsNil)
+	c.Assert(rawVal, HasLen, 0)
+
+	pairs, err := store.MvccStore.VerBatchGet(reqCtx, [][]byte{[]byte("t1"), []byte("t2"), []byte("t3")}, 12)
+	c.Assert(err, IsNil)
+	c.Assert(pairs, HasLen, 1)
+	c.Assert(pairs[0].Key, BytesEquals, []byte("t1"))
+
+	pairs, err = store.MvccStore.VerScan(reqCtx, []byte("t0"), []byte("t9"), 10, false, false, 15)
+	c.Assert(err, IsNil)
+	c.Assert(pairs, HasLen, 2)
+	c.Assert(pairs[0].Value.Value, BytesEquals, []byte("v10"))
+	c.Assert(pairs[1].Value.Version, Equals, uint64(15))
+	pairs, err = store.MvccStore.VerScan(reqCtx, []byte("t9"), []byte("t0"), 1, true, true, 0)
+	c.Assert(err, IsNil)
+	c.Assert(pairs, HasLen, 1)
+	c.Assert(pairs[0].Key, BytesEquals, []byte("t2"))
+	c.Assert(pairs[0].Value.Value, HasLen, 0)
+
+	del := &kvrpcpb.VerMutation{Op: kvrpcpb.VerOp_VerDelete, Key: []byte("t2")}
+	c.Assert(store.MvccStore.VerMut(reqCtx, []*kvrpcpb.VerMutation{del}, 30), IsNil)
+	val, err = store.MvccStore.VerGet(reqCtx, []byte("t2"), 0)
+	c.Assert(err, IsNil)
+	c.Assert(val, IsNil)
+	val, err = store.MvccStore.VerGet(reqCtx, []byte("t2"), 29)
+	c.Assert(err, IsNil)
+	c.Assert(val.Version, Equals, uint64(15))
+
+	// The version is encoded in the key, so an older version written later is kept and never discarded by GC.
+	put("t1", "v5", 5)
+	val, err = store.MvccStore.VerGet(reqCtx, []byte("t1"), 7)
+	c.Assert(err, IsNil)
+	c.Assert(val.Value, BytesEquals, []byte("v5"))
+	val, err = store.MvccStore.VerGet(reqCtx, []byte("t1"), 0)
+	c.Assert(err, IsNil)
+	c.Assert(val.Version, Equals, uint64(20))
+	filter := &GCCompactionFilter{safePoint: math.MaxUint64, rawFilter: NewRawTTLCompactionFilter(0)}
+	verKey := mvcc.EncodeVerKey([]byte("t1"), 5)
+	c.Assert(filter.Filter(verKey, []byte("v5"), mvcc.VerUserMeta), Equals, badger.DecisionKeep)
+	c.Assert(filter.Filter(verKey, nil, mvcc.VerDeleteUserMeta), Equals, badger.DecisionKeep)
+	key, version, err := mvcc.DecodeVerKey(verKey)
+	c.Assert(err, IsNil)
+	c.Assert(key, BytesEquals, []byte("t1"))
+	c.Assert(version, Equals, uint64(5))
+
+	c.Assert(store.MvccStore.VerDeleteRange(reqCtx, []byte("t0"), []byte("t9")), IsNil)
+	for _, version := range []uint64{10, 15, 20, 0} {
+		pairs, err = store.MvccStore.VerScan(reqCtx, nil, nil, 10, true, false, version)
+		c.Assert(err, IsNil)
+		c.Assert(pairs, HasLen, 0)
+	}
+}
+
+func (s *testMvccSuite) TestMemLockTable(c *C) {
+	table := newMemLockTable()
+	k1, k2 := []byte("k1"), []byte("k2")
+	c.Assert(table.checkKeys(100, nil, k1), IsNil)
+	c.Assert(table.checkKeys(maxSystemTS, nil, k1), IsNil)
+	c.Assert(table.getMaxTS(), Equals, uint64(100))
+
+	var locks []*mvcc.MvccLock
+	for i := 0; i < 2; i++ {
+		locks = append(locks, &mvcc.MvccLock{
+			MvccLockHdr: mvcc.MvccLockHdr{
+				StartTS:        50,
+				Op:             uint8(kvrpcpb.Op_Put),
+				PrimaryLen:     uint16(len(k1)),
+				UseAsyncCommit: true,
+			},
+			Primary: k1,
+		})
+	}
+	// The min commit ts is greater than the max read ts.
+	c.Assert(table.lockKeys([][]byte{k1, k2}, locks, 51), Equals, uint64(101))
+	c.Assert(locks[0].MinCommitTS, Equals, uint64(101))
+
+	c.Assert(table.checkKeys(40, nil, k1), IsNil)
+	c.Assert(table.checkKeys(300, []uint64{50}, k1), IsNil)
+	err := table.checkKeys(300, nil, k2)
+	c.Assert(err, NotNil)
+	c.Assert(err.(*ErrLocked).Lock.StartTS, Equals, uint64(50))
+	c.Assert(table.getMaxTS(), Equals, uint64(300))
+	var lockedKeys int
+	table.checkRange(300, []byte("k"), []byte("k2"), nil, func(key []byte, err error) {
+		c.Assert(key, BytesEquals, k1)
+		lockedKeys++
+	})
+	c.Assert(lockedKeys, Equals, 1)
+
+	table.unlockKeys([][]byte{k1, k2}, 60)
+	c.Assert(table.checkKeys(300, nil, k1), NotNil)
+	table.unlockKeys([][]byte{k1, k2}, 50)
+	c.Assert(table.checkKeys(300, nil, k1, k2), IsNil)
+}
+
+func (s *testMvccSuite) TestSyncMaxTS(c *C) {
+	store, err := NewTestStore("TestSyncMaxTS", "TestSyncMaxTS", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	// The max ts is synced when the store starts.
+	startMaxTS := store.MvccStore.memLocks.getMaxTS()
+	c.Assert(startMaxTS, Greater, uint64(0))
+
+	// The regions of raftstore start unsynced.
+	regCtx := &regionCtx{maxTSEpoch: 1}
+	_, synced := regCtx.getMaxTSEpoch()
+	c.Assert(synced, IsFalse)
+	c.Assert(store.MvccStore.syncMaxTS(regCtx), IsNil)
+	_, synced = regCtx.getMaxTSEpoch()
+	c.Assert(synced, IsTrue)
+	maxTS := store.MvccStore.memLocks.getMaxTS()
+	c.Assert(maxTS, Greater, uint64(0))
+
+	// The synced region doesn't fetch a ts from PD.
+	c.Assert(store.MvccStore.syncMaxTS(regCtx), IsNil)
+	c.Assert(store.MvccStore.memLocks.getMaxTS(), Equals, maxTS)
+
+	regCtx.invalidateMaxTS()
+	_, synced = regCtx.getMaxTSEpoch()
+	c.Assert(synced, IsFalse)
+	c.Assert(store.MvccStore.syncMaxTS(regCtx), IsNil)
+	c.Assert(store.MvccStore.memLocks.getMaxTS(), Greater, maxTS)
+
+	// The regions without raft have no role changes, they fetch a ts from PD until the store is synced.
+	standalone := &regionCtx{}
+	maxTS = store.MvccStore.memLocks.getMaxTS()
+	atomic.StoreInt32(&store.MvccStore.maxTSSynced, 0)
+	c.Assert(store.MvccStore.syncMaxTS(standalone), IsNil)
+	c.Assert(store.MvccStore.memLocks.getMaxTS(), Greater, maxTS)
+	maxTS = store.MvccStore.memLocks.getMaxTS()
+	c.Assert(store.MvccStore.syncMaxTS(standalone), IsNil)
+	c.Assert(store.MvccStore.memLocks.getMaxTS(), Equals, maxTS)
+}
+
+func (s *testMvccSuite) TestPublishSafeTSUpdatesMaxTS(c *C) {
+	store, err := NewTestStore("TestPublishSafeTSUpdatesMaxTS", "TestPublishSafeTSUpdatesMaxTS", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	regCtx := &regionCtx{}
+	safeTS := store.MvccStore.memLocks.getMaxTS() + 100
+	store.MvccStore.publishSafeTS(regCtx, safeTS)
+	c.Assert(regCtx.getSafeTS(), Equals, safeTS)
+	// An async commit transaction prewritten now can not commit before the safe ts.
+	c.Assert(store.MvccStore.memLocks.getMaxTS(), Equals, safeTS)
+
+	// The transaction being prewritten keeps the safe ts below its start ts, and the max ts is updated with
+	// the ts instead of the safe ts, so the transactions prewritten later commit after the ts.
+	key := []byte("tkey")
+	memLock := &mvcc.MvccLock{
+		MvccLockHdr: mvcc.MvccLockHdr{
+			StartTS:        safeTS + 10,
+			Op:             uint8(kvrpcpb.Op_Put),
+			PrimaryLen:     uint16(len(key)),
+			UseAsyncCommit: true,
+		},
+		Primary: key,
+	}
+	store.MvccStore.memLocks.lockKeys([][]byte{key}, []*mvcc.MvccLock{memLock}, safeTS+11)
+	ts := memLock.MinCommitTS + 100
+	store.MvccStore.publishSafeTS(regCtx, ts)
+	c.Assert(regCtx.getSafeTS(), Equals, safeTS+9)
+	c.Assert(store.MvccStore.memLocks.getMaxTS(), Equals, ts)
+	store.MvccStore.memLocks.unlockKeys([][]byte{key}, safeTS+10)
+	store.MvccStore.publishSafeTS(regCtx, ts)
+	c.Assert(regCtx.getSafeTS(), Equals, ts)
+}
+
+func (s *testMvccSuite) TestRoleChangeInvalidatesMaxTS(c *C) {
+	regCtx := &regionCtx{maxTSEpoch: 1}
+	regCtx.setMaxTSSynced(1)
+	// The event handler is not running, the max ts must be invalidated before OnRoleChange returns.
+	rm := &RaftRegionManager{
+		regionManager: regionManager{regions: map[uint64]*regionCtx{1: regCtx}},
+		eventCh:       make(chan interface{}, 2),
+	}
+	rm.OnRoleChange(1, raft.StateLeader)
+	_, synced := regCtx.getMaxTSEpoch()
+	c.Assert(synced, IsFalse)
+	// The role change of an unknown region is ignored.
+	rm.OnRoleChange(2, raft.StateFollower)
+}
+
+func (s *testMvccSuite) TestLockWAL(c *C) {
+	dir, err := ioutil.TempDir("", "TestLockWAL")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	ls := lockstore.NewMemStore(4096)
+	wal, err := OpenLockWAL(dir, ls)
+	c.Assert(err, IsNil)
+	batch := new(writeLockBatch)
+	batch.set([]byte("k1"), []byte("v1"))
+	batch.set([]byte("k2"), []byte("v2"))
+	c.Assert(wal.Append(batch.entries), IsNil)
+	batch = new(writeLockBatch)
+	batch.delete([]byte("k1"))
+	batch.set([]byte("k3"), []byte("v3"))
+	c.Assert(wal.Append(batch.entries), IsNil)
+	// A torn record is written by a crash.
+	_, err = wal.file.Write([]byte{1, 2, 3})
+	c.Assert(err, IsNil)
+
+	// The locks are recovered from the log without the checkpoint on close.
+	ls = lockstore.NewMemStore(4096)
+	wal, err = OpenLockWAL(dir, ls)
+	c.Assert(err, IsNil)
+	c.Assert(ls.Get([]byte("k1"), nil), IsNil)
+	c.Assert(ls.Get([]byte("k2"), nil), BytesEquals, []byte("v2"))
+	c.Assert(ls.Get([]byte("k3"), nil), BytesEquals, []byte("v3"))
+
+	// The recovered locks are checkpointed and the older logs are removed.
+	fileNums, err := lockWALFileNums(dir)
+	c.Assert(err, IsNil)
+	c.Assert(fileNums, DeepEquals, []uint64{wal.fileNum})
+	batch = new(writeLockBatch)
+	batch.set([]byte("k4"), []byte("v4"))
+	c.Assert(wal.Append(batch.entries), IsNil)
+	ls.Put([]byte("k4"), []byte("v4"))
+	c.Assert(wal.Close(), IsNil)
+
+	ls = lockstore.NewMemStore(4096)
+	_, err = OpenLockWAL(dir, ls)
+	c.Assert(err, IsNil)
+	c.Assert(ls.Get([]byte("k2"), nil), BytesEquals, []byte("v2"))
+	c.Assert(ls.Get([]byte("k4"), nil), BytesEquals, []byte("v4"))
+}
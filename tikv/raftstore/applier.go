@@ -25,6 +25,7 @@ import (
 	"github.com/pingcap/badger/y"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
@@ -150,7 +151,9 @@ type execResultRollbackMerge struct {
 type execResultComputeHash struct {
 	region *metapb.Region
 	index  uint64
-	snap   *mvcc.DBSnapshot
+	txn    *badger.Txn
+	// Closed by the compute hash worker after the locks of the region are copied.
+	locksCopied chan struct{}
 }
 
 type execResultVerifyHash struct {
@@ -331,7 +334,7 @@ func (ac *applyContext) prepareFor(d *applier) {
 ///
 /// This call is valid only when it's between a `prepare_for` and `finish_for`.
 func (ac *applyContext) commit(d *applier) {
-	if ac.lastAppliedIndex < d.applyState.appliedIndex {
+	if ac.lastAppliedIndex < d.applyState.appliedIndex && !d.merged {
 		d.writeApplyState(ac.wb)
 	}
 	// last_applied_index doesn't need to be updated, set persistent to true will
@@ -368,7 +371,10 @@ func (ac *applyContext) writeToDB() {
 
 /// Finishes `Apply`s for the applier.
 func (ac *applyContext) finishFor(d *applier, results []execResult) {
-	if !d.pendingRemove {
+	// The logs caught up for merge may not be in the local raft log, so the apply state is not
+	// persisted to keep it consistent with the raft log. Applying them again after restart is fine,
+	// and the source region becomes tombstone once the CommitMerge is applied.
+	if !d.pendingRemove && !d.merged {
 		d.writeApplyState(ac.wb)
 	}
 	ac.commitOpt(d, false)
@@ -378,6 +384,7 @@ func (ac *applyContext) finishFor(d *applier, results []execResult) {
 		execResults:      results,
 		metrics:          d.metrics,
 		appliedIndexTerm: d.appliedIndexTerm,
+		merged:           d.merged,
 	}
 	ac.applyTaskResList = append(ac.applyTaskResList, res)
 }
@@ -508,6 +515,16 @@ func (s *waitSourceMergeState) String() string {
 		len(s.pendingEntries), len(s.pendingMsgs), s.readyToMerge.Load(), s.catchUpLogs != nil)
 }
 
+/// A temporary state that keeps the entries and messages after ComputeHash.
+type waitComputeHashState struct {
+	/// The entries after ComputeHash that need to continue to be applied.
+	pendingEntries []eraftpb.Entry
+	/// The messages that need to continue to be handled after the pending entries.
+	pendingMsgs []Msg
+	/// Closed by the compute hash worker after the locks are copied.
+	locksCopied chan struct{}
+}
+
 /// The applier of a Region which is responsible for handling committed
 /// raft log entries of a Region.
 ///
@@ -546,8 +563,13 @@ type applier struct {
 	/// A temporary state that keeps track of the progress of the source peer state when
 	/// CommitMerge is unable to be executed.
 	waitMergeState *waitSourceMergeState
+	/// A temporary state that holds the entries after ComputeHash until the compute hash worker
+	/// copies the locks of the region, as the lock store has no snapshot.
+	waitComputeHashState *waitComputeHashState
 	// ID of last region that reports ready.
 	readySourceRegion uint64
+	/// The CatchUpLogs which can't be handled until the logs before its entries are applied.
+	pendingCatchUpLogs *catchUpLogs
 
 	/// We writes apply_state to KV DB, in one write batch together with kv data.
 	///
@@ -615,6 +637,18 @@ func (a *applier) handleRaftCommittedEntries(aCtx *applyContext, committedEntrie
 		case applyResultTypeNone:
 		case applyResultTypeExecResult:
 			results = append(results, res.data)
+			// The source logs of a merge are applied without waiting, the source region is destroyed after that.
+			if computeHash, ok := res.data.(*execResultComputeHash); ok && !a.merged {
+				aCtx.committedCount -= len(committedEntries) - i - 1
+				pendingEntries := make([]eraftpb.Entry, 0, len(committedEntries)-i-1)
+				pendingEntries = append(pendingEntries, committedEntries[i+1:]...)
+				aCtx.finishFor(a, results)
+				a.waitComputeHashState = &waitComputeHashState{
+					pendingEntries: pendingEntries,
+					locksCopied:    computeHash.locksCopied,
+				}
+				return
+			}
 		case applyResultTypeWaitMergeResource:
 			readyToMerge := res.data.(*atomic.Uint64)
 			aCtx.committedCount -= len(committedEntries) - i
@@ -898,6 +932,10 @@ func (a *applier) execWriteCmd(aCtx *applyContext, rlog raftlog.RaftLog) (
 	req := rlog.GetRaftCmdRequest()
 	requests := req.GetRequests()
 	writeCmdOps := createWriteCmdOps(requests)
+	if err := a.checkWriteCmdOps(aCtx, writeCmdOps); err != nil {
+		resp = ErrResp(err)
+		return
+	}
 	rangeDeleted := false
 	for _, op := range writeCmdOps {
 		switch x := op.(type) {
@@ -910,6 +948,16 @@ func (a *applier) execWriteCmd(aCtx *applyContext, rlog raftlog.RaftLog) (
 		case *raft_cmdpb.DeleteRangeRequest:
 			a.execDeleteRange(aCtx, x)
 			rangeDeleted = true
+		case *raft_cmdpb.PutRequest:
+			// The raw user meta is appended to the value.
+			metaOff := len(x.Value) - 8
+			a.execRawPut(aCtx, x.Key, x.Value[:metaOff], mvcc.RawUserMeta(x.Value[metaOff:]))
+		case *raft_cmdpb.DeleteRequest:
+			a.execRawDelete(aCtx, x.Key)
+		case *verOp:
+			a.execVerOp(aCtx, *x)
+		case *ingestSSTOp:
+			a.execIngestSST(aCtx, *x)
 		default:
 			log.S().Fatalf("invalid input op=%v", x)
 		}
@@ -959,6 +1007,26 @@ func (a *applier) execCustomLog(actx *applyContext, cl *raftlog.CustomRaftLog) (
 			actx.wb.DeleteLock(key)
 			cnt++
 		})
+	case raftlog.TypeRawPut:
+		cl.IterateRawPut(func(key, val []byte, expireTS uint64) {
+			a.execRawPut(actx, key, val, mvcc.NewRawUserMeta(expireTS))
+			cnt++
+		})
+	case raftlog.TypeRawDelete:
+		cl.IterateRawDelete(func(key []byte) {
+			a.execRawDelete(actx, key)
+			cnt++
+		})
+	case raftlog.TypeVerPut:
+		cl.IterateVerPut(func(key, val []byte, version uint64) {
+			a.execVerPut(actx, key, val, version)
+			cnt++
+		})
+	case raftlog.TypeVerDelete:
+		cl.IterateVerDelete(func(key []byte, version uint64) {
+			a.execVerDelete(actx, key, version)
+			cnt++
+		})
 	}
 	resp = &raft_cmdpb.RaftCmdResponse{Header: &raft_cmdpb.RaftResponseHeader{}}
 	resp.Responses = make([]*raft_cmdpb.Response, cnt)
@@ -985,6 +1053,17 @@ type rollbackOp struct {
 	delLock    *raft_cmdpb.DeleteRequest
 }
 
+// a versioned put or delete, the version is appended to the value of put or the key of delete.
+type verOp struct {
+	put *raft_cmdpb.PutRequest
+	del *raft_cmdpb.DeleteRequest
+}
+
+// the SST files of an import to be ingested together.
+type ingestSSTOp struct {
+	metas []*import_sstpb.SSTMeta
+}
+
 // createWriteCmdOps regroups requests into operations.
 func createWriteCmdOps(requests []*raft_cmdpb.Request) (ops []interface{}) {
 	// If first request is delete write, then this is a GC command, we can ignore it.
@@ -1020,6 +1099,10 @@ func createWriteCmdOps(requests []*raft_cmdpb.Request) (ops []interface{}) {
 				ops = append(ops, &rollbackOp{
 					delLock: req.Delete,
 				})
+			case CFRaw:
+				ops = append(ops, del)
+			case CFVer:
+				ops = append(ops, &verOp{del: del})
 			default:
 				panic("unreachable")
 			}
@@ -1038,6 +1121,10 @@ func createWriteCmdOps(requests []*raft_cmdpb.Request) (ops []interface{}) {
 			case CFLock:
 				// Prewrite with short value.
 				ops = append(ops, &prewriteOp{putLock: put})
+			case CFRaw:
+				ops = append(ops, put)
+			case CFVer:
+				ops = append(ops, &verOp{put: put})
 			case CFWrite:
 				writeType := put.Value[0]
 				if writeType == mvcc.WriteTypeRollback {
@@ -1071,9 +1158,15 @@ func createWriteCmdOps(requests []*raft_cmdpb.Request) (ops []interface{}) {
 				}
 			}
 		case raft_cmdpb.CmdType_DeleteRange:
-			ops = append(ops, &req.DeleteRange)
+			ops = append(ops, req.DeleteRange)
 		case raft_cmdpb.CmdType_IngestSST:
-			panic("ingestSST not unsupported")
+			// The consecutive IngestSST requests are the files of one import, they are ingested together.
+			op := &ingestSSTOp{}
+			for ; i < len(requests) && requests[i].IngestSst != nil; i++ {
+				op.metas = append(op.metas, requests[i].IngestSst.Sst)
+			}
+			i--
+			ops = append(ops, op)
 		case raft_cmdpb.CmdType_Snap, raft_cmdpb.CmdType_Get:
 			// Readonly commands are handled in raftstore directly.
 			// Don't panic here in case there are old entries need to be applied.
@@ -1130,6 +1223,9 @@ func (a *applier) commitLock(aCtx *applyContext, rawKey []byte, val []byte, comm
 	if lock.Op != uint8(kvrpcpb.Op_Lock) {
 		aCtx.wb.SetWithUserMeta(y.KeyWithTs(rawKey, commitTS), lock.Value, userMeta)
 		sizeDiff = int64(len(rawKey) + len(lock.Value))
+		if lock.Op == uint8(kvrpcpb.Op_Del) {
+			a.metrics.deleteKeysHint++
+		}
 	} else if bytes.Equal(lock.Primary, rawKey) {
 		aCtx.wb.SetOpLock(y.KeyWithTs(rawKey, commitTS), userMeta)
 	}
@@ -1159,6 +1255,8 @@ func (a *applier) execRollback(aCtx *applyContext, op rollbackOp) {
 			panic(op.putWrite.Key)
 		}
 		aCtx.wb.Rollback(y.KeyWithTs(rawKey, mvcc.DecodeKeyTS(remain)))
+		// The rollback records are dropped by GC like the deletes.
+		a.metrics.deleteKeysHint++
 		if op.delLock != nil {
 			aCtx.wb.DeleteLock(rawKey)
 		}
@@ -1173,33 +1271,145 @@ func (a *applier) execRollback(aCtx *applyContext, op rollbackOp) {
 	}
 }
 
-func (a *applier) execDeleteRange(aCtx *applyContext, req *raft_cmdpb.DeleteRangeRequest) {
-	_, startKey, err := codec.DecodeBytes(req.StartKey, nil)
-	if err != nil {
-		panic(req.StartKey)
-	}
-	_, endKey, err := codec.DecodeBytes(req.EndKey, nil)
-	if err != nil {
-		panic(req.EndKey)
+// execRawPut and execRawDelete use KvTS as the version, it is replaced by StateTS when the batch is written.
+func (a *applier) execRawPut(aCtx *applyContext, key, value []byte, userMeta mvcc.RawUserMeta) {
+	aCtx.wb.SetWithUserMeta(y.KeyWithTs(mvcc.EncodeRawKey(key), KvTS), value, userMeta)
+	a.metrics.sizeDiffHint += uint64(len(key) + len(value))
+}
+
+func (a *applier) execRawDelete(aCtx *applyContext, key []byte) {
+	aCtx.wb.Delete(y.KeyWithTs(mvcc.EncodeRawKey(key), KvTS))
+	a.metrics.deleteKeysHint++
+}
+
+func (a *applier) execVerOp(aCtx *applyContext, op verOp) {
+	if op.put != nil {
+		val, version := splitVersion(op.put.Value)
+		a.execVerPut(aCtx, op.put.Key, val, version)
+	} else {
+		key, version := splitVersion(op.del.Key)
+		a.execVerDelete(aCtx, key, version)
 	}
-	txn := aCtx.getTxn()
-	it := dbreader.NewIterator(txn, false, startKey, endKey)
-	for it.Seek(startKey); it.Valid(); it.Next() {
-		item := it.Item()
-		if bytes.Compare(item.Key(), endKey) >= 0 {
-			break
+}
+
+// execVerPut and execVerDelete encode the version given by the client in the key and use KvTS as the badger
+// version like raw keys, a delete is kept as an entry so it hides the older versions.
+func (a *applier) execVerPut(aCtx *applyContext, key, value []byte, version uint64) {
+	aCtx.wb.SetWithUserMeta(y.KeyWithTs(mvcc.EncodeVerKey(key, version), KvTS), value, mvcc.VerUserMeta)
+	a.metrics.sizeDiffHint += uint64(len(key) + len(value))
+}
+
+func (a *applier) execVerDelete(aCtx *applyContext, key []byte, version uint64) {
+	aCtx.wb.SetWithUserMeta(y.KeyWithTs(mvcc.EncodeVerKey(key, version), KvTS), nil, mvcc.VerDeleteUserMeta)
+}
+
+// checkWriteCmdOps checks the DeleteRange ranges, the raw and versioned values and the SST files before any
+// operation is executed, so the command is rejected as a whole if a range is out of the region, a value is
+// malformed or a file is missing, corrupted or out of the region. The files are removed once ingested, so an
+// IngestSST applied again after restart is rejected here.
+func (a *applier) checkWriteCmdOps(aCtx *applyContext, ops []interface{}) error {
+	for _, op := range ops {
+		switch x := op.(type) {
+		case *raft_cmdpb.DeleteRangeRequest:
+			if err := checkDeleteRange(x, a.region); err != nil {
+				return err
+			}
+		case *raft_cmdpb.PutRequest:
+			// The raw user meta is appended to the value.
+			if len(x.Value) < 8 {
+				return errors.Errorf("invalid raw put value %v", x.Value)
+			}
+		case *verOp:
+			// The version is appended to the value of a put and the key of a delete.
+			if x.put != nil && len(x.put.Value) < 8 {
+				return errors.Errorf("invalid versioned put value %v", x.put.Value)
+			}
+			if x.del != nil && len(x.del.Key) < 8 {
+				return errors.Errorf("invalid versioned delete key %v", x.del.Key)
+			}
+		case *ingestSSTOp:
+			for _, meta := range x.metas {
+				if err := checkSSTForIngestion(meta, a.region); err != nil {
+					return err
+				}
+				if err := aCtx.engines.importer.Validate(meta); err != nil {
+					return err
+				}
+			}
 		}
-		aCtx.wb.Delete(y.KeyWithTs(item.KeyCopy(nil), item.Version()+1))
 	}
-	it.Close()
-	lockIt := aCtx.engines.kv.LockStore.NewIterator()
-	for lockIt.Seek(startKey); lockIt.Valid(); lockIt.Next() {
-		if bytes.Compare(lockIt.Key(), endKey) >= 0 {
-			break
+	return nil
+}
+
+// checkDeleteRange checks the range is in the region like TiKV does, otherwise the data of the neighbouring
+// regions would be deleted only on the replicas of this region. The raw and versioned key spaces are not
+// bounded by the internal key prefix, so an empty end key is accepted for them if the region has no end key.
+func checkDeleteRange(req *raft_cmdpb.DeleteRangeRequest, region *metapb.Region) error {
+	if len(req.EndKey) == 0 && (cfKeySpace(req.Cf) == mvcc.KeySpaceTxn || len(region.EndKey) > 0) {
+		return errors.New("invalid end key")
+	}
+	if _, _, err := codec.DecodeBytes(req.StartKey, nil); err != nil {
+		return errors.Annotatef(err, "invalid start key %v", req.StartKey)
+	}
+	if err := CheckKeyInRegion(req.StartKey, region); err != nil {
+		return err
+	}
+	if len(req.EndKey) == 0 {
+		return nil
+	}
+	if _, _, err := codec.DecodeBytes(req.EndKey, nil); err != nil {
+		return errors.Annotatef(err, "invalid end key %v", req.EndKey)
+	}
+	return CheckKeyInRegionInclusive(req.EndKey, region)
+}
+
+func (a *applier) execIngestSST(aCtx *applyContext, op ingestSSTOp) {
+	// The write batch is already written before IngestSST.
+	if err := aCtx.engines.importer.Ingest(aCtx.engines.kv, op.metas); err != nil {
+		panic(fmt.Sprintf("%s failed to ingest sst %v, err %v", a.tag, op.metas, err))
+	}
+	aCtx.engines.importer.Delete(op.metas)
+	for _, meta := range op.metas {
+		a.metrics.sizeDiffHint += meta.Length
+	}
+	// The cached txn can not see the ingested keys.
+	if aCtx.txn != nil {
+		aCtx.txn.Discard()
+		aCtx.txn = nil
+	}
+}
+
+// execDeleteRange deletes the keys in the range of the key space of the CF, the locks are also deleted in the
+// transactional key space. The range is checked by checkDeleteRange. The deletes are added to the write batch,
+// so they are persisted atomically with the apply state.
+func (a *applier) execDeleteRange(aCtx *applyContext, req *raft_cmdpb.DeleteRangeRequest) {
+	space := cfKeySpace(req.Cf)
+	_, startKey, _ := codec.DecodeBytes(req.StartKey, nil)
+	var endKey []byte
+	if len(req.EndKey) > 0 {
+		_, endKey, _ = codec.DecodeBytes(req.EndKey, nil)
+	}
+	startKey, endKey = space.EncodeRange(startKey, endKey)
+	// The write batch is already written before DeleteRange, a new txn sees all the keys in the range.
+	txn := aCtx.engines.kv.DB.NewTransaction(false)
+	reader := dbreader.NewDBReader(startKey, endKey, txn)
+	keys := collectRangeKeys(reader.GetIter(), startKey, endKey, nil)
+	reader.Close()
+	for _, key := range keys {
+		key.Version++
+		aCtx.wb.Delete(key)
+	}
+	if space == mvcc.KeySpaceTxn {
+		lockKeys := collectLockRangeKeys(aCtx.engines.kv.LockStore.NewIterator(), startKey, endKey, nil)
+		for _, key := range lockKeys {
+			aCtx.wb.DeleteLock(key.UserKey)
 		}
-		aCtx.wb.DeleteLock(safeCopy(lockIt.Key()))
 	}
-	return
+	// The cached txn may see the deleted keys.
+	if aCtx.txn != nil {
+		aCtx.txn.Discard()
+		aCtx.txn = nil
+	}
 }
 
 func (a *applier) execChangePeer(aCtx *applyContext, req *raft_cmdpb.AdminRequest) (
@@ -1396,17 +1606,113 @@ func (a *applier) execBatchSplit(aCtx *applyContext, req *raft_cmdpb.AdminReques
 
 func (a *applier) execPrepareMerge(aCtx *applyContext, req *raft_cmdpb.AdminRequest) (
 	resp *raft_cmdpb.AdminResponse, result applyResult, err error) {
-	return // TODO: merge
+	prepareMerge := req.PrepareMerge
+	index := aCtx.execCtx.index
+	if prepareMerge.MinIndex > index {
+		panic(fmt.Sprintf("%s min index %d should not be larger than index %d", a.tag, prepareMerge.MinIndex, index))
+	}
+	region := new(metapb.Region)
+	if err := CloneMsg(a.region, region); err != nil {
+		panic(err)
+	}
+	region.RegionEpoch.ConfVer++
+	region.RegionEpoch.Version++
+	mergeState := &rspb.MergeState{
+		MinIndex: prepareMerge.MinIndex,
+		Target:   prepareMerge.Target,
+		Commit:   index,
+	}
+	WritePeerState(aCtx.wb, region, rspb.PeerState_Merging, mergeState)
+	log.S().Infof("%s execute PrepareMerge, min index %d, target %s, commit %d",
+		a.tag, mergeState.MinIndex, mergeState.Target, mergeState.Commit)
+	resp = new(raft_cmdpb.AdminResponse)
+	result = applyResult{tp: applyResultTypeExecResult, data: &execResultPrepareMerge{
+		region: region,
+		state:  mergeState,
+	}}
+	return
 }
 
+// The target applier asks the source applier to catch up logs and waits for it, then the CommitMerge is
+// executed again after the source applier is ready.
+//
+// The logs of the source region is guaranteed to be applied before CommitMerge is executed, and the source
+// applier is stopped, so there is no race to write the apply state of both source and target.
 func (a *applier) execCommitMerge(aCtx *applyContext, req *raft_cmdpb.AdminRequest) (
 	resp *raft_cmdpb.AdminResponse, result applyResult, err error) {
-	return // TODO: merge
+	merge := req.CommitMerge
+	source := merge.Source
+	sourceID := source.Id
+	if a.readySourceRegion != sourceID {
+		if a.readySourceRegion != 0 {
+			panic(fmt.Sprintf("%s unexpected ready source region %d, expected %d", a.tag, a.readySourceRegion, sourceID))
+		}
+		log.S().Infof("%s asking source region %d to catch up logs, commit %d", a.tag, sourceID, merge.Commit)
+		readyToMerge := atomic.NewUint64(0)
+		aCtx.applyResCh <- NewPeerMsg(MsgTypeApplyCatchUpLogs, sourceID, &catchUpLogs{
+			targetRegionID: a.region.Id,
+			merge:          merge,
+			readyToMerge:   readyToMerge,
+		})
+		result = applyResult{tp: applyResultTypeWaitMergeResource, data: readyToMerge}
+		return
+	}
+	a.readySourceRegion = 0
+	log.S().Infof("%s execute CommitMerge, source region %s", a.tag, source)
+	region := new(metapb.Region)
+	if err := CloneMsg(a.region, region); err != nil {
+		panic(err)
+	}
+	// Use the max version so that pd can ensure the merged region has a priority.
+	version := region.RegionEpoch.Version
+	if source.RegionEpoch.Version > version {
+		version = source.RegionEpoch.Version
+	}
+	region.RegionEpoch.Version = version + 1
+	if bytes.Equal(region.EndKey, source.StartKey) {
+		region.EndKey = source.EndKey
+	} else {
+		region.StartKey = source.StartKey
+	}
+	WritePeerState(aCtx.wb, region, rspb.PeerState_Normal, nil)
+	// The merge state of the tombstone source records the target, so a stale peer of the source
+	// region can be told to wait for the merge or to remove itself.
+	WritePeerState(aCtx.wb, source, rspb.PeerState_Tombstone, &rspb.MergeState{Target: a.region})
+	resp = new(raft_cmdpb.AdminResponse)
+	result = applyResult{tp: applyResultTypeExecResult, data: &execResultCommitMerge{
+		region: region,
+		source: source,
+	}}
+	return
 }
 
 func (a *applier) execRollbackMerge(aCtx *applyContext, req *raft_cmdpb.AdminRequest) (
 	resp *raft_cmdpb.AdminResponse, result applyResult, err error) {
-	return // TODO: merge
+	state, err := getRegionLocalState(aCtx.engines.kv.DB, a.region.Id)
+	if err != nil {
+		panic(fmt.Sprintf("%s failed to load region state %v", a.tag, err))
+	}
+	if state.State != rspb.PeerState_Merging {
+		panic(fmt.Sprintf("%s unexpected state of merging region %s", a.tag, state))
+	}
+	rollback := req.RollbackMerge
+	if state.MergeState.Commit != rollback.Commit {
+		panic(fmt.Sprintf("%s rollbacks a wrong merge %d != %d", a.tag, state.MergeState.Commit, rollback.Commit))
+	}
+	region := new(metapb.Region)
+	if err := CloneMsg(a.region, region); err != nil {
+		panic(err)
+	}
+	// Update version to avoid duplicated rollback requests.
+	region.RegionEpoch.Version++
+	WritePeerState(aCtx.wb, region, rspb.PeerState_Normal, nil)
+	log.S().Infof("%s execute RollbackMerge, commit %d", a.tag, rollback.Commit)
+	resp = new(raft_cmdpb.AdminResponse)
+	result = applyResult{tp: applyResultTypeExecResult, data: &execResultRollbackMerge{
+		region: region,
+		commit: rollback.Commit,
+	}}
+	return
 }
 
 func (a *applier) execCompactLog(aCtx *applyContext, req *raft_cmdpb.AdminRequest) (
@@ -1446,7 +1752,14 @@ func (a *applier) execCompactLog(aCtx *applyContext, req *raft_cmdpb.AdminReques
 func (a *applier) execComputeHash(aCtx *applyContext, req *raft_cmdpb.AdminRequest) (
 	resp *raft_cmdpb.AdminResponse, result applyResult, err error) {
 	resp = new(raft_cmdpb.AdminResponse)
-	// TODO: run in goroutine.
+	// The write batch is written before ComputeHash, so the engine contains all the changes before the index.
+	// The lock store has no snapshot, the applier holds the following entries until the worker copies the locks.
+	result = applyResult{tp: applyResultTypeExecResult, data: &execResultComputeHash{
+		region:      a.region,
+		index:       aCtx.execCtx.index,
+		txn:         aCtx.engines.kv.DB.NewTransaction(false),
+		locksCopied: make(chan struct{}),
+	}}
 	return
 }
 
@@ -1462,7 +1775,9 @@ func (a *applier) execVerifyHash(aCtx *applyContext, req *raft_cmdpb.AdminReques
 }
 
 type catchUpLogs struct {
-	merge        *raft_cmdpb.CommitMergeRequest
+	targetRegionID uint64
+	merge          *raft_cmdpb.CommitMergeRequest
+	/// Set to the source region id when the source applier has applied all the logs.
 	readyToMerge *atomic.Uint64
 }
 
@@ -1496,11 +1811,21 @@ func (a *applier) handleApply(aCtx *applyContext, apply *apply) {
 		apply.entries[i] = eraftpb.Entry{}
 	}
 	apply.entries = apply.entries[:0]
-	if a.waitMergeState != nil {
+	a.afterCommittedEntries(aCtx)
+}
+
+/// Destroys the applier or catches up the pending logs for merge after the committed entries are applied.
+func (a *applier) afterCommittedEntries(aCtx *applyContext) {
+	if a.waitMergeState != nil || a.waitComputeHashState != nil {
 		return
 	}
 	if a.pendingRemove {
 		a.destroy(aCtx)
+		return
+	}
+	if logs := a.pendingCatchUpLogs; logs != nil {
+		a.pendingCatchUpLogs = nil
+		a.catchUpLogsForMerge(aCtx, logs)
 	}
 }
 
@@ -1538,6 +1863,7 @@ func (a *applier) destroy(aCtx *applyContext) {
 		if res.regionID == regionID {
 			// Flush before destroying to avoid reordering messages.
 			aCtx.flush()
+			break
 		}
 	}
 	log.S().Infof("%s remove applier", a.tag)
@@ -1562,12 +1888,105 @@ func (a *applier) handleDestroy(aCtx *applyContext, regionID uint64) {
 	}
 }
 
+/// Continues to apply the pending entries and handle the pending messages after the source region
+/// is ready. Returns false if the applier is still waiting for a source region.
 func (a *applier) resumePendingMerge(aCtx *applyContext) bool {
-	return false // TODO: merge
+	state := a.waitMergeState
+	sourceRegionID := state.readyToMerge.Load()
+	if sourceRegionID == 0 {
+		return false
+	}
+	a.readySourceRegion = sourceRegionID
+	a.waitMergeState = nil
+	if aCtx.timer == nil {
+		now := time.Now()
+		aCtx.timer = &now
+	}
+	a.handleRaftCommittedEntries(aCtx, state.pendingEntries)
+	if a.waitMergeState != nil {
+		// Another CommitMerge in the pending entries is waiting for its source region.
+		a.waitMergeState.pendingMsgs = state.pendingMsgs
+		a.waitMergeState.catchUpLogs = state.catchUpLogs
+		return false
+	}
+	for i, msg := range state.pendingMsgs {
+		a.handleTask(aCtx, msg)
+		if a.waitMergeState != nil {
+			// Another CommitMerge in the pending messages is waiting for its source region.
+			a.waitMergeState.pendingMsgs = append(a.waitMergeState.pendingMsgs, state.pendingMsgs[i+1:]...)
+			a.waitMergeState.catchUpLogs = state.catchUpLogs
+			return false
+		}
+	}
+	if state.catchUpLogs != nil {
+		// The cascaded merge is finished, the logs are all applied now.
+		a.logsUpToDateForMerge(aCtx, state.catchUpLogs)
+	}
+	return true
 }
 
+/// Continues to apply the pending entries and handle the pending messages after the compute hash worker
+/// copies the locks of the region.
+func (a *applier) resumeComputeHash(aCtx *applyContext) {
+	state := a.waitComputeHashState
+	a.waitComputeHashState = nil
+	if aCtx.timer == nil {
+		now := time.Now()
+		aCtx.timer = &now
+	}
+	a.handleRaftCommittedEntries(aCtx, state.pendingEntries)
+	a.afterCommittedEntries(aCtx)
+	// The messages are held again if the pending entries wait for a merge or another ComputeHash.
+	for _, msg := range state.pendingMsgs {
+		a.handleTask(aCtx, msg)
+	}
+}
+
+/// Applies the logs of the source region carried by the CommitMerge, the logs may not be committed in
+/// the local raft log yet.
 func (a *applier) catchUpLogsForMerge(aCtx *applyContext, logs *catchUpLogs) {
-	// TODO: merge
+	if a.stopped {
+		return
+	}
+	if aCtx.timer == nil {
+		now := time.Now()
+		aCtx.timer = &now
+	}
+	appliedIndex := a.applyState.appliedIndex
+	if appliedIndex < logs.merge.Commit {
+		var entries []eraftpb.Entry
+		for _, entry := range logs.merge.Entries {
+			if entry.Index > appliedIndex {
+				entries = append(entries, *entry)
+			}
+		}
+		if len(entries) == 0 || entries[0].Index != appliedIndex+1 {
+			// The logs before the carried entries are not applied yet, try again after they are applied.
+			log.S().Infof("%s wait for logs to be applied before catching up, applied index %d", a.tag, appliedIndex)
+			a.pendingCatchUpLogs = logs
+			return
+		}
+		log.S().Infof("%s catch up logs for merge, applied index %d, commit %d", a.tag, appliedIndex, logs.merge.Commit)
+		a.merged = true
+		a.handleRaftCommittedEntries(aCtx, entries)
+		if a.waitMergeState != nil {
+			// There is a CommitMerge in the logs, wait for its source region first.
+			a.waitMergeState.catchUpLogs = logs
+			return
+		}
+	}
+	a.logsUpToDateForMerge(aCtx, logs)
+}
+
+/// Stops the source applier and notifies the target applier that the source region is ready to merge.
+func (a *applier) logsUpToDateForMerge(aCtx *applyContext, logs *catchUpLogs) {
+	regionID := a.region.Id
+	log.S().Infof("%s source logs are all applied now, notify target region %d", a.tag, logs.targetRegionID)
+	// The source peer will be destroyed when the target peer handles the result of CommitMerge.
+	a.merged = true
+	a.destroy(aCtx)
+	logs.readyToMerge.Store(regionID)
+	aCtx.applyResCh <- NewPeerMsg(MsgTypeApplyLogsUpToDate, logs.targetRegionID, nil)
 }
 
 func (a *applier) handleGenSnapshot(aCtx *applyContext, snapTask *GenSnapTask) {
@@ -1585,6 +2004,24 @@ func (a *applier) handleGenSnapshot(aCtx *applyContext, snapTask *GenSnapTask) {
 }
 
 func (a *applier) handleTask(aCtx *applyContext, msg Msg) {
+	if a.waitMergeState != nil {
+		// Check it again immediately as catching up logs can be very fast.
+		if !a.resumePendingMerge(aCtx) {
+			a.waitMergeState.pendingMsgs = append(a.waitMergeState.pendingMsgs, msg)
+			return
+		}
+	}
+	if state := a.waitComputeHashState; state != nil {
+		select {
+		case <-state.locksCopied:
+			a.resumeComputeHash(aCtx)
+			// The resumed entries may wait again.
+			a.handleTask(aCtx, msg)
+		default:
+			state.pendingMsgs = append(state.pendingMsgs, msg)
+		}
+		return
+	}
 	switch msg.Type {
 	case MsgTypeApply:
 		a.handleApply(aCtx, msg.Data.(*apply))
@@ -1597,6 +2034,9 @@ func (a *applier) handleTask(aCtx *applyContext, msg Msg) {
 	case MsgTypeApplyCatchUpLogs:
 		a.catchUpLogsForMerge(aCtx, msg.Data.(*catchUpLogs))
 	case MsgTypeApplyLogsUpToDate:
+		// It's only used to wake up the target applier, the pending merge is resumed above.
+	case MsgTypeApplyResume:
+		// It's only used to wake up the applier after the locks are copied, the entries are resumed above.
 	case MsgTypeApplySnapshot:
 		a.handleGenSnapshot(aCtx, msg.Data.(*GenSnapTask))
 	}
@@ -0,0 +1,609 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/ngaut/unistore/config"
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/ngaut/unistore/tikv/raftstore/raftlog"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/pdpb"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/stretchr/testify/require"
+	pdclient "github.com/tikv/pd/client"
+	"github.com/zhangjinpeng1987/raft"
+)
+
+const testClusterID = 1
+
+// testPDClient is an in-memory PD client, it keeps the regions reported by the stores.
+type testPDClient struct {
+	idAlloc uint64
+
+	mu      sync.RWMutex
+	stores  map[uint64]*metapb.Store
+	regions map[uint64]*metapb.Region
+	leaders map[uint64]*metapb.Peer
+	handler func(*pdpb.RegionHeartbeatResponse)
+}
+
+func newTestPDClient() *testPDClient {
+	return &testPDClient{
+		idAlloc: 1000,
+		stores:  make(map[uint64]*metapb.Store),
+		regions: make(map[uint64]*metapb.Region),
+		leaders: make(map[uint64]*metapb.Peer),
+	}
+}
+
+func (pd *testPDClient) GetClusterID(ctx context.Context) uint64 {
+	return testClusterID
+}
+
+func (pd *testPDClient) AllocID(ctx context.Context) (uint64, error) {
+	return atomic.AddUint64(&pd.idAlloc, 1), nil
+}
+
+func (pd *testPDClient) Bootstrap(ctx context.Context, store *metapb.Store, region *metapb.Region) (*pdpb.BootstrapResponse, error) {
+	pd.putRegion(region, nil)
+	return &pdpb.BootstrapResponse{Header: &pdpb.ResponseHeader{ClusterId: testClusterID}}, nil
+}
+
+func (pd *testPDClient) IsBootstrapped(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
+func (pd *testPDClient) PutStore(ctx context.Context, store *metapb.Store) error {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	pd.stores[store.Id] = proto.Clone(store).(*metapb.Store)
+	return nil
+}
+
+func (pd *testPDClient) GetStore(ctx context.Context, storeID uint64) (*metapb.Store, error) {
+	pd.mu.RLock()
+	defer pd.mu.RUnlock()
+	store := pd.stores[storeID]
+	if store == nil {
+		return nil, errors.Errorf("store %d not found", storeID)
+	}
+	return proto.Clone(store).(*metapb.Store), nil
+}
+
+func (pd *testPDClient) GetRegion(ctx context.Context, key []byte) (*pdclient.Region, error) {
+	pd.mu.RLock()
+	defer pd.mu.RUnlock()
+	for id, region := range pd.regions {
+		if bytes.Compare(region.StartKey, key) <= 0 && (len(region.EndKey) == 0 || bytes.Compare(key, region.EndKey) < 0) {
+			return &pdclient.Region{Meta: proto.Clone(region).(*metapb.Region), Leader: pd.leaders[id]}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (pd *testPDClient) GetRegionByID(ctx context.Context, regionID uint64) (*pdclient.Region, error) {
+	pd.mu.RLock()
+	defer pd.mu.RUnlock()
+	region := pd.regions[regionID]
+	if region == nil {
+		return nil, nil
+	}
+	return &pdclient.Region{Meta: proto.Clone(region).(*metapb.Region), Leader: pd.leaders[regionID]}, nil
+}
+
+func (pd *testPDClient) ReportRegion(req *pdpb.RegionHeartbeatRequest) {
+	pd.putRegion(req.Region, req.Leader)
+}
+
+// putRegion updates the region if its epoch is not stale.
+func (pd *testPDClient) putRegion(region *metapb.Region, leader *metapb.Peer) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	if old := pd.regions[region.Id]; old != nil {
+		oldEpoch, epoch := old.RegionEpoch, region.RegionEpoch
+		if epoch.Version < oldEpoch.Version || epoch.ConfVer < oldEpoch.ConfVer {
+			return
+		}
+	}
+	pd.regions[region.Id] = proto.Clone(region).(*metapb.Region)
+	if leader != nil {
+		pd.leaders[region.Id] = leader
+	}
+}
+
+func (pd *testPDClient) AskSplit(ctx context.Context, region *metapb.Region) (*pdpb.AskSplitResponse, error) {
+	return nil, errors.New("unsupported")
+}
+
+func (pd *testPDClient) AskBatchSplit(ctx context.Context, region *metapb.Region, count int) (*pdpb.AskBatchSplitResponse, error) {
+	resp := new(pdpb.AskBatchSplitResponse)
+	for i := 0; i < count; i++ {
+		newRegionID, _ := pd.AllocID(ctx)
+		id := &pdpb.SplitID{NewRegionId: newRegionID}
+		for range region.Peers {
+			peerID, _ := pd.AllocID(ctx)
+			id.NewPeerIds = append(id.NewPeerIds, peerID)
+		}
+		resp.Ids = append(resp.Ids, id)
+	}
+	return resp, nil
+}
+
+func (pd *testPDClient) ReportBatchSplit(ctx context.Context, regions []*metapb.Region) error {
+	for _, region := range regions {
+		pd.putRegion(region, nil)
+	}
+	return nil
+}
+
+func (pd *testPDClient) GetGCSafePoint(ctx context.Context) (uint64, error) {
+	return 0, nil
+}
+
+func (pd *testPDClient) StoreHeartbeat(ctx context.Context, stats *pdpb.StoreStats) error {
+	return nil
+}
+
+func (pd *testPDClient) GetTS(ctx context.Context) (int64, int64, error) {
+	return time.Now().UnixNano() / int64(time.Millisecond), int64(atomic.AddUint64(&pd.idAlloc, 1)), nil
+}
+
+func (pd *testPDClient) SetRegionHeartbeatResponseHandler(h func(*pdpb.RegionHeartbeatResponse)) {
+	pd.mu.Lock()
+	pd.handler = h
+	pd.mu.Unlock()
+}
+
+func (pd *testPDClient) Close() {}
+
+// testTransport delivers the raft messages to the routers of the running stores.
+type testTransport struct {
+	mu      sync.RWMutex
+	routers map[uint64]*router
+	// filter returns true if the message should be dropped.
+	filter func(msg *rspb.RaftMessage) bool
+}
+
+func (t *testTransport) Send(msg *rspb.RaftMessage) error {
+	t.mu.RLock()
+	to := t.routers[msg.ToPeer.StoreId]
+	from := t.routers[msg.FromPeer.StoreId]
+	filter := t.filter
+	t.mu.RUnlock()
+	if to == nil || (filter != nil && filter(msg)) {
+		return nil
+	}
+	if msg.Message.Snapshot != nil {
+		// Snapshots are not sent between the test stores, let the leader retry.
+		if from != nil {
+			_ = from.send(msg.RegionId, NewMsg(MsgTypeSignificantMsg, &MsgSignificant{
+				Type:           MsgSignificantTypeStatus,
+				ToPeerID:       msg.ToPeer.Id,
+				SnapshotStatus: raft.SnapshotFailure,
+			}))
+		}
+		return nil
+	}
+	return to.sendRaftMessage(msg)
+}
+
+func (t *testTransport) setRouter(storeID uint64, r *router) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r == nil {
+		delete(t.routers, storeID)
+	} else {
+		t.routers[storeID] = r
+	}
+}
+
+func (t *testTransport) setFilter(filter func(msg *rspb.RaftMessage) bool) {
+	t.mu.Lock()
+	t.filter = filter
+	t.mu.Unlock()
+}
+
+// testPeerEventObserver records the roles and the leader checkers of the peers on a store.
+type testPeerEventObserver struct {
+	mu       sync.Mutex
+	roles    map[uint64]raft.StateType
+	checkers map[uint64]LeaderChecker
+}
+
+func newTestPeerEventObserver() *testPeerEventObserver {
+	return &testPeerEventObserver{
+		roles:    make(map[uint64]raft.StateType),
+		checkers: make(map[uint64]LeaderChecker),
+	}
+}
+
+func (ob *testPeerEventObserver) setChecker(ctx *PeerEventContext) {
+	ob.mu.Lock()
+	ob.checkers[ctx.RegionId] = ctx.LeaderChecker
+	ob.mu.Unlock()
+}
+
+func (ob *testPeerEventObserver) OnPeerCreate(ctx *PeerEventContext, region *metapb.Region) {
+	ob.setChecker(ctx)
+}
+
+func (ob *testPeerEventObserver) OnPeerApplySnap(ctx *PeerEventContext, region *metapb.Region) {
+	ob.setChecker(ctx)
+}
+
+func (ob *testPeerEventObserver) OnPeerDestroy(ctx *PeerEventContext) {
+	ob.mu.Lock()
+	delete(ob.roles, ctx.RegionId)
+	delete(ob.checkers, ctx.RegionId)
+	ob.mu.Unlock()
+}
+
+func (ob *testPeerEventObserver) OnSplitRegion(derived *metapb.Region, regions []*metapb.Region, peers []*PeerEventContext) {
+	for _, ctx := range peers {
+		ob.setChecker(ctx)
+	}
+}
+
+func (ob *testPeerEventObserver) OnRegionConfChange(ctx *PeerEventContext, epoch *metapb.RegionEpoch) {
+}
+
+func (ob *testPeerEventObserver) OnRegionMerge(ctx *PeerEventContext, target, source *metapb.Region) {
+	ob.mu.Lock()
+	delete(ob.roles, source.Id)
+	delete(ob.checkers, source.Id)
+	ob.checkers[target.Id] = ctx.LeaderChecker
+	ob.mu.Unlock()
+}
+
+func (ob *testPeerEventObserver) OnRoleChange(regionID uint64, newState raft.StateType) {
+	ob.mu.Lock()
+	ob.roles[regionID] = newState
+	ob.mu.Unlock()
+}
+
+func (ob *testPeerEventObserver) role(regionID uint64) raft.StateType {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	return ob.roles[regionID]
+}
+
+// testReadIndexObserver records the read index requests checked by a store and returns the lock set by the test.
+type testReadIndexObserver struct {
+	mu     sync.Mutex
+	reqs   []*raft_cmdpb.ReadIndexRequest
+	locked *kvrpcpb.LockInfo
+}
+
+func (ob *testReadIndexObserver) OnReadIndex(req *raft_cmdpb.ReadIndexRequest) *kvrpcpb.LockInfo {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	ob.reqs = append(ob.reqs, req)
+	return ob.locked
+}
+
+func (ob *testReadIndexObserver) setLocked(locked *kvrpcpb.LockInfo) {
+	ob.mu.Lock()
+	ob.locked = locked
+	ob.mu.Unlock()
+}
+
+func (ob *testReadIndexObserver) requests() []*raft_cmdpb.ReadIndexRequest {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	return append([]*raft_cmdpb.ReadIndexRequest{}, ob.reqs...)
+}
+
+type testNode struct {
+	kvPath       string
+	raftPath     string
+	engines      *Engines
+	router       *router
+	system       *raftBatchSystem
+	observer     *testPeerEventObserver
+	readObserver *testReadIndexObserver
+}
+
+// testCluster runs the raftstores of several stores in one process, the stores share a PD client
+// and exchange the raft messages by the routers.
+type testCluster struct {
+	t     *testing.T
+	cfg   *Config
+	pd    *testPDClient
+	trans *testTransport
+	nodes map[uint64]*testNode
+}
+
+func newTestClusterConfig() *Config {
+	cfg := NewDefaultConfig()
+	cfg.RaftBaseTickInterval = 20 * time.Millisecond
+	cfg.RaftHeartbeatTicks = 2
+	cfg.RaftElectionTimeoutTicks = 10
+	cfg.RaftStoreMaxLeaderLease = 150 * time.Millisecond
+	cfg.PdHeartbeatTickInterval = 100 * time.Millisecond
+	cfg.MergeCheckTickInterval = 100 * time.Millisecond
+	return cfg
+}
+
+// newTestCluster bootstraps the stores 1 to count with region 1 which has a peer on every store, so
+// the stores don't need snapshots to create the peers.
+func newTestCluster(t *testing.T, count int) *testCluster {
+	c := &testCluster{
+		t:     t,
+		cfg:   newTestClusterConfig(),
+		pd:    newTestPDClient(),
+		trans: &testTransport{routers: make(map[uint64]*router)},
+		nodes: make(map[uint64]*testNode),
+	}
+	region := &metapb.Region{
+		Id:          1,
+		RegionEpoch: &metapb.RegionEpoch{Version: InitEpochVer, ConfVer: InitEpochConfVer},
+	}
+	for i := 1; i <= count; i++ {
+		region.Peers = append(region.Peers, &metapb.Peer{Id: uint64(i), StoreId: uint64(i)})
+	}
+	for _, peer := range region.Peers {
+		engines := newTestEngines(t)
+		require.Nil(t, BootstrapStore(engines, testClusterID, peer.StoreId))
+		require.Nil(t, writePrepareBootstrap(engines, region))
+		require.Nil(t, ClearPrepareBootstrapState(engines))
+		closeTestEngines(t, engines)
+		c.nodes[peer.StoreId] = &testNode{kvPath: engines.kvPath, raftPath: engines.raftPath}
+	}
+	_, err := c.pd.Bootstrap(context.Background(), nil, region)
+	require.Nil(t, err)
+	for storeID := range c.nodes {
+		c.startNode(storeID)
+	}
+	return c
+}
+
+func closeTestEngines(t *testing.T, engines *Engines) {
+	require.Nil(t, engines.kv.DB.Close())
+	require.Nil(t, engines.raft.Close())
+}
+
+func (c *testCluster) startNode(storeID uint64) {
+	node := c.nodes[storeID]
+	node.engines = openTestEngines(c.t, node.kvPath, node.raftPath)
+	node.observer = newTestPeerEventObserver()
+	node.readObserver = new(testReadIndexObserver)
+	globalCfg := config.DefaultConf
+	router, system := createRaftBatchSystem(&globalCfg, c.cfg)
+	system.readIndexObserver = node.readObserver
+	node.router, node.system = router, system
+	store := &metapb.Store{Id: storeID, Address: fmt.Sprintf("store%d", storeID)}
+	require.Nil(c.t, c.pd.PutStore(context.Background(), store))
+	snapMgr := NewSnapManager(filepath.Join(node.kvPath, "snap"), router)
+	pdWorker := newWorker("pd-worker", new(sync.WaitGroup))
+	c.trans.setRouter(storeID, router)
+	require.Nil(c.t, system.start(store, c.cfg, node.engines, c.trans, c.pd, snapMgr, pdWorker, node.observer))
+}
+
+func (c *testCluster) stopNode(storeID uint64) {
+	node := c.nodes[storeID]
+	c.trans.setRouter(storeID, nil)
+	node.system.shutDown()
+	closeTestEngines(c.t, node.engines)
+	node.engines, node.router, node.system = nil, nil, nil
+}
+
+func (c *testCluster) shutdown() {
+	for storeID, node := range c.nodes {
+		if node.system != nil {
+			c.stopNode(storeID)
+		}
+		os.RemoveAll(node.kvPath)
+		os.RemoveAll(node.raftPath)
+	}
+}
+
+// region returns the region of the peer on the store, nil if the store has no such peer.
+func (c *testCluster) region(storeID, regionID uint64) *metapb.Region {
+	ctx := c.nodes[storeID].system.ctx
+	ctx.storeMetaLock.RLock()
+	defer ctx.storeMetaLock.RUnlock()
+	region := ctx.storeMeta.regions[regionID]
+	if region == nil {
+		return nil
+	}
+	return proto.Clone(region).(*metapb.Region)
+}
+
+// waitLeader returns the store of the leader of the region.
+func (c *testCluster) waitLeader(regionID uint64) uint64 {
+	for i := 0; i < 500; i++ {
+		for storeID, node := range c.nodes {
+			if node.system != nil && node.observer.role(regionID) == raft.StateLeader {
+				return storeID
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatalf("no leader of region %d", regionID)
+	return 0
+}
+
+func (c *testCluster) newRequestHeader(storeID, regionID uint64) *raft_cmdpb.RaftRequestHeader {
+	region := c.region(storeID, regionID)
+	require.NotNil(c.t, region)
+	return &raft_cmdpb.RaftRequestHeader{
+		RegionId:    regionID,
+		Peer:        findPeer(region, storeID),
+		RegionEpoch: region.RegionEpoch,
+	}
+}
+
+// call sends the request to the peer on the store and waits for the response.
+func (c *testCluster) call(storeID uint64, req *raft_cmdpb.RaftCmdRequest) *raft_cmdpb.RaftCmdResponse {
+	cb := NewCallback()
+	err := c.nodes[storeID].router.sendRaftCommand(&MsgRaftCmd{
+		SendTime: time.Now(),
+		Request:  raftlog.NewRequest(req),
+		Callback: cb,
+	})
+	if err != nil {
+		return ErrResp(err)
+	}
+	require.True(c.t, cb.WaitResp(5*time.Second))
+	return cb.resp
+}
+
+// mustCallLeader sends the request built by newReq to the leader of the region until it succeeds.
+func (c *testCluster) mustCallLeader(regionID uint64, newReq func(header *raft_cmdpb.RaftRequestHeader) *raft_cmdpb.RaftCmdRequest) *raft_cmdpb.RaftCmdResponse {
+	var resp *raft_cmdpb.RaftCmdResponse
+	for i := 0; i < 50; i++ {
+		storeID := c.waitLeader(regionID)
+		resp = c.call(storeID, newReq(c.newRequestHeader(storeID, regionID)))
+		if resp.Header.Error == nil {
+			return resp
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.t.Fatalf("request to region %d failed: %v", regionID, resp.Header.Error)
+	return nil
+}
+
+func (c *testCluster) mustPutRaw(regionID uint64, key, value []byte) {
+	val := append(append([]byte{}, value...), mvcc.NewRawUserMeta(0)...)
+	c.mustCallLeader(regionID, func(header *raft_cmdpb.RaftRequestHeader) *raft_cmdpb.RaftCmdRequest {
+		return &raft_cmdpb.RaftCmdRequest{
+			Header: header,
+			Requests: []*raft_cmdpb.Request{{
+				CmdType: raft_cmdpb.CmdType_Put,
+				Put:     &raft_cmdpb.PutRequest{Cf: CFRaw, Key: key, Value: val},
+			}},
+		}
+	})
+}
+
+// getRaw reads the raw value in the kv engine of the store, nil is returned if it doesn't exist.
+func (c *testCluster) getRaw(storeID uint64, key []byte) []byte {
+	var val []byte
+	err := c.nodes[storeID].engines.kv.DB.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(mvcc.EncodeRawKey(key))
+		if err != nil {
+			return err
+		}
+		val, err = item.ValueCopy(nil)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	require.Nil(c.t, err)
+	return val
+}
+
+// waitRaw waits until the raw value on the store is the expected one, nil means the key is deleted.
+func (c *testCluster) waitRaw(storeID uint64, key, value []byte) {
+	for i := 0; i < 300; i++ {
+		if bytes.Equal(c.getRaw(storeID, key), value) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(c.t, value, c.getRaw(storeID, key))
+}
+
+// mustSplit splits the region at the raw key and returns the left region, the region keeps the right part.
+func (c *testCluster) mustSplit(regionID uint64, key []byte) *metapb.Region {
+	for i := 0; i < 50; i++ {
+		storeID := c.waitLeader(regionID)
+		region := c.region(storeID, regionID)
+		cb := NewCallback()
+		err := c.nodes[storeID].router.send(regionID, Msg{Type: MsgTypeSplitRegion, Data: &MsgSplitRegion{
+			RegionEpoch: region.RegionEpoch,
+			SplitKeys:   [][]byte{rawRegionKey(key)},
+			Callback:    cb,
+		}})
+		if err == nil && cb.WaitResp(5*time.Second) && cb.resp.Header.Error == nil {
+			regions := cb.resp.AdminResponse.Splits.Regions
+			return regions[0]
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.t.Fatalf("failed to split region %d", regionID)
+	return nil
+}
+
+// rawRegionKey returns the region key of the raw key.
+func rawRegionKey(key []byte) []byte {
+	return codec.EncodeBytes(nil, key)
+}
+
+// mustTransferLeader transfers the leader of the region to the peer on the store.
+func (c *testCluster) mustTransferLeader(regionID, storeID uint64) {
+	for i := 0; i < 50; i++ {
+		if c.nodes[storeID].observer.role(regionID) == raft.StateLeader {
+			return
+		}
+		leader := c.waitLeader(regionID)
+		if leader != storeID {
+			region := c.region(leader, regionID)
+			c.call(leader, &raft_cmdpb.RaftCmdRequest{
+				Header: c.newRequestHeader(leader, regionID),
+				AdminRequest: &raft_cmdpb.AdminRequest{
+					CmdType:        raft_cmdpb.AdminCmdType_TransferLeader,
+					TransferLeader: &raft_cmdpb.TransferLeaderRequest{Peer: findPeer(region, storeID)},
+				},
+			})
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.t.Fatalf("failed to transfer the leader of region %d to store %d", regionID, storeID)
+}
+
+// mustPrepareMerge proposes PrepareMerge to merge the source region into the target region.
+func (c *testCluster) mustPrepareMerge(source, target uint64) {
+	c.mustCallLeader(source, func(header *raft_cmdpb.RaftRequestHeader) *raft_cmdpb.RaftCmdRequest {
+		return &raft_cmdpb.RaftCmdRequest{
+			Header: header,
+			AdminRequest: &raft_cmdpb.AdminRequest{
+				CmdType:      raft_cmdpb.AdminCmdType_PrepareMerge,
+				PrepareMerge: &raft_cmdpb.PrepareMergeRequest{Target: c.region(header.Peer.StoreId, target)},
+			},
+		}
+	})
+}
+
+// waitMerged waits until the source region is merged into the target region on the store.
+func (c *testCluster) waitMerged(storeID, source, target uint64) {
+	for i := 0; i < 500; i++ {
+		if c.region(storeID, source) == nil && c.nodes[storeID].router.get(source) == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Nil(c.t, c.region(storeID, source))
+	require.Nil(c.t, c.nodes[storeID].router.get(source))
+	region := c.region(storeID, target)
+	require.NotNil(c.t, region)
+	require.Len(c.t, region.StartKey, 0)
+}
@@ -0,0 +1,211 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/ngaut/unistore/rocksdb"
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/pingcap/badger"
+)
+
+// compactedRangeInputBytes is the input size of a range in a CompactedEvent, the declined bytes of the
+// regions are calculated by the ranges.
+const compactedRangeInputBytes = 1 * MB
+
+// CompactionFilterFactory creates the compaction filter of badger.
+type CompactionFilterFactory func(targetLevel int, startKey, endKey []byte) badger.CompactionFilter
+
+// CompactionListener records the entries passed to the compaction filters of badger, the sizes of the
+// entries before and after the compactions are reported to the store as CompactedEvent, so the approximate
+// sizes of the regions decline after the compactions drop the deleted data.
+type CompactionListener struct {
+	mu        sync.Mutex
+	recorders []*compactionRecorder
+}
+
+func NewCompactionListener() *CompactionListener {
+	return &CompactionListener{}
+}
+
+// WrapFilterFactory wraps the compaction filter factory to record the entries of the compactions.
+func (l *CompactionListener) WrapFilterFactory(factory CompactionFilterFactory) CompactionFilterFactory {
+	return func(targetLevel int, startKey, endKey []byte) badger.CompactionFilter {
+		r := &compactionRecorder{filter: factory(targetLevel, startKey, endKey), outputLevel: targetLevel}
+		l.mu.Lock()
+		l.recorders = append(l.recorders, r)
+		l.mu.Unlock()
+		return r
+	}
+}
+
+// takeEvents returns the events of the entries recorded since the last call. A compaction may pause
+// between two calls, so it is removed as finished only if it records nothing since the last two calls.
+func (l *CompactionListener) takeEvents() []*rocksdb.CompactedEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var events []*rocksdb.CompactedEvent
+	running := l.recorders[:0]
+	for _, r := range l.recorders {
+		event := r.takeEvent()
+		if event == nil {
+			if r.idle {
+				continue
+			}
+			r.idle = true
+			running = append(running, r)
+			continue
+		}
+		r.idle = false
+		running = append(running, r)
+		events = append(events, event)
+	}
+	for i := len(running); i < len(l.recorders); i++ {
+		l.recorders[i] = nil
+	}
+	l.recorders = running
+	return events
+}
+
+type compactedKeyClass byte
+
+const (
+	compactedKeyLocal compactedKeyClass = iota
+	compactedKeyData
+	compactedKeyExtra
+	compactedKeyRaw
+	compactedKeyVer
+)
+
+func classifyCompactedKey(key []byte) compactedKeyClass {
+	switch {
+	case bytes.HasPrefix(key, mvcc.RawKeyPrefix):
+		return compactedKeyRaw
+	case bytes.HasPrefix(key, mvcc.VerKeyPrefix):
+		return compactedKeyVer
+	case isExtraTxnStatusKey(key):
+		return compactedKeyExtra
+	case bytes.Compare(key, MinDataKey) >= 0 && bytes.Compare(key, MaxDataKey) < 0:
+		return compactedKeyData
+	}
+	return compactedKeyLocal
+}
+
+// regionKeyOf converts the key stored in DB to the key in the region range, nil is returned if the key
+// is invalid.
+func regionKeyOf(key []byte, class compactedKeyClass) []byte {
+	switch class {
+	case compactedKeyRaw:
+		return safeCopy(mvcc.DecodeRawKey(key))
+	case compactedKeyVer:
+		regionKey, _, err := mvcc.DecodeVerKey(key)
+		if err != nil {
+			return nil
+		}
+		return regionKey
+	case compactedKeyExtra:
+		return mvcc.DecodeExtraTxnStatusKey(key)
+	}
+	return safeCopy(key)
+}
+
+// compactionRecorder is the compaction filter that records the entries of a compaction. The keys of
+// different classes are not in the same order in the region key space, so they are in different ranges.
+type compactionRecorder struct {
+	filter      badger.CompactionFilter
+	outputLevel int
+	// idle is set if the last takeEvents got no event, it's protected by the mutex of the listener.
+	idle bool
+
+	mu        sync.Mutex
+	ranges    []rocksdb.CompactedRange
+	cur       rocksdb.CompactedRange
+	curClass  compactedKeyClass
+	lastKey   []byte
+	recording bool
+}
+
+func (r *compactionRecorder) Filter(key, value, userMeta []byte) badger.Decision {
+	decision := r.filter.Filter(key, value, userMeta)
+	class := classifyCompactedKey(key)
+	if class == compactedKeyLocal {
+		return decision
+	}
+	inputBytes := uint64(len(key) + len(value) + len(userMeta))
+	var outputBytes uint64
+	switch decision {
+	case badger.DecisionKeep:
+		outputBytes = inputBytes
+	case badger.DecisionMarkTombstone:
+		outputBytes = uint64(len(key))
+	}
+	r.mu.Lock()
+	if r.recording && (class != r.curClass || r.cur.InputBytes >= compactedRangeInputBytes) {
+		r.finishRange()
+	}
+	if !r.recording {
+		r.cur = rocksdb.CompactedRange{StartKey: regionKeyOf(key, class)}
+		r.curClass = class
+		r.recording = r.cur.StartKey != nil
+	}
+	if r.recording {
+		r.cur.InputBytes += inputBytes
+		r.cur.OutputBytes += outputBytes
+		r.lastKey = append(r.lastKey[:0], key...)
+	}
+	r.mu.Unlock()
+	return decision
+}
+
+func (r *compactionRecorder) Guards() []badger.Guard {
+	return r.filter.Guards()
+}
+
+// finishRange appends the current range, the end key is the key next to the last key in the range.
+func (r *compactionRecorder) finishRange() {
+	r.recording = false
+	lastKey := regionKeyOf(r.lastKey, r.curClass)
+	if lastKey == nil {
+		return
+	}
+	r.cur.EndKey = append(lastKey, 0)
+	r.ranges = append(r.ranges, r.cur)
+}
+
+func (r *compactionRecorder) takeEvent() *rocksdb.CompactedEvent {
+	r.mu.Lock()
+	if r.recording {
+		r.finishRange()
+	}
+	ranges := r.ranges
+	r.ranges = nil
+	r.mu.Unlock()
+	if len(ranges) == 0 {
+		return nil
+	}
+	event := &rocksdb.CompactedEvent{OutputLevel: r.outputLevel, Ranges: ranges}
+	for _, ran := range ranges {
+		event.TotalInputBytes += int(ran.InputBytes)
+		event.TotalOutputBytes += int(ran.OutputBytes)
+		if event.StartKey == nil || bytes.Compare(ran.StartKey, event.StartKey) < 0 {
+			event.StartKey = ran.StartKey
+		}
+		if bytes.Compare(ran.EndKey, event.EndKey) > 0 {
+			event.EndKey = ran.EndKey
+		}
+	}
+	return event
+}
@@ -0,0 +1,129 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/y"
+	"github.com/stretchr/testify/require"
+)
+
+// dropPrefixFilter drops the keys with the prefix.
+type dropPrefixFilter struct {
+	prefix []byte
+}
+
+func (f *dropPrefixFilter) Filter(key, value, userMeta []byte) badger.Decision {
+	if bytes.HasPrefix(key, f.prefix) {
+		return badger.DecisionDrop
+	}
+	return badger.DecisionKeep
+}
+
+func (f *dropPrefixFilter) Guards() []badger.Guard {
+	return nil
+}
+
+func TestCompactionListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compaction_listener")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	listener := NewCompactionListener()
+	opts := badger.DefaultOptions
+	opts.Dir = dir
+	opts.ValueDir = dir
+	opts.CompactL0WhenClose = true
+	opts.CompactionFilterFactory = listener.WrapFilterFactory(func(targetLevel int, startKey, endKey []byte) badger.CompactionFilter {
+		return &dropPrefixFilter{prefix: []byte("t1")}
+	})
+	db, err := badger.Open(opts)
+	require.Nil(t, err)
+	const numKeys = 100
+	value := make([]byte, 64)
+	require.Nil(t, db.Update(func(txn *badger.Txn) error {
+		for i := 0; i < numKeys; i++ {
+			for _, key := range [][]byte{
+				[]byte(fmt.Sprintf("t0%03d", i)),
+				[]byte(fmt.Sprintf("t1%03d", i)),
+				mvcc.EncodeRawKey([]byte(fmt.Sprintf("r%03d", i))),
+			} {
+				require.Nil(t, txn.SetEntry(&badger.Entry{Key: y.KeyWithTs(key, KvTS), Value: value}))
+			}
+		}
+		return nil
+	}))
+	db.UpdateSafeTs(math.MaxUint64)
+	// The memory table is compacted to L1 when the DB is closed.
+	require.Nil(t, db.Close())
+
+	events := listener.takeEvents()
+	require.NotEmpty(t, events)
+	var inputBytes, outputBytes int
+	var dataRange, rawRange bool
+	for _, event := range events {
+		inputBytes += event.TotalInputBytes
+		outputBytes += event.TotalOutputBytes
+		for _, ran := range event.Ranges {
+			switch {
+			case bytes.Equal(ran.StartKey, []byte("t0000")):
+				dataRange = true
+				require.True(t, ran.InputBytes > ran.OutputBytes)
+			case bytes.Equal(ran.StartKey, []byte("r000")):
+				// The raw keys are reported as the keys in the region range.
+				rawRange = true
+				require.Equal(t, ran.InputBytes, ran.OutputBytes)
+				require.Equal(t, []byte("r099\x00"), ran.EndKey)
+			}
+		}
+	}
+	require.True(t, dataRange)
+	require.True(t, rawRange)
+	require.Equal(t, numKeys*(len("t1000")+len(value)), inputBytes-outputBytes)
+	// The finished compactions are not reported again.
+	require.Empty(t, listener.takeEvents())
+}
+
+func TestCompactionListenerIdleTick(t *testing.T) {
+	listener := NewCompactionListener()
+	factory := listener.WrapFilterFactory(func(targetLevel int, startKey, endKey []byte) badger.CompactionFilter {
+		return &dropPrefixFilter{prefix: []byte("t1")}
+	})
+	filter := factory(1, nil, nil)
+	value := make([]byte, 64)
+	filter.Filter([]byte("t0000"), value, nil)
+	events := listener.takeEvents()
+	require.Len(t, events, 1)
+	require.Equal(t, []byte("t0000"), events[0].StartKey)
+
+	// The compaction records nothing in a tick, but it's kept.
+	require.Empty(t, listener.takeEvents())
+	filter.Filter([]byte("t1000"), value, nil)
+	events = listener.takeEvents()
+	require.Len(t, events, 1)
+	require.Equal(t, []byte("t1000"), events[0].StartKey)
+	require.Equal(t, 0, events[0].TotalOutputBytes)
+
+	// The compaction idle in two ticks is finished.
+	require.Empty(t, listener.takeEvents())
+	require.Empty(t, listener.takeEvents())
+	require.Empty(t, listener.recorders)
+}
@@ -218,9 +218,8 @@ func NewDefaultConfig() *Config {
 		PeerStaleStateCheckInterval:      5 * time.Minute,
 		LeaderTransferMaxLogLag:          10,
 		SnapApplyBatchSize:               10 * MB,
-		// Disable consistency check by default as it will hurt performance.
-		// We should turn on this only in our tests.
-		ConsistencyCheckInterval: 0,
+		// The consistency check reads all the data of a region, so it runs rarely by default.
+		ConsistencyCheckInterval: 24 * time.Hour,
 		ReportRegionFlowInterval: 1 * time.Minute,
 		RaftStoreMaxLeaderLease:  9 * time.Second,
 		RightDeriveWhenSplit:     true,
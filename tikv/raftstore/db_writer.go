@@ -14,6 +14,7 @@
 package raftstore
 
 import (
+	"encoding/binary"
 	"time"
 
 	"github.com/ngaut/unistore/config"
@@ -23,13 +24,17 @@ import (
 	"github.com/pingcap/badger/y"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
 	rcpb "github.com/pingcap/kvproto/pkg/raft_cmdpb"
 	"github.com/pingcap/tidb/util/codec"
 )
 
 type raftDBWriter struct {
 	router           *router
+	importer         *SSTImporter
+	observer         *mvcc.LockObserver
 	useCustomRaftLog bool
 }
 
@@ -46,9 +51,11 @@ type raftWriteBatch struct {
 	requests []*rcpb.Request
 	startTS  uint64
 	commitTS uint64
+	observer *mvcc.LockObserver
 }
 
 func (wb *raftWriteBatch) Prewrite(key []byte, lock *mvcc.MvccLock) {
+	wb.observer.Observe(key, lock)
 	encodedKey := codec.EncodeBytes(nil, key)
 	putLock, putDefault := mvcc.EncodeLockCFValue(lock)
 	if len(putDefault) != 0 {
@@ -158,41 +165,133 @@ func (wb *raftWriteBatch) PessimisticRollback(key []byte) {
 	})
 }
 
+// RawPut appends the raw user meta to the value, so every replica gets the same expire time.
+func (wb *raftWriteBatch) RawPut(key, value []byte, expireTS uint64) {
+	val := make([]byte, 0, len(value)+8)
+	val = append(val, value...)
+	val = append(val, mvcc.NewRawUserMeta(expireTS)...)
+	wb.requests = append(wb.requests, &rcpb.Request{
+		CmdType: rcpb.CmdType_Put,
+		Put: &rcpb.PutRequest{
+			Cf:    CFRaw,
+			Key:   key,
+			Value: val,
+		},
+	})
+}
+
+func (wb *raftWriteBatch) RawDelete(key []byte) {
+	wb.requests = append(wb.requests, &rcpb.Request{
+		CmdType: rcpb.CmdType_Delete,
+		Delete: &rcpb.DeleteRequest{
+			Cf:  CFRaw,
+			Key: key,
+		},
+	})
+}
+
+// VerPut appends the version to the value and VerDelete appends it to the key.
+func (wb *raftWriteBatch) VerPut(key, value []byte, version uint64) {
+	wb.requests = append(wb.requests, &rcpb.Request{
+		CmdType: rcpb.CmdType_Put,
+		Put: &rcpb.PutRequest{
+			Cf:    CFVer,
+			Key:   key,
+			Value: appendVersion(value, version),
+		},
+	})
+}
+
+func (wb *raftWriteBatch) VerDelete(key []byte, version uint64) {
+	wb.requests = append(wb.requests, &rcpb.Request{
+		CmdType: rcpb.CmdType_Delete,
+		Delete: &rcpb.DeleteRequest{
+			Cf:  CFVer,
+			Key: appendVersion(key, version),
+		},
+	})
+}
+
+func appendVersion(b []byte, version uint64) []byte {
+	buf := make([]byte, len(b)+8)
+	copy(buf, b)
+	binary.BigEndian.PutUint64(buf[len(b):], version)
+	return buf
+}
+
+func splitVersion(b []byte) ([]byte, uint64) {
+	off := len(b) - 8
+	return b[:off], binary.BigEndian.Uint64(b[off:])
+}
+
+// keySpaceCF returns the CF of DeleteRange requests in the key space.
+func keySpaceCF(space mvcc.KeySpace) CFName {
+	switch space {
+	case mvcc.KeySpaceRaw:
+		return CFRaw
+	case mvcc.KeySpaceVer:
+		return CFVer
+	}
+	return ""
+}
+
+func cfKeySpace(cf CFName) mvcc.KeySpace {
+	switch cf {
+	case CFRaw:
+		return mvcc.KeySpaceRaw
+	case CFVer:
+		return mvcc.KeySpaceVer
+	}
+	return mvcc.KeySpaceTxn
+}
+
 func (writer *raftDBWriter) NewWriteBatch(startTS, commitTS uint64, ctx *kvrpcpb.Context) mvcc.WriteBatch {
 	if writer.useCustomRaftLog {
-		return NewCustomWriteBatch(startTS, commitTS, ctx)
+		return NewCustomWriteBatch(startTS, commitTS, ctx, writer.observer)
 	}
 	return &raftWriteBatch{
 		ctx:      ctx,
 		startTS:  startTS,
 		commitTS: commitTS,
+		observer: writer.observer,
 	}
 }
 
-func (writer *raftDBWriter) Write(batch mvcc.WriteBatch) error {
-	cmd := &MsgRaftCmd{
-		SendTime: time.Now(),
-		Callback: NewCallback(),
+func newRaftRequestHeader(ctx *kvrpcpb.Context) *rcpb.RaftRequestHeader {
+	return &rcpb.RaftRequestHeader{
+		RegionId:    ctx.RegionId,
+		Peer:        ctx.Peer,
+		RegionEpoch: ctx.RegionEpoch,
+		Term:        ctx.Term,
 	}
-	var reqLen int
+}
+
+func (writer *raftDBWriter) Write(batch mvcc.WriteBatch) error {
+	var (
+		rlog   raftlog.RaftLog
+		reqLen int
+	)
 	switch x := batch.(type) {
 	case *raftWriteBatch:
-		ctx := x.ctx
-		header := &rcpb.RaftRequestHeader{
-			RegionId:    ctx.RegionId,
-			Peer:        ctx.Peer,
-			RegionEpoch: ctx.RegionEpoch,
-			Term:        ctx.Term,
-		}
-		cmd.Request = raftlog.NewRequest(&rcpb.RaftCmdRequest{
-			Header:   header,
+		rlog = raftlog.NewRequest(&rcpb.RaftCmdRequest{
+			Header:   newRaftRequestHeader(x.ctx),
 			Requests: x.requests,
 		})
 		reqLen = len(x.requests)
 	case *customWriteBatch:
-		cmd.Request = x.builder.Build()
+		rlog = x.builder.Build()
 		reqLen = x.builder.Len()
 	}
+	return writer.propose(rlog, reqLen)
+}
+
+// propose sends the raft log to the region and waits until it is applied.
+func (writer *raftDBWriter) propose(rlog raftlog.RaftLog, reqLen int) error {
+	cmd := &MsgRaftCmd{
+		SendTime: time.Now(),
+		Request:  rlog,
+		Callback: NewCallback(),
+	}
 	start := time.Now()
 	err := writer.router.sendRaftCommand(cmd)
 	if err != nil {
@@ -230,13 +329,77 @@ func (writer *raftDBWriter) checkResponse(resp *rcpb.RaftCmdResponse, reqCount i
 	return nil
 }
 
-func (writer *raftDBWriter) DeleteRange(startKey, endKey []byte, latchHandle mvcc.LatchHandle) error {
-	return nil // TODO: stub
+// DeleteRange proposes a DeleteRange command, every replica deletes the keys in the range when the command
+// is applied, the locks are also deleted in the transactional key space. An empty endKey is only allowed in
+// the raw and versioned key spaces, it is rejected when the command is applied if the region has an end key.
+func (writer *raftDBWriter) DeleteRange(space mvcc.KeySpace, startKey, endKey []byte, _ mvcc.LatchHandle, ctx *kvrpcpb.Context) error {
+	if space == mvcc.KeySpaceTxn && len(endKey) == 0 {
+		return errors.New("invalid end key")
+	}
+	req := &rcpb.DeleteRangeRequest{
+		Cf:       keySpaceCF(space),
+		StartKey: codec.EncodeBytes(nil, startKey),
+	}
+	if len(endKey) > 0 {
+		req.EndKey = codec.EncodeBytes(nil, endKey)
+	}
+	rlog := raftlog.NewRequest(&rcpb.RaftCmdRequest{
+		Header: newRaftRequestHeader(ctx),
+		Requests: []*rcpb.Request{{
+			CmdType:     rcpb.CmdType_DeleteRange,
+			DeleteRange: req,
+		}},
+	})
+	return writer.propose(rlog, 1)
 }
 
-func NewDBWriter(conf *config.Config, router *RaftstoreRouter) mvcc.DBWriter {
+// Import writes the mutations into SST files in the import directory and ingests them into the region.
+func (writer *raftDBWriter) Import(mutations []*kvrpcpb.Mutation, commitTS uint64, region *metapb.Region, ctx *kvrpcpb.Context) error {
+	metas, err := writer.importer.WriteMutations(ctx.RegionId, ctx.RegionEpoch, mutations, commitTS)
+	if err != nil || len(metas) == 0 {
+		return err
+	}
+	err = writer.Ingest(metas, region, ctx)
+	if err != nil {
+		// The files are removed by the applier once ingested.
+		writer.importer.Delete(metas)
+	}
+	return err
+}
+
+// Ingest checks the SST files against the region, uploads them to the stores of the other peers and proposes
+// IngestSST commands referencing them, the files are ingested when the commands are applied.
+func (writer *raftDBWriter) Ingest(metas []*import_sstpb.SSTMeta, region *metapb.Region, ctx *kvrpcpb.Context) error {
+	for _, meta := range metas {
+		if err := checkSSTForIngestion(meta, region); err != nil {
+			return err
+		}
+		if err := writer.importer.Validate(meta); err != nil {
+			return err
+		}
+	}
+	if err := writer.importer.Replicate(region, ctx.GetPeer().GetStoreId(), metas); err != nil {
+		return err
+	}
+	requests := make([]*rcpb.Request, 0, len(metas))
+	for _, meta := range metas {
+		requests = append(requests, &rcpb.Request{
+			CmdType:   rcpb.CmdType_IngestSST,
+			IngestSst: &rcpb.IngestSSTRequest{Sst: meta},
+		})
+	}
+	rlog := raftlog.NewRequest(&rcpb.RaftCmdRequest{
+		Header:   newRaftRequestHeader(ctx),
+		Requests: requests,
+	})
+	return writer.propose(rlog, len(requests))
+}
+
+func NewDBWriter(conf *config.Config, bundle *mvcc.DBBundle, router *RaftstoreRouter) mvcc.DBWriter {
 	return &raftDBWriter{
 		router:           router.router,
+		importer:         router.importer,
+		observer:         &bundle.LockObserver,
 		useCustomRaftLog: conf.RaftStore.CustomRaftLog,
 	}
 }
@@ -267,12 +430,35 @@ func (w *TestRaftWriter) Write(batch mvcc.WriteBatch) error {
 	return nil
 }
 
-func (w *TestRaftWriter) DeleteRange(start, end []byte, latchHandle mvcc.LatchHandle) error {
-	return nil
+func (w *TestRaftWriter) DeleteRange(space mvcc.KeySpace, start, end []byte, latchHandle mvcc.LatchHandle, ctx *kvrpcpb.Context) error {
+	start, end = space.EncodeRange(start, end)
+	return deleteRange(w.dbBundle, start, end)
+}
+
+func (w *TestRaftWriter) Import(mutations []*kvrpcpb.Mutation, commitTS uint64, region *metapb.Region, ctx *kvrpcpb.Context) error {
+	metas, err := w.engine.importer.WriteMutations(ctx.RegionId, ctx.RegionEpoch, mutations, commitTS)
+	if err != nil || len(metas) == 0 {
+		return err
+	}
+	defer w.engine.importer.Delete(metas)
+	return w.engine.importer.Ingest(w.dbBundle, metas)
+}
+
+func (w *TestRaftWriter) Ingest(metas []*import_sstpb.SSTMeta, region *metapb.Region, ctx *kvrpcpb.Context) error {
+	for _, meta := range metas {
+		if err := checkSSTForIngestion(meta, region); err != nil {
+			return err
+		}
+		if err := w.engine.importer.Validate(meta); err != nil {
+			return err
+		}
+	}
+	defer w.engine.importer.Delete(metas)
+	return w.engine.importer.Ingest(w.dbBundle, metas)
 }
 
 func (w *TestRaftWriter) NewWriteBatch(startTS, commitTS uint64, ctx *kvrpcpb.Context) mvcc.WriteBatch {
-	return NewCustomWriteBatch(startTS, commitTS, ctx)
+	return NewCustomWriteBatch(startTS, commitTS, ctx, &w.dbBundle.LockObserver)
 }
 
 func NewTestRaftWriter(dbBundle *mvcc.DBBundle, engine *Engines) mvcc.DBWriter {
@@ -287,6 +473,7 @@ type customWriteBatch struct {
 	startTS  uint64
 	commitTS uint64
 	builder  *raftlog.CustomBuilder
+	observer *mvcc.LockObserver
 }
 
 func (wb *customWriteBatch) setType(tp raftlog.CustomRaftLogType) {
@@ -299,6 +486,7 @@ func (wb *customWriteBatch) setType(tp raftlog.CustomRaftLogType) {
 }
 
 func (wb *customWriteBatch) Prewrite(key []byte, lock *mvcc.MvccLock) {
+	wb.observer.Observe(key, lock)
 	wb.setType(raftlog.TypePrewrite)
 	wb.builder.AppendLock(key, lock.MarshalBinary())
 }
@@ -323,7 +511,27 @@ func (wb *customWriteBatch) PessimisticRollback(key []byte) {
 	wb.builder.AppendPessimisticRollback(key)
 }
 
-func NewCustomWriteBatch(startTS, commitTS uint64, ctx *kvrpcpb.Context) mvcc.WriteBatch {
+func (wb *customWriteBatch) RawPut(key, value []byte, expireTS uint64) {
+	wb.setType(raftlog.TypeRawPut)
+	wb.builder.AppendRawPut(key, value, expireTS)
+}
+
+func (wb *customWriteBatch) RawDelete(key []byte) {
+	wb.setType(raftlog.TypeRawDelete)
+	wb.builder.AppendRawDelete(key)
+}
+
+func (wb *customWriteBatch) VerPut(key, value []byte, version uint64) {
+	wb.setType(raftlog.TypeVerPut)
+	wb.builder.AppendVerPut(key, value, version)
+}
+
+func (wb *customWriteBatch) VerDelete(key []byte, version uint64) {
+	wb.setType(raftlog.TypeVerDelete)
+	wb.builder.AppendVerDelete(key, version)
+}
+
+func NewCustomWriteBatch(startTS, commitTS uint64, ctx *kvrpcpb.Context, observer *mvcc.LockObserver) mvcc.WriteBatch {
 	header := raftlog.CustomHeader{
 		RegionID: ctx.RegionId,
 		Epoch:    raftlog.NewEpoch(ctx.RegionEpoch.Version, ctx.RegionEpoch.ConfVer),
@@ -336,5 +544,6 @@ func NewCustomWriteBatch(startTS, commitTS uint64, ctx *kvrpcpb.Context) mvcc.Wr
 		startTS:  startTS,
 		commitTS: commitTS,
 		builder:  b,
+		observer: observer,
 	}
 }
@@ -24,6 +24,7 @@ import (
 	"github.com/pingcap/badger"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	rfpb "github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	"github.com/pingcap/tidb/util/codec"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -179,3 +180,145 @@ func TestRaftWriteBatch_Rollback(t *testing.T) {
 	val := engines.kv.LockStore.Get(primary, nil)
 	assert.Nil(t, val)
 }
+
+func TestRaftWriteBatch_DeleteRange(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	apply := new(applier)
+	apply.region = genTestRegion(1, 1, 1)
+	apply.region.StartKey = codec.EncodeBytes(nil, []byte("t"))
+	apply.region.EndKey = codec.EncodeBytes(nil, []byte("t9"))
+	applyCtx := newApplyContext("test", nil, engines, nil, NewDefaultConfig())
+	execRequests := func(requests []*rfpb.Request) *rfpb.RaftCmdResponse {
+		resp, _ := apply.execWriteCmd(applyCtx, raftlog.NewRequest(&rfpb.RaftCmdRequest{
+			Header:   new(rfpb.RaftRequestHeader),
+			Requests: requests,
+		}))
+		err := applyCtx.wb.WriteToKV(engines.kv)
+		assert.Nil(t, err)
+		applyCtx.wb.Reset()
+		return resp
+	}
+	keys := make([][]byte, 4)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("t%08d_r%08d", i, i))
+		lock := &mvcc.MvccLock{
+			MvccLockHdr: mvcc.MvccLockHdr{
+				StartTS:    100,
+				TTL:        10,
+				Op:         uint8(kvrpcpb.Op_Put),
+				PrimaryLen: uint16(len(keys[i])),
+			},
+			Primary: keys[i],
+			Value:   []byte("value"),
+		}
+		wb := &raftWriteBatch{startTS: 100, commitTS: 200}
+		wb.Prewrite(keys[i], lock)
+		execRequests(wb.requests)
+		if i == 3 {
+			// Leave the last key locked.
+			break
+		}
+		wb.requests = nil
+		wb.Commit(keys[i], lock)
+		execRequests(wb.requests)
+	}
+
+	// The range across the region is rejected and nothing is deleted.
+	resp := execRequests([]*rfpb.Request{{
+		CmdType: rfpb.CmdType_DeleteRange,
+		DeleteRange: &rfpb.DeleteRangeRequest{
+			StartKey: codec.EncodeBytes(nil, keys[1]),
+			EndKey:   codec.EncodeBytes(nil, []byte("tz")),
+		},
+	}})
+	assert.NotNil(t, resp.Header.Error.GetKeyNotInRegion())
+	engines.kv.DB.View(func(txn *badger.Txn) error {
+		for _, key := range keys[:3] {
+			_, err := txn.Get(key)
+			assert.Nil(t, err)
+		}
+		return nil
+	})
+	assert.NotNil(t, engines.kv.LockStore.Get(keys[3], nil))
+
+	resp = execRequests([]*rfpb.Request{{
+		CmdType: rfpb.CmdType_DeleteRange,
+		DeleteRange: &rfpb.DeleteRangeRequest{
+			StartKey: codec.EncodeBytes(nil, keys[1]),
+			EndKey:   codec.EncodeBytes(nil, []byte("t9")),
+		},
+	}})
+	assert.Nil(t, resp.Header.Error)
+
+	engines.kv.DB.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(keys[0])
+		assert.Nil(t, err)
+		for _, key := range keys[1:] {
+			_, err = txn.Get(key)
+			assert.Equal(t, badger.ErrKeyNotFound, err)
+		}
+		return nil
+	})
+	assert.Nil(t, engines.kv.LockStore.Get(keys[3], nil))
+
+	// The raw keys are deleted in the raw key space, an empty end key is rejected because the region has an end key.
+	wb := &raftWriteBatch{}
+	wb.RawPut(keys[0], []byte("raw"), 0)
+	wb.RawPut(keys[1], []byte("raw"), 0)
+	execRequests(wb.requests)
+	resp = execRequests([]*rfpb.Request{{
+		CmdType: rfpb.CmdType_DeleteRange,
+		DeleteRange: &rfpb.DeleteRangeRequest{
+			Cf:       CFRaw,
+			StartKey: codec.EncodeBytes(nil, keys[1]),
+		},
+	}})
+	assert.NotNil(t, resp.Header.Error)
+	resp = execRequests([]*rfpb.Request{{
+		CmdType: rfpb.CmdType_DeleteRange,
+		DeleteRange: &rfpb.DeleteRangeRequest{
+			Cf:       CFRaw,
+			StartKey: codec.EncodeBytes(nil, keys[1]),
+			EndKey:   codec.EncodeBytes(nil, []byte("t9")),
+		},
+	}})
+	assert.Nil(t, resp.Header.Error)
+	engines.kv.DB.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(mvcc.EncodeRawKey(keys[0]))
+		assert.Nil(t, err)
+		_, err = txn.Get(mvcc.EncodeRawKey(keys[1]))
+		assert.Equal(t, badger.ErrKeyNotFound, err)
+		return nil
+	})
+}
+
+func TestRaftWriteBatch_InvalidValue(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	apply := new(applier)
+	apply.region = genTestRegion(1, 1, 1)
+	applyCtx := newApplyContext("test", nil, engines, nil, NewDefaultConfig())
+	requests := [][]*rfpb.Request{
+		{{
+			CmdType: rfpb.CmdType_Put,
+			Put:     &rfpb.PutRequest{Cf: CFRaw, Key: []byte("tkey"), Value: []byte("short")},
+		}},
+		{{
+			CmdType: rfpb.CmdType_Put,
+			Put:     &rfpb.PutRequest{Cf: CFVer, Key: []byte("tkey"), Value: []byte("short")},
+		}},
+		{{
+			CmdType: rfpb.CmdType_Delete,
+			Delete:  &rfpb.DeleteRequest{Cf: CFVer, Key: []byte("tkey")},
+		}},
+	}
+	for _, reqs := range requests {
+		resp, _ := apply.execWriteCmd(applyCtx, raftlog.NewRequest(&rfpb.RaftCmdRequest{
+			Header:   new(rfpb.RaftRequestHeader),
+			Requests: reqs,
+		}))
+		assert.NotNil(t, resp.Header.Error)
+		assert.Len(t, applyCtx.wb.entries, 0)
+	}
+}
@@ -16,6 +16,7 @@ package raftstore
 import (
 	"bytes"
 	"math"
+	"path/filepath"
 	"sync/atomic"
 	"time"
 
@@ -70,6 +71,9 @@ type Engines struct {
 	kvPath   string
 	raft     *badger.DB
 	raftPath string
+	importer *SSTImporter
+
+	compactionListener *CompactionListener
 }
 
 func NewEngines(kvEngine *mvcc.DBBundle, raftEngine *badger.DB, kvPath, raftPath string) *Engines {
@@ -78,9 +82,16 @@ func NewEngines(kvEngine *mvcc.DBBundle, raftEngine *badger.DB, kvPath, raftPath
 		kvPath:   kvPath,
 		raft:     raftEngine,
 		raftPath: raftPath,
+		importer: NewSSTImporter(filepath.Join(kvPath, importDirName)),
 	}
 }
 
+// SetCompactionListener sets the listener that wraps the compaction filters of the kv engine, the store
+// reports the compactions recorded by it.
+func (en *Engines) SetCompactionListener(listener *CompactionListener) {
+	en.compactionListener = listener
+}
+
 func (en *Engines) newRegionSnapshot(regionId, redoIdx uint64) (snap *regionSnapshot, err error) {
 	// We need to get the old region state out of the snapshot transaction to fetch data in lockStore.
 	// The lockStore data must be fetch before we start the snapshot transaction to make sure there is no newer data
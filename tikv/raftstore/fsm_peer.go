@@ -16,11 +16,13 @@ package raftstore
 import (
 	"bytes"
 	"fmt"
+	"math"
+	"sync/atomic"
 	"time"
 
 	"github.com/ngaut/unistore/tikv/raftstore/raftlog"
 
-	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/pingcap/badger"
 	"github.com/pingcap/badger/y"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/eraftpb"
@@ -55,6 +57,8 @@ type PeerEventObserver interface {
 	OnSplitRegion(derived *metapb.Region, regions []*metapb.Region, peers []*PeerEventContext)
 	// OnRegionConfChange will be invoked after conf change updated region's epoch.
 	OnRegionConfChange(ctx *PeerEventContext, epoch *metapb.RegionEpoch)
+	// OnRegionMerge will be invoked after the source region is merged into the target region.
+	OnRegionMerge(ctx *PeerEventContext, target, source *metapb.Region)
 	// OnRoleChange will be invoked after peer state has changed
 	OnRoleChange(regionId uint64, newState raft.StateType)
 }
@@ -158,6 +162,9 @@ func newRaftMsgHandler(fsm *peerFsm, ctx *RaftContext) *peerMsgHandler {
 
 func (d *peerMsgHandler) HandleMsgs(msgs ...Msg) {
 	for _, msg := range msgs {
+		if d.hasPendingMergeApplyResult() {
+			d.resumeHandlePendingApplyResult()
+		}
 		switch msg.Type {
 		case MsgTypeRaftMessage:
 			raftMsg := msg.Data.(*rspb.RaftMessage)
@@ -191,12 +198,18 @@ func (d *peerMsgHandler) HandleMsgs(msgs ...Msg) {
 			d.onApproximateRegionKeys(msg.Data.(uint64))
 		case MsgTypeCompactionDeclineBytes:
 			d.onCompactionDeclinedBytes(msg.Data.(uint64))
+		case MsgTypeCompactCheck:
+			d.onCompactCheck()
 		case MsgTypeHalfSplitRegion:
 			half := msg.Data.(*MsgHalfSplitRegion)
 			d.onScheduleHalfSplitRegion(half.RegionEpoch)
 		case MsgTypeMergeResult:
 			result := msg.Data.(*MsgMergeResult)
 			d.onMergeResult(result.TargetPeer, result.Stale)
+		case MsgTypeApplyCatchUpLogs, MsgTypeApplyLogsUpToDate, MsgTypeApplyResume:
+			// The messages between the source and target appliers of a merge and the messages from the
+			// compute hash worker are forwarded in order with the apply tasks of the region.
+			d.ctx.applyMsgs.appendMsg(d.regionID(), msg)
 		case MsgTypeGcSnap:
 			gcSnap := msg.Data.(*MsgGCSnap)
 			d.onGCSnap(gcSnap.Snaps)
@@ -247,12 +260,47 @@ func (d *peerMsgHandler) startTicker() {
 	d.onCheckMerge()
 }
 
+/// Lets the target peer know that the apply result of PrepareMerge is handled by inserting a merge lock
+/// for the region, or waking up the target peer if it is already waiting for it.
 func (d *peerMsgHandler) notifyPrepareMerge() {
-	// TODO: merge func
+	regionID := d.regionID()
+	version := d.region().RegionEpoch.Version
+	d.ctx.storeMetaLock.Lock()
+	defer d.ctx.storeMetaLock.Unlock()
+	meta := d.ctx.storeMeta
+	lock, ok := meta.mergeLocks[regionID]
+	if !ok || lock.readyToMerge == nil {
+		meta.mergeLocks[regionID] = &mergeLock{version: version}
+		return
+	}
+	if lock.version == version {
+		atomic.StoreUint32(lock.readyToMerge, 1)
+		targetID := d.peer.PendingMergeState.Target.Id
+		// Send an empty message to make sure the target peer checks readyToMerge.
+		_ = d.ctx.router.send(targetID, NewPeerMsg(MsgTypeNoop, targetID, nil))
+	} else if lock.version < version {
+		panic(fmt.Sprintf("%s expects version %d but got %d", d.tag(), version, lock.version))
+	}
 }
 
+/// Handles the apply results which are waiting for the source peer of CommitMerge. Returns false if
+/// it is still waiting.
 func (d *peerMsgHandler) resumeHandlePendingApplyResult() bool {
-	return false // TODO: merge func
+	state := d.peer.PendingMergeApplyResult
+	if atomic.LoadUint32(state.readyToMerge) == 0 {
+		return false
+	}
+	d.peer.PendingMergeApplyResult = nil
+	for i, res := range state.results {
+		d.onApplyResult(res)
+		if d.peer.PendingMergeApplyResult != nil {
+			// Another CommitMerge is waiting for its source peer.
+			newState := d.peer.PendingMergeApplyResult
+			newState.results = append(newState.results, state.results[i+1:]...)
+			return false
+		}
+	}
+	return true
 }
 
 func (d *peerMsgHandler) onGCSnap(snaps []SnapKeyWithSending) {
@@ -442,6 +490,7 @@ func (d *peerMsgHandler) onRaftMsg(msg *rspb.RaftMessage) error {
 		return nil
 	}
 	d.peer.insertPeerCache(msg.GetFromPeer())
+	d.checkReplicaReadIndex(msg.GetMessage())
 	err = d.peer.Step(msg.GetMessage())
 	if err != nil {
 		return err
@@ -548,8 +597,56 @@ func handleStaleMsg(trans Transport, msg *rspb.RaftMessage, curEpoch *metapb.Reg
 	}
 }
 
+/// Checks whether the stale source peer should be destroyed after receiving a merge target message,
+/// the peers of the source region on other stores are already merged.
 func (d *peerMsgHandler) needGCMerge(msg *rspb.RaftMessage) (bool, error) {
-	return false, nil // TODO: merge func
+	mergeTarget := msg.MergeTarget
+	targetRegionID := mergeTarget.Id
+	log.S().Debugf("%s receive merge target %s", d.tag(), mergeTarget)
+	// The epoch in merge target is the state of the target peer at the time when the source peer is merged,
+	// record it to let the target peer on this store decide whether to destroy the source peer.
+	d.ctx.storeMetaLock.Lock()
+	meta := d.ctx.storeMeta
+	meta.targetsMap[d.regionID()] = targetRegionID
+	targets, ok := meta.pendingMergeTargets[targetRegionID]
+	if !ok {
+		targets = make(map[uint64]*metapb.RegionEpoch)
+		meta.pendingMergeTargets[targetRegionID] = targets
+	}
+	targets[d.regionID()] = mergeTarget.RegionEpoch
+	if r, ok := meta.regions[targetRegionID]; ok {
+		d.ctx.storeMetaLock.Unlock()
+		// The target peer may have moved on, e.g. merged and split again, then it can't find
+		// the source peer, the source peer destroys itself in this case.
+		return IsEpochStale(mergeTarget.RegionEpoch, r.RegionEpoch), nil
+	}
+	d.ctx.storeMetaLock.Unlock()
+	// All the target peers must exist before merging, so the target region in the message should
+	// be staler than the local target region.
+	return d.isMergeTargetRegionStale(mergeTarget)
+}
+
+func (d *peerMsgHandler) isMergeTargetRegionStale(target *metapb.Region) (bool, error) {
+	state, err := getRegionLocalState(d.ctx.engine.kv.DB, target.Id)
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			log.S().Errorf("%s target region %d doesn't exist, maybe pd doesn't ensure all target peers exist before merging",
+				d.tag(), target.Id)
+			return false, nil
+		}
+		return false, err
+	}
+	if IsEpochStale(target.RegionEpoch, state.Region.RegionEpoch) {
+		return true, nil
+	}
+	targetPeer := findPeer(target, d.storeID())
+	localPeer := findPeer(state.Region, d.storeID())
+	if targetPeer != nil && localPeer != nil && targetPeer.Id == localPeer.Id && state.State == rspb.PeerState_Tombstone {
+		// The local target peer has already been destroyed.
+		return true, nil
+	}
+	log.S().Errorf("%s unexpected local state %s of merge target %s", d.tag(), state, target)
+	return false, nil
 }
 
 func (d *peerMsgHandler) handleGCPeerMsg(msg *rspb.RaftMessage) {
@@ -916,40 +1013,232 @@ func (d *peerMsgHandler) onReadySplitRegion(derived *metapb.Region, regions []*m
 	d.ctx.peerEventObserver.OnSplitRegion(derived, regions, newPeers)
 }
 
+/// Checks whether the local target peer is ready to merge. Returns false if it should wait till next round,
+/// and an error if the merge should be rollbacked.
 func (d *peerMsgHandler) validateMergePeer(targetRegion *metapb.Region) (bool, error) {
-	return false, nil // TODO: merge func
+	regionID := targetRegion.Id
+	d.ctx.storeMetaLock.RLock()
+	existRegion := d.ctx.storeMeta.regions[regionID]
+	d.ctx.storeMetaLock.RUnlock()
+	if existRegion != nil {
+		existEpoch := existRegion.RegionEpoch
+		expectEpoch := targetRegion.RegionEpoch
+		if IsEpochStale(expectEpoch, existEpoch) {
+			return false, errors.Errorf("target region changed %s -> %s", targetRegion, existRegion)
+		}
+		if IsEpochStale(existEpoch, expectEpoch) {
+			log.S().Infof("%s target region %d still not catch up, skip", d.tag(), regionID)
+			return false, nil
+		}
+		return true, nil
+	}
+	state, err := getRegionLocalState(d.ctx.engine.kv.DB, regionID)
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			log.S().Infof("%s target region %d is not created yet, skip", d.tag(), regionID)
+			return false, nil
+		}
+		return false, err
+	}
+	if state.State == rspb.PeerState_Tombstone {
+		return false, errors.Errorf("target region %d is tombstone", regionID)
+	}
+	return false, nil
 }
 
+/// Asks the target peer on this store to propose CommitMerge with the logs of the source region.
 func (d *peerMsgHandler) scheduleMerge() error {
-	return nil // TODO: merge func
+	state := d.peer.PendingMergeState
+	target := state.Target
+	ok, err := d.validateMergePeer(target)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// Wait till next round.
+		return nil
+	}
+	var entries []*eraftpb.Entry
+	low := state.MinIndex + 1
+	if low <= state.Commit {
+		ents, err := d.peer.Store().Entries(low, state.Commit+1, math.MaxUint64)
+		if err != nil {
+			return err
+		}
+		entries = make([]*eraftpb.Entry, len(ents))
+		for i := range ents {
+			entries[i] = &ents[i]
+		}
+	}
+	targetPeer := findPeer(target, d.storeID())
+	req := newAdminRequest(target.Id, targetPeer)
+	req.Header.RegionEpoch = target.RegionEpoch
+	req.AdminRequest = &raft_cmdpb.AdminRequest{
+		CmdType: raft_cmdpb.AdminCmdType_CommitMerge,
+		CommitMerge: &raft_cmdpb.CommitMergeRequest{
+			Source:  d.region(),
+			Commit:  state.Commit,
+			Entries: entries,
+		},
+	}
+	// It assumes that the unit of network isolation is store rather than peer, so a quorum
+	// stores of the source region should also be the quorum stores of the target region.
+	return d.ctx.router.sendRaftCommand(&MsgRaftCmd{
+		SendTime: time.Now(),
+		Request:  raftlog.NewRequest(req),
+	})
 }
 
 func (d *peerMsgHandler) rollbackMerge() {
-	// TODO: merge func
+	req := newAdminRequest(d.regionID(), d.peer.Meta)
+	req.Header.RegionEpoch = d.region().RegionEpoch
+	req.AdminRequest = &raft_cmdpb.AdminRequest{
+		CmdType: raft_cmdpb.AdminCmdType_RollbackMerge,
+		RollbackMerge: &raft_cmdpb.RollbackMergeRequest{
+			Commit: d.peer.PendingMergeState.Commit,
+		},
+	}
+	d.proposeRaftCommand(raftlog.NewRequest(req), nil)
 }
 
 func (d *peerMsgHandler) onCheckMerge() {
-	// TODO: merge func
+	if d.stopped || d.peer.PendingMergeState == nil {
+		return
+	}
+	d.ticker.schedule(PeerTickCheckMerge)
+	if err := d.scheduleMerge(); err != nil {
+		log.S().Infof("%s failed to schedule merge, rollback, err %v", d.tag(), err)
+		d.rollbackMerge()
+	}
 }
 
 func (d *peerMsgHandler) onReadyPrepareMerge(region *metapb.Region, state *rspb.MergeState, merged bool) {
-	// TODO: merge func
+	d.ctx.storeMetaLock.Lock()
+	d.ctx.storeMeta.setRegion(region, d.peer)
+	d.ctx.storeMetaLock.Unlock()
+	d.ctx.peerEventObserver.OnRegionConfChange(d.peer.getEventContext(), region.RegionEpoch)
+	d.peer.PendingMergeState = state
+	d.notifyPrepareMerge()
+	if merged {
+		// The PrepareMerge is applied when catching up logs for CommitMerge, there is no need to
+		// schedule merge again.
+		return
+	}
+	d.onCheckMerge()
 }
 
+/// Updates the store meta after CommitMerge is applied. The source peer must handle the apply
+/// result of PrepareMerge first, otherwise readyToMerge is returned to wait for it.
 func (d *peerMsgHandler) onReadyCommitMerge(region, source *metapb.Region) *uint32 {
-	return nil // TODO: merge func
+	d.ctx.storeMetaLock.Lock()
+	defer d.ctx.storeMetaLock.Unlock()
+	meta := d.ctx.storeMeta
+	version := source.RegionEpoch.Version
+	lock, ok := meta.mergeLocks[source.Id]
+	if !ok || lock.version < version {
+		lock = &mergeLock{version: version, readyToMerge: new(uint32)}
+		meta.mergeLocks[source.Id] = lock
+		log.S().Infof("%s wait for source region %d to handle PrepareMerge", d.tag(), source.Id)
+		return lock.readyToMerge
+	}
+	if lock.version > version {
+		panic(fmt.Sprintf("%s unexpected merge lock version %d of source %s", d.tag(), lock.version, source))
+	}
+	if lock.readyToMerge != nil && atomic.LoadUint32(lock.readyToMerge) == 0 {
+		return lock.readyToMerge
+	}
+	delete(meta.mergeLocks, source.Id)
+
+	if !meta.regionRanges.Delete(source.EndKey) {
+		panic(fmt.Sprintf("%s source region %d is not found in region ranges", d.tag(), source.Id))
+	}
+	// The old end key of the target is the start key of the source if the source is on the right side.
+	oldEndKey := region.EndKey
+	if bytes.Equal(region.EndKey, source.EndKey) {
+		oldEndKey = source.StartKey
+	}
+	if !meta.regionRanges.Delete(oldEndKey) {
+		panic(d.tag() + " meta corrupted")
+	}
+	meta.regionRanges.Put(region.EndKey, regionIDToBytes(region.Id))
+	delete(meta.regions, source.Id)
+	meta.setRegion(region, d.peer)
+	d.ctx.peerEventObserver.OnRegionMerge(d.peer.getEventContext(), region, source)
+	// Make approximate size and keys updated in time.
+	d.peer.SizeDiffHint = d.ctx.cfg.RegionSplitCheckDiff
+	if d.peer.IsLeader() {
+		log.S().Infof("%s notify pd with merge %s into %s", d.tag(), source, region)
+		d.peer.HeartbeatPd(d.ctx.pdTaskSender)
+	}
+	err := d.ctx.router.send(source.Id, NewPeerMsg(MsgTypeMergeResult, source.Id, &MsgMergeResult{
+		TargetPeer: d.peer.Meta,
+		Stale:      false,
+	}))
+	if err != nil {
+		panic(fmt.Sprintf("%s failed to send merge result to source region %d, err %v", d.tag(), source.Id, err))
+	}
+	return nil
 }
 
+/// Handles the rollback of merge, commit is 0 and region is nil if the merge is rollbacked by
+/// applying a snapshot.
 func (d *peerMsgHandler) onReadyRollbackMerge(commit uint64, region *metapb.Region) {
-	// TODO: merge func
+	pendingCommit := d.peer.PendingMergeState.Commit
+	if commit != 0 && pendingCommit != commit {
+		panic(fmt.Sprintf("%s rollbacks a wrong merge %d != %d", d.tag(), pendingCommit, commit))
+	}
+	d.peer.PendingMergeState = nil
+	d.ctx.storeMetaLock.Lock()
+	if lock, ok := d.ctx.storeMeta.mergeLocks[d.regionID()]; ok && lock.readyToMerge == nil {
+		delete(d.ctx.storeMeta.mergeLocks, d.regionID())
+	}
+	if region != nil {
+		d.ctx.storeMeta.setRegion(region, d.peer)
+	}
+	d.ctx.storeMetaLock.Unlock()
+	if region != nil {
+		d.ctx.peerEventObserver.OnRegionConfChange(d.peer.getEventContext(), region.RegionEpoch)
+	}
+	if d.peer.IsLeader() {
+		log.S().Infof("%s notify pd with rollback merge %d", d.tag(), commit)
+		d.peer.HeartbeatPd(d.ctx.pdTaskSender)
+	}
 }
 
 func (d *peerMsgHandler) onMergeResult(target *metapb.Peer, stale bool) {
-	// TODO: merge func
+	if state := d.peer.PendingMergeState; state != nil {
+		exists := false
+		for _, p := range state.Target.Peers {
+			if p.StoreId == target.StoreId && p.Id <= target.Id {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			panic(fmt.Sprintf("%s unexpected merge result, merge state %s, target %s, stale %v",
+				d.tag(), state, target, stale))
+		}
+	}
+	if stale {
+		d.onStaleMerge()
+		return
+	}
+	log.S().Infof("%s merge finished, target %s", d.tag(), target)
+	// The applier of the source peer is already stopped after catching up logs, and the data of
+	// the source region is kept for the target.
+	if job := d.peer.MaybeDestroy(); job != nil {
+		d.destroyPeer(true)
+	}
 }
 
 func (d *peerMsgHandler) onStaleMerge() {
-	// TODO: merge func
+	if d.peer.PendingRemove {
+		return
+	}
+	log.S().Infof("%s successful merge can't be continued, try to gc stale peer", d.tag())
+	if job := d.peer.MaybeDestroy(); job != nil {
+		d.handleDestroyPeer(job)
+	}
 }
 
 func (d *peerMsgHandler) onReadyApplySnapshot(applyResult *ApplySnapResult) {
@@ -998,7 +1287,7 @@ func (d *peerMsgHandler) onReadyResult(merged bool, execResults []execResult) (*
 		case *execResultRollbackMerge:
 			d.onReadyRollbackMerge(x.commit, x.region)
 		case *execResultComputeHash:
-			d.onReadyComputeHash(x.region, x.index, x.snap)
+			d.onReadyComputeHash(x.region, x.index, x.txn, x.locksCopied)
 		case *execResultVerifyHash:
 			d.onReadyVerifyHash(x.index, x.hash)
 		case *execResultDeleteRange:
@@ -1009,7 +1298,38 @@ func (d *peerMsgHandler) onReadyResult(merged bool, execResults []execResult) (*
 }
 
 func (d *peerMsgHandler) checkMergeProposal(msg *raft_cmdpb.RaftCmdRequest) error {
-	return nil // TODO: merge func
+	adminReq := msg.GetAdminRequest()
+	if adminReq.GetPrepareMerge() == nil && adminReq.GetCommitMerge() == nil {
+		return nil
+	}
+	region := d.region()
+	if prepareMerge := adminReq.GetPrepareMerge(); prepareMerge != nil {
+		targetRegion := prepareMerge.Target
+		d.ctx.storeMetaLock.RLock()
+		r := d.ctx.storeMeta.regions[targetRegion.Id]
+		d.ctx.storeMetaLock.RUnlock()
+		if r == nil {
+			return errors.Errorf("target region %d doesn't exist", targetRegion.Id)
+		}
+		if !RegionEqual(r, targetRegion) {
+			return errors.Errorf("target region not matched, skip proposing: %s != %s", r, targetRegion)
+		}
+		if !isSiblingRegions(targetRegion, region) {
+			return errors.Errorf("%s and %s are not sibling, skip proposing", targetRegion, region)
+		}
+		if !regionOnSameStores(targetRegion, region) {
+			return errors.Errorf("peers doesn't match %s != %s, reject merge", region.Peers, targetRegion.Peers)
+		}
+		return nil
+	}
+	sourceRegion := adminReq.GetCommitMerge().Source
+	if !isSiblingRegions(sourceRegion, region) {
+		return errors.Errorf("%s and %s should be sibling", sourceRegion, region)
+	}
+	if !regionOnSameStores(sourceRegion, region) {
+		return errors.Errorf("peers not matched: %s %s", sourceRegion, region)
+	}
+	return nil
 }
 
 func (d *peerMsgHandler) preProposeRaftCommand(rlog raftlog.RaftLog) (*raft_cmdpb.RaftCmdResponse, error) {
@@ -1026,7 +1346,10 @@ func (d *peerMsgHandler) preProposeRaftCommand(rlog raftlog.RaftLog) (*raft_cmdp
 	// Check whether the store has the right peer to handle the request.
 	regionID := d.regionID()
 	leaderID := d.peer.LeaderId()
-	if !d.peer.IsLeader() {
+	// A follower can serve replica reads by getting the read index from the leader, the read index
+	// request is dropped by raft if there is no leader.
+	allowReplicaRead := isReplicaReadRequest(req) && leaderID != InvalidID
+	if !d.peer.IsLeader() && !allowReplicaRead {
 		leader := d.peer.getPeerFromCache(leaderID)
 		return nil, &ErrNotLeader{regionID, leader}
 	}
@@ -1053,6 +1376,54 @@ func (d *peerMsgHandler) preProposeRaftCommand(rlog raftlog.RaftLog) (*raft_cmdp
 	return nil, err
 }
 
+func isReplicaReadRequest(req *raft_cmdpb.RaftCmdRequest) bool {
+	if req == nil || req.AdminRequest != nil || len(req.Requests) == 0 {
+		return false
+	}
+	for _, r := range req.Requests {
+		switch r.CmdType {
+		case raft_cmdpb.CmdType_ReadIndex:
+		case raft_cmdpb.CmdType_Get, raft_cmdpb.CmdType_Snap:
+			if !req.GetHeader().GetReplicaRead() {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// checkReplicaReadIndex checks the read index of a follower by the ReadIndexObserver of the leader, the lock
+// blocking the read replaces the request in the context, so raft returns it to the follower.
+func (d *peerMsgHandler) checkReplicaReadIndex(m *eraftpb.Message) {
+	if m.MsgType != eraftpb.MessageType_MsgReadIndex || len(m.Entries) != 1 || d.ctx.readIndexObserver == nil ||
+		!d.peer.IsLeader() {
+		return
+	}
+	ctx := unmarshalReadIndexCtx(m.Entries[0].Data)
+	if ctx == nil || ctx.req == nil {
+		return
+	}
+	if locked := d.ctx.readIndexObserver.OnReadIndex(ctx.req); locked != nil {
+		ctx.req, ctx.locked = nil, locked
+		m.Entries[0].Data = ctx.marshal()
+	}
+}
+
+// checkReadIndex checks the read index request of the leader by the ReadIndexObserver, it returns the lock
+// blocking the read. The followers check it by the leader in checkReplicaReadIndex.
+func (d *peerMsgHandler) checkReadIndex(msg *raft_cmdpb.RaftCmdRequest) *kvrpcpb.LockInfo {
+	if d.ctx.readIndexObserver == nil || !d.peer.IsLeader() {
+		return nil
+	}
+	req := getReadIndexRequest(msg)
+	if req == nil {
+		return nil
+	}
+	return d.ctx.readIndexObserver.OnReadIndex(req)
+}
+
 func (d *peerMsgHandler) proposeRaftCommand(rlog raftlog.RaftLog, cb *Callback) {
 	resp, err := d.preProposeRaftCommand(rlog)
 	if err != nil {
@@ -1074,6 +1445,12 @@ func (d *peerMsgHandler) proposeRaftCommand(rlog raftlog.RaftLog, cb *Callback)
 		cb.Done(ErrResp(err))
 		return
 	}
+	if locked := d.checkReadIndex(msg); locked != nil {
+		resp = d.peer.handleRead(d.ctx.engine.kv, msg, false, 0)
+		bindReadIndexLocked(resp, locked)
+		cb.Done(resp)
+		return
+	}
 
 	// Note:
 	// The peer that is being checked is a leader. It might step down to be a follower later. It
@@ -1214,7 +1591,8 @@ func (d *peerMsgHandler) onSplitRegionCheckTick() {
 	if !d.peer.IsLeader() {
 		return
 	}
-	if d.peer.SizeDiffHint < d.ctx.cfg.RegionSplitCheckDiff {
+	if d.peer.SizeDiffHint < d.ctx.cfg.RegionSplitCheckDiff &&
+		d.peer.CompactionDeclinedBytes < d.ctx.cfg.RegionSplitCheckDiff {
 		return
 	}
 	d.ctx.splitCheckTaskSender <- task{
@@ -1306,6 +1684,38 @@ func (d *peerMsgHandler) onApproximateRegionKeys(keys uint64) {
 
 func (d *peerMsgHandler) onCompactionDeclinedBytes(declinedBytes uint64) {
 	d.peer.CompactionDeclinedBytes += declinedBytes
+	// Decline the approximate size at once, so the next heartbeat reports the size after compaction.
+	if size := d.peer.ApproximateSize; size != nil {
+		newSize := uint64(0)
+		if *size > declinedBytes {
+			newSize = *size - declinedBytes
+		}
+		d.peer.ApproximateSize = &newSize
+	}
+}
+
+// onCompactCheck compacts the ranges of the region if it has many tombstones. The tombstones are estimated by
+// the deletes counted by the applier since the last compaction, and the other entries by the approximate keys.
+func (d *peerMsgHandler) onCompactCheck() {
+	if d.stopped || !d.peer.isInitialized() {
+		return
+	}
+	tombstones := d.peer.deleteKeysHint
+	entries := tombstones
+	if keys := d.peer.ApproximateKeys; keys != nil {
+		entries += *keys
+	}
+	if !needCompact(tombstones, entries, d.ctx.cfg.RegionCompactMinTombstones, d.ctx.cfg.RegionCompactTombstonesPencent) {
+		return
+	}
+	log.S().Infof("%s schedule compaction, tombstones %d, entries %d", d.tag(), tombstones, entries)
+	d.peer.deleteKeysHint = 0
+	region := d.region()
+	ranges := append([]keyRange{{startKey: RawStartKey(region), endKey: RawEndKey(region)}},
+		keySpaceRanges(region.StartKey, region.EndKey)...)
+	for _, ran := range ranges {
+		d.ctx.compactTaskSender <- task{tp: taskTypeCompact, data: &compactTask{keyRange: ran}}
+	}
 }
 
 func (d *peerMsgHandler) onScheduleHalfSplitRegion(regionEpoch *metapb.RegionEpoch) {
@@ -1381,15 +1791,16 @@ func (d *peerMsgHandler) onCheckPeerStaleStateTick() {
 	}
 }
 
-func (d *peerMsgHandler) onReadyComputeHash(region *metapb.Region, index uint64, snap *mvcc.DBSnapshot) {
+func (d *peerMsgHandler) onReadyComputeHash(region *metapb.Region, index uint64, txn *badger.Txn, locksCopied chan struct{}) {
 	d.peer.ConsistencyState.LastCheckTime = time.Now()
 	log.S().Infof("%s schedule compute hash task", d.tag())
 	d.ctx.computeHashTaskSender <- task{
 		tp: taskTypeComputeHash,
 		data: &computeHashTask{
-			region: region,
-			index:  index,
-			snap:   snap,
+			region:      region,
+			index:       index,
+			txn:         txn,
+			locksCopied: locksCopied,
 		},
 	}
 }
@@ -0,0 +1,129 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeRegion(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.shutdown()
+	source := c.mustSplit(1, []byte("m"))
+	c.mustPutRaw(source.Id, []byte("a"), []byte("v"))
+	c.mustPutRaw(1, []byte("x"), []byte("v"))
+
+	c.mustPrepareMerge(source.Id, 1)
+	for storeID := range c.nodes {
+		c.waitMerged(storeID, source.Id, 1)
+	}
+	// The data of the source region is kept for the target region.
+	c.mustPutRaw(1, []byte("b"), []byte("v"))
+	for storeID := range c.nodes {
+		for _, key := range []string{"a", "b", "x"} {
+			c.waitRaw(storeID, []byte(key), []byte("v"))
+		}
+	}
+}
+
+func TestMergeRollback(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.shutdown()
+	source := c.mustSplit(1, []byte("m"))
+	c.mustTransferLeader(source.Id, 3)
+	c.mustTransferLeader(1, 1)
+
+	// Store 3 doesn't know the target region is split, so it proposes PrepareMerge with the stale target.
+	c.trans.setFilter(func(msg *rspb.RaftMessage) bool {
+		return msg.RegionId == 1 && (msg.ToPeer.StoreId == 3 || msg.FromPeer.StoreId == 3)
+	})
+	c.mustSplit(1, []byte("p"))
+	staleTarget := c.region(3, 1)
+	resp := c.call(3, &raft_cmdpb.RaftCmdRequest{
+		Header: c.newRequestHeader(3, source.Id),
+		AdminRequest: &raft_cmdpb.AdminRequest{
+			CmdType:      raft_cmdpb.AdminCmdType_PrepareMerge,
+			PrepareMerge: &raft_cmdpb.PrepareMergeRequest{Target: staleTarget},
+		},
+	})
+	require.Nil(t, resp.Header.Error)
+	// The writes are rejected in merging.
+	resp = c.call(3, &raft_cmdpb.RaftCmdRequest{
+		Header: c.newRequestHeader(3, source.Id),
+		Requests: []*raft_cmdpb.Request{{
+			CmdType: raft_cmdpb.CmdType_Put,
+			Put:     &raft_cmdpb.PutRequest{Cf: CFRaw, Key: []byte("a"), Value: make([]byte, 8)},
+		}},
+	})
+	require.NotNil(t, resp.Header.Error)
+
+	// The target region on store 3 catches up the split, the merge is rollbacked then.
+	c.trans.setFilter(nil)
+	for storeID := range c.nodes {
+		for i := 0; i < 500; i++ {
+			region := c.region(storeID, source.Id)
+			if region.RegionEpoch.Version == source.RegionEpoch.Version+2 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		region := c.region(storeID, source.Id)
+		require.Equal(t, source.RegionEpoch.Version+2, region.RegionEpoch.Version)
+		require.Equal(t, source.RegionEpoch.ConfVer+1, region.RegionEpoch.ConfVer)
+		require.Len(t, region.StartKey, 0)
+	}
+	c.mustPutRaw(source.Id, []byte("a"), []byte("v"))
+	for storeID := range c.nodes {
+		c.waitRaw(storeID, []byte("a"), []byte("v"))
+	}
+}
+
+func TestMergeRecoverAfterRestart(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.shutdown()
+	source := c.mustSplit(1, []byte("m"))
+	c.mustPutRaw(source.Id, []byte("a"), []byte("v"))
+
+	// The target region can't commit CommitMerge before the stores restart.
+	c.trans.setFilter(func(msg *rspb.RaftMessage) bool {
+		return msg.RegionId == 1
+	})
+	c.mustPrepareMerge(source.Id, 1)
+	time.Sleep(200 * time.Millisecond)
+	for storeID := range c.nodes {
+		require.NotNil(t, c.region(storeID, source.Id))
+	}
+	for storeID := range c.nodes {
+		c.stopNode(storeID)
+	}
+
+	// The source peers are loaded with the merge state and schedule CommitMerge again.
+	c.trans.setFilter(nil)
+	for storeID := range c.nodes {
+		c.startNode(storeID)
+	}
+	for storeID := range c.nodes {
+		c.waitMerged(storeID, source.Id, 1)
+	}
+	c.mustPutRaw(1, []byte("b"), []byte("v"))
+	for storeID := range c.nodes {
+		c.waitRaw(storeID, []byte("a"), []byte("v"))
+		c.waitRaw(storeID, []byte("b"), []byte("v"))
+	}
+}
@@ -35,6 +35,7 @@ import (
 	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
 	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
 	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/util/codec"
 )
 
 type storeMeta struct {
@@ -75,7 +76,15 @@ func (m *storeMeta) setRegion(region *metapb.Region, peer *Peer) {
 	peer.SetRegion(region)
 }
 
+// mergeLock synchronizes the source and target peers of a merge on the same store. The source peer
+// inserts it after handling PrepareMerge, the target peer waits on readyToMerge if CommitMerge
+// is applied before that.
 type mergeLock struct {
+	// version is the region epoch version of the source region after PrepareMerge.
+	version uint64
+	// readyToMerge is set by the target peer which is waiting for the source peer, it is nil if
+	// the source peer comes first.
+	readyToMerge *uint32
 }
 
 type GlobalContext struct {
@@ -95,6 +104,7 @@ type GlobalContext struct {
 	compactTaskSender     chan<- task
 	pdClient              pd.Client
 	peerEventObserver     PeerEventObserver
+	readIndexObserver     ReadIndexObserver
 	globalStats           *storeStats
 }
 
@@ -357,12 +367,13 @@ type workers struct {
 }
 
 type raftBatchSystem struct {
-	ctx       *GlobalContext
-	router    *router
-	workers   *workers
-	closeCh   chan struct{}
-	wg        *sync.WaitGroup
-	globalCfg *config.Config
+	ctx               *GlobalContext
+	router            *router
+	workers           *workers
+	closeCh           chan struct{}
+	wg                *sync.WaitGroup
+	globalCfg         *config.Config
+	readIndexObserver ReadIndexObserver
 }
 
 func (bs *raftBatchSystem) start(
@@ -410,6 +421,7 @@ func (bs *raftBatchSystem) start(
 		compactTaskSender:     bs.workers.compactWorker.sender,
 		pdClient:              pdClient,
 		peerEventObserver:     observer,
+		readIndexObserver:     bs.readIndexObserver,
 		globalStats:           new(storeStats),
 	}
 	regionPeers, err := bs.loadPeers()
@@ -447,9 +459,9 @@ func (bs *raftBatchSystem) startWorkers(peers []*peerFsm) {
 	workers.splitCheckWorker.start(newSplitCheckRunner(engines.kv.DB, router, cfg.SplitCheck))
 	workers.regionWorker.start(newRegionTaskHandler(bs.globalCfg, engines, ctx.snapMgr, cfg.SnapApplyBatchSize, cfg.CleanStalePeerDelay))
 	workers.raftLogGCWorker.start(&raftLogGCTaskHandler{})
-	workers.compactWorker.start(&compactTaskHandler{engine: engines.kv.DB})
+	workers.compactWorker.start(&compactTaskHandler{engine: engines.kv.DB, router: bs.router})
 	workers.pdWorker.start(newPDTaskHandler(ctx.store.Id, ctx.pdClient, bs.router))
-	workers.computeHashWorker.start(&computeHashTaskHandler{router: bs.router})
+	workers.computeHashWorker.start(&computeHashTaskHandler{lockStore: engines.kv.LockStore, router: bs.router})
 }
 
 func (bs *raftBatchSystem) shutDown() {
@@ -523,7 +535,12 @@ func (d *storeMsgHandler) checkMsg(msg *rspb.RaftMessage) (bool, error) {
 	region := localState.Region
 	regionEpoch := region.RegionEpoch
 	if localState.MergeState != nil {
-		// TODO: Merge
+		// The region is merged, let the stale peer of the source region know the merge target,
+		// so it can be destroyed once the target catches up.
+		log.S().Infof("merged peer receives a stale message. region_id:%d, from_region_epoch:%s, current_region_epoch:%s, msg_type:%s",
+			regionID, fromEpoch, regionEpoch, msgType)
+		notExist := findPeer(region, fromStoreID) == nil
+		handleStaleMsg(d.ctx.trans, msg, regionEpoch, !notExist, localState.MergeState.Target)
 		return true, nil
 	}
 	// The region in this peer is already destroyed
@@ -657,11 +674,63 @@ func destroyRegions(router *router, regionsToDestroy []uint64, toPeer *metapb.Pe
 }
 
 func (d *storeMsgHandler) onCompactionFinished(event *rocksdb.CompactedEvent) {
-	// TODO: not supported.
+	// If size declining is trivial, skip.
+	var totalBytesDeclined int
+	if event.TotalInputBytes > event.TotalOutputBytes {
+		totalBytesDeclined = event.TotalInputBytes - event.TotalOutputBytes
+	}
+	if uint64(totalBytesDeclined) < d.ctx.cfg.RegionSplitCheckDiff || totalBytesDeclined*10 < event.TotalInputBytes {
+		return
+	}
+	// RegionSplitCheckDiff / 16 is an experienced value.
+	d.ctx.storeMetaLock.RLock()
+	regionDeclinedBytes := calcRegionDeclinedBytes(event, d.ctx.storeMeta.regionRanges, d.ctx.cfg.RegionSplitCheckDiff/16)
+	d.ctx.storeMetaLock.RUnlock()
+	for _, pair := range regionDeclinedBytes {
+		_ = d.ctx.router.send(pair.regionID, NewPeerMsg(MsgTypeCompactionDeclineBytes, pair.regionID, pair.declinedBytes))
+	}
 }
 
 func (d *storeMsgHandler) onCompactCheckTick() {
-	// TODO: not supported.
+	d.ticker.scheduleStore(StoreTickCompactCheck)
+	if listener := d.ctx.engine.compactionListener; listener != nil {
+		for _, event := range listener.takeEvents() {
+			d.onCompactionFinished(event)
+		}
+	}
+	if len(d.ctx.compactTaskSender) > 0 {
+		log.S().Debugf("compact worker is busy, check space redundancy next time")
+		return
+	}
+	for _, regionID := range d.regionsNeedCompactCheck() {
+		_ = d.ctx.router.send(regionID, NewPeerMsg(MsgTypeCompactCheck, regionID, nil))
+	}
+}
+
+// regionsNeedCompactCheck returns the next RegionCompactCheckStep regions after the last checked key.
+// The check starts from the first region again after the last region is checked.
+func (d *storeMsgHandler) regionsNeedCompactCheck() []uint64 {
+	step := int(d.ctx.cfg.RegionCompactCheckStep)
+	startKey := d.lastCompactCheckKey
+	regionIDs := make([]uint64, 0, step)
+	d.ctx.storeMetaLock.RLock()
+	defer d.ctx.storeMetaLock.RUnlock()
+	it := d.ctx.storeMeta.regionRanges.NewIterator()
+	for it.Seek(startKey); it.Valid() && len(regionIDs) < step; it.Next() {
+		// The region ranges are keyed by the end keys, the last region with an empty end key is checked at last.
+		if len(it.Key()) == 0 || bytes.Equal(it.Key(), startKey) {
+			continue
+		}
+		regionIDs = append(regionIDs, regionIDFromBytes(it.Value()))
+		d.lastCompactCheckKey = safeCopy(it.Key())
+	}
+	if len(regionIDs) < step {
+		if val := d.ctx.storeMeta.regionRanges.Get(nil, nil); len(val) > 0 {
+			regionIDs = append(regionIDs, regionIDFromBytes(val))
+		}
+		d.lastCompactCheckKey = nil
+	}
+	return regionIDs
 }
 
 func (d *storeMsgHandler) storeHeartbeatPD() {
@@ -837,9 +906,60 @@ type regionIDDeclinedBytesPair struct {
 	declinedBytes uint64
 }
 
+// calcRegionDeclinedBytes splits the declined bytes of the compaction into the regions, the region ranges are keyed by
+// the end keys of the regions. The keys in the event are raw data keys.
 func calcRegionDeclinedBytes(event *rocksdb.CompactedEvent,
 	regionRanges *lockstore.MemStore, bytesThreshold uint64) []regionIDDeclinedBytesPair {
-	return nil // TODO: not supported.
+	startKey := codec.EncodeBytes(nil, event.StartKey)
+	endKey := codec.EncodeBytes(nil, event.EndKey)
+	// Calculate influenced regions.
+	var influencedRegions []regionIDDeclinedBytesPair
+	var endKeys [][]byte
+	covered := false
+	it := regionRanges.NewIterator()
+	it.Seek(startKey)
+	if it.Valid() && bytes.Equal(it.Key(), startKey) {
+		it.Next()
+	}
+	for ; it.Valid(); it.Next() {
+		influencedRegions = append(influencedRegions, regionIDDeclinedBytesPair{regionID: regionIDFromBytes(it.Value())})
+		endKeys = append(endKeys, safeCopy(it.Key()))
+		if bytes.Compare(it.Key(), endKey) >= 0 {
+			covered = true
+			break
+		}
+	}
+	if !covered {
+		// The last region has an empty end key.
+		if val := regionRanges.Get(nil, nil); len(val) > 0 {
+			influencedRegions = append(influencedRegions, regionIDDeclinedBytesPair{regionID: regionIDFromBytes(val)})
+			endKeys = append(endKeys, nil)
+		}
+	}
+	rangeStartKeys := make([][]byte, len(event.Ranges))
+	for i, r := range event.Ranges {
+		rangeStartKeys[i] = codec.EncodeBytes(nil, r.StartKey)
+	}
+	// Calculate declined bytes for each region, the end keys are in incremental order.
+	var regionDeclinedBytes []regionIDDeclinedBytesPair
+	var lastEndKey []byte
+	for i, region := range influencedRegions {
+		var oldSize, newSize uint64
+		for j, r := range event.Ranges {
+			key := rangeStartKeys[j]
+			if bytes.Compare(key, lastEndKey) >= 0 && (endKeys[i] == nil || bytes.Compare(key, endKeys[i]) < 0) {
+				oldSize += r.InputBytes
+				newSize += r.OutputBytes
+			}
+		}
+		lastEndKey = endKeys[i]
+		// Filter some trivial declines for better performance.
+		if oldSize > newSize && oldSize-newSize > bytesThreshold {
+			region.declinedBytes = oldSize - newSize
+			regionDeclinedBytes = append(regionDeclinedBytes, region)
+		}
+	}
+	return regionDeclinedBytes
 }
 
 func isRangeCovered(meta *storeMeta, start, end []byte) bool {
@@ -0,0 +1,68 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/ngaut/unistore/lockstore"
+	"github.com/ngaut/unistore/rocksdb"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalcRegionDeclinedBytes(t *testing.T) {
+	regionRanges := lockstore.NewMemStore(4096)
+	regionRanges.Put(codec.EncodeBytes(nil, []byte("b")), regionIDToBytes(1))
+	regionRanges.Put(codec.EncodeBytes(nil, []byte("d")), regionIDToBytes(2))
+	regionRanges.Put(nil, regionIDToBytes(3))
+
+	event := &rocksdb.CompactedEvent{
+		StartKey: []byte("a"),
+		EndKey:   []byte("e"),
+		Ranges: []rocksdb.CompactedRange{
+			{StartKey: []byte("a"), EndKey: []byte("b"), InputBytes: 100, OutputBytes: 0},
+			{StartKey: []byte("b"), EndKey: []byte("c"), InputBytes: 50, OutputBytes: 40},
+			{StartKey: []byte("d"), EndKey: []byte("e"), InputBytes: 200, OutputBytes: 0},
+		},
+	}
+	assert.Equal(t, []regionIDDeclinedBytesPair{
+		{regionID: 1, declinedBytes: 100},
+		{regionID: 3, declinedBytes: 200},
+	}, calcRegionDeclinedBytes(event, regionRanges, 20))
+	assert.Equal(t, []regionIDDeclinedBytesPair{
+		{regionID: 1, declinedBytes: 100},
+		{regionID: 2, declinedBytes: 10},
+		{regionID: 3, declinedBytes: 200},
+	}, calcRegionDeclinedBytes(event, regionRanges, 0))
+}
+
+func TestRegionsNeedCompactCheck(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.RegionCompactCheckStep = 2
+	meta := newStoreMeta()
+	meta.regionRanges.Put(codec.EncodeBytes(nil, []byte("b")), regionIDToBytes(1))
+	meta.regionRanges.Put(codec.EncodeBytes(nil, []byte("d")), regionIDToBytes(2))
+	meta.regionRanges.Put(codec.EncodeBytes(nil, []byte("f")), regionIDToBytes(3))
+	meta.regionRanges.Put(nil, regionIDToBytes(4))
+	d := &storeMsgHandler{storeFsm: &storeFsm{}, ctx: &StoreContext{GlobalContext: &GlobalContext{
+		cfg:           cfg,
+		storeMeta:     meta,
+		storeMetaLock: new(sync.RWMutex),
+	}}}
+	assert.Equal(t, []uint64{1, 2}, d.regionsNeedCompactCheck())
+	assert.Equal(t, []uint64{3, 4}, d.regionsNeedCompactCheck())
+	assert.Equal(t, []uint64{1, 2}, d.regionsNeedCompactCheck())
+}
@@ -17,6 +17,7 @@ import (
 	"bytes"
 	"encoding/binary"
 
+	"github.com/ngaut/unistore/tikv/mvcc"
 	"github.com/pingcap/badger/y"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/metapb"
@@ -160,6 +161,30 @@ func RawEndKey(region *metapb.Region) []byte {
 	return decoded
 }
 
+// rawDataKey decodes a region boundary key, emptyKey is returned if the key is empty.
+func rawDataKey(key, emptyKey []byte) []byte {
+	if len(key) == 0 {
+		return emptyKey
+	}
+	_, decoded, err := codec.DecodeBytes(key, nil)
+	y.Assert(err == nil)
+	return decoded
+}
+
+// keySpaceRanges returns the ranges of the raw and versioned keys in [startKey, endKey), the keys are encoded
+// region boundary keys and an empty endKey means no end. The ranges are in the internal key space, out of the
+// data range [RawStartKey, RawEndKey) of a region, so they are handled separately.
+func keySpaceRanges(startKey, endKey []byte) []keyRange {
+	start, end := rawDataKey(startKey, nil), rawDataKey(endKey, nil)
+	ranges := make([]keyRange, 0, 2)
+	for _, space := range []mvcc.KeySpace{mvcc.KeySpaceRaw, mvcc.KeySpaceVer} {
+		r := keyRange{}
+		r.startKey, r.endKey = space.EncodeRange(start, end)
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
 /// RaftLogIndex gets the log index from raft log key generated by `raft_log_key`.
 func RaftLogIndex(key []byte) (uint64, error) {
 	if len(key) != RegionRaftLogLen {
@@ -43,6 +43,7 @@ const (
 	MsgTypeStart                  MsgType = 14
 	MsgTypeApplyRes               MsgType = 15
 	MsgTypeNoop                   MsgType = 16
+	MsgTypeCompactCheck           MsgType = 17
 
 	MsgTypeStoreRaftMessage   MsgType = 101
 	MsgTypeStoreSnapshotStats MsgType = 102
@@ -63,6 +64,7 @@ const (
 	MsgTypeApplyLogsUpToDate MsgType = 305
 	MsgTypeApplyDestroy      MsgType = 306
 	MsgTypeApplySnapshot     MsgType = 307
+	MsgTypeApplyResume       MsgType = 308
 
 	msgDefaultChanSize = 1024
 )
@@ -84,6 +86,7 @@ func NewMsg(tp MsgType, data interface{}) Msg {
 type Callback struct {
 	resp           *raft_cmdpb.RaftCmdResponse
 	wg             sync.WaitGroup
+	done           chan struct{}
 	raftBeginTime  time.Time
 	raftDoneTime   time.Time
 	applyBeginTime time.Time
@@ -93,12 +96,28 @@ type Callback struct {
 func (cb *Callback) Done(resp *raft_cmdpb.RaftCmdResponse) {
 	if cb != nil {
 		cb.resp = resp
+		if cb.done != nil {
+			close(cb.done)
+		}
 		cb.wg.Done()
 	}
 }
 
+// WaitResp waits for the response until the timeout, false is returned if it times out and the response
+// must not be read.
+func (cb *Callback) WaitResp(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-cb.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
 func NewCallback() *Callback {
-	cb := &Callback{}
+	cb := &Callback{done: make(chan struct{})}
 	cb.wg.Add(1)
 	return cb
 }
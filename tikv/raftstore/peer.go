@@ -26,6 +26,7 @@ import (
 
 	"github.com/ngaut/unistore/tikv/mvcc"
 	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/pdpb"
 	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
@@ -56,6 +57,10 @@ type ReadIndexRequest struct {
 	id             uint64
 	cmds           []*ReqCbPair
 	renewLeaseTime *time.Time
+	// readIndex is set when the read state is ready.
+	readIndex uint64
+	// locked is the lock blocking the replica read, it is returned by the leader.
+	locked *kvrpcpb.LockInfo
 }
 
 func NewReadIndexRequest(id uint64, cmds []*ReqCbPair, renewLeaseTime *time.Time) *ReadIndexRequest {
@@ -76,6 +81,39 @@ type ReadIndexQueue struct {
 	idAllocator uint64
 	reads       []*ReadIndexRequest
 	readyCnt    int
+	// term is the term when the last read is added.
+	term uint64
+}
+
+func (q *ReadIndexQueue) push(read *ReadIndexRequest, term uint64) {
+	q.reads = append(q.reads, read)
+	q.term = term
+}
+
+// readyRead marks the read of the read state ready. The read states are returned in the order of the reads,
+// so the reads before it which are not ready have been dropped by raft, they are failed. nil is returned if
+// the read has been failed by a role or term change.
+func (q *ReadIndexQueue) readyRead(state raft.ReadState, term uint64) *ReadIndexRequest {
+	for i := q.readyCnt; i < len(q.reads); i++ {
+		read := q.reads[i]
+		if len(state.RequestCtx) < readIndexCtxIDLen || !bytes.Equal(state.RequestCtx[:readIndexCtxIDLen], read.binaryId()) {
+			continue
+		}
+		for _, dropped := range q.reads[q.readyCnt:i] {
+			for _, reqCbPair := range dropped.cmds {
+				NotifyStaleReq(term, reqCbPair.Cb)
+			}
+			dropped.cmds = nil
+		}
+		q.reads = append(q.reads[:q.readyCnt], q.reads[i:]...)
+		read.readIndex = state.Index
+		if ctx := unmarshalReadIndexCtx(state.RequestCtx); ctx != nil {
+			read.locked = ctx.locked
+		}
+		q.readyCnt++
+		return read
+	}
+	return nil
 }
 
 func (q *ReadIndexQueue) PopFront() *ReadIndexRequest {
@@ -721,6 +759,8 @@ func (p *Peer) CheckStaleState(cfg *Config) StaleState {
 func (p *Peer) OnRoleChanged(observer PeerEventObserver, ready *raft.Ready) {
 	ss := ready.SoftState
 	if ss != nil {
+		p.leaderChecker.leaderID.Store(ss.Lead)
+		p.leaderChecker.leaderTerm.Store(p.Term())
 		if ss.RaftState == raft.StateLeader {
 			// The local read can only be performed after a new leader has applied
 			// the first empty entry on its term. After that the lease expiring time
@@ -1079,36 +1119,23 @@ func (p *Peer) HandleRaftReadyApply(kv *mvcc.DBBundle, applyMsgs *applyMsgs, rea
 
 func (p *Peer) ApplyReads(kv *mvcc.DBBundle, ready *raft.Ready) {
 	var proposeTime *time.Time
-	if p.readyToHandleRead() {
-		for _, state := range ready.ReadStates {
-			read := p.pendingReads.PopFront()
-			if read == nil {
-				panic("read should exist")
-			}
-			if bytes.Compare(state.RequestCtx, read.binaryId()) != 0 {
-				panic(fmt.Sprintf("request ctx: %v not equal to read id: %v", state.RequestCtx, read.binaryId()))
-			}
-			for _, reqCb := range read.cmds {
-				resp := p.handleRead(kv, reqCb.Req, true)
-				reqCb.Cb.Done(resp)
-			}
-			read.cmds = nil
-			proposeTime = read.renewLeaseTime
-		}
-	} else {
-		for _, state := range ready.ReadStates {
-			read := p.pendingReads.reads[p.pendingReads.readyCnt]
-			if bytes.Compare(state.RequestCtx, read.binaryId()) != 0 {
-				panic(fmt.Sprintf("request ctx: %v not equal to read id: %v", state.RequestCtx, read.binaryId()))
-			}
-			p.pendingReads.readyCnt += 1
+	for _, state := range ready.ReadStates {
+		if read := p.pendingReads.readyRead(state, p.Term()); read != nil && read.renewLeaseTime != nil {
 			proposeTime = read.renewLeaseTime
 		}
 	}
+	if !p.IsLeader() {
+		// A follower gets the read index from the leader, the reads can be handled after
+		// the applied index catches up.
+		p.handleReplicaReads(kv)
+		proposeTime = nil
+	} else if p.readyToHandleRead() {
+		p.handleReadyReads(kv)
+	}
 
 	// Note that only after handle read_states can we identify what requests are
 	// actually stale.
-	if ready.SoftState != nil {
+	if ready.SoftState != nil || p.pendingReads.term != p.Term() {
 		// all uncommitted reads will be dropped silently in raft.
 		p.pendingReads.ClearUncommitted(p.Term())
 	}
@@ -1123,6 +1150,42 @@ func (p *Peer) ApplyReads(kv *mvcc.DBBundle, ready *raft.Ready) {
 	}
 }
 
+// handleReadyReads responds all the ready reads of the leader.
+func (p *Peer) handleReadyReads(kv *mvcc.DBBundle) {
+	for ; p.pendingReads.readyCnt > 0; p.pendingReads.readyCnt-- {
+		read := p.pendingReads.PopFront()
+		for _, reqCb := range read.cmds {
+			resp := p.handleRead(kv, reqCb.Req, true, read.readIndex)
+			reqCb.Cb.Done(resp)
+		}
+		read.cmds = nil
+	}
+}
+
+// readyToHandleReplicaRead returns true if the data of the read index has been applied.
+func (p *Peer) readyToHandleReplicaRead(readIndex uint64) bool {
+	// Wait until the applied index reaches the read index, see more in readyToHandleRead().
+	return p.Store().AppliedIndex() >= readIndex && !p.isSplitting() && !p.isMerging()
+}
+
+// handleReplicaReads responds the ready reads in order whose read index has been applied.
+func (p *Peer) handleReplicaReads(kv *mvcc.DBBundle) {
+	for p.pendingReads.readyCnt > 0 {
+		read := p.pendingReads.reads[0]
+		if !p.readyToHandleReplicaRead(read.readIndex) {
+			return
+		}
+		p.pendingReads.PopFront()
+		p.pendingReads.readyCnt -= 1
+		for _, reqCb := range read.cmds {
+			resp := p.handleRead(kv, reqCb.Req, true, read.readIndex)
+			bindReadIndexLocked(resp, read.locked)
+			reqCb.Cb.Done(resp)
+		}
+		read.cmds = nil
+	}
+}
+
 func (p *Peer) PostApply(kv *mvcc.DBBundle, applyState applyState, appliedIndexTerm uint64, merged bool, applyMetrics applyMetrics) bool {
 	hasReady := false
 	if p.IsApplyingSnapshot() {
@@ -1151,19 +1214,10 @@ func (p *Peer) PostApply(kv *mvcc.DBBundle, applyState applyState, appliedIndexT
 		hasReady = true
 	}
 
-	if p.pendingReads.readyCnt > 0 && p.readyToHandleRead() {
-		for i := 0; i < p.pendingReads.readyCnt; i++ {
-			read := p.pendingReads.PopFront()
-			if read == nil {
-				panic("read is nil, this should not happen")
-			}
-			for _, reqCb := range read.cmds {
-				resp := p.handleRead(kv, reqCb.Req, true)
-				reqCb.Cb.Done(resp)
-			}
-			read.cmds = nil
-		}
-		p.pendingReads.readyCnt = 0
+	if p.pendingReads.readyCnt > 0 && !p.IsLeader() {
+		p.handleReplicaReads(kv)
+	} else if p.pendingReads.readyCnt > 0 && p.readyToHandleRead() {
+		p.handleReadyReads(kv)
 	}
 
 	// Only leaders need to update applied_index_term.
@@ -1372,7 +1426,7 @@ func (p *Peer) readyToTransferLeader(cfg *Config, peer *metapb.Peer) bool {
 }
 
 func (p *Peer) readLocal(kv *mvcc.DBBundle, req *raft_cmdpb.RaftCmdRequest, cb *Callback) {
-	resp := p.handleRead(kv, req, false)
+	resp := p.handleRead(kv, req, false, p.Store().AppliedIndex())
 	cb.Done(resp)
 }
 
@@ -1400,13 +1454,17 @@ func (p *Peer) readIndex(cfg *Config, req *raft_cmdpb.RaftCmdRequest, errResp *r
 		cb.Done(errResp)
 		return false
 	}
+	if !p.IsLeader() {
+		return p.replicaReadIndex(req, cb)
+	}
 
 	now := time.Now()
 	renewLeaseTime := &now
 	readsLen := len(p.pendingReads.reads)
 	if readsLen > 0 {
 		read := p.pendingReads.reads[readsLen-1]
-		if read.renewLeaseTime.Add(cfg.RaftStoreMaxLeaderLease).After(*renewLeaseTime) {
+		// The replica reads of the previous term have no renew lease time.
+		if read.renewLeaseTime != nil && read.renewLeaseTime.Add(cfg.RaftStoreMaxLeaderLease).After(*renewLeaseTime) {
 			read.cmds = append(read.cmds, &ReqCbPair{Req: req, Cb: cb})
 			return false
 		}
@@ -1430,7 +1488,7 @@ func (p *Peer) readIndex(cfg *Config, req *raft_cmdpb.RaftCmdRequest, errResp *r
 	}
 
 	cmds := []*ReqCbPair{&ReqCbPair{req, cb}}
-	p.pendingReads.reads = append(p.pendingReads.reads, NewReadIndexRequest(id, cmds, renewLeaseTime))
+	p.pendingReads.push(NewReadIndexRequest(id, cmds, renewLeaseTime), p.Term())
 
 	// TimeoutNow has been sent out, so we need to propose explicitly to
 	// update leader lease.
@@ -1449,6 +1507,24 @@ func (p *Peer) readIndex(cfg *Config, req *raft_cmdpb.RaftCmdRequest, errResp *r
 	return true
 }
 
+// replicaReadIndex sends the read index request to the leader, the read is handled after the
+// read index is returned and applied. The start ts and the key ranges of the read are sent in
+// the context, so the leader checks them with its ReadIndexObserver.
+func (p *Peer) replicaReadIndex(req *raft_cmdpb.RaftCmdRequest, cb *Callback) bool {
+	if p.LeaderId() == raft.None {
+		// Raft drops the read index request silently if there is no leader.
+		NotifyStaleReq(p.Term(), cb)
+		return false
+	}
+	id := p.pendingReads.NextId()
+	ctx := &readIndexCtx{id: id, req: getReadIndexRequest(req)}
+	p.RaftGroup.ReadIndex(ctx.marshal())
+
+	cmds := []*ReqCbPair{{req, cb}}
+	p.pendingReads.push(NewReadIndexRequest(id, cmds, nil), p.Term())
+	return true
+}
+
 func (p *Peer) GetMinProgress() uint64 {
 	var minMatch uint64 = math.MaxUint64
 	hasProgress := false
@@ -1644,9 +1720,9 @@ func (p *Peer) ProposeConfChange(cfg *Config, req *raft_cmdpb.RaftCmdRequest) (u
 	return proposeIndex, nil
 }
 
-func (p *Peer) handleRead(kv *mvcc.DBBundle, req *raft_cmdpb.RaftCmdRequest, checkEpoch bool) *raft_cmdpb.RaftCmdResponse {
+func (p *Peer) handleRead(kv *mvcc.DBBundle, req *raft_cmdpb.RaftCmdRequest, checkEpoch bool, readIndex uint64) *raft_cmdpb.RaftCmdResponse {
 	readExecutor := NewReadExecutor(checkEpoch)
-	resp := readExecutor.Execute(req, p.Region())
+	resp := readExecutor.Execute(req, p.Region(), readIndex)
 	BindRespTerm(resp, p.Term())
 	return resp
 }
@@ -1710,7 +1786,7 @@ func Inspect(i RequestInspector, req *raft_cmdpb.RaftCmdRequest) (RequestPolicy,
 	hasRead, hasWrite := false, false
 	for _, r := range req.Requests {
 		switch r.CmdType {
-		case raft_cmdpb.CmdType_Get, raft_cmdpb.CmdType_Snap:
+		case raft_cmdpb.CmdType_Get, raft_cmdpb.CmdType_Snap, raft_cmdpb.CmdType_ReadIndex:
 			hasRead = true
 		case raft_cmdpb.CmdType_Delete, raft_cmdpb.CmdType_Put, raft_cmdpb.CmdType_DeleteRange,
 			raft_cmdpb.CmdType_IngestSST:
@@ -1728,7 +1804,8 @@ func Inspect(i RequestInspector, req *raft_cmdpb.RaftCmdRequest) (RequestPolicy,
 		return RequestPolicy_ProposeNormal, nil
 	}
 
-	if req.Header != nil && req.Header.ReadQuorum {
+	// Replica reads must get the read index from the leader.
+	if req.Header != nil && (req.Header.ReadQuorum || req.Header.ReplicaRead) {
 		return RequestPolicy_ReadIndex, nil
 	}
 
@@ -1760,7 +1837,7 @@ func NewReadExecutor(checkEpoch bool) *ReadExecutor {
 	}
 }
 
-func (r *ReadExecutor) Execute(msg *raft_cmdpb.RaftCmdRequest, region *metapb.Region) *raft_cmdpb.RaftCmdResponse {
+func (r *ReadExecutor) Execute(msg *raft_cmdpb.RaftCmdRequest, region *metapb.Region, readIndex uint64) *raft_cmdpb.RaftCmdResponse {
 	if r.checkEpoch {
 		if err := CheckRegionEpoch(msg, region, true); err != nil {
 			log.S().Debugf("[region %v] epoch not match, err: %v", region.Id, err)
@@ -1774,6 +1851,10 @@ func (r *ReadExecutor) Execute(msg *raft_cmdpb.RaftCmdRequest, region *metapb.Re
 		case raft_cmdpb.CmdType_Snap:
 			resp = new(raft_cmdpb.Response)
 			resp.CmdType = req.CmdType
+		case raft_cmdpb.CmdType_ReadIndex:
+			resp = new(raft_cmdpb.Response)
+			resp.CmdType = req.CmdType
+			resp.ReadIndex = &raft_cmdpb.ReadIndexResponse{ReadIndex: readIndex}
 		default:
 			panic("unreachable")
 		}
@@ -682,264 +682,33 @@ func (ps *PeerStorage) clearExtraData(newRegion *metapb.Region) {
 	newStartKey, newEndKey := RawStartKey(newRegion), RawEndKey(newRegion)
 	regionId := newRegion.Id
 	if bytes.Compare(oldStartKey, newStartKey) < 0 {
-		ps.regionSched <- task{
-			tp: taskTypeRegionDestroy,
-			data: &regionTask{
-				regionId: regionId,
-				startKey: oldStartKey,
-				endKey:   newStartKey,
-			},
-		}
+		ps.scheduleDestroy(regionId, oldStartKey, newStartKey)
 	}
 	if bytes.Compare(newEndKey, oldEndKey) < 0 {
-		ps.regionSched <- task{
-			tp: taskTypeRegionDestroy,
-			data: &regionTask{
-				regionId: regionId,
-				startKey: newEndKey,
-				endKey:   oldEndKey,
-			},
-		}
-	}
-}
-
-func getSyncLogFromEntry(entry eraftpb.Entry) bool {
-	if entry.SyncLog {
-		return true
-	}
-	if len(entry.Context) > 0 {
-		return entryCtx(entry.Context[0]).IsSyncLog()
-	}
-	return false
-}
-
-func fetchEntriesTo(engine *badger.DB, regionID, low, high, maxSize uint64, buf []eraftpb.Entry) ([]eraftpb.Entry, uint64, error) {
-	var totalSize uint64
-	nextIndex := low
-	exceededMaxSize := false
-	txn := engine.NewTransaction(false)
-	defer txn.Discard()
-	if high-low <= raftLogMultiGetCnt {
-		// If election happens in inactive regions, they will just try
-		// to fetch one empty log.
-		for i := low; i < high; i++ {
-			key := RaftLogKey(regionID, i)
-			item, err := txn.Get(key)
-			if err == badger.ErrKeyNotFound {
-				return nil, 0, raft.ErrUnavailable
-			} else if err != nil {
-				return nil, 0, err
-			}
-			val, err := item.Value()
-			if err != nil {
-				return nil, 0, err
-			}
-			var entry eraftpb.Entry
-			err = entry.Unmarshal(val)
-			if err != nil {
-				return nil, 0, err
-			}
-			y.Assert(entry.Index == i)
-			totalSize += uint64(len(val))
-
-			if len(buf) == 0 || totalSize <= maxSize {
-				buf = append(buf, entry)
-			}
-			if totalSize > maxSize {
-				break
-			}
-		}
-		return buf, totalSize, nil
-	}
-	startKey := RaftLogKey(regionID, low)
-	endKey := RaftLogKey(regionID, high)
-	iter := dbreader.NewIterator(txn, false, startKey, endKey)
-	defer iter.Close()
-	for iter.Seek(startKey); iter.Valid(); iter.Next() {
-		item := iter.Item()
-		if bytes.Compare(item.Key(), endKey) >= 0 {
-			break
-		}
-		val, err := item.Value()
-		if err != nil {
-			return nil, 0, err
-		}
-		var entry eraftpb.Entry
-		err = entry.Unmarshal(val)
-		if err != nil {
-			return nil, 0, err
-		}
-		// May meet gap or has been compacted.
-		if entry.Index != nextIndex {
-			break
-		}
-		nextIndex++
-		totalSize += uint64(len(val))
-		exceededMaxSize = totalSize > maxSize
-		if !exceededMaxSize || len(buf) == 0 {
-			buf = append(buf, entry)
-		}
-		if exceededMaxSize {
-			break
-		}
-	}
-	// If we get the correct number of entries, returns,
-	// or the total size almost exceeds max_size, returns.
-	if len(buf) == int(high-low) || exceededMaxSize {
-		return buf, totalSize, nil
-	}
-	// Here means we don't fetch enough entries.
-	return nil, 0, raft.ErrUnavailable
-}
-
-func ClearMeta(engines *Engines, kvWB, raftWB *WriteBatch, regionID uint64, lastIndex uint64) error {
-	start := time.Now()
-	kvWB.Delete(y.KeyWithTs(RegionStateKey(regionID), KvTS))
-	kvWB.Delete(y.KeyWithTs(ApplyStateKey(regionID), KvTS))
-
-	firstIndex := lastIndex + 1
-	beginLogKey := RaftLogKey(regionID, 0)
-	endLogKey := RaftLogKey(regionID, firstIndex)
-	err := engines.raft.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-		it.Seek(beginLogKey)
-		if it.Valid() && bytes.Compare(it.Item().Key(), endLogKey) < 0 {
-			logIdx, err1 := RaftLogIndex(it.Item().Key())
-			if err1 != nil {
-				return err1
-			}
-			firstIndex = logIdx
-		}
-		return nil
-	})
-	if err != nil {
-		return err
-	}
-	for i := firstIndex; i <= lastIndex; i++ {
-		raftWB.Delete(y.KeyWithTs(RaftLogKey(regionID, i), RaftTS))
-	}
-	raftWB.Delete(y.KeyWithTs(RaftStateKey(regionID), RaftTS))
-	log.S().Infof(
-		"[region %d] clear peer 1 meta key 1 apply key 1 raft key and %d raft logs, takes %v",
-		regionID,
-		lastIndex+1-firstIndex,
-		time.Since(start),
-	)
-	return nil
-}
-
-func WritePeerState(kvWB *WriteBatch, region *metapb.Region, state rspb.PeerState, mergeState *rspb.MergeState) {
-	regionID := region.Id
-	regionState := new(rspb.RegionLocalState)
-	regionState.State = state
-	regionState.Region = region
-	if mergeState != nil {
-		regionState.MergeState = mergeState
-	}
-	data, _ := regionState.Marshal()
-	kvWB.Set(y.KeyWithTs(RegionStateKey(regionID), KvTS), data)
-}
-
-// Apply the peer with given snapshot.
-func (ps *PeerStorage) ApplySnapshot(ctx *InvokeContext, snap *eraftpb.Snapshot, kvWB *WriteBatch, raftWB *WriteBatch) error {
-	log.S().Infof("%v begin to apply snapshot", ps.Tag)
-
-	snapData := new(rspb.RaftSnapshotData)
-	if err := snapData.Unmarshal(snap.Data); err != nil {
-		return err
-	}
-
-	if snapData.Region.Id != ps.region.Id {
-		return fmt.Errorf("mismatch region id %v != %v", snapData.Region.Id, ps.region.Id)
-	}
-
-	if ps.isInitialized() {
-		// we can only delete the old data when the peer is initialized.
-		if err := ps.clearMeta(kvWB, raftWB); err != nil {
-			return err
-		}
-	}
-
-	WritePeerState(kvWB, snapData.Region, rspb.PeerState_Applying, nil)
-
-	lastIdx := snap.Metadata.Index
-
-	ctx.RaftState.lastIndex = lastIdx
-	ctx.lastTerm = snap.Metadata.Term
-	ctx.ApplyState.appliedIndex = lastIdx
-
-	// The snapshot only contains log which index > applied index, so
-	// here the truncate state's (index, term) is in snapshot metadata.
-	ctx.ApplyState.truncatedIndex = lastIdx
-	ctx.ApplyState.truncatedTerm = snap.Metadata.Term
-
-	log.S().Debugf("%v apply snapshot for region %v with state %v ok", ps.Tag, snapData.Region, ctx.ApplyState)
-
-	ctx.SnapRegion = snapData.Region
-	return nil
-}
-
-/// Save memory states to disk.
-///
-/// This function only write data to `ready_ctx`'s `WriteBatch`. It's caller's duty to write
-/// it explicitly to disk. If it's flushed to disk successfully, `post_ready` should be called
-/// to update the memory states properly.
-/// Do not modify ready in this function, this is a requirement to advance the ready object properly later.
-func (ps *PeerStorage) SaveReadyState(kvWB, raftWB *WriteBatch, ready *raft.Ready) (*InvokeContext, error) {
-	ctx := NewInvokeContext(ps)
-	var snapshotIdx uint64 = 0
-	if !raft.IsEmptySnap(&ready.Snapshot) {
-		if err := ps.ApplySnapshot(ctx, &ready.Snapshot, kvWB, raftWB); err != nil {
-			return nil, err
-		}
-		snapshotIdx = ctx.RaftState.lastIndex
+		ps.scheduleDestroy(regionId, newEndKey, oldEndKey)
 	}
-
-	if len(ready.Entries) != 0 {
-		if err := ps.Append(ctx, ready.Entries, raftWB); err != nil {
-			return nil, err
+	// The raw and versioned keys are not bounded by the data range, an empty end key means no end.
+	if bytes.Compare(ps.region.StartKey, newRegion.StartKey) < 0 {
+		for _, r := range keySpaceRanges(ps.region.StartKey, newRegion.StartKey) {
+			ps.scheduleDestroy(regionId, r.startKey, r.endKey)
 		}
 	}
-
-	// Last index is 0 means the peer is created from raft message
-	// and has not applied snapshot yet, so skip persistent hard state.
-	if ctx.RaftState.lastIndex > 0 {
-		if !raft.IsEmptyHardState(ready.HardState) {
-			ctx.RaftState.commit = ready.HardState.Commit
-			ctx.RaftState.term = ready.HardState.Term
-			ctx.RaftState.vote = ready.HardState.Vote
+	if len(newRegion.EndKey) > 0 && (len(ps.region.EndKey) == 0 || bytes.Compare(newRegion.EndKey, ps.region.EndKey) < 0) {
+		for _, r := range keySpaceRanges(newRegion.EndKey, ps.region.EndKey) {
+			ps.scheduleDestroy(regionId, r.startKey, r.endKey)
 		}
 	}
-
-	if ctx.RaftState != ps.raftState {
-		ctx.saveRaftStateTo(raftWB)
-		if snapshotIdx > 0 {
-			// in case of restart happen when we just write region state to Applying,
-			// but not write raft_local_state to raft rocksdb in time.
-			// we write raft state to default rocksdb, with last index set to snap index,
-			// in case of recv raft log after snapshot.
-			ctx.saveSnapshotRaftStateTo(snapshotIdx, kvWB)
-		}
-	}
-
-	// only when apply snapshot
-	if ctx.ApplyState != ps.applyState {
-		ctx.saveApplyStateTo(kvWB)
-	}
-
-	return ctx, nil
 }
 
-func PeerEqual(l, r *metapb.Peer) bool {
-	return l.Id == r.Id && l.StoreId == r.StoreId && l.Role == r.Role
-}
-
-func RegionEqual(l, r *metapb.Region) bool {
-	if l == nil || r == nil {
-		return false
+func (ps *PeerStorage) scheduleDestroy(regionId uint64, startKey, endKey []byte) {
+	ps.regionSched <- task{
+		tp: taskTypeRegionDestroy,
+		data: &regionTask{
+			regionId: regionId,
+			startKey: startKey,
+			endKey:   endKey,
+		},
 	}
-	return l.Id == r.Id && l.RegionEpoch.Version == r.RegionEpoch.Version && l.RegionEpoch.ConfVer == r.RegionEpoch.ConfVer
 }
 
 // Update the memory state after ready changes are flushed to disk successfully.
@@ -987,8 +756,12 @@ func (ps *PeerStorage) SetRegion(region *metapb.Region) {
 	ps.region = region
 }
 
+// ClearData schedules the tasks to delete the data of the region, including the raw and versioned keys.
 func (ps *PeerStorage) ClearData() error {
-	// Todo: currently it is a place holder
+	ps.scheduleDestroy(ps.region.Id, RawStartKey(ps.region), RawEndKey(ps.region))
+	for _, r := range keySpaceRanges(ps.region.StartKey, ps.region.EndKey) {
+		ps.scheduleDestroy(ps.region.Id, r.startKey, r.endKey)
+	}
 	return nil
 }
 
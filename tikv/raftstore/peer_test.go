@@ -15,10 +15,15 @@ package raftstore
 
 import (
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/ngaut/unistore/tikv/raftstore/raftlog"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
 	"github.com/stretchr/testify/assert"
+	"github.com/zhangjinpeng1987/raft"
 )
 
 func TestGetSyncLogFromRequest(t *testing.T) {
@@ -193,6 +198,19 @@ func TestRequestInspector(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, inspectPolicy, RequestPolicy_ReadIndex)
 
+	// Replica read
+	for _, op := range []raft_cmdpb.CmdType{raft_cmdpb.CmdType_Snap, raft_cmdpb.CmdType_ReadIndex} {
+		request := new(raft_cmdpb.Request)
+		request.CmdType = op
+		req = new(raft_cmdpb.RaftCmdRequest)
+		req.Requests = []*raft_cmdpb.Request{request}
+		req.Header = new(raft_cmdpb.RaftRequestHeader)
+		req.Header.ReplicaRead = true
+		inspectPolicy, err = inspector.inspect(req)
+		assert.Nil(t, err)
+		assert.Equal(t, inspectPolicy, RequestPolicy_ReadIndex)
+	}
+
 	// Err(_)
 	var errTbl []*raft_cmdpb.RaftCmdRequest
 	for _, op := range []raft_cmdpb.CmdType{raft_cmdpb.CmdType_Prewrite, raft_cmdpb.CmdType_Invalid} {
@@ -218,3 +236,121 @@ func TestRequestInspector(t *testing.T) {
 		assert.NotNil(t, err)
 	}
 }
+
+func TestLeaderCheckerReadLocal(t *testing.T) {
+	region := genTestRegion(1, 1, 1)
+	checker := &leaderChecker{peerID: 1, region: unsafe.Pointer(region)}
+	checker.term.Store(5)
+	checker.appliedIndexTerm.Store(5)
+	lease := NewLease(time.Second)
+	lease.Renew(time.Now())
+	checker.leaderLease = unsafe.Pointer(lease.MaybeNewRemoteLease(5))
+
+	req := &raft_cmdpb.RaftCmdRequest{
+		Header: &raft_cmdpb.RaftRequestHeader{
+			RegionId:    1,
+			Peer:        region.Peers[0],
+			RegionEpoch: region.RegionEpoch,
+			Term:        5,
+		},
+		Requests: []*raft_cmdpb.Request{{CmdType: raft_cmdpb.CmdType_Snap}},
+	}
+	assert.True(t, isLocalReadRequest(req))
+	resp, ok := checker.readLocal(req, time.Now())
+	assert.True(t, ok)
+	assert.Nil(t, resp.Header.Error)
+	assert.Equal(t, uint64(5), resp.Header.CurrentTerm)
+
+	// The reads after the lease are handled by the peer.
+	_, ok = checker.readLocal(req, time.Now().Add(2*time.Second))
+	assert.False(t, ok)
+
+	// The reads of a stale epoch are handled by the peer.
+	req.Header.RegionEpoch = &metapb.RegionEpoch{Version: 0, ConfVer: 1}
+	_, ok = checker.readLocal(req, time.Now())
+	assert.False(t, ok)
+	req.Header.RegionEpoch = region.RegionEpoch
+
+	// The leader hasn't applied an entry of its term.
+	checker.appliedIndexTerm.Store(4)
+	_, ok = checker.readLocal(req, time.Now())
+	assert.False(t, ok)
+	checker.appliedIndexTerm.Store(5)
+
+	checker.invalid.Store(true)
+	_, ok = checker.readLocal(req, time.Now())
+	assert.False(t, ok)
+
+	req.Header.ReadQuorum = true
+	assert.False(t, isLocalReadRequest(req))
+}
+
+func TestReadIndexQueueReadyRead(t *testing.T) {
+	q := new(ReadIndexQueue)
+	cbs := make([]*Callback, 3)
+	for i := range cbs {
+		cbs[i] = NewCallback()
+		q.push(NewReadIndexRequest(q.NextId(), []*ReqCbPair{{Cb: cbs[i]}}, nil), 3)
+	}
+	// An unknown read state is ignored.
+	assert.Nil(t, q.readyRead(raft.ReadState{Index: 10, RequestCtx: []byte("unknown")}, 3))
+	assert.Equal(t, 0, q.readyCnt)
+
+	// The read states skip the second read, it is dropped by raft.
+	read := q.readyRead(raft.ReadState{Index: 10, RequestCtx: q.reads[0].binaryId()}, 3)
+	assert.Equal(t, uint64(10), read.readIndex)
+	read = q.readyRead(raft.ReadState{Index: 11, RequestCtx: q.reads[2].binaryId()}, 3)
+	assert.Equal(t, uint64(11), read.readIndex)
+	assert.Equal(t, 2, q.readyCnt)
+	assert.Len(t, q.reads, 2)
+	assert.True(t, cbs[1].WaitResp(time.Second))
+	assert.NotNil(t, cbs[1].resp.Header.Error.StaleCommand)
+	assert.False(t, cbs[0].WaitResp(0))
+
+	// The reads are failed after all of them are ready or cleared.
+	assert.Nil(t, q.readyRead(raft.ReadState{Index: 12, RequestCtx: read.binaryId()}, 3))
+	cb := NewCallback()
+	q.push(NewReadIndexRequest(q.NextId(), []*ReqCbPair{{Cb: cb}}, nil), 4)
+	q.ClearUncommitted(4)
+	assert.Len(t, q.reads, 2)
+	assert.True(t, cb.WaitResp(time.Second))
+	assert.NotNil(t, cb.resp.Header.Error.StaleCommand)
+}
+
+func TestIsLeaderReadsLocally(t *testing.T) {
+	region := genTestRegion(1, 1, 1)
+	peer := &Peer{}
+	checker := &peer.leaderChecker
+	checker.peerID = 1
+	checker.region = unsafe.Pointer(region)
+	checker.term.Store(5)
+	checker.appliedIndexTerm.Store(5)
+	lease := NewLease(time.Second)
+	lease.Renew(time.Now())
+	checker.leaderLease = unsafe.Pointer(lease.MaybeNewRemoteLease(5))
+
+	// No peer FSM is running, the commands sent to the peer stay in the channel.
+	router := newRouter(nil, nil)
+	router.peers.Store(region.Id, &peerState{peer: &peerFsm{peer: peer}})
+	raftRouter := &RaftstoreRouter{router: router, localReader: newLocalReader(router)}
+	ctx := &kvrpcpb.Context{RegionId: 1, Peer: region.Peers[0], RegionEpoch: region.RegionEpoch, Term: 5}
+	assert.Nil(t, checker.IsLeader(ctx, raftRouter))
+	assert.Equal(t, 0, len(router.peerSender))
+
+	// The reads after the lease are sent to the peer.
+	checker.leaderLease = unsafe.Pointer(NewLease(time.Second).MaybeNewRemoteLease(5))
+	req := &raft_cmdpb.RaftCmdRequest{
+		Header: &raft_cmdpb.RaftRequestHeader{
+			RegionId:    1,
+			Peer:        region.Peers[0],
+			RegionEpoch: region.RegionEpoch,
+			Term:        5,
+		},
+		Requests: []*raft_cmdpb.Request{{CmdType: raft_cmdpb.CmdType_Snap}},
+	}
+	assert.Nil(t, raftRouter.SendCommand(req, NewCallback()))
+	assert.Equal(t, 1, len(router.peerSender))
+
+	checker.invalid.Store(true)
+	assert.NotNil(t, checker.IsLeader(ctx, raftRouter).GetRegionNotFound())
+}
@@ -31,9 +31,13 @@ const (
 	TypeRolback             CustomRaftLogType = 3
 	TypePessimisticLock     CustomRaftLogType = 4
 	TypePessimisticRollback CustomRaftLogType = 5
+	TypeRawPut              CustomRaftLogType = 6
+	TypeRawDelete           CustomRaftLogType = 7
+	TypeVerPut              CustomRaftLogType = 8
+	TypeVerDelete           CustomRaftLogType = 9
 )
 
-// CustomRaftLog is the raft log format for unistore to store Prewrite/Commit/PessimisticLock.
+// CustomRaftLog is the raft log format for unistore to store Prewrite/Commit/PessimisticLock/RawKV.
 //  | flag(1) | type(1) | version(2) | header(40) | entries
 //
 // It reduces the cost of marshal/unmarshal and avoid DB lookup during apply.
@@ -176,6 +180,24 @@ func (rl *CustomRaftLog) IteratePessimisticRollback(itFunc func(key []byte)) {
 	}
 }
 
+func (rl *CustomRaftLog) IterateRawPut(itFunc func(key, val []byte, expireTS uint64)) {
+	rl.IterateCommit(itFunc)
+}
+
+func (rl *CustomRaftLog) IterateRawDelete(itFunc func(key []byte)) {
+	rl.IteratePessimisticRollback(itFunc)
+}
+
+func (rl *CustomRaftLog) IterateVerPut(itFunc func(key, val []byte, version uint64)) {
+	rl.IterateCommit(itFunc)
+}
+
+func (rl *CustomRaftLog) IterateVerDelete(itFunc func(key []byte, version uint64)) {
+	rl.IterateRollback(func(key []byte, version uint64, _ bool) {
+		itFunc(key, version)
+	})
+}
+
 type CustomBuilder struct {
 	data []byte
 	cnt  int
@@ -223,6 +245,22 @@ func (b *CustomBuilder) AppendPessimisticRollback(key []byte) {
 	b.cnt++
 }
 
+func (b *CustomBuilder) AppendRawPut(key, value []byte, expireTS uint64) {
+	b.AppendCommit(key, value, expireTS)
+}
+
+func (b *CustomBuilder) AppendRawDelete(key []byte) {
+	b.AppendPessimisticRollback(key)
+}
+
+func (b *CustomBuilder) AppendVerPut(key, value []byte, version uint64) {
+	b.AppendCommit(key, value, version)
+}
+
+func (b *CustomBuilder) AppendVerDelete(key []byte, version uint64) {
+	b.AppendRollback(key, version, false)
+}
+
 func (b *CustomBuilder) SetType(tp CustomRaftLogType) {
 	b.data[1] = byte(tp)
 }
@@ -14,13 +14,12 @@
 package raftstore
 
 import (
-	"fmt"
+	"encoding/binary"
+	"sync"
 	stdatomic "sync/atomic"
 	"time"
 	"unsafe"
 
-	"github.com/ngaut/unistore/tikv/raftstore/raftlog"
-	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/errorpb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
@@ -30,6 +29,8 @@ import (
 
 type LeaderChecker interface {
 	IsLeader(ctx *kvrpcpb.Context, router *RaftstoreRouter) *errorpb.Error
+	// AgreeLeader returns true if the local peer has the same leader, term and region epoch as the leader info.
+	AgreeLeader(info *kvrpcpb.LeaderInfo) bool
 }
 
 type leaderChecker struct {
@@ -39,18 +40,30 @@ type leaderChecker struct {
 	appliedIndexTerm atomic.Uint64
 	leaderLease      unsafe.Pointer // *RemoteLease
 	region           unsafe.Pointer // *metapb.Region
+	// leaderID and leaderTerm are the leader known by the local peer, it is updated on role change.
+	leaderID   atomic.Uint64
+	leaderTerm atomic.Uint64
 }
 
-func (c *leaderChecker) IsLeader(ctx *kvrpcpb.Context, router *RaftstoreRouter) *errorpb.Error {
-	snapTime := time.Now()
-	isExpired, err := c.isExpired(ctx, &snapTime)
-	if err != nil {
-		return RaftstoreErrToPbError(err)
+func (c *leaderChecker) AgreeLeader(info *kvrpcpb.LeaderInfo) bool {
+	if c.invalid.Load() {
+		return false
 	}
-	if !isExpired {
-		return nil
+	if c.leaderID.Load() != info.PeerId || c.leaderTerm.Load() != info.Term {
+		return false
 	}
+	region := (*metapb.Region)(stdatomic.LoadPointer(&c.region))
+	epoch := info.GetRegionEpoch()
+	return epoch.GetVersion() == region.GetRegionEpoch().GetVersion() &&
+		epoch.GetConfVer() == region.GetRegionEpoch().GetConfVer()
+}
 
+// IsLeader sends a snap command through the router, the local reader serves it on the caller goroutine if
+// the local peer is the leader with a valid lease, otherwise the peer checks its leadership by read index.
+func (c *leaderChecker) IsLeader(ctx *kvrpcpb.Context, router *RaftstoreRouter) *errorpb.Error {
+	if c.invalid.Load() {
+		return RaftstoreErrToPbError(&ErrRegionNotFound{RegionId: ctx.RegionId})
+	}
 	cb := NewCallback()
 	req := new(raft_cmdpb.Request)
 	req.CmdType = raft_cmdpb.CmdType_Snap
@@ -65,56 +78,199 @@ func (c *leaderChecker) IsLeader(ctx *kvrpcpb.Context, router *RaftstoreRouter)
 		Header:   header,
 		Requests: []*raft_cmdpb.Request{req},
 	}
-	msg := &MsgRaftCmd{
-		SendTime: time.Now(),
-		Request:  raftlog.NewRequest(cmd),
-		Callback: cb,
-	}
-	err = router.router.sendRaftCommand(msg)
+	err := router.SendCommand(cmd, cb)
 	if err != nil {
 		return RaftstoreErrToPbError(err)
 	}
 
-	cb.wg.Wait()
-
-	if cb.resp.Header.Error != nil {
+	if !cb.WaitResp(readIndexTimeout) {
+		return errReadIndexTimeout()
+	}
+	if cb.resp.Header.GetError() != nil {
 		return cb.resp.Header.Error
 	}
 	return nil
 }
 
-func (c *leaderChecker) isExpired(ctx *kvrpcpb.Context, snapTime *time.Time) (bool, error) {
+// readLocal executes the read request if the local peer is the leader with a valid lease, it returns false
+// if the request must be handled by the peer, the peer returns the error if the request doesn't match.
+func (c *leaderChecker) readLocal(req *raft_cmdpb.RaftCmdRequest, now time.Time) (*raft_cmdpb.RaftCmdResponse, bool) {
 	if c.invalid.Load() {
-		return false, &ErrRegionNotFound{RegionId: ctx.RegionId}
+		return nil, false
+	}
+	header := req.Header
+	if header.GetPeer().GetId() != c.peerID {
+		return nil, false
 	}
-
-	peerID := c.peerID
 	term := c.term.Load()
+	if header.Term != 0 && term > header.Term+1 {
+		return nil, false
+	}
 	region := (*metapb.Region)(stdatomic.LoadPointer(&c.region))
+	if CheckRegionEpoch(req, region, true) != nil {
+		return nil, false
+	}
+	if c.appliedIndexTerm.Load() != term {
+		return nil, false
+	}
 	lease := (*RemoteLease)(stdatomic.LoadPointer(&c.leaderLease))
-	appliedIndexTerm := c.appliedIndexTerm.Load()
+	if lease == nil || lease.Term() != term || lease.Inspect(&now) != LeaseState_Valid {
+		return nil, false
+	}
+	resp := NewReadExecutor(false).Execute(req, region, 0)
+	BindRespTerm(resp, term)
+	return resp, true
+}
+
+// localReader serves the reads under a valid leader lease on the caller goroutine without the raft worker.
+// The leader checkers of the peers are cached as the delegates of the regions, a delegate is removed once
+// its peer is destroyed.
+type localReader struct {
+	router    *router
+	delegates sync.Map // regionID -> *leaderChecker
+}
+
+func newLocalReader(router *router) *localReader {
+	return &localReader{router: router}
+}
 
-	if ctx.Peer.Id != peerID {
-		return false, errors.Errorf("mismatch peer id %d != %d", ctx.Peer.Id, peerID)
+func (r *localReader) getDelegate(regionID uint64) *leaderChecker {
+	if v, ok := r.delegates.Load(regionID); ok {
+		delegate := v.(*leaderChecker)
+		if !delegate.invalid.Load() {
+			return delegate
+		}
+		r.delegates.Delete(regionID)
+	}
+	ps := r.router.get(regionID)
+	if ps == nil {
+		return nil
+	}
+	delegate := &ps.peer.peer.leaderChecker
+	if delegate.invalid.Load() {
+		return nil
 	}
+	r.delegates.Store(regionID, delegate)
+	return delegate
+}
 
-	if !(ctx.Term == 0 || term <= ctx.Term+1) {
-		return false, &ErrStaleCommand{}
+// read returns true if the request is served locally.
+func (r *localReader) read(req *raft_cmdpb.RaftCmdRequest, cb *Callback) bool {
+	if !isLocalReadRequest(req) {
+		return false
+	}
+	delegate := r.getDelegate(req.Header.RegionId)
+	if delegate == nil {
+		return false
 	}
+	resp, ok := delegate.readLocal(req, time.Now())
+	if !ok {
+		return false
+	}
+	cb.Done(resp)
+	return true
+}
 
-	if ctx.RegionEpoch == nil {
-		return false, errors.New("missing epoch")
+// isLocalReadRequest returns true if the request only contains snap commands and doesn't require the read
+// index, the other reads are handled by the peer.
+func isLocalReadRequest(req *raft_cmdpb.RaftCmdRequest) bool {
+	header := req.Header
+	if header == nil || header.ReadQuorum || header.ReplicaRead || req.AdminRequest != nil || len(req.Requests) == 0 {
+		return false
 	}
-	// for get request, we don't care ConfVersion.
-	if ctx.RegionEpoch.Version != region.RegionEpoch.Version {
-		err := &ErrEpochNotMatch{}
-		err.Message = fmt.Sprintf("current epoch of region %d is %s, but you sent %s",
-			region.Id, region.RegionEpoch, ctx.RegionEpoch)
-		return false, err
+	for _, r := range req.Requests {
+		if r.CmdType != raft_cmdpb.CmdType_Snap {
+			return false
+		}
 	}
+	return true
+}
+
+// ReadIndexObserver is called by the leader for the read index requests with the start ts and the key ranges
+// of the reads. The transactions committed later must get commit ts greater than the start ts, and the read
+// must not miss the transactions being committed in the ranges, the lock of such a transaction is returned.
+type ReadIndexObserver interface {
+	OnReadIndex(req *raft_cmdpb.ReadIndexRequest) *kvrpcpb.LockInfo
+}
 
-	if appliedIndexTerm != term {
-		return true, nil
+const (
+	readIndexCtxIDLen = 8
+
+	readIndexCtxRequest byte = 1
+	readIndexCtxLocked  byte = 2
+)
+
+// readIndexCtx is the context of a read index passed to raft. It starts with the 8 bytes id of the read, a
+// replica read index appends its ReadIndexRequest. The leader replaces the request with the lock blocking
+// the read, the context is returned to the follower in the read state.
+type readIndexCtx struct {
+	id     uint64
+	req    *raft_cmdpb.ReadIndexRequest
+	locked *kvrpcpb.LockInfo
+}
+
+func (c *readIndexCtx) marshal() []byte {
+	buf := make([]byte, readIndexCtxIDLen, readIndexCtxIDLen+1)
+	binary.BigEndian.PutUint64(buf, c.id)
+	var data []byte
+	switch {
+	case c.locked != nil:
+		buf = append(buf, readIndexCtxLocked)
+		data, _ = c.locked.Marshal()
+	case c.req != nil:
+		buf = append(buf, readIndexCtxRequest)
+		data, _ = c.req.Marshal()
+	}
+	return append(buf, data...)
+}
+
+// unmarshalReadIndexCtx returns nil if the data is not a read index context.
+func unmarshalReadIndexCtx(data []byte) *readIndexCtx {
+	if len(data) < readIndexCtxIDLen {
+		return nil
+	}
+	c := &readIndexCtx{id: binary.BigEndian.Uint64(data)}
+	if len(data) == readIndexCtxIDLen {
+		return c
+	}
+	switch data[readIndexCtxIDLen] {
+	case readIndexCtxRequest:
+		c.req = new(raft_cmdpb.ReadIndexRequest)
+		if c.req.Unmarshal(data[readIndexCtxIDLen+1:]) != nil {
+			return nil
+		}
+	case readIndexCtxLocked:
+		c.locked = new(kvrpcpb.LockInfo)
+		if c.locked.Unmarshal(data[readIndexCtxIDLen+1:]) != nil {
+			return nil
+		}
+	default:
+		return nil
+	}
+	return c
+}
+
+// getReadIndexRequest returns the first ReadIndexRequest in the command.
+func getReadIndexRequest(req *raft_cmdpb.RaftCmdRequest) *raft_cmdpb.ReadIndexRequest {
+	for _, r := range req.Requests {
+		if r.CmdType == raft_cmdpb.CmdType_ReadIndex && r.ReadIndex != nil {
+			return r.ReadIndex
+		}
+	}
+	return nil
+}
+
+// bindReadIndexLocked sets the lock blocking the read to the read index responses.
+func bindReadIndexLocked(resp *raft_cmdpb.RaftCmdResponse, locked *kvrpcpb.LockInfo) {
+	if locked == nil {
+		return
+	}
+	for _, r := range resp.Responses {
+		if r.CmdType == raft_cmdpb.CmdType_ReadIndex {
+			if r.ReadIndex == nil {
+				r.ReadIndex = new(raft_cmdpb.ReadIndexResponse)
+			}
+			r.ReadIndex.Locked = locked
+		}
 	}
-	return lease.Inspect(snapTime) == LeaseState_Expired, nil
 }
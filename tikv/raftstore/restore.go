@@ -88,7 +88,9 @@ func restoreAppliedEntry(entry *eraftpb.Entry, txn *badger.Txn, lockStore *locks
 		case *commitOp:
 			restoreCommit(*x, lockStore)
 		case *rollbackOp:
-		case *raft_cmdpb.DeleteRangeRequest:
+		case *raft_cmdpb.DeleteRangeRequest, *ingestSSTOp:
+		case *raft_cmdpb.PutRequest, *raft_cmdpb.DeleteRequest, *verOp:
+			// Raw kv and versioned kv operations don't touch the lock store.
 		default:
 			log.S().Fatalf("invalid input op=%v", x)
 		}
@@ -95,4 +95,13 @@ func TestRestore(t *testing.T) {
 	txn = engines.kv.DB.NewTransaction(true)
 	err = restoreAppliedEntry(genEntry(wbPessimisticRollback, t), txn, lockStore)
 	require.Nil(t, err)
+
+	// Restore versioned put and delete, they don't touch the lock store.
+	wbVer := &raftWriteBatch{}
+	wbVer.VerPut([]byte("vk"), v1, 7)
+	wbVer.VerDelete([]byte("vk"), 8)
+	txn = engines.kv.DB.NewTransaction(true)
+	err = restoreAppliedEntry(genEntry(wbVer, t), txn, lockStore)
+	require.Nil(t, err)
+	require.Nil(t, lockStore.Get([]byte("vk"), nil))
 }
@@ -19,6 +19,7 @@ import (
 	"time"
 
 	"github.com/ngaut/unistore/tikv/raftstore/raftlog"
+	"github.com/pingcap/kvproto/pkg/errorpb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
@@ -101,12 +102,16 @@ func (pr *router) sendStore(msg Msg) {
 
 // RaftstoreRouter exports SendCommand method for other packages.
 type RaftstoreRouter struct {
-	router *router
-	// TODO: add localReader here.
+	router      *router
+	localReader *localReader
+	importer    *SSTImporter
 }
 
+// SendCommand serves the request with the local reader if possible, otherwise it sends the request to the peer.
 func (r *RaftstoreRouter) SendCommand(req *raft_cmdpb.RaftCmdRequest, cb *Callback) error {
-	// TODO: support local reader
+	if r.localReader != nil && r.localReader.read(req, cb) {
+		return nil
+	}
 	msg := &MsgRaftCmd{
 		SendTime: time.Now(),
 		Request:  raftlog.NewRequest(req),
@@ -115,6 +120,50 @@ func (r *RaftstoreRouter) SendCommand(req *raft_cmdpb.RaftCmdRequest, cb *Callba
 	return r.router.sendRaftCommand(msg)
 }
 
+// readIndexTimeout is longer than an election, the pending reads are failed by the peer when the role or
+// the term changes, the timeout covers the read index messages dropped silently by raft.
+const readIndexTimeout = 20 * time.Second
+
+// errReadIndexTimeout returns a StaleCommand error, so the client retries the request.
+func errReadIndexTimeout() *errorpb.Error {
+	return &errorpb.Error{Message: "read index timeout", StaleCommand: &errorpb.StaleCommand{}}
+}
+
+// ReadIndex gets the read index from the leader of the region and waits until the local peer
+// has applied it, so it can be called on followers and learners. The leader checks the start ts and the key
+// ranges with its ReadIndexObserver, the lock blocking the read is returned in the response.
+func (r *RaftstoreRouter) ReadIndex(ctx *kvrpcpb.Context, startTS uint64, ranges []*kvrpcpb.KeyRange) (*raft_cmdpb.ReadIndexResponse, *errorpb.Error) {
+	cb := NewCallback()
+	header := &raft_cmdpb.RaftRequestHeader{
+		RegionId:    ctx.RegionId,
+		Peer:        ctx.Peer,
+		RegionEpoch: ctx.RegionEpoch,
+		Term:        ctx.Term,
+		ReadQuorum:  true,
+	}
+	req := &raft_cmdpb.Request{
+		CmdType: raft_cmdpb.CmdType_ReadIndex,
+		ReadIndex: &raft_cmdpb.ReadIndexRequest{
+			StartTs:   startTS,
+			KeyRanges: ranges,
+		},
+	}
+	cmd := &raft_cmdpb.RaftCmdRequest{
+		Header:   header,
+		Requests: []*raft_cmdpb.Request{req},
+	}
+	if err := r.SendCommand(cmd, cb); err != nil {
+		return nil, RaftstoreErrToPbError(err)
+	}
+	if !cb.WaitResp(readIndexTimeout) {
+		return nil, errReadIndexTimeout()
+	}
+	if cb.resp.Header.Error != nil {
+		return nil, cb.resp.Header.Error
+	}
+	return cb.resp.Responses[0].GetReadIndex(), nil
+}
+
 func (r *RaftstoreRouter) SplitRegion(ctx *kvrpcpb.Context, keys [][]byte) ([]*metapb.Region, error) {
 	cb := NewCallback()
 	msg := &MsgSplitRegion{
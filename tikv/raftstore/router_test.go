@@ -0,0 +1,114 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFollowerReadIndex(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.shutdown()
+	c.mustPutRaw(1, []byte("k"), []byte("v1"))
+	leader := c.waitLeader(1)
+	follower := leader%3 + 1
+	c.waitRaw(follower, []byte("k"), []byte("v1"))
+
+	// The follower doesn't get the logs, but the leader gets the quorum from the other follower.
+	c.trans.setFilter(func(msg *rspb.RaftMessage) bool {
+		return msg.ToPeer.StoreId == follower && msg.Message.MsgType == eraftpb.MessageType_MsgAppend
+	})
+	c.mustPutRaw(1, []byte("k"), []byte("v2"))
+	region := c.region(follower, 1)
+	rpcCtx := &kvrpcpb.Context{
+		RegionId:    1,
+		RegionEpoch: region.RegionEpoch,
+		Peer:        findPeer(region, follower),
+	}
+	readRouter := &RaftstoreRouter{router: c.nodes[follower].router}
+	errCh := make(chan *errorpb.Error, 1)
+	go func() {
+		_, err := readRouter.ReadIndex(rpcCtx, 0, nil)
+		errCh <- err
+	}()
+	// The read waits until the follower applies the read index.
+	select {
+	case err := <-errCh:
+		t.Fatalf("read index returned before the log is applied, err %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	require.Equal(t, []byte("v1"), c.getRaw(follower, []byte("k")))
+
+	c.trans.setFilter(nil)
+	select {
+	case err := <-errCh:
+		require.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("read index timeout")
+	}
+	require.Equal(t, []byte("v2"), c.getRaw(follower, []byte("k")))
+}
+
+func TestFollowerReadIndexLocked(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.shutdown()
+	c.mustPutRaw(1, []byte("k"), []byte("v1"))
+	leader := c.waitLeader(1)
+	follower := leader%3 + 1
+	c.waitRaw(follower, []byte("k"), []byte("v1"))
+
+	readCtx := func(storeID uint64) *kvrpcpb.Context {
+		region := c.region(storeID, 1)
+		return &kvrpcpb.Context{
+			RegionId:    1,
+			RegionEpoch: region.RegionEpoch,
+			Peer:        findPeer(region, storeID),
+		}
+	}
+	lock := &kvrpcpb.LockInfo{Key: []byte("k"), PrimaryLock: []byte("k"), LockVersion: 5, UseAsyncCommit: true}
+	c.nodes[leader].readObserver.setLocked(lock)
+	ranges := []*kvrpcpb.KeyRange{{StartKey: []byte("a"), EndKey: []byte("z")}}
+
+	// The leader checks the start ts and the ranges of the follower, and returns the lock to it.
+	followerRouter := &RaftstoreRouter{router: c.nodes[follower].router}
+	resp, err := followerRouter.ReadIndex(readCtx(follower), 10, ranges)
+	require.Nil(t, err)
+	require.Equal(t, lock.Key, resp.GetLocked().GetKey())
+	require.Equal(t, lock.LockVersion, resp.GetLocked().GetLockVersion())
+	reqs := c.nodes[leader].readObserver.requests()
+	require.NotEmpty(t, reqs)
+	require.Equal(t, uint64(10), reqs[len(reqs)-1].StartTs)
+	require.Equal(t, ranges[0].StartKey, reqs[len(reqs)-1].KeyRanges[0].StartKey)
+	require.Equal(t, ranges[0].EndKey, reqs[len(reqs)-1].KeyRanges[0].EndKey)
+	require.Empty(t, c.nodes[follower].readObserver.requests())
+
+	// The read index of the leader itself is checked too.
+	leaderRouter := &RaftstoreRouter{router: c.nodes[leader].router}
+	resp, err = leaderRouter.ReadIndex(readCtx(leader), 11, ranges)
+	require.Nil(t, err)
+	require.Equal(t, lock.Key, resp.GetLocked().GetKey())
+
+	c.nodes[leader].readObserver.setLocked(nil)
+	resp, err = followerRouter.ReadIndex(readCtx(follower), 12, ranges)
+	require.Nil(t, err)
+	require.Nil(t, resp.GetLocked())
+	require.NotZero(t, resp.GetReadIndex())
+}
@@ -34,10 +34,12 @@ type RaftInnerServer struct {
 	globalConfig  *config.Config
 	storeMeta     metapb.Store
 	eventObserver PeerEventObserver
+	readObserver  ReadIndexObserver
 
 	node        *Node
 	snapManager *SnapManager
 	router      *router
+	localReader *localReader
 	batchSystem *raftBatchSystem
 	pdWorker    *worker
 	snapWorker  *worker
@@ -97,7 +99,6 @@ func (ris *RaftInnerServer) Setup(pdClient pd.Client) {
 	ris.pdWorker = newWorker("pd-worker", &wg)
 	ris.snapWorker = newWorker("snap-worker", &wg)
 
-	// TODO: create local reader
 	// TODO: create storage read pool
 	// TODO: create cop read pool
 	// TODO: create cop endpoint
@@ -105,8 +106,10 @@ func (ris *RaftInnerServer) Setup(pdClient pd.Client) {
 	cfg := ris.raftConfig
 	router, batchSystem := createRaftBatchSystem(ris.globalConfig, cfg)
 
-	ris.router = router // TODO: init with local reader
+	ris.router = router
+	ris.localReader = newLocalReader(router)
 	ris.snapManager = NewSnapManager(cfg.SnapPath, router)
+	ris.engines.importer.SetUploader(newGrpcSSTUploader(cfg, pdClient))
 	ris.batchSystem = batchSystem
 	ris.lsDumper = &lockStoreDumper{
 		stopCh:      make(chan struct{}),
@@ -116,7 +119,12 @@ func (ris *RaftInnerServer) Setup(pdClient pd.Client) {
 }
 
 func (ris *RaftInnerServer) GetRaftstoreRouter() *RaftstoreRouter {
-	return &RaftstoreRouter{router: ris.router}
+	return &RaftstoreRouter{router: ris.router, localReader: ris.localReader, importer: ris.engines.importer}
+}
+
+// GetSSTImporter returns the importer that keeps the uploaded SST files of the store.
+func (ris *RaftInnerServer) GetSSTImporter() *SSTImporter {
+	return ris.engines.importer
 }
 
 func (ris *RaftInnerServer) GetStoreMeta() *metapb.Store {
@@ -127,7 +135,13 @@ func (ris *RaftInnerServer) SetPeerEventObserver(ob PeerEventObserver) {
 	ris.eventObserver = ob
 }
 
+// SetReadIndexObserver sets the observer to check the read index requests when the store is the leader.
+func (ris *RaftInnerServer) SetReadIndexObserver(ob ReadIndexObserver) {
+	ris.readObserver = ob
+}
+
 func (ris *RaftInnerServer) Start(pdClient pd.Client) error {
+	ris.batchSystem.readIndexObserver = ris.readObserver
 	ris.node = NewNode(ris.batchSystem, &ris.storeMeta, ris.raftConfig, pdClient, ris.eventObserver)
 
 	raftClient := newRaftClient(ris.raftConfig, pdClient)
@@ -44,6 +44,8 @@ const (
 	CFLock    CFName = "lock"
 	CFWrite   CFName = "write"
 	CFRaft    CFName = "raft"
+	CFRaw     CFName = "raw"
+	CFVer     CFName = "ver"
 
 	snapGenPrefix       = "gen" // Name prefix for the self-generated snapshot file.
 	snapRevPrefix       = "rev" // Name prefix for the received snapshot file.
@@ -743,12 +745,22 @@ func (s *Snap) Apply(opts ApplyOptions) (ApplyResult, error) {
 	if err != nil {
 		return result, err
 	}
-	applier, err := newSnapApplier(s.CFFiles)
+	return applyCFFiles(s.CFFiles, opts)
+}
+
+// applyCFFiles applies the CF files in the snapshot layout, the puts are added to the builder,
+// the locks are put into the lock store and the rollbacks and op locks are added to the write batch.
+func applyCFFiles(cfFiles []*CFFile, opts ApplyOptions) (ApplyResult, error) {
+	var result ApplyResult
+	applier, err := newSnapApplier(cfFiles)
 	if err != nil {
 		return result, err
 	}
 	defer applier.close()
 
+	// The raw and versioned keys are written with a new version of this DB, so it is greater than the deletes
+	// of the cleaned up range and less than the later writes.
+	var keySpaceVersion uint64
 	for {
 		item, err1 := applier.next()
 		if err1 != nil {
@@ -760,6 +772,12 @@ func (s *Snap) Apply(opts ApplyOptions) (ApplyResult, error) {
 		switch item.applySnapType {
 		case applySnapTypePut:
 			result.HasPut = true
+			if bytes.HasPrefix(item.key.UserKey, mvcc.RawKeyPrefix) || bytes.HasPrefix(item.key.UserKey, mvcc.VerKeyPrefix) {
+				if keySpaceVersion == 0 {
+					keySpaceVersion = atomic.AddUint64(&opts.DBBundle.StateTS, 1)
+				}
+				item.key.Version = keySpaceVersion
+			}
 			opts.Builder.Add(item.key, y.ValueStruct{
 				Value:    item.val,
 				UserMeta: item.userMeta,
@@ -201,7 +201,17 @@ func (ai *snapApplier) nextWrite() (*applySnapItem, error) {
 	}
 	item.applySnapType = applySnapTypePut
 	item.key = y.KeyWithTs(ai.curWriteKey, ai.curWriteCommitTS)
-	item.userMeta = mvcc.NewDBUserMeta(writeVal.startTS, ai.curWriteCommitTS)
+	switch {
+	case bytes.HasPrefix(ai.curWriteKey, mvcc.RawKeyPrefix):
+		item.userMeta = mvcc.NewRawUserMeta(writeVal.startTS)
+	case bytes.HasPrefix(ai.curWriteKey, mvcc.VerKeyPrefix):
+		item.userMeta = mvcc.VerUserMeta
+		if writeVal.writeType == byte(kvrpcpb.Op_Del) {
+			item.userMeta = mvcc.VerDeleteUserMeta
+		}
+	default:
+		item.userMeta = mvcc.NewDBUserMeta(writeVal.startTS, ai.curWriteCommitTS)
+	}
 	val, err := ai.popFullValue(ai.curWriteKey, writeVal.startTS, writeVal.shortValue, writeVal.writeType)
 	if err != nil {
 		return nil, err
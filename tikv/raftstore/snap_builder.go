@@ -32,6 +32,7 @@ func newSnapBuilder(cfFiles []*CFFile, snap *regionSnapshot, region *metapb.Regi
 	b := new(snapBuilder)
 	b.cfFiles = cfFiles
 	b.endKey = RawEndKey(region)
+	b.keySpaceRanges = keySpaceRanges(region.StartKey, region.EndKey)
 	b.extraEndKey = mvcc.EncodeExtraTxnStatusKey(b.endKey, 0)
 	b.txn = snap.txn
 	itOpt := badger.DefaultIteratorOptions
@@ -75,6 +76,7 @@ func newSnapBuilder(cfFiles []*CFFile, snap *regionSnapshot, region *metapb.Regi
 // TODO: handle rollbacks and locks the region later.
 type snapBuilder struct {
 	endKey          []byte
+	keySpaceRanges  []keyRange
 	extraEndKey     []byte
 	txn             *badger.Txn
 	lockIterator    *lockstore.Iterator
@@ -99,6 +101,13 @@ func (b *snapBuilder) build() error {
 		b.extraIterator.Close()
 		b.txn.Discard()
 	}()
+	if err := b.buildData(); err != nil {
+		return err
+	}
+	return b.addKeySpaceEntries()
+}
+
+func (b *snapBuilder) buildData() error {
 	for {
 		var err error
 		switch b.currentKeyType() {
@@ -246,15 +255,48 @@ func (b *snapBuilder) addExtraEntry() error {
 	return nil
 }
 
+// addKeySpaceEntries adds the raw and versioned keys of the region after the data keys, they are greater than
+// all the data keys. Only the latest version of every DB key is added, the expire time of a raw key is stored
+// as the start ts and a versioned delete is stored as a delete.
+func (b *snapBuilder) addKeySpaceEntries() error {
+	it := b.txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for _, r := range b.keySpaceRanges {
+		for it.Seek(r.startKey); it.Valid(); it.Next() {
+			item := it.Item()
+			key := item.Key()
+			if bytes.Compare(key, r.endKey) >= 0 {
+				break
+			}
+			val, err := item.Value()
+			if err != nil {
+				return err
+			}
+			var startTS uint64
+			writeType := byte(kvrpcpb.Op_Put)
+			if bytes.HasPrefix(key, mvcc.RawKeyPrefix) {
+				startTS = mvcc.RawUserMeta(item.UserMeta()).ExpireTS()
+			} else if bytes.Equal(item.UserMeta(), mvcc.VerDeleteUserMeta) {
+				writeType = byte(kvrpcpb.Op_Del)
+			}
+			if err = b.addSSTKey(key, startTS, 0, val, writeType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (b *snapBuilder) addSSTKey(key []byte, startTS, commitTS uint64, val []byte, writeType byte) error {
 	writeCFKey := encodeRocksDBSSTKey(key, &commitTS)
 	writeCFVal := new(writeCFValue)
 	writeCFVal.writeType = writeType
 	writeCFVal.startTS = startTS
-	if len(val) <= shortValueMaxLen {
+	// An empty put value is stored in the default CF, because an empty short value means the value is there.
+	if len(val) <= shortValueMaxLen && (len(val) > 0 || writeType != byte(kvrpcpb.Op_Put)) {
 		writeCFVal.shortValue = val
 	} else {
-		defaultCFKey := encodeRocksDBSSTKey(b.curDBKey, &startTS)
+		defaultCFKey := encodeRocksDBSSTKey(key, &startTS)
 		err := b.defaultCFWriter.Put(defaultCFKey, val)
 		if err != nil {
 			return err
@@ -0,0 +1,363 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ngaut/unistore/rocksdb"
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/options"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+const importDirName = "import"
+
+// SSTImporter manages the SST files to be ingested, the files are kept in the import directory of
+// the kv engine and named by the uuid and the CF of their metas.
+// A group of files with the same uuid is in the snapshot CF layout: the default and write CFs are
+// rocksdb SST files and the lock CF is a plain file. The group is ingested together at the commit ts
+// encoded in the write CF keys.
+type SSTImporter struct {
+	dir      string
+	uploader SSTUploader
+}
+
+func NewSSTImporter(dir string) *SSTImporter {
+	return &SSTImporter{dir: dir}
+}
+
+// SSTUploader uploads an SST file to another store, so the peer on the store can ingest it.
+type SSTUploader interface {
+	Upload(storeID uint64, meta *import_sstpb.SSTMeta, path string) error
+}
+
+// SetUploader sets the uploader used to replicate the files to the stores of the other peers.
+func (imp *SSTImporter) SetUploader(uploader SSTUploader) {
+	imp.uploader = uploader
+}
+
+// Path returns the path of the SST file described by the meta.
+func (imp *SSTImporter) Path(meta *import_sstpb.SSTMeta) string {
+	return filepath.Join(imp.dir, fmt.Sprintf("%x_%s%s", meta.Uuid, meta.CfName, sstFileSuffix))
+}
+
+// WriteMutations writes the mutations committed at commitTS into the SST files of the region and returns
+// their metas. The values longer than shortValueMaxLen are written to the default CF.
+func (imp *SSTImporter) WriteMutations(regionID uint64, epoch *metapb.RegionEpoch, mutations []*kvrpcpb.Mutation, commitTS uint64) ([]*import_sstpb.SSTMeta, error) {
+	if len(mutations) == 0 {
+		return nil, nil
+	}
+	mutations = append([]*kvrpcpb.Mutation{}, mutations...)
+	sort.SliceStable(mutations, func(i, j int) bool {
+		return bytes.Compare(mutations[i].Key, mutations[j].Key) < 0
+	})
+	// The later mutation of a key wins.
+	deduped := mutations[:0]
+	for _, m := range mutations {
+		if n := len(deduped); n > 0 && bytes.Equal(deduped[n-1].Key, m.Key) {
+			deduped[n-1] = m
+			continue
+		}
+		deduped = append(deduped, m)
+	}
+	mutations = deduped
+
+	if err := os.MkdirAll(imp.dir, 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var (
+		defaultWriter *rocksdb.SstFileWriter
+		defaultFile   *os.File
+		metas         []*import_sstpb.SSTMeta
+	)
+	newMeta := func(cf CFName) *import_sstpb.SSTMeta {
+		return &import_sstpb.SSTMeta{
+			Uuid:        uuid,
+			CfName:      cf,
+			RegionId:    regionID,
+			RegionEpoch: epoch,
+			Range: &import_sstpb.Range{
+				Start: codec.EncodeBytes(nil, mutations[0].Key),
+				End:   codec.EncodeBytes(nil, mutations[len(mutations)-1].Key),
+			},
+		}
+	}
+	writeMeta := newMeta(CFWrite)
+	writeFile, err := os.Create(imp.Path(writeMeta))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer writeFile.Close()
+	writeWriter := rocksdb.NewSstFileWriter(writeFile, rocksdb.NewDefaultBlockBasedTableOptions(bytes.Compare))
+	for _, m := range mutations {
+		var writeType kvrpcpb.Op
+		switch m.Op {
+		case kvrpcpb.Op_Put, kvrpcpb.Op_Insert:
+			writeType = kvrpcpb.Op_Put
+		case kvrpcpb.Op_Del:
+			writeType = kvrpcpb.Op_Del
+		default:
+			imp.Delete(append(metas, writeMeta))
+			return nil, errors.Errorf("unsupported import mutation op %v", m.Op)
+		}
+		writeVal := &writeCFValue{writeType: byte(writeType), startTS: commitTS}
+		if writeType == kvrpcpb.Op_Put {
+			if len(m.Value) > 0 && len(m.Value) <= shortValueMaxLen {
+				writeVal.shortValue = m.Value
+			} else {
+				if defaultWriter == nil {
+					defaultMeta := newMeta(CFDefault)
+					metas = append(metas, defaultMeta)
+					if defaultFile, err = os.Create(imp.Path(defaultMeta)); err != nil {
+						imp.Delete(append(metas, writeMeta))
+						return nil, errors.WithStack(err)
+					}
+					defer defaultFile.Close()
+					defaultWriter = rocksdb.NewSstFileWriter(defaultFile, rocksdb.NewDefaultBlockBasedTableOptions(bytes.Compare))
+				}
+				if err = defaultWriter.Put(encodeRocksDBSSTKey(m.Key, &commitTS), m.Value); err != nil {
+					imp.Delete(append(metas, writeMeta))
+					return nil, err
+				}
+			}
+		}
+		if err = writeWriter.Put(encodeRocksDBSSTKey(m.Key, &commitTS), encodeWriteCFValue(writeVal)); err != nil {
+			imp.Delete(append(metas, writeMeta))
+			return nil, err
+		}
+	}
+	metas = append(metas, writeMeta)
+	if defaultWriter != nil {
+		if err = defaultWriter.Finish(); err != nil {
+			imp.Delete(metas)
+			return nil, err
+		}
+	}
+	if err = writeWriter.Finish(); err != nil {
+		imp.Delete(metas)
+		return nil, err
+	}
+	for _, meta := range metas {
+		if meta.Length, meta.Crc32, err = fileChecksum(imp.Path(meta)); err != nil {
+			imp.Delete(metas)
+			return nil, err
+		}
+	}
+	return metas, nil
+}
+
+func fileChecksum(path string) (uint64, uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, errors.WithStack(err)
+	}
+	defer f.Close()
+	digest := crc32.NewIEEE()
+	n, err := io.Copy(digest, f)
+	if err != nil {
+		return 0, 0, errors.WithStack(err)
+	}
+	return uint64(n), digest.Sum32(), nil
+}
+
+// Validate checks the file of the meta exists and matches the length and the checksum.
+func (imp *SSTImporter) Validate(meta *import_sstpb.SSTMeta) error {
+	return checkSSTFile(imp.Path(meta), meta)
+}
+
+func checkSSTFile(path string, meta *import_sstpb.SSTMeta) error {
+	length, checksum, err := fileChecksum(path)
+	if err != nil {
+		return err
+	}
+	if length != meta.Length || checksum != meta.Crc32 {
+		return errors.Errorf("sst file %s mismatch, length %d checksum %d, expected length %d checksum %d",
+			path, length, checksum, meta.Length, meta.Crc32)
+	}
+	return nil
+}
+
+// checkSSTMeta checks the uuid and the CF of an uploaded meta, they are used as the name of the file.
+func checkSSTMeta(meta *import_sstpb.SSTMeta) error {
+	if len(meta.Uuid) != 16 {
+		return errors.Errorf("invalid sst uuid %v", meta.Uuid)
+	}
+	for _, cf := range snapshotCFs {
+		if meta.CfName == cf {
+			return nil
+		}
+	}
+	return errors.Errorf("unsupported sst cf %s", meta.CfName)
+}
+
+// SSTUploadFile is an SST file being uploaded, it is moved to the path of the meta once it is finished and
+// matches the meta, so a partially uploaded file is never ingested.
+type SSTUploadFile struct {
+	imp  *SSTImporter
+	meta *import_sstpb.SSTMeta
+	file *os.File
+}
+
+// CreateUploadFile creates the file to receive the uploaded data of the meta.
+func (imp *SSTImporter) CreateUploadFile(meta *import_sstpb.SSTMeta) (*SSTUploadFile, error) {
+	if err := checkSSTMeta(meta); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(imp.dir, 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	file, err := ioutil.TempFile(imp.dir, "upload_*.sst")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &SSTUploadFile{imp: imp, meta: meta, file: file}, nil
+}
+
+func (f *SSTUploadFile) Write(data []byte) error {
+	_, err := f.file.Write(data)
+	return errors.WithStack(err)
+}
+
+// Finish validates the uploaded file and moves it to the path of the meta.
+func (f *SSTUploadFile) Finish() error {
+	path := f.file.Name()
+	if err := f.file.Close(); err != nil {
+		os.Remove(path)
+		return errors.WithStack(err)
+	}
+	if err := checkSSTFile(path, f.meta); err != nil {
+		os.Remove(path)
+		return err
+	}
+	if err := os.Rename(path, f.imp.Path(f.meta)); err != nil {
+		os.Remove(path)
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// Abort removes the partially uploaded file.
+func (f *SSTUploadFile) Abort() {
+	f.file.Close()
+	os.Remove(f.file.Name())
+}
+
+// Replicate uploads the files of the metas to the stores of the other peers of the region. The followers
+// validate the files when the IngestSST command is applied, so the files must be replicated before the
+// command is proposed.
+func (imp *SSTImporter) Replicate(region *metapb.Region, storeID uint64, metas []*import_sstpb.SSTMeta) error {
+	for _, peer := range region.Peers {
+		if peer.StoreId == storeID {
+			continue
+		}
+		if imp.uploader == nil {
+			return errors.Errorf("no uploader to replicate sst files to store %d", peer.StoreId)
+		}
+		for _, meta := range metas {
+			if err := imp.uploader.Upload(peer.StoreId, meta, imp.Path(meta)); err != nil {
+				return errors.Annotatef(err, "upload sst file %s to store %d", imp.Path(meta), peer.StoreId)
+			}
+		}
+	}
+	return nil
+}
+
+// checkSSTForIngestion checks the meta is for the region and the range of the file is in the region.
+func checkSSTForIngestion(meta *import_sstpb.SSTMeta, region *metapb.Region) error {
+	if meta.RegionId != region.Id {
+		return errors.Errorf("sst region id %d does not match region %d", meta.RegionId, region.Id)
+	}
+	epoch, sstEpoch := region.RegionEpoch, meta.RegionEpoch
+	if sstEpoch.GetConfVer() != epoch.ConfVer || sstEpoch.GetVersion() != epoch.Version {
+		return &ErrEpochNotMatch{
+			Message: fmt.Sprintf("sst epoch %s does not match region epoch %s", sstEpoch, epoch),
+			Regions: []*metapb.Region{region},
+		}
+	}
+	if err := CheckKeyInRegion(meta.Range.GetStart(), region); err != nil {
+		return err
+	}
+	return CheckKeyInRegion(meta.Range.GetEnd(), region)
+}
+
+// Ingest ingests the files of the metas into the kv engine, the metas must be in the same group.
+// The table built for ingestion is not compressed, it is rewritten by compactions later.
+func (imp *SSTImporter) Ingest(db *mvcc.DBBundle, metas []*import_sstpb.SSTMeta) error {
+	cfFiles := make([]*CFFile, len(snapshotCFs))
+	for i, cf := range snapshotCFs {
+		cfFiles[i] = &CFFile{CF: cf}
+	}
+	for _, meta := range metas {
+		var cfFile *CFFile
+		for _, f := range cfFiles {
+			if f.CF == meta.CfName {
+				cfFile = f
+			}
+		}
+		if cfFile == nil {
+			return errors.Errorf("unsupported sst cf %s", meta.CfName)
+		}
+		cfFile.Path = imp.Path(meta)
+		cfFile.Size = meta.Length
+	}
+	if err := os.MkdirAll(imp.dir, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	tableFile, err := ioutil.TempFile(imp.dir, "ingest_*.sst")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(tableFile.Name())
+	builder := db.DB.NewExternalTableBuilder(tableFile, options.None, NewInfLimiter())
+	builder.SetIsManaged()
+	wb := new(WriteBatch)
+	result, err := applyCFFiles(cfFiles, *newApplyOptions(db, nil, nil, builder, wb))
+	if err != nil {
+		return err
+	}
+	if result.HasPut {
+		if _, err = builder.Finish(); err != nil {
+			return err
+		}
+		if _, err = db.DB.IngestExternalFiles([]badger.ExternalTableSpec{{Filename: tableFile.Name()}}); err != nil {
+			return err
+		}
+	}
+	return wb.WriteToKV(db)
+}
+
+// Delete removes the files of the metas.
+func (imp *SSTImporter) Delete(metas []*import_sstpb.SSTMeta) {
+	for _, meta := range metas {
+		os.Remove(imp.Path(meta))
+	}
+}
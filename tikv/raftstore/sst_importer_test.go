@@ -0,0 +1,185 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/ngaut/unistore/tikv/raftstore/raftlog"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	rfpb "github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSTImporter(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	region := genTestRegion(1, 1, 1)
+	longValue := make([]byte, shortValueMaxLen+1)
+	mutations := []*kvrpcpb.Mutation{
+		{Op: kvrpcpb.Op_Put, Key: []byte("tc"), Value: longValue},
+		{Op: kvrpcpb.Op_Put, Key: []byte("tb"), Value: []byte("old")},
+		{Op: kvrpcpb.Op_Del, Key: []byte("td")},
+		{Op: kvrpcpb.Op_Put, Key: []byte("tb"), Value: []byte("new")},
+	}
+	importer := engines.importer
+	metas, err := importer.WriteMutations(region.Id, region.RegionEpoch, mutations, 100)
+	require.Nil(t, err)
+	require.Len(t, metas, 2)
+	for _, meta := range metas {
+		assert.Nil(t, importer.Validate(meta))
+		assert.Nil(t, checkSSTForIngestion(meta, region))
+	}
+
+	// The files are rejected by the regions with another epoch or range.
+	staleRegion := genTestRegion(1, 1, 1)
+	staleRegion.RegionEpoch.Version++
+	assert.NotNil(t, checkSSTForIngestion(metas[0], staleRegion))
+	otherRegion := genTestRegion(1, 1, 1)
+	otherRegion.EndKey = metas[0].Range.End
+	assert.NotNil(t, checkSSTForIngestion(metas[0], otherRegion))
+
+	apply := new(applier)
+	apply.region = region
+	applyCtx := newApplyContext("test", nil, engines, nil, NewDefaultConfig())
+	var requests []*rfpb.Request
+	for _, meta := range metas {
+		requests = append(requests, &rfpb.Request{
+			CmdType:   rfpb.CmdType_IngestSST,
+			IngestSst: &rfpb.IngestSSTRequest{Sst: meta},
+		})
+	}
+	rlog := raftlog.NewRequest(&rfpb.RaftCmdRequest{
+		Header:   new(rfpb.RaftRequestHeader),
+		Requests: requests,
+	})
+	resp, _ := apply.execWriteCmd(applyCtx, rlog)
+	require.Nil(t, resp.Header.Error)
+	require.Nil(t, applyCtx.wb.WriteToKV(engines.kv))
+	assert.Equal(t, []byte("new"), getDBValue(t, engines.kv.DB, []byte("tb"), 100))
+	assert.Equal(t, longValue, getDBValue(t, engines.kv.DB, []byte("tc"), 100))
+	assert.Len(t, getDBValue(t, engines.kv.DB, []byte("td"), 100), 0)
+
+	// The files are removed once ingested, the command applied again is rejected.
+	for _, meta := range metas {
+		assert.NotNil(t, importer.Validate(meta))
+	}
+	resp, _ = apply.execWriteCmd(applyCtx, rlog)
+	assert.NotNil(t, resp.Header.Error)
+}
+
+// testSSTUploader uploads the files to the import directories of the stores in the test cluster.
+type testSSTUploader struct {
+	c *testCluster
+}
+
+func (u *testSSTUploader) Upload(storeID uint64, meta *import_sstpb.SSTMeta, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	file, err := u.c.nodes[storeID].engines.importer.CreateUploadFile(meta)
+	if err != nil {
+		return err
+	}
+	if err = file.Write(data); err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Finish()
+}
+
+func TestSSTUploadFile(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	region := genTestRegion(1, 1, 1)
+	importer := engines.importer
+	mutations := []*kvrpcpb.Mutation{{Op: kvrpcpb.Op_Put, Key: []byte("ta"), Value: []byte("v")}}
+	metas, err := importer.WriteMutations(region.Id, region.RegionEpoch, mutations, 100)
+	require.Nil(t, err)
+	require.Len(t, metas, 1)
+	data, err := ioutil.ReadFile(importer.Path(metas[0]))
+	require.Nil(t, err)
+	importer.Delete(metas)
+
+	// A partially uploaded file is rejected.
+	file, err := importer.CreateUploadFile(metas[0])
+	require.Nil(t, err)
+	require.Nil(t, file.Write(data[:len(data)-1]))
+	require.NotNil(t, file.Finish())
+	require.NotNil(t, importer.Validate(metas[0]))
+
+	file, err = importer.CreateUploadFile(metas[0])
+	require.Nil(t, err)
+	require.Nil(t, file.Write(data))
+	require.Nil(t, file.Finish())
+	require.Nil(t, importer.Validate(metas[0]))
+
+	// The meta names the file, so the CF must be a snapshot CF.
+	invalidMeta := *metas[0]
+	invalidMeta.CfName = "../" + CFWrite
+	_, err = importer.CreateUploadFile(&invalidMeta)
+	require.NotNil(t, err)
+}
+
+func TestIngestSSTReplicated(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.shutdown()
+	c.mustTransferLeader(1, 1)
+	leader := c.nodes[1]
+	leader.engines.importer.SetUploader(&testSSTUploader{c: c})
+	writer := &raftDBWriter{router: leader.router, importer: leader.engines.importer}
+	region := c.region(1, 1)
+	ctx := &kvrpcpb.Context{RegionId: 1, RegionEpoch: region.RegionEpoch, Peer: findPeer(region, 1)}
+	mutations := []*kvrpcpb.Mutation{
+		{Op: kvrpcpb.Op_Put, Key: []byte("ta"), Value: []byte("va")},
+		{Op: kvrpcpb.Op_Put, Key: []byte("tb"), Value: make([]byte, shortValueMaxLen+1)},
+	}
+	require.Nil(t, writer.Import(mutations, 100, region, ctx))
+
+	// Every replica ingests the files and removes them.
+	for storeID, node := range c.nodes {
+		importDir := filepath.Join(node.kvPath, importDirName)
+		for i := 0; i < 300; i++ {
+			files, err := ioutil.ReadDir(importDir)
+			require.Nil(t, err)
+			if len(files) == 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		files, err := ioutil.ReadDir(importDir)
+		require.Nil(t, err)
+		require.Len(t, files, 0, "store %d", storeID)
+		require.Equal(t, []byte("va"), getDBValue(t, node.engines.kv.DB, []byte("ta"), 100))
+		require.Len(t, getDBValue(t, node.engines.kv.DB, []byte("tb"), 100), shortValueMaxLen+1)
+	}
+
+	// The files out of the region are rejected before they are uploaded.
+	staleRegion := proto.Clone(region).(*metapb.Region)
+	staleRegion.RegionEpoch.Version++
+	metas, err := leader.engines.importer.WriteMutations(1, staleRegion.RegionEpoch, mutations, 200)
+	require.Nil(t, err)
+	require.NotNil(t, writer.Ingest(metas, region, ctx))
+	for _, meta := range metas {
+		require.NotNil(t, c.nodes[2].engines.importer.Validate(meta))
+	}
+}
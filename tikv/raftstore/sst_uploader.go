@@ -0,0 +1,92 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ngaut/unistore/pd"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// grpcSSTUploader uploads the SST files by the ImportSST service of the other stores.
+type grpcSSTUploader struct {
+	config *Config
+	pdCli  pd.Client
+}
+
+func newGrpcSSTUploader(config *Config, pdCli pd.Client) *grpcSSTUploader {
+	return &grpcSSTUploader{config: config, pdCli: pdCli}
+}
+
+func (u *grpcSSTUploader) Upload(storeID uint64, meta *import_sstpb.SSTMeta, path string) error {
+	start := time.Now()
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+	// Importing is a low frequent operation, we can afford resolving the store address every time.
+	addr, err := getStoreAddr(storeID, u.pdCli)
+	if err != nil {
+		return err
+	}
+	cc, err := grpc.Dial(addr, grpc.WithInsecure(),
+		grpc.WithInitialWindowSize(int32(u.config.GrpcInitialWindowSize)),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    u.config.GrpcKeepAliveTime,
+			Timeout: u.config.GrpcKeepAliveTimeout,
+		}))
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	stream, err := import_sstpb.NewImportSSTClient(cc).Upload(context.TODO())
+	if err != nil {
+		return err
+	}
+	err = stream.Send(&import_sstpb.UploadRequest{Chunk: &import_sstpb.UploadRequest_Meta{Meta: meta}})
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, snapChunkLen)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&import_sstpb.UploadRequest{Chunk: &import_sstpb.UploadRequest_Data{Data: buf[:n]}}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if _, err = stream.CloseAndRecv(); err != nil {
+		return err
+	}
+	log.Info("uploaded sst file", zap.Uint64("store id", storeID), zap.String("file", path),
+		zap.Uint64("size", meta.Length), zap.Duration("duration", time.Since(start)))
+	return nil
+}
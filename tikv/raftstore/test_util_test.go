@@ -16,6 +16,7 @@ package raftstore
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/ngaut/unistore/tikv/mvcc"
@@ -28,11 +29,19 @@ import (
 )
 
 func newTestEngines(t *testing.T) *Engines {
+	kvPath, err := ioutil.TempDir("", "unistore_kv")
+	require.Nil(t, err)
+	raftPath, err := ioutil.TempDir("", "unistore_raft")
+	require.Nil(t, err)
+	return openTestEngines(t, kvPath, raftPath)
+}
+
+// openTestEngines opens the engines in the directories, it is used to restart a store too.
+func openTestEngines(t *testing.T, kvPath, raftPath string) *Engines {
 	engines := new(Engines)
 	engines.kv = new(mvcc.DBBundle)
+	engines.kvPath = kvPath
 	var err error
-	engines.kvPath, err = ioutil.TempDir("", "unistore_kv")
-	require.Nil(t, err)
 	kvOpts := badger.DefaultOptions
 	kvOpts.Dir = engines.kvPath
 	kvOpts.ValueDir = engines.kvPath
@@ -40,8 +49,8 @@ func newTestEngines(t *testing.T) *Engines {
 	engines.kv.DB, err = badger.Open(kvOpts)
 	engines.kv.LockStore = lockstore.NewMemStore(16 * 1024)
 	require.Nil(t, err)
-	engines.raftPath, err = ioutil.TempDir("", "unistore_raft")
-	require.Nil(t, err)
+	engines.importer = NewSSTImporter(filepath.Join(engines.kvPath, importDirName))
+	engines.raftPath = raftPath
 	raftOpts := badger.DefaultOptions
 	raftOpts.Dir = engines.raftPath
 	raftOpts.ValueDir = engines.raftPath
@@ -377,6 +377,32 @@ func findPeer(region *metapb.Region, storeID uint64) *metapb.Peer {
 	return nil
 }
 
+// isSiblingRegions checks whether the two regions are adjacent.
+func isSiblingRegions(lhs, rhs *metapb.Region) bool {
+	if lhs.Id == rhs.Id {
+		return false
+	}
+	if bytes.Equal(lhs.StartKey, rhs.EndKey) && len(rhs.EndKey) > 0 {
+		return true
+	}
+	return bytes.Equal(lhs.EndKey, rhs.StartKey) && len(lhs.EndKey) > 0
+}
+
+// regionOnSameStores checks whether the peers of the two regions are on the same stores with the same roles.
+func regionOnSameStores(lhs, rhs *metapb.Region) bool {
+	if len(lhs.Peers) != len(rhs.Peers) {
+		return false
+	}
+	// Every store can only have one replica for the same region, so one round check is enough.
+	for _, lp := range lhs.Peers {
+		rp := findPeer(rhs, lp.StoreId)
+		if rp == nil || rp.Role != lp.Role {
+			return false
+		}
+	}
+	return true
+}
+
 func removePeer(region *metapb.Region, storeID uint64) *metapb.Peer {
 	for i, peer := range region.Peers {
 		if peer.StoreId == storeID {
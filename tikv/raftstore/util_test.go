@@ -200,6 +200,33 @@ func TestEpochStale(t *testing.T) {
 	}
 }
 
+func TestIsSiblingRegions(t *testing.T) {
+	newRegion := func(id uint64, start, end string) *metapb.Region {
+		return &metapb.Region{Id: id, StartKey: []byte(start), EndKey: []byte(end)}
+	}
+	assert.True(t, isSiblingRegions(newRegion(1, "", "b"), newRegion(2, "b", "")))
+	assert.True(t, isSiblingRegions(newRegion(2, "b", "d"), newRegion(1, "a", "b")))
+	assert.False(t, isSiblingRegions(newRegion(1, "a", "b"), newRegion(2, "c", "d")))
+	assert.False(t, isSiblingRegions(newRegion(1, "", ""), newRegion(2, "", "")))
+	assert.False(t, isSiblingRegions(newRegion(1, "a", "b"), newRegion(1, "b", "c")))
+}
+
+func TestRegionOnSameStores(t *testing.T) {
+	newRegion := func(peers ...*metapb.Peer) *metapb.Region {
+		return &metapb.Region{Peers: peers}
+	}
+	voter := func(id, storeID uint64) *metapb.Peer {
+		return &metapb.Peer{Id: id, StoreId: storeID, Role: metapb.PeerRole_Voter}
+	}
+	learner := func(id, storeID uint64) *metapb.Peer {
+		return &metapb.Peer{Id: id, StoreId: storeID, Role: metapb.PeerRole_Learner}
+	}
+	assert.True(t, regionOnSameStores(newRegion(voter(1, 1), voter(2, 2)), newRegion(voter(3, 2), voter(4, 1))))
+	assert.False(t, regionOnSameStores(newRegion(voter(1, 1), voter(2, 2)), newRegion(voter(3, 1), voter(4, 3))))
+	assert.False(t, regionOnSameStores(newRegion(voter(1, 1), voter(2, 2)), newRegion(voter(3, 1))))
+	assert.False(t, regionOnSameStores(newRegion(voter(1, 1), learner(2, 2)), newRegion(voter(3, 1), voter(4, 2))))
+}
+
 func TestCheckRegionEpoch(t *testing.T) {
 	epoch := new(metapb.RegionEpoch)
 	epoch.ConfVer = 2
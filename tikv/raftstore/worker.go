@@ -18,7 +18,10 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io/ioutil"
+	"math"
 	"os"
 	"sync"
 	"sync/atomic"
@@ -26,6 +29,7 @@ import (
 
 	"github.com/ngaut/unistore/config"
 	"github.com/ngaut/unistore/lockstore"
+	"github.com/ngaut/unistore/rocksdb"
 	"github.com/ngaut/unistore/tikv/dbreader"
 	"github.com/ngaut/unistore/tikv/mvcc"
 	"github.com/pingcap/badger"
@@ -105,7 +109,9 @@ type splitCheckTask struct {
 type computeHashTask struct {
 	index  uint64
 	region *metapb.Region
-	snap   *mvcc.DBSnapshot
+	txn    *badger.Txn
+	// The applier of the region waits for it to be closed before applying the entries after the index.
+	locksCopied chan struct{}
 }
 
 type pdAskSplitTask struct {
@@ -657,6 +663,12 @@ func (snapCtx *snapContext) cleanUpOriginData(regionState *rspb.RegionLocalState
 	if err := deleteRange(snapCtx.engiens.kv, startKey, endKey); err != nil {
 		return err
 	}
+	for _, r := range keySpaceRanges(regionState.Region.StartKey, regionState.Region.EndKey) {
+		snapCtx.cleanUpOverlapRanges(r.startKey, r.endKey)
+		if err := deleteRange(snapCtx.engiens.kv, r.startKey, r.endKey); err != nil {
+			return err
+		}
+	}
 	if err := checkAbort(status); err != nil {
 		return err
 	}
@@ -936,7 +948,7 @@ func (r *regionTaskHandler) handle(t task) {
 	case taskTypeRegionDestroy:
 		// Try to delay the range deletion because
 		// there might be a coprocessor request related to this range
-		regionTask := t.data.(regionTask)
+		regionTask := t.data.(*regionTask)
 		if !r.ctx.insertPendingDeleteRange(regionTask.regionId, regionTask.startKey, regionTask.endKey) {
 			// Use delete files
 			r.ctx.cleanUpRange(regionTask.regionId, regionTask.startKey, regionTask.endKey, false)
@@ -1029,16 +1041,163 @@ func (r *raftLogGCTaskHandler) handle(t task) {
 
 type compactTaskHandler struct {
 	engine *badger.DB
+	router *router
 }
 
 func (r *compactTaskHandler) handle(t task) {
-	// TODO: stub
+	switch t.tp {
+	case taskTypeCompact:
+		r.compactRange(t.data.(*compactTask).keyRange)
+	}
+}
+
+// needCompact checks whether the tombstones reach both the number threshold and the percentage threshold of the entries.
+func needCompact(tombstones, entries, tombstoneNumThreshold, tombstonePercentThreshold uint64) bool {
+	return tombstones >= tombstoneNumThreshold && tombstones*100 >= tombstonePercentThreshold*entries
+}
+
+// rangeCompactor is implemented by the engines that can compact the tables overlapping a key range.
+type rangeCompactor interface {
+	CompactRange(startKey, endKey []byte) error
+}
+
+// compactRange compacts the tables overlapping the range, the compaction filter drops the tombstones and the
+// versions before the safe point. The live keys are kept, so the range can be compacted at any time.
+func (r *compactTaskHandler) compactRange(ran keyRange) {
+	compactor, ok := interface{}(r.engine).(rangeCompactor)
+	if !ok {
+		log.Warn("the engine doesn't support compacting a range")
+		return
+	}
+	start := time.Now()
+	if err := compactor.CompactRange(ran.startKey, ran.endKey); err != nil {
+		log.Error("failed to compact range", zap.Binary("start key", ran.startKey),
+			zap.Binary("end key", ran.endKey), zap.Error(err))
+		return
+	}
+	log.Info("compact range finished", zap.Binary("start key", ran.startKey), zap.Binary("end key", ran.endKey),
+		zap.Duration("takes", time.Since(start)))
 }
 
 type computeHashTaskHandler struct {
-	router *router
+	lockStore *lockstore.MemStore
+	router    *router
 }
 
 func (r *computeHashTaskHandler) handle(t task) {
-	// TODO: stub
+	task := t.data.(*computeHashTask)
+	region := task.region
+	// The lock store has no snapshot, the applier of the region doesn't apply the entries after the
+	// ComputeHash until the locks are copied.
+	lockSnap := copyRegionLocks(r.lockStore, region)
+	close(task.locksCopied)
+	if err := r.router.send(region.Id, NewPeerMsg(MsgTypeApplyResume, region.Id, nil)); err != nil {
+		log.Warn("failed to resume applier", zap.Uint64("region id", region.Id), zap.Error(err))
+	}
+	hash, err := computeRegionHash(region, &mvcc.DBSnapshot{Txn: task.txn, LockStore: lockSnap})
+	if err != nil {
+		log.Error("failed to calculate hash", zap.Uint64("region id", region.Id), zap.Error(err))
+		return
+	}
+	log.Info("computed hash", zap.Uint64("region id", region.Id), zap.Uint64("index", task.index), zap.Binary("hash", hash))
+	msg := NewPeerMsg(MsgTypeComputeResult, region.Id, &MsgComputeHashResult{
+		Index: task.index,
+		Hash:  hash,
+	})
+	if err = r.router.send(region.Id, msg); err != nil {
+		log.Warn("failed to send hash compute result", zap.Uint64("region id", region.Id), zap.Error(err))
+	}
+}
+
+func copyRegionLocks(lockStore *lockstore.MemStore, region *metapb.Region) *lockstore.MemStore {
+	lockSnap := lockstore.NewMemStore(8 << 20)
+	startKey, endKey := RawStartKey(region), RawEndKey(region)
+	it := lockStore.NewIterator()
+	for it.Seek(startKey); it.Valid() && bytes.Compare(it.Key(), endKey) < 0; it.Next() {
+		lockSnap.Put(it.Key(), it.Value())
+	}
+	return lockSnap
+}
+
+// computeRegionHash calculates the crc32 checksum of the region state, the data, the extra transaction status
+// keys, the raw and versioned keys and the locks in the snapshot. The versions of the keys are not included
+// because the raw and versioned keys are written with local versions.
+func computeRegionHash(region *metapb.Region, snap *mvcc.DBSnapshot) ([]byte, error) {
+	defer snap.Txn.Discard()
+	digest := crc32.NewIEEE()
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], region.Id)
+	digest.Write(buf[:])
+	startKey, endKey := RawStartKey(region), RawEndKey(region)
+	err := hashRange(digest, snap.Txn, startKey, endKey, func(item *badger.Item) bool {
+		// The extra keys in the data range of the first and the last regions are hashed below.
+		return !item.IsEmpty() && !isExtraTxnStatusKey(item.Key())
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The rollbacks and the Op_Lock records are stored in the extra keys with empty values.
+	extraStart, extraEnd := mvcc.EncodeExtraTxnStatusKey(startKey, math.MaxUint64), mvcc.EncodeExtraTxnStatusKey(endKey, 0)
+	err = hashRange(digest, snap.Txn, extraStart, extraEnd, func(item *badger.Item) bool {
+		if !isExtraTxnStatusKey(item.Key()) {
+			return false
+		}
+		key := mvcc.DecodeExtraTxnStatusKey(item.Key())
+		return bytes.Compare(key, startKey) >= 0 && bytes.Compare(key, endKey) < 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range keySpaceRanges(region.StartKey, region.EndKey) {
+		err = hashRange(digest, snap.Txn, r.startKey, r.endKey, func(item *badger.Item) bool {
+			// A versioned delete hides the older versions, so it's a part of the data.
+			return !item.IsEmpty() || bytes.Equal(item.UserMeta(), mvcc.VerDeleteUserMeta)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	lockIt := snap.LockStore.NewIterator()
+	for lockIt.Seek(startKey); lockIt.Valid() && bytes.Compare(lockIt.Key(), endKey) < 0; lockIt.Next() {
+		digest.Write(lockIt.Key())
+		digest.Write(lockIt.Value())
+	}
+	// The region state is the same on all replicas after the ComputeHash is applied.
+	regionState, err := getValueTxn(snap.Txn, RegionStateKey(region.Id))
+	if err != nil {
+		return nil, err
+	}
+	digest.Write(regionState)
+	binary.BigEndian.PutUint32(buf[:4], digest.Sum32())
+	return append([]byte{}, buf[:4]...), nil
+}
+
+// hashRange writes the key, the user meta and the value of the latest version of the keys in [startKey, endKey)
+// accepted by the filter to the digest.
+func hashRange(digest hash.Hash32, txn *badger.Txn, startKey, endKey []byte, filter func(item *badger.Item) bool) error {
+	it := dbreader.NewIterator(txn, false, startKey, endKey)
+	defer it.Close()
+	for it.Seek(startKey); it.Valid(); it.Next() {
+		item := it.Item()
+		if bytes.Compare(item.Key(), endKey) >= 0 {
+			break
+		}
+		if !filter(item) {
+			continue
+		}
+		val, err := item.Value()
+		if err != nil {
+			return err
+		}
+		digest.Write(item.Key())
+		digest.Write(item.UserMeta())
+		digest.Write(val)
+	}
+	return nil
+}
+
+// isExtraTxnStatusKey checks whether the key is an extra transaction status key, the first byte of the data key
+// 'm' or 't' is incremented to 'n' or 'u' in it.
+func isExtraTxnStatusKey(key []byte) bool {
+	return len(key) > 0 && (key[0] == 'n' || key[0] == 'u')
 }
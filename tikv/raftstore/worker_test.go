@@ -15,6 +15,7 @@ package raftstore
 
 import (
 	"io/ioutil"
+	"math"
 	"os"
 	"sync"
 	"testing"
@@ -265,6 +266,139 @@ func TestPendingApplies(t *testing.T) {
 	// todo, check cf num files at level 0 is 2
 }
 
+func TestSnapRawAndVerKeys(t *testing.T) {
+	kvPath, err := ioutil.TempDir("", "testSnapRawAndVerKeys")
+	require.Nil(t, err)
+	regionID := uint64(1)
+	db := getTestDBForRegions(t, kvPath, []uint64{regionID})
+	engines := newEnginesWithKVDb(t, db)
+	engines.kvPath = kvPath
+	defer cleanUpTestEngineData(engines)
+
+	rawKey := func(key string) y.Key {
+		return y.KeyWithTs(mvcc.EncodeRawKey([]byte(key)), KvTS)
+	}
+	verKey := func(key string, version uint64) y.Key {
+		return y.KeyWithTs(mvcc.EncodeVerKey([]byte(key), version), KvTS)
+	}
+	wb := new(WriteBatch)
+	wb.SetWithUserMeta(rawKey("tb"), []byte("raw"), mvcc.NewRawUserMeta(0))
+	wb.SetWithUserMeta(rawKey("tc"), make([]byte, 128), mvcc.NewRawUserMeta(math.MaxUint32))
+	wb.SetWithUserMeta(verKey("tb", 10), []byte("v10"), mvcc.VerUserMeta)
+	wb.SetWithUserMeta(verKey("tb", 20), nil, mvcc.VerDeleteUserMeta)
+	wb.SetWithUserMeta(verKey("tc", 10), nil, mvcc.VerUserMeta)
+	// The keys out of the region are not in the snapshot and are kept.
+	wb.SetWithUserMeta(rawKey("tzz"), []byte("out"), mvcc.NewRawUserMeta(0))
+	wb.SetWithUserMeta(verKey("tzz", 10), []byte("out"), mvcc.VerUserMeta)
+	require.Nil(t, wb.WriteToKV(db))
+
+	get := func(key []byte) (val, userMeta []byte, found bool) {
+		require.Nil(t, db.DB.View(func(txn *badger.Txn) error {
+			txn.SetReadTS(math.MaxUint64)
+			item, err := txn.Get(key)
+			if err == badger.ErrKeyNotFound {
+				return nil
+			}
+			require.Nil(t, err)
+			val, err = item.ValueCopy(nil)
+			require.Nil(t, err)
+			userMeta, found = item.UserMeta(), true
+			return nil
+		}))
+		return
+	}
+
+	snapPath, err := ioutil.TempDir("", "unistore_snap")
+	require.Nil(t, err)
+	defer os.RemoveAll(snapPath)
+	mgr := NewSnapManager(snapPath, nil)
+	runner := newRegionTaskHandler(&config.DefaultConf, engines, mgr, 0, 0)
+	txn := engines.kv.DB.NewTransaction(false)
+	index, _, err := getAppliedIdxTermForSnapshot(engines.raft, txn, regionID)
+	require.Nil(t, err)
+	txn.Discard()
+	tx := make(chan *eraftpb.Snapshot, 1)
+	runner.handle(task{
+		tp:   taskTypeRegionGen,
+		data: &regionTask{regionId: regionID, notifier: tx, redoIdx: index + 1},
+	})
+	snap := <-tx
+	key := SnapKeyFromRegionSnap(regionID, snap)
+	s1, err := mgr.GetSnapshotForSending(key)
+	require.Nil(t, err)
+	s2, err := mgr.GetSnapshotForReceiving(key, snap.Data)
+	require.Nil(t, err)
+	require.Nil(t, copySnapshot(s2, s1))
+
+	// The keys written after the snapshot are stale, they are removed when the snapshot is applied.
+	wb = new(WriteBatch)
+	wb.SetWithUserMeta(rawKey("tb"), []byte("stale"), mvcc.NewRawUserMeta(0))
+	wb.SetWithUserMeta(rawKey("td"), []byte("stale"), mvcc.NewRawUserMeta(0))
+	wb.SetWithUserMeta(verKey("td", 10), []byte("stale"), mvcc.VerUserMeta)
+	regionLocalState, err := getRegionLocalState(engines.kv.DB, regionID)
+	require.Nil(t, err)
+	regionLocalState.State = rspb.PeerState_Applying
+	require.Nil(t, wb.SetMsg(y.KeyWithTs(RegionStateKey(regionID), KvTS), regionLocalState))
+	require.Nil(t, wb.WriteToKV(engines.kv))
+
+	status := JobStatus_Pending
+	runner.handle(task{
+		tp:   taskTypeRegionApply,
+		data: &regionTask{regionId: regionID, status: &status},
+	})
+	require.Equal(t, JobStatus_Finished, status)
+
+	val, userMeta, found := get(mvcc.EncodeRawKey([]byte("tb")))
+	require.True(t, found)
+	assert.Equal(t, []byte("raw"), val)
+	assert.Equal(t, uint64(0), mvcc.RawUserMeta(userMeta).ExpireTS())
+	val, userMeta, found = get(mvcc.EncodeRawKey([]byte("tc")))
+	require.True(t, found)
+	assert.Len(t, val, 128)
+	assert.Equal(t, uint64(math.MaxUint32), mvcc.RawUserMeta(userMeta).ExpireTS())
+	val, userMeta, found = get(mvcc.EncodeVerKey([]byte("tb"), 10))
+	require.True(t, found)
+	assert.Equal(t, []byte("v10"), val)
+	assert.Equal(t, mvcc.VerUserMeta, userMeta)
+	_, userMeta, found = get(mvcc.EncodeVerKey([]byte("tb"), 20))
+	require.True(t, found)
+	assert.Equal(t, mvcc.VerDeleteUserMeta, userMeta)
+	val, userMeta, found = get(mvcc.EncodeVerKey([]byte("tc"), 10))
+	require.True(t, found)
+	assert.Len(t, val, 0)
+	assert.Equal(t, mvcc.VerUserMeta, userMeta)
+	_, _, found = get(mvcc.EncodeRawKey([]byte("td")))
+	assert.False(t, found)
+	_, _, found = get(mvcc.EncodeVerKey([]byte("td"), 10))
+	assert.False(t, found)
+	_, _, found = get(mvcc.EncodeRawKey([]byte("tzz")))
+	assert.True(t, found)
+
+	// The applied keys have an older version than the later writes.
+	wb = new(WriteBatch)
+	wb.SetWithUserMeta(rawKey("tb"), []byte("new"), mvcc.NewRawUserMeta(0))
+	require.Nil(t, wb.WriteToKV(db))
+	val, _, _ = get(mvcc.EncodeRawKey([]byte("tb")))
+	assert.Equal(t, []byte("new"), val)
+
+	// Destroying the peer deletes the raw and versioned keys in the region.
+	region := genTestRegion(regionID, 1, 1)
+	for _, r := range keySpaceRanges(region.StartKey, region.EndKey) {
+		runner.handle(task{
+			tp:   taskTypeRegionDestroy,
+			data: &regionTask{regionId: regionID, startKey: r.startKey, endKey: r.endKey},
+		})
+	}
+	_, _, found = get(mvcc.EncodeRawKey([]byte("tb")))
+	assert.False(t, found)
+	_, _, found = get(mvcc.EncodeVerKey([]byte("tb"), 10))
+	assert.False(t, found)
+	_, _, found = get(mvcc.EncodeRawKey([]byte("tzz")))
+	assert.True(t, found)
+	_, _, found = get(mvcc.EncodeVerKey([]byte("tzz"), 10))
+	assert.True(t, found)
+}
+
 func TestGcRaftLog(t *testing.T) {
 	engines := newTestEngines(t)
 	defer cleanUpTestEngineData(engines)
@@ -381,3 +515,54 @@ func raftLogMustExist(t *testing.T, db *badger.DB, regionId, startIdx, endIdx ui
 		})
 	}
 }
+
+func TestComputeRegionHash(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	require.Nil(t, BootstrapStore(engines, 1, 1))
+	region, err := PrepareBootstrap(engines, 1, 1, 1)
+	require.Nil(t, err)
+	require.Nil(t, engines.kv.DB.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(&badger.Entry{Key: y.KeyWithTs([]byte("t1"), 100), Value: []byte("v1")})
+	}))
+	computeHash := func() []byte {
+		hash, err := computeRegionHash(region, &mvcc.DBSnapshot{
+			Txn:       engines.kv.DB.NewTransaction(false),
+			LockStore: engines.kv.LockStore,
+		})
+		require.Nil(t, err)
+		return hash
+	}
+	hash := computeHash()
+	assert.Equal(t, hash, computeHash())
+
+	engines.kv.LockStore.Put([]byte("t2"), []byte("lock"))
+	hashWithLock := computeHash()
+	assert.NotEqual(t, hash, hashWithLock)
+
+	require.Nil(t, engines.kv.DB.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(&badger.Entry{Key: y.KeyWithTs([]byte("t3"), 100), Value: []byte("v3")})
+	}))
+	hash = computeHash()
+	assert.NotEqual(t, hashWithLock, hash)
+
+	// The rollback records, the raw keys and the versioned deletes are hashed too.
+	for _, entry := range []*badger.Entry{
+		{Key: y.KeyWithTs(mvcc.EncodeExtraTxnStatusKey([]byte("t4"), 90), 90), UserMeta: mvcc.NewDBUserMeta(90, 0)},
+		{Key: y.KeyWithTs(mvcc.EncodeRawKey([]byte("r1")), KvTS), Value: []byte("v"), UserMeta: mvcc.NewRawUserMeta(0)},
+		{Key: y.KeyWithTs(mvcc.EncodeVerKey([]byte("v1"), 10), KvTS), UserMeta: mvcc.VerDeleteUserMeta},
+	} {
+		require.Nil(t, engines.kv.DB.Update(func(txn *badger.Txn) error {
+			return txn.SetEntry(entry)
+		}))
+		newHash := computeHash()
+		assert.NotEqual(t, hash, newHash)
+		hash = newHash
+	}
+}
+
+func TestNeedCompact(t *testing.T) {
+	assert.True(t, needCompact(8, 20, 8, 40))
+	assert.False(t, needCompact(8, 20, 9, 40))
+	assert.False(t, needCompact(8, 20, 8, 50))
+}
@@ -0,0 +1,333 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bytes"
+	"math"
+	"time"
+
+	"github.com/ngaut/unistore/tikv/dbreader"
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/ngaut/unistore/tikv/raftstore"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+// Raw keys are stored with the RawKeyPrefix in the internal key space, every write uses a new
+// version, so the latest version is always read.
+const rawReadTS = math.MaxUint64
+
+// errRawEmptyValue is returned for the raw puts with an empty value, raw gets can't tell it from a missing key.
+var errRawEmptyValue = errors.New("value is empty")
+
+// checkRawKeys returns a KeyNotInRegion error if any key is out of the region range.
+func (req *requestCtx) checkRawKeys(keys ...[]byte) *errorpb.Error {
+	for _, key := range keys {
+		err := raftstore.CheckKeyInRegion(codec.EncodeBytes(nil, key), req.regCtx.meta)
+		if err != nil {
+			return raftstore.RaftstoreErrToPbError(err)
+		}
+	}
+	return nil
+}
+
+// keyRange returns the range of [startKey, endKey) limited in the region, the raw and versioned key spaces are
+// not bounded by the internal key prefix, so an empty endKey is kept if the region has no end key.
+func (req *requestCtx) keyRange(startKey, endKey []byte) (start, end []byte) {
+	regCtx := req.regCtx
+	if regCtx.lessThanStartKey(startKey) {
+		startKey = regCtx.startKey
+	}
+	regionEnd := regCtx.endKey
+	if bytes.Equal(regionEnd, InternalKeyPrefix) {
+		regionEnd = nil
+	}
+	if len(regionEnd) > 0 && (len(endKey) == 0 || bytes.Compare(endKey, regionEnd) > 0) {
+		endKey = regionEnd
+	}
+	return startKey, endKey
+}
+
+// encodedRange returns the range of the keys stored in DB for [startKey, endKey) of the key space limited in the region.
+func (req *requestCtx) encodedRange(space mvcc.KeySpace, startKey, endKey []byte) (start, end []byte) {
+	return space.EncodeRange(req.keyRange(startKey, endKey))
+}
+
+func encodePrefixedKey(prefix, key []byte) []byte {
+	b := make([]byte, 0, len(prefix)+len(key))
+	b = append(b, prefix...)
+	return append(b, key...)
+}
+
+// rawReader reads the latest version of raw keys, expired keys are invisible.
+type rawReader struct {
+	txn      *badger.Txn
+	prefix   []byte
+	startKey []byte
+	endKey   []byte
+	now      uint64
+}
+
+func (req *requestCtx) newRawReader(startKey, endKey []byte) *rawReader {
+	start, end := req.encodedRange(mvcc.KeySpaceRaw, startKey, endKey)
+	txn := req.svr.mvccStore.db.NewTransaction(false)
+	txn.SetReadTS(rawReadTS)
+	return &rawReader{
+		txn:      txn,
+		prefix:   mvcc.RawKeyPrefix,
+		startKey: start,
+		endKey:   end,
+		now:      uint64(time.Now().Unix()),
+	}
+}
+
+func (r *rawReader) encodeKey(key []byte) []byte {
+	return encodePrefixedKey(r.prefix, key)
+}
+
+// decodeKey returns the key without the prefix, it shares memory with encodedKey.
+func (r *rawReader) decodeKey(encodedKey []byte) []byte {
+	return encodedKey[len(r.prefix):]
+}
+
+func (r *rawReader) isValid(item *badger.Item) bool {
+	return item != nil && !item.IsEmpty() && !mvcc.RawUserMeta(item.UserMeta()).IsExpired(r.now)
+}
+
+// getItem returns nil if the key doesn't exist or is expired.
+func (r *rawReader) getItem(key []byte) (*badger.Item, error) {
+	item, err := r.txn.Get(r.encodeKey(key))
+	if err != nil && err != badger.ErrKeyNotFound {
+		return nil, errors.Trace(err)
+	}
+	if !r.isValid(item) {
+		return nil, nil
+	}
+	return item, nil
+}
+
+func (r *rawReader) get(key []byte) ([]byte, error) {
+	item, err := r.getItem(key)
+	if item == nil || err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+func (r *rawReader) batchGet(keys [][]byte) ([]*kvrpcpb.KvPair, error) {
+	encodedKeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		encodedKeys[i] = r.encodeKey(key)
+	}
+	items, err := r.txn.MultiGet(encodedKeys)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	pairs := make([]*kvrpcpb.KvPair, 0, len(keys))
+	for i, item := range items {
+		if !r.isValid(item) {
+			continue
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		pairs = append(pairs, &kvrpcpb.KvPair{
+			Key:   keys[i],
+			Value: val,
+		})
+	}
+	return pairs, nil
+}
+
+// scan iterates the range of the reader, the lower bound is inclusive and the upper bound is exclusive.
+func (r *rawReader) scan(limit int, keyOnly, reverse bool) ([]*kvrpcpb.KvPair, error) {
+	var pairs []*kvrpcpb.KvPair
+	err := r.iterate(reverse, func(item *badger.Item) (bool, error) {
+		pair := &kvrpcpb.KvPair{Key: safeCopy(r.decodeKey(item.Key()))}
+		if !keyOnly {
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return false, errors.Trace(err)
+			}
+			pair.Value = val
+		}
+		pairs = append(pairs, pair)
+		return len(pairs) < limit, nil
+	})
+	return pairs, err
+}
+
+// iterate calls f with the valid items in the range of the reader until f returns false or an error.
+func (r *rawReader) iterate(reverse bool, f func(item *badger.Item) (bool, error)) error {
+	it := dbreader.NewIterator(r.txn, reverse, r.startKey, r.endKey)
+	defer it.Close()
+	if reverse {
+		it.Seek(r.endKey)
+	} else {
+		it.Seek(r.startKey)
+	}
+	for ; it.Valid(); it.Next() {
+		item := it.Item()
+		key := item.Key()
+		if reverse {
+			if bytes.Compare(key, r.startKey) < 0 {
+				break
+			}
+			if bytes.Equal(key, r.endKey) {
+				continue
+			}
+		} else if exceedEndKey(key, r.endKey) {
+			break
+		}
+		if !r.isValid(item) {
+			continue
+		}
+		if ok, err := f(item); !ok || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *rawReader) close() {
+	r.txn.Discard()
+}
+
+func (store *MVCCStore) RawGet(reqCtx *requestCtx, key []byte) ([]byte, error) {
+	reader := reqCtx.newRawReader(nil, nil)
+	defer reader.close()
+	return reader.get(key)
+}
+
+// RawGetKeyTTL returns the remaining TTL in seconds, 0 means the key has no TTL.
+func (store *MVCCStore) RawGetKeyTTL(reqCtx *requestCtx, key []byte) (ttl uint64, notFound bool, err error) {
+	reader := reqCtx.newRawReader(nil, nil)
+	defer reader.close()
+	item, err := reader.getItem(key)
+	if item == nil || err != nil {
+		return 0, true, err
+	}
+	expireTS := mvcc.RawUserMeta(item.UserMeta()).ExpireTS()
+	if expireTS == 0 {
+		return 0, false, nil
+	}
+	return expireTS - reader.now, false, nil
+}
+
+func (store *MVCCStore) RawBatchGet(reqCtx *requestCtx, keys [][]byte) ([]*kvrpcpb.KvPair, error) {
+	reader := reqCtx.newRawReader(nil, nil)
+	defer reader.close()
+	return reader.batchGet(keys)
+}
+
+// RawScan scans [startKey, endKey), if reverse is true, startKey is the upper bound and endKey is the lower bound.
+func (store *MVCCStore) RawScan(reqCtx *requestCtx, startKey, endKey []byte, limit uint32, keyOnly, reverse bool) ([]*kvrpcpb.KvPair, error) {
+	if limit == 0 {
+		return nil, nil
+	}
+	if reverse {
+		startKey, endKey = endKey, startKey
+	}
+	reader := reqCtx.newRawReader(startKey, endKey)
+	defer reader.close()
+	return reader.scan(int(limit), keyOnly, reverse)
+}
+
+// RawPut puts the pairs with the TTL in seconds, 0 means no TTL.
+func (store *MVCCStore) RawPut(reqCtx *requestCtx, pairs []*kvrpcpb.KvPair, ttl uint64) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+	keys := make([][]byte, len(pairs))
+	for i, pair := range pairs {
+		if len(pair.Value) == 0 {
+			return errRawEmptyValue
+		}
+		keys[i] = mvcc.EncodeRawKey(pair.Key)
+	}
+	hashVals := keysToHashVals(keys...)
+	regCtx := reqCtx.regCtx
+	regCtx.AcquireLatches(hashVals)
+	defer regCtx.ReleaseLatches(hashVals)
+	batch := store.dbWriter.NewWriteBatch(0, 0, reqCtx.rpcCtx)
+	expireTS := mvcc.RawExpireTS(ttl, uint64(time.Now().Unix()))
+	for _, pair := range pairs {
+		batch.RawPut(pair.Key, pair.Value, expireTS)
+	}
+	return store.dbWriter.Write(batch)
+}
+
+func (store *MVCCStore) RawDelete(reqCtx *requestCtx, keys [][]byte) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	encodedKeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		encodedKeys[i] = mvcc.EncodeRawKey(key)
+	}
+	hashVals := keysToHashVals(encodedKeys...)
+	regCtx := reqCtx.regCtx
+	regCtx.AcquireLatches(hashVals)
+	defer regCtx.ReleaseLatches(hashVals)
+	batch := store.dbWriter.NewWriteBatch(0, 0, reqCtx.rpcCtx)
+	for _, key := range keys {
+		batch.RawDelete(key)
+	}
+	return store.dbWriter.Write(batch)
+}
+
+// RawCompareAndSwap puts the value if the current value matches the expected one, the value must not be empty.
+// It holds the latch of the key, so it is serialized with other raw writes on the same key.
+func (store *MVCCStore) RawCompareAndSwap(reqCtx *requestCtx, req *kvrpcpb.RawCASRequest) (*kvrpcpb.RawCASResponse, error) {
+	if len(req.Value) == 0 {
+		return nil, errRawEmptyValue
+	}
+	hashVals := keysToHashVals(mvcc.EncodeRawKey(req.Key))
+	regCtx := reqCtx.regCtx
+	regCtx.AcquireLatches(hashVals)
+	defer regCtx.ReleaseLatches(hashVals)
+	reader := reqCtx.newRawReader(nil, nil)
+	prevVal, err := reader.get(req.Key)
+	reader.close()
+	if err != nil {
+		return nil, err
+	}
+	resp := &kvrpcpb.RawCASResponse{
+		PreviousNotExist: prevVal == nil,
+		PreviousValue:    prevVal,
+	}
+	if req.PreviousNotExist != resp.PreviousNotExist ||
+		(!req.PreviousNotExist && !bytes.Equal(req.PreviousValue, prevVal)) {
+		return resp, nil
+	}
+	batch := store.dbWriter.NewWriteBatch(0, 0, reqCtx.rpcCtx)
+	batch.RawPut(req.Key, req.Value, mvcc.RawExpireTS(req.Ttl, uint64(time.Now().Unix())))
+	if err = store.dbWriter.Write(batch); err != nil {
+		return nil, err
+	}
+	resp.Succeed = true
+	return resp, nil
+}
+
+// RawDeleteRange deletes the raw keys in [startKey, endKey) limited in the region, the range is deleted in bounded
+// batches with latches by the standalone writer and by a single DeleteRange command in raft mode.
+func (store *MVCCStore) RawDeleteRange(reqCtx *requestCtx, startKey, endKey []byte) error {
+	startKey, endKey = reqCtx.keyRange(startKey, endKey)
+	return store.dbWriter.DeleteRange(mvcc.KeySpaceRaw, startKey, endKey, reqCtx.regCtx, reqCtx.rpcCtx)
+}
@@ -16,6 +16,7 @@ package tikv
 import (
 	"bytes"
 	"encoding/binary"
+	"math"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -61,6 +62,14 @@ type regionCtx struct {
 
 	latches       *latches
 	leaderChecker raftstore.LeaderChecker
+	// safeTS is the max ts that stale reads can read at on this replica.
+	safeTS uint64
+	// resolving is set when the safe ts is being advanced.
+	resolving int32
+	// maxTSEpoch is increased on role changes, the reads served by the other replicas are not recorded
+	// in the local max ts. The max ts is synced with PD for the epoch in syncedMaxTSEpoch.
+	maxTSEpoch       uint64
+	syncedMaxTSEpoch uint64
 }
 
 type latches struct {
@@ -128,6 +137,10 @@ func newRegionCtx(meta *metapb.Region, latches *latches, checker raftstore.Leade
 		regionEpoch:   unsafe.Pointer(meta.GetRegionEpoch()),
 		leaderChecker: checker,
 	}
+	if checker != nil {
+		// The region may have been served by other stores.
+		regCtx.maxTSEpoch = 1
+	}
 	regCtx.startKey = regCtx.rawStartKey()
 	regCtx.endKey = regCtx.rawEndKey()
 	if len(regCtx.endKey) == 0 {
@@ -145,6 +158,43 @@ func (ri *regionCtx) updateRegionEpoch(epoch *metapb.RegionEpoch) {
 	atomic.StorePointer(&ri.regionEpoch, (unsafe.Pointer)(epoch))
 }
 
+func (ri *regionCtx) getSafeTS() uint64 {
+	return atomic.LoadUint64(&ri.safeTS)
+}
+
+// updateSafeTS advances the safe ts, it never goes backward.
+func (ri *regionCtx) updateSafeTS(ts uint64) {
+	for {
+		old := atomic.LoadUint64(&ri.safeTS)
+		if ts <= old || atomic.CompareAndSwapUint64(&ri.safeTS, old, ts) {
+			return
+		}
+	}
+}
+
+// getMaxTSEpoch returns the current max ts epoch and whether the max ts is synced for it.
+func (ri *regionCtx) getMaxTSEpoch() (epoch uint64, synced bool) {
+	epoch = atomic.LoadUint64(&ri.maxTSEpoch)
+	return epoch, atomic.LoadUint64(&ri.syncedMaxTSEpoch) == epoch
+}
+
+func (ri *regionCtx) setMaxTSSynced(epoch uint64) {
+	atomic.StoreUint64(&ri.syncedMaxTSEpoch, epoch)
+}
+
+// invalidateMaxTS requires the max ts to be synced again before it is used to calculate min commit ts.
+func (ri *regionCtx) invalidateMaxTS() {
+	atomic.AddUint64(&ri.maxTSEpoch, 1)
+}
+
+// overlaps returns true if the region overlaps with the raw key range [startKey, endKey).
+func (ri *regionCtx) overlaps(startKey, endKey []byte) bool {
+	if len(endKey) > 0 && bytes.Compare(endKey, ri.startKey) <= 0 {
+		return false
+	}
+	return !ri.greaterEqualEndKey(startKey)
+}
+
 func (ri *regionCtx) rawStartKey() []byte {
 	if len(ri.meta.StartKey) == 0 {
 		return nil
@@ -249,9 +299,14 @@ type RegionManager interface {
 	GetRegionFromCtx(ctx *kvrpcpb.Context) (*regionCtx, *errorpb.Error)
 	GetStoreInfoFromCtx(ctx *kvrpcpb.Context) (string, uint64, *errorpb.Error)
 	SplitRegion(req *kvrpcpb.SplitRegionRequest) *kvrpcpb.SplitRegionResponse
+	ReadIndex(req *kvrpcpb.ReadIndexRequest) *kvrpcpb.ReadIndexResponse
+	GetStoreSafeTS(keyRange *kvrpcpb.KeyRange) uint64
+	CheckLeader(infos []*kvrpcpb.LeaderInfo) []uint64
 	GetStoreIDByAddr(addr string) (uint64, error)
 	GetStoreAddrByStoreId(storeId uint64) (string, error)
 	Close() error
+
+	regionByKey(key []byte) *regionCtx
 }
 
 type regionManager struct {
@@ -322,6 +377,55 @@ func (rm *regionManager) GetRegionFromCtx(ctx *kvrpcpb.Context) (*regionCtx, *er
 	return ri, nil
 }
 
+// regionByKey returns the region containing the key, nil if there is no such region.
+func (rm *regionManager) regionByKey(key []byte) *regionCtx {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	for _, ri := range rm.regions {
+		if !ri.lessThanStartKey(key) && !ri.greaterEqualEndKey(key) {
+			return ri
+		}
+	}
+	return nil
+}
+
+// GetStoreSafeTS returns the min safe ts of the regions overlapped with the key range.
+func (rm *regionManager) GetStoreSafeTS(keyRange *kvrpcpb.KeyRange) uint64 {
+	var safeTS uint64 = math.MaxUint64
+	rm.mu.RLock()
+	for _, ri := range rm.regions {
+		if !ri.overlaps(keyRange.GetStartKey(), keyRange.GetEndKey()) {
+			continue
+		}
+		if ts := ri.getSafeTS(); ts < safeTS {
+			safeTS = ts
+		}
+	}
+	rm.mu.RUnlock()
+	if safeTS == math.MaxUint64 {
+		return 0
+	}
+	return safeTS
+}
+
+// CheckLeader returns the IDs of the regions whose leader is the same as the leader info in this store.
+func (rm *regionManager) CheckLeader(infos []*kvrpcpb.LeaderInfo) []uint64 {
+	regionIDs := make([]uint64, 0, len(infos))
+	rm.mu.RLock()
+	for _, info := range infos {
+		ri := rm.regions[info.RegionId]
+		if ri == nil {
+			continue
+		}
+		// Regions without leader checker have only one replica.
+		if ri.leaderChecker == nil || ri.leaderChecker.AgreeLeader(info) {
+			regionIDs = append(regionIDs, info.RegionId)
+		}
+	}
+	rm.mu.RUnlock()
+	return regionIDs
+}
+
 func (rm *regionManager) isEpochStale(lhs, rhs *metapb.RegionEpoch) bool {
 	return lhs.GetConfVer() != rhs.GetConfVer() || lhs.GetVersion() != rhs.GetVersion()
 }
@@ -373,6 +477,8 @@ type RaftRegionManager struct {
 	router   *raftstore.RaftstoreRouter
 	eventCh  chan interface{}
 	detector *DetectorServer
+	closeCh  chan struct{}
+	wg       sync.WaitGroup
 }
 
 func NewRaftRegionManager(store *metapb.Store, router *raftstore.RaftstoreRouter, detector *DetectorServer) *RaftRegionManager {
@@ -385,6 +491,7 @@ func NewRaftRegionManager(store *metapb.Store, router *raftstore.RaftstoreRouter
 		},
 		eventCh:  make(chan interface{}, 1024),
 		detector: detector,
+		closeCh:  make(chan struct{}),
 	}
 	go m.runEventHandler()
 	return m
@@ -448,20 +555,49 @@ func (rm *RaftRegionManager) OnRegionConfChange(ctx *raftstore.PeerEventContext,
 	}
 }
 
+type regionMergeEvent struct {
+	ctx    *raftstore.PeerEventContext
+	target *metapb.Region
+	source *metapb.Region
+}
+
+func (rm *RaftRegionManager) OnRegionMerge(ctx *raftstore.PeerEventContext, target, source *metapb.Region) {
+	rm.eventCh <- &regionMergeEvent{
+		ctx:    ctx,
+		target: target,
+		source: source,
+	}
+}
+
 type regionRoleChangeEvent struct {
 	regionId uint64
 	newState raft.StateType
 }
 
+// OnRoleChange invalidates the max ts before it returns, the async commit prewrites served after the role
+// change must not use the max ts synced before it.
 func (rm *RaftRegionManager) OnRoleChange(regionId uint64, newState raft.StateType) {
+	rm.mu.RLock()
+	region := rm.regions[regionId]
+	rm.mu.RUnlock()
+	if region != nil {
+		region.invalidateMaxTS()
+	}
 	rm.eventCh <- &regionRoleChangeEvent{regionId: regionId, newState: newState}
 }
 
+// GetRegionFromCtx checks the leader unless it is a stale read or a replica read, the requestCtx only allows them
+// in the read handlers.
 func (rm *RaftRegionManager) GetRegionFromCtx(ctx *kvrpcpb.Context) (*regionCtx, *errorpb.Error) {
 	regionCtx, err := rm.regionManager.GetRegionFromCtx(ctx)
 	if err != nil {
 		return nil, err
 	}
+	if ctx.GetStaleRead() || ctx.GetReplicaRead() {
+		// The read ts is checked against the safe ts of the region for stale reads, and replica reads wait
+		// for the read index of the leader, both are done by newReadRequestCtx.
+		return regionCtx, nil
+	}
 	if err := regionCtx.leaderChecker.IsLeader(ctx, rm.router); err != nil {
 		return nil, err
 	}
@@ -469,6 +605,8 @@ func (rm *RaftRegionManager) GetRegionFromCtx(ctx *kvrpcpb.Context) (*regionCtx,
 }
 
 func (rm *RaftRegionManager) Close() error {
+	close(rm.closeCh)
+	rm.wg.Wait()
 	return nil
 }
 
@@ -495,6 +633,11 @@ func (rm *RaftRegionManager) runEventHandler() {
 			rm.mu.Lock()
 			delete(rm.regions, x.regionID)
 			rm.mu.Unlock()
+		case *regionMergeEvent:
+			rm.mu.Lock()
+			delete(rm.regions, x.source.Id)
+			rm.regions[x.target.Id] = newRegionCtx(x.target, rm.latches, x.ctx.LeaderChecker)
+			rm.mu.Unlock()
 		case *peerApplySnapEvent:
 			rm.mu.Lock()
 			rm.regions[x.region.Id] = newRegionCtx(x.region, rm.latches, x.ctx.LeaderChecker)
@@ -503,6 +646,9 @@ func (rm *RaftRegionManager) runEventHandler() {
 			rm.mu.RLock()
 			region := rm.regions[x.regionId]
 			rm.mu.RUnlock()
+			if region == nil {
+				continue
+			}
 			if bytes.Compare(region.startKey, []byte{}) == 0 && len(region.meta.Peers) > 0 {
 				newRole := Follower
 				if x.newState == raft.StateLeader {
@@ -527,6 +673,18 @@ func (rm *RaftRegionManager) SplitRegion(req *kvrpcpb.SplitRegionRequest) *kvrpc
 	return &kvrpcpb.SplitRegionResponse{Regions: regions}
 }
 
+// ReadIndex doesn't check the leader lease, so followers and learners can get the read index.
+func (rm *RaftRegionManager) ReadIndex(req *kvrpcpb.ReadIndexRequest) *kvrpcpb.ReadIndexResponse {
+	if _, err := rm.regionManager.GetRegionFromCtx(req.Context); err != nil {
+		return &kvrpcpb.ReadIndexResponse{RegionError: err}
+	}
+	resp, err := rm.router.ReadIndex(req.Context, req.StartTs, req.Ranges)
+	if err != nil {
+		return &kvrpcpb.ReadIndexResponse{RegionError: err}
+	}
+	return &kvrpcpb.ReadIndexResponse{ReadIndex: resp.GetReadIndex(), Locked: resp.GetLocked()}
+}
+
 type StandAloneRegionManager struct {
 	regionManager
 	bundle     *mvcc.DBBundle
@@ -912,6 +1070,11 @@ func (rm *StandAloneRegionManager) SplitRegion(req *kvrpcpb.SplitRegionRequest)
 	return &kvrpcpb.SplitRegionResponse{}
 }
 
+// ReadIndex returns an empty response, there is only one replica in standalone mode.
+func (rm *StandAloneRegionManager) ReadIndex(req *kvrpcpb.ReadIndexRequest) *kvrpcpb.ReadIndexResponse {
+	return &kvrpcpb.ReadIndexResponse{}
+}
+
 func (rm *StandAloneRegionManager) Close() error {
 	close(rm.closeCh)
 	rm.wg.Wait()
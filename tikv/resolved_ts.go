@@ -0,0 +1,145 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const advanceSafeTSInterval = time.Second
+
+// minLockTS returns the min start ts of the locks in the key range, pessimistic locks are ignored because
+// they don't block reads. It returns math.MaxUint64 if there is no lock.
+func (store *MVCCStore) minLockTS(startKey, endKey []byte) uint64 {
+	var minTS uint64 = math.MaxUint64
+	it := store.lockStore.NewIterator()
+	for it.Seek(startKey); it.Valid(); it.Next() {
+		if exceedEndKey(it.Key(), endKey) {
+			break
+		}
+		lock := mvcc.DecodeLock(it.Value())
+		if lock.Op == uint8(kvrpcpb.Op_PessimisticLock) {
+			continue
+		}
+		if lock.StartTS < minTS {
+			minTS = lock.StartTS
+		}
+	}
+	return minTS
+}
+
+// resolveTS returns the max ts that is safe to read in the key range if all the transactions that may
+// commit before ts have their locks in the memory locks or the lock store. The memory locks are collected
+// first, a prewrite writes its locks to the lock store before it removes the memory locks.
+func (store *MVCCStore) resolveTS(startKey, endKey []byte, ts uint64) uint64 {
+	minLockTS := store.memLocks.minLockTS(startKey, endKey)
+	if lockTS := store.minLockTS(startKey, endKey); lockTS < minLockTS {
+		minLockTS = lockTS
+	}
+	if minLockTS <= ts {
+		return minLockTS - 1
+	}
+	return ts
+}
+
+// StartResolvedTSWorker starts to advance the safe ts of the regions in the store periodically.
+func (rm *RaftRegionManager) StartResolvedTSWorker(store *MVCCStore) {
+	rm.wg.Add(1)
+	go rm.runResolvedTSWorker(store)
+}
+
+func (rm *RaftRegionManager) runResolvedTSWorker(store *MVCCStore) {
+	defer rm.wg.Done()
+	ticker := time.NewTicker(advanceSafeTSInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rm.closeCh:
+			return
+		case <-ticker.C:
+		}
+		// The ts must be fetched before the locks are collected, transactions that prewrite after it
+		// will get a larger commit ts.
+		physical, logical, err := store.pdClient.GetTS(context.Background())
+		if err != nil {
+			log.Warn("get ts for resolved ts failed", zap.Error(err))
+			continue
+		}
+		ts := uint64(physical)<<18 + uint64(logical)
+		rm.mu.RLock()
+		regions := make([]*regionCtx, 0, len(rm.regions))
+		for _, ri := range rm.regions {
+			regions = append(regions, ri)
+		}
+		rm.mu.RUnlock()
+		for _, ri := range regions {
+			// The previous round may still be waiting for the read index.
+			if !atomic.CompareAndSwapInt32(&ri.resolving, 0, 1) {
+				continue
+			}
+			go func(ri *regionCtx) {
+				defer atomic.StoreInt32(&ri.resolving, 0)
+				rm.advanceSafeTS(store, ri, ts)
+			}(ri)
+		}
+	}
+}
+
+// advanceSafeTS advances the safe ts of the region to ts if there is no lock before it.
+// The leader checks its lease and a follower waits until it has applied the read index of
+// the leader at ts, the leader updates its max ts with ts and returns the memory lock in the region,
+// so all the transactions that may commit before ts are visible in the local lock store.
+func (rm *RaftRegionManager) advanceSafeTS(store *MVCCStore, ri *regionCtx, ts uint64) {
+	var peer *metapb.Peer
+	for _, p := range ri.meta.Peers {
+		if p.StoreId == rm.storeMeta.Id {
+			peer = p
+			break
+		}
+	}
+	if peer == nil {
+		return
+	}
+	ctx := &kvrpcpb.Context{
+		RegionId:    ri.meta.Id,
+		RegionEpoch: ri.getRegionEpoch(),
+		Peer:        peer,
+	}
+	if err := ri.leaderChecker.IsLeader(ctx, rm.router); err != nil {
+		ranges := []*kvrpcpb.KeyRange{{StartKey: ri.startKey, EndKey: ri.endKey}}
+		resp, err := rm.router.ReadIndex(ctx, ts, ranges)
+		if err != nil || resp.GetLocked() != nil {
+			// The leader has not confirmed ts, the transaction being prewritten may commit before it.
+			return
+		}
+	}
+	store.publishSafeTS(ri, ts)
+}
+
+// publishSafeTS updates the safe ts of the region with the resolved ts. The max ts is updated with ts before
+// the locks are collected, so the async commit transactions prewritten later commit after ts, and the ones
+// being prewritten are found in the memory locks, the stale reads at the safe ts can not miss them.
+func (store *MVCCStore) publishSafeTS(ri *regionCtx, ts uint64) {
+	store.memLocks.updateMaxTS(ts)
+	ri.updateSafeTS(store.resolveTS(ri.startKey, ri.endKey, ts))
+}
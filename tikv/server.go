@@ -15,12 +15,16 @@ package tikv
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"io"
+	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/ngaut/unistore/tikv/dbreader"
+	"github.com/ngaut/unistore/tikv/mvcc"
 	"github.com/ngaut/unistore/tikv/raftstore"
 	"github.com/ngaut/unistore/util/lockwaiter"
 	"github.com/pingcap/errors"
@@ -31,11 +35,13 @@ import (
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/mpp"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
 	"github.com/pingcap/kvproto/pkg/tikvpb"
 	"github.com/pingcap/log"
 	"github.com/pingcap/tidb/kv"
 	"github.com/pingcap/tidb/store/mockstore/unistore/client"
 	"github.com/pingcap/tidb/store/mockstore/unistore/cophandler"
+	"github.com/pingcap/tidb/util/codec"
 	"github.com/pingcap/tipb/go-tipb"
 	"go.uber.org/zap"
 )
@@ -47,6 +53,8 @@ type Server struct {
 	regionManager RegionManager
 	innerServer   InnerServer
 	RPCClient     client.Client
+	mppTasks      *MPPTaskHandlerMap
+	coprV2        *CoprocessorV2Registry
 	wg            sync.WaitGroup
 	refCount      int32
 	stopped       int32
@@ -57,6 +65,8 @@ func NewServer(rm RegionManager, store *MVCCStore, innerServer InnerServer) *Ser
 		mvccStore:     store,
 		regionManager: rm,
 		innerServer:   innerServer,
+		mppTasks:      NewMPPTaskHandlerMap(),
+		coprV2:        NewCoprocessorV2Registry(),
 	}
 }
 
@@ -117,6 +127,12 @@ type requestCtx struct {
 }
 
 func newRequestCtx(svr *Server, ctx *kvrpcpb.Context, method string) (*requestCtx, error) {
+	return createRequestCtx(svr, ctx, method, false)
+}
+
+// createRequestCtx creates the requestCtx, replica reads and stale reads are rejected unless followerRead is set
+// by the read handlers, because the leader check is skipped for them.
+func createRequestCtx(svr *Server, ctx *kvrpcpb.Context, method string, followerRead bool) (*requestCtx, error) {
 	atomic.AddInt32(&svr.refCount, 1)
 	if atomic.LoadInt32(&svr.stopped) > 0 {
 		atomic.AddInt32(&svr.refCount, -1)
@@ -128,7 +144,11 @@ func newRequestCtx(svr *Server, ctx *kvrpcpb.Context, method string) (*requestCt
 		startTime: time.Now(),
 		rpcCtx:    ctx,
 	}
-	req.regCtx, req.regErr = svr.regionManager.GetRegionFromCtx(ctx)
+	if !followerRead && (ctx.GetReplicaRead() || ctx.GetStaleRead()) {
+		req.regErr = &errorpb.Error{Message: fmt.Sprintf("%s doesn't support replica read or stale read", method)}
+	} else {
+		req.regCtx, req.regErr = svr.regionManager.GetRegionFromCtx(ctx)
+	}
 	storeAddr, storeId, regErr := svr.regionManager.GetStoreInfoFromCtx(ctx)
 	req.storeAddr = storeAddr
 	req.storeId = storeId
@@ -138,6 +158,83 @@ func newRequestCtx(svr *Server, ctx *kvrpcpb.Context, method string) (*requestCt
 	return req, nil
 }
 
+// newReadRequestCtx creates the requestCtx for reads at readTS in the key ranges, the reads may be served by
+// followers. Replica reads wait for the read index of the leader, which updates its max ts with readTS and
+// returns the memory lock in the ranges as an ErrLocked error.
+// Stale reads are rejected if the data at readTS may be incomplete on this replica.
+func newReadRequestCtx(svr *Server, ctx *kvrpcpb.Context, method string, readTS uint64, ranges []*kvrpcpb.KeyRange) (*requestCtx, error) {
+	req, err := createRequestCtx(svr, ctx, method, true)
+	if err != nil {
+		return nil, err
+	}
+	if req.regErr == nil && ctx.GetStaleRead() {
+		req.regErr = req.checkSafeTS(readTS)
+	}
+	if req.regErr == nil && ctx.GetReplicaRead() {
+		resp := svr.regionManager.ReadIndex(&kvrpcpb.ReadIndexRequest{Context: ctx, StartTs: readTS, Ranges: ranges})
+		if resp.RegionError != nil {
+			req.regErr = resp.RegionError
+		} else if resp.Locked != nil {
+			req.finish()
+			return nil, buildLockErrFromInfo(resp.Locked)
+		}
+	}
+	return req, nil
+}
+
+// pointKeyRanges returns the key ranges covering the keys.
+func pointKeyRanges(keys ...[]byte) []*kvrpcpb.KeyRange {
+	ranges := make([]*kvrpcpb.KeyRange, 0, len(keys))
+	for _, key := range keys {
+		ranges = append(ranges, &kvrpcpb.KeyRange{StartKey: key, EndKey: append(safeCopy(key), 0)})
+	}
+	return ranges
+}
+
+// scanKeyRanges returns the key range of the scan, the start key is the upper bound of a reverse scan.
+func scanKeyRanges(req *kvrpcpb.ScanRequest) []*kvrpcpb.KeyRange {
+	if req.Reverse {
+		return []*kvrpcpb.KeyRange{{StartKey: req.EndKey, EndKey: req.StartKey}}
+	}
+	return []*kvrpcpb.KeyRange{{StartKey: req.StartKey, EndKey: req.EndKey}}
+}
+
+func copKeyRanges(copRanges []*coprocessor.KeyRange) []*kvrpcpb.KeyRange {
+	ranges := make([]*kvrpcpb.KeyRange, 0, len(copRanges))
+	for _, ran := range copRanges {
+		ranges = append(ranges, &kvrpcpb.KeyRange{StartKey: ran.Start, EndKey: ran.End})
+	}
+	return ranges
+}
+
+func (req *requestCtx) checkSafeTS(readTS uint64) *errorpb.Error {
+	if req.regCtx.leaderChecker == nil {
+		// Standalone and mock regions have only one replica, the data is always complete.
+		return nil
+	}
+	safeTS := req.regCtx.getSafeTS()
+	if readTS <= safeTS {
+		return nil
+	}
+	return &errorpb.Error{
+		Message:      fmt.Sprintf("data is not ready, read ts %d, safe ts %d", readTS, safeTS),
+		ServerIsBusy: &errorpb.ServerIsBusy{Reason: "data is not ready"},
+	}
+}
+
+// checkKeyRange returns a KeyNotInRegion error if [startKey, endKey) is not in the region.
+func (req *requestCtx) checkKeyRange(startKey, endKey []byte) *errorpb.Error {
+	meta := req.regCtx.meta
+	err := raftstore.CheckKeyInRegion(codec.EncodeBytes(nil, startKey), meta)
+	if err == nil {
+		err = raftstore.CheckKeyInRegionInclusive(codec.EncodeBytes(nil, endKey), meta)
+	}
+	if err != nil {
+		return raftstore.RaftstoreErrToPbError(err)
+	}
+	return nil
+}
+
 // For read-only requests that doesn't acquire latches, this function must be called after all locks has been checked.
 func (req *requestCtx) getDBReader() *dbreader.DBReader {
 	if req.reader == nil {
@@ -156,7 +253,7 @@ func (req *requestCtx) finish() {
 }
 
 func (svr *Server) KvGet(ctx context.Context, req *kvrpcpb.GetRequest) (*kvrpcpb.GetResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "KvGet")
+	reqCtx, err := newReadRequestCtx(svr, req.Context, "KvGet", req.GetVersion(), pointKeyRanges(req.Key))
 	if err != nil {
 		return &kvrpcpb.GetResponse{Error: convertToKeyError(err)}, nil
 	}
@@ -182,7 +279,7 @@ func (svr *Server) KvGet(ctx context.Context, req *kvrpcpb.GetRequest) (*kvrpcpb
 }
 
 func (svr *Server) KvScan(ctx context.Context, req *kvrpcpb.ScanRequest) (*kvrpcpb.ScanResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "KvScan")
+	reqCtx, err := newReadRequestCtx(svr, req.Context, "KvScan", req.GetVersion(), scanKeyRanges(req))
 	if err != nil {
 		return &kvrpcpb.ScanResponse{Pairs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
 	}
@@ -224,6 +321,7 @@ func (svr *Server) KvPessimisticLock(ctx context.Context, req *kvrpcpb.Pessimist
 			LockKey:         errLocked.Key,
 			LockTS:          errLocked.Lock.StartTS,
 			DeadlockKeyHash: result.DeadlockResp.DeadlockKeyHash,
+			WaitChain:       result.DeadlockResp.WaitChain,
 		}
 		resp.Errors, resp.RegionError = convertToPBErrors(deadlockErr)
 		return resp, nil
@@ -368,28 +466,127 @@ func (svr *Server) KvCommit(ctx context.Context, req *kvrpcpb.CommitRequest) (*k
 }
 
 func (svr *Server) RawGetKeyTTL(ctx context.Context, req *kvrpcpb.RawGetKeyTTLRequest) (*kvrpcpb.RawGetKeyTTLResponse, error) {
-	// TODO
-	return &kvrpcpb.RawGetKeyTTLResponse{}, nil
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawGetKeyTTL")
+	if err != nil {
+		return &kvrpcpb.RawGetKeyTTLResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawGetKeyTTLResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if regErr := reqCtx.checkRawKeys(req.Key); regErr != nil {
+		return &kvrpcpb.RawGetKeyTTLResponse{RegionError: regErr}, nil
+	}
+	ttl, notFound, err := svr.mvccStore.RawGetKeyTTL(reqCtx, req.Key)
+	if err != nil {
+		return &kvrpcpb.RawGetKeyTTLResponse{Error: err.Error()}, nil
+	}
+	return &kvrpcpb.RawGetKeyTTLResponse{
+		Ttl:      ttl,
+		NotFound: notFound,
+	}, nil
 }
 
-func (svr *Server) KvImport(context.Context, *kvrpcpb.ImportRequest) (*kvrpcpb.ImportResponse, error) {
-	// TODO
+// KvImport writes the mutations committed at the commit version without transactions. The request has no
+// context, so the mutations are grouped by the local regions containing their keys.
+func (svr *Server) KvImport(_ context.Context, req *kvrpcpb.ImportRequest) (*kvrpcpb.ImportResponse, error) {
+	_, storeID, err := svr.localStoreInfo()
+	if err != nil {
+		return &kvrpcpb.ImportResponse{Error: err.Error()}, nil
+	}
+	var (
+		regions []*regionCtx
+		groups  = make(map[uint64][]*kvrpcpb.Mutation)
+	)
+	for _, m := range req.Mutations {
+		ri := svr.regionManager.regionByKey(m.Key)
+		if ri == nil {
+			return &kvrpcpb.ImportResponse{RegionError: &errorpb.Error{
+				Message:        fmt.Sprintf("key %q is not in any region", m.Key),
+				KeyNotInRegion: &errorpb.KeyNotInRegion{Key: m.Key},
+			}}, nil
+		}
+		if _, ok := groups[ri.meta.Id]; !ok {
+			regions = append(regions, ri)
+		}
+		groups[ri.meta.Id] = append(groups[ri.meta.Id], m)
+	}
+	for _, ri := range regions {
+		ctx := &kvrpcpb.Context{RegionId: ri.meta.Id, RegionEpoch: ri.getRegionEpoch()}
+		for _, peer := range ri.meta.Peers {
+			if peer.StoreId == storeID {
+				ctx.Peer = peer
+			}
+		}
+		reqCtx, err := newRequestCtx(svr, ctx, "KvImport")
+		if err != nil {
+			return &kvrpcpb.ImportResponse{Error: err.Error()}, nil
+		}
+		if reqCtx.regErr != nil {
+			reqCtx.finish()
+			return &kvrpcpb.ImportResponse{RegionError: reqCtx.regErr}, nil
+		}
+		err = svr.mvccStore.Import(reqCtx, groups[ri.meta.Id], req.CommitVersion)
+		reqCtx.finish()
+		if err != nil {
+			resp := &kvrpcpb.ImportResponse{}
+			resp.Error, resp.RegionError = convertToRawError(err)
+			return resp, nil
+		}
+	}
 	return &kvrpcpb.ImportResponse{}, nil
 }
 
-func (svr *Server) RawCompareAndSwap(context.Context, *kvrpcpb.RawCASRequest) (*kvrpcpb.RawCASResponse, error) {
-	// TODO
-	return &kvrpcpb.RawCASResponse{}, nil
+func (svr *Server) RawCompareAndSwap(ctx context.Context, req *kvrpcpb.RawCASRequest) (*kvrpcpb.RawCASResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawCompareAndSwap")
+	if err != nil {
+		return &kvrpcpb.RawCASResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawCASResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if regErr := reqCtx.checkRawKeys(req.Key); regErr != nil {
+		return &kvrpcpb.RawCASResponse{RegionError: regErr}, nil
+	}
+	resp, err := svr.mvccStore.RawCompareAndSwap(reqCtx, req)
+	if err != nil {
+		resp = &kvrpcpb.RawCASResponse{}
+		resp.Error, resp.RegionError = convertToRawError(err)
+	}
+	return resp, nil
 }
 
-func (svr *Server) CoprocessorV2(context.Context, *coprocessor_v2.RawCoprocessorRequest) (*coprocessor_v2.RawCoprocessorResponse, error) {
-	// TODO
-	return &coprocessor_v2.RawCoprocessorResponse{}, nil
+// RegisterCoprocessorV2 registers a CoprocessorV2 plugin, it should be called before the server starts to serve.
+func (svr *Server) RegisterCoprocessorV2(name, version string, handler CoprocessorV2Handler) error {
+	return svr.coprV2.Register(name, version, handler)
 }
 
-func (svr *Server) GetStoreSafeTS(context.Context, *kvrpcpb.StoreSafeTSRequest) (*kvrpcpb.StoreSafeTSResponse, error) {
-	// TODO
-	return &kvrpcpb.StoreSafeTSResponse{}, nil
+// CoprocessorV2 routes the request to the plugin by the name and version requirement.
+func (svr *Server) CoprocessorV2(ctx context.Context, req *coprocessor_v2.RawCoprocessorRequest) (*coprocessor_v2.RawCoprocessorResponse, error) {
+	handler, err := svr.coprV2.Get(req.CoprName, req.CoprVersionReq)
+	if err != nil {
+		return &coprocessor_v2.RawCoprocessorResponse{OtherError: err.Error()}, nil
+	}
+	reqCtx, err := newRequestCtx(svr, req.Context, "CoprocessorV2")
+	if err != nil {
+		return &coprocessor_v2.RawCoprocessorResponse{OtherError: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &coprocessor_v2.RawCoprocessorResponse{RegionError: reqCtx.regErr}, nil
+	}
+	data, err := callCoprocessorV2(ctx, handler, reqCtx.getDBReader(), req.Data)
+	if err != nil {
+		return &coprocessor_v2.RawCoprocessorResponse{OtherError: err.Error()}, nil
+	}
+	return &coprocessor_v2.RawCoprocessorResponse{Data: data}, nil
+}
+
+func (svr *Server) GetStoreSafeTS(ctx context.Context, req *kvrpcpb.StoreSafeTSRequest) (*kvrpcpb.StoreSafeTSResponse, error) {
+	return &kvrpcpb.StoreSafeTSResponse{
+		SafeTs: svr.regionManager.GetStoreSafeTS(req.KeyRange),
+	}, nil
 }
 
 func (svr *Server) KvCleanup(ctx context.Context, req *kvrpcpb.CleanupRequest) (*kvrpcpb.CleanupResponse, error) {
@@ -413,7 +610,7 @@ func (svr *Server) KvCleanup(ctx context.Context, req *kvrpcpb.CleanupRequest) (
 }
 
 func (svr *Server) KvBatchGet(ctx context.Context, req *kvrpcpb.BatchGetRequest) (*kvrpcpb.BatchGetResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "KvBatchGet")
+	reqCtx, err := newReadRequestCtx(svr, req.Context, "KvBatchGet", req.GetVersion(), pointKeyRanges(req.Keys...))
 	if err != nil {
 		return &kvrpcpb.BatchGetResponse{Pairs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
 	}
@@ -502,65 +699,247 @@ func (svr *Server) KvDeleteRange(ctx context.Context, req *kvrpcpb.DeleteRangeRe
 	if reqCtx.regErr != nil {
 		return &kvrpcpb.DeleteRangeResponse{RegionError: reqCtx.regErr}, nil
 	}
-	err = svr.mvccStore.dbWriter.DeleteRange(req.StartKey, req.EndKey, reqCtx.regCtx)
+	if len(req.EndKey) == 0 {
+		return &kvrpcpb.DeleteRangeResponse{Error: "invalid end key"}, nil
+	}
+	// The range must not cross the region, otherwise the data of the neighbouring regions is deleted only on
+	// the replicas of this region.
+	if regErr := reqCtx.checkKeyRange(req.StartKey, req.EndKey); regErr != nil {
+		return &kvrpcpb.DeleteRangeResponse{RegionError: regErr}, nil
+	}
+	err = svr.mvccStore.dbWriter.DeleteRange(mvcc.KeySpaceTxn, req.StartKey, req.EndKey, reqCtx.regCtx, req.Context)
 	if err != nil {
 		log.Error("delete range failed", zap.Error(err))
+		if regErr := extractRegionError(err); regErr != nil {
+			return &kvrpcpb.DeleteRangeResponse{RegionError: regErr}, nil
+		}
+		return &kvrpcpb.DeleteRangeResponse{Error: err.Error()}, nil
 	}
 	return &kvrpcpb.DeleteRangeResponse{}, nil
 }
 
 // RawKV commands.
-func (svr *Server) RawGet(context.Context, *kvrpcpb.RawGetRequest) (*kvrpcpb.RawGetResponse, error) {
-	return &kvrpcpb.RawGetResponse{}, nil
+func (svr *Server) RawGet(ctx context.Context, req *kvrpcpb.RawGetRequest) (*kvrpcpb.RawGetResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawGet")
+	if err != nil {
+		return &kvrpcpb.RawGetResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawGetResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if regErr := reqCtx.checkRawKeys(req.Key); regErr != nil {
+		return &kvrpcpb.RawGetResponse{RegionError: regErr}, nil
+	}
+	val, err := svr.mvccStore.RawGet(reqCtx, req.Key)
+	if err != nil {
+		return &kvrpcpb.RawGetResponse{Error: err.Error()}, nil
+	}
+	return &kvrpcpb.RawGetResponse{
+		Value:    val,
+		NotFound: len(val) == 0,
+	}, nil
 }
 
-func (svr *Server) RawPut(context.Context, *kvrpcpb.RawPutRequest) (*kvrpcpb.RawPutResponse, error) {
-	return &kvrpcpb.RawPutResponse{}, nil
+func (svr *Server) RawPut(ctx context.Context, req *kvrpcpb.RawPutRequest) (*kvrpcpb.RawPutResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawPut")
+	if err != nil {
+		return &kvrpcpb.RawPutResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawPutResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if regErr := reqCtx.checkRawKeys(req.Key); regErr != nil {
+		return &kvrpcpb.RawPutResponse{RegionError: regErr}, nil
+	}
+	err = svr.mvccStore.RawPut(reqCtx, []*kvrpcpb.KvPair{{Key: req.Key, Value: req.Value}}, req.Ttl)
+	resp := &kvrpcpb.RawPutResponse{}
+	resp.Error, resp.RegionError = convertToRawError(err)
+	return resp, nil
 }
 
-func (svr *Server) RawDelete(context.Context, *kvrpcpb.RawDeleteRequest) (*kvrpcpb.RawDeleteResponse, error) {
-	return &kvrpcpb.RawDeleteResponse{}, nil
+func (svr *Server) RawDelete(ctx context.Context, req *kvrpcpb.RawDeleteRequest) (*kvrpcpb.RawDeleteResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawDelete")
+	if err != nil {
+		return &kvrpcpb.RawDeleteResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawDeleteResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if regErr := reqCtx.checkRawKeys(req.Key); regErr != nil {
+		return &kvrpcpb.RawDeleteResponse{RegionError: regErr}, nil
+	}
+	err = svr.mvccStore.RawDelete(reqCtx, [][]byte{req.Key})
+	resp := &kvrpcpb.RawDeleteResponse{}
+	resp.Error, resp.RegionError = convertToRawError(err)
+	return resp, nil
 }
 
-func (svr *Server) RawScan(context.Context, *kvrpcpb.RawScanRequest) (*kvrpcpb.RawScanResponse, error) {
-	return &kvrpcpb.RawScanResponse{}, nil
+func (svr *Server) RawScan(ctx context.Context, req *kvrpcpb.RawScanRequest) (*kvrpcpb.RawScanResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawScan")
+	if err != nil {
+		return &kvrpcpb.RawScanResponse{Kvs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawScanResponse{RegionError: reqCtx.regErr}, nil
+	}
+	pairs, err := svr.mvccStore.RawScan(reqCtx, req.StartKey, req.EndKey, req.Limit, req.KeyOnly, req.Reverse)
+	if err != nil {
+		return &kvrpcpb.RawScanResponse{Kvs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+	}
+	return &kvrpcpb.RawScanResponse{Kvs: pairs}, nil
 }
 
-func (svr *Server) RawBatchDelete(context.Context, *kvrpcpb.RawBatchDeleteRequest) (*kvrpcpb.RawBatchDeleteResponse, error) {
-	return &kvrpcpb.RawBatchDeleteResponse{}, nil
+func (svr *Server) RawBatchDelete(ctx context.Context, req *kvrpcpb.RawBatchDeleteRequest) (*kvrpcpb.RawBatchDeleteResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawBatchDelete")
+	if err != nil {
+		return &kvrpcpb.RawBatchDeleteResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawBatchDeleteResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if regErr := reqCtx.checkRawKeys(req.Keys...); regErr != nil {
+		return &kvrpcpb.RawBatchDeleteResponse{RegionError: regErr}, nil
+	}
+	err = svr.mvccStore.RawDelete(reqCtx, req.Keys)
+	resp := &kvrpcpb.RawBatchDeleteResponse{}
+	resp.Error, resp.RegionError = convertToRawError(err)
+	return resp, nil
 }
 
-func (svr *Server) RawBatchGet(context.Context, *kvrpcpb.RawBatchGetRequest) (*kvrpcpb.RawBatchGetResponse, error) {
-	return &kvrpcpb.RawBatchGetResponse{}, nil
+func (svr *Server) RawBatchGet(ctx context.Context, req *kvrpcpb.RawBatchGetRequest) (*kvrpcpb.RawBatchGetResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawBatchGet")
+	if err != nil {
+		return &kvrpcpb.RawBatchGetResponse{Pairs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawBatchGetResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if regErr := reqCtx.checkRawKeys(req.Keys...); regErr != nil {
+		return &kvrpcpb.RawBatchGetResponse{RegionError: regErr}, nil
+	}
+	pairs, err := svr.mvccStore.RawBatchGet(reqCtx, req.Keys)
+	if err != nil {
+		return &kvrpcpb.RawBatchGetResponse{Pairs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+	}
+	return &kvrpcpb.RawBatchGetResponse{Pairs: pairs}, nil
 }
 
-func (svr *Server) RawBatchPut(context.Context, *kvrpcpb.RawBatchPutRequest) (*kvrpcpb.RawBatchPutResponse, error) {
-	return &kvrpcpb.RawBatchPutResponse{}, nil
+func (svr *Server) RawBatchPut(ctx context.Context, req *kvrpcpb.RawBatchPutRequest) (*kvrpcpb.RawBatchPutResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawBatchPut")
+	if err != nil {
+		return &kvrpcpb.RawBatchPutResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawBatchPutResponse{RegionError: reqCtx.regErr}, nil
+	}
+	for _, pair := range req.Pairs {
+		if regErr := reqCtx.checkRawKeys(pair.Key); regErr != nil {
+			return &kvrpcpb.RawBatchPutResponse{RegionError: regErr}, nil
+		}
+	}
+	err = svr.mvccStore.RawPut(reqCtx, req.Pairs, req.Ttl)
+	resp := &kvrpcpb.RawBatchPutResponse{}
+	resp.Error, resp.RegionError = convertToRawError(err)
+	return resp, nil
 }
 
-func (svr *Server) RawBatchScan(context.Context, *kvrpcpb.RawBatchScanRequest) (*kvrpcpb.RawBatchScanResponse, error) {
-	return &kvrpcpb.RawBatchScanResponse{}, nil
+func (svr *Server) RawBatchScan(ctx context.Context, req *kvrpcpb.RawBatchScanRequest) (*kvrpcpb.RawBatchScanResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawBatchScan")
+	if err != nil {
+		return &kvrpcpb.RawBatchScanResponse{Kvs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawBatchScanResponse{RegionError: reqCtx.regErr}, nil
+	}
+	var kvs []*kvrpcpb.KvPair
+	for _, ran := range req.Ranges {
+		pairs, err := svr.mvccStore.RawScan(reqCtx, ran.StartKey, ran.EndKey, req.EachLimit, req.KeyOnly, req.Reverse)
+		if err != nil {
+			return &kvrpcpb.RawBatchScanResponse{Kvs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+		}
+		kvs = append(kvs, pairs...)
+	}
+	return &kvrpcpb.RawBatchScanResponse{Kvs: kvs}, nil
 }
 
-func (svr *Server) RawDeleteRange(context.Context, *kvrpcpb.RawDeleteRangeRequest) (*kvrpcpb.RawDeleteRangeResponse, error) {
-	return &kvrpcpb.RawDeleteRangeResponse{}, nil
+func (svr *Server) RawDeleteRange(ctx context.Context, req *kvrpcpb.RawDeleteRangeRequest) (*kvrpcpb.RawDeleteRangeResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawDeleteRange")
+	if err != nil {
+		return &kvrpcpb.RawDeleteRangeResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawDeleteRangeResponse{RegionError: reqCtx.regErr}, nil
+	}
+	err = svr.mvccStore.RawDeleteRange(reqCtx, req.StartKey, req.EndKey)
+	resp := &kvrpcpb.RawDeleteRangeResponse{}
+	resp.Error, resp.RegionError = convertToRawError(err)
+	return resp, nil
 }
 
 // SQL push down commands.
 func (svr *Server) Coprocessor(_ context.Context, req *coprocessor.Request) (*coprocessor.Response, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "Coprocessor")
+	reqCtx, err := newReadRequestCtx(svr, req.Context, "Coprocessor", req.GetStartTs(), copKeyRanges(req.Ranges))
 	if err != nil {
-		return &coprocessor.Response{OtherError: convertToKeyError(err).String()}, nil
+		return convertToCopResponse(err), nil
 	}
 	defer reqCtx.finish()
 	if reqCtx.regErr != nil {
 		return &coprocessor.Response{RegionError: reqCtx.regErr}, nil
 	}
+	if err = svr.mvccStore.memLocks.checkCopRanges(req); err != nil {
+		return &coprocessor.Response{Locked: convertToKeyError(err).Locked}, nil
+	}
 	return cophandler.HandleCopRequest(reqCtx.getDBReader(), svr.mvccStore.lockStore, req), nil
 }
 
-func (svr *Server) CoprocessorStream(*coprocessor.Request, tikvpb.Tikv_CoprocessorStreamServer) error {
-	// TODO
+// CoprocessorStream handles the request in sub ranges and sends a response for each of them with the range
+// it covers. The next sub range is not handled until the previous response is sent, so a slow client
+// slows down the scan instead of piling up responses in memory.
+func (svr *Server) CoprocessorStream(req *coprocessor.Request, stream tikvpb.Tikv_CoprocessorStreamServer) error {
+	reqCtx, err := newReadRequestCtx(svr, req.Context, "CoprocessorStream", req.GetStartTs(), copKeyRanges(req.Ranges))
+	if err != nil {
+		return stream.Send(convertToCopResponse(err))
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return stream.Send(&coprocessor.Response{RegionError: reqCtx.regErr})
+	}
+	if err = svr.mvccStore.memLocks.checkCopRanges(req); err != nil {
+		return stream.Send(&coprocessor.Response{Locked: convertToKeyError(err).Locked})
+	}
+	dbReader := reqCtx.getDBReader()
+	if req.Tp != kv.ReqTypeDAG {
+		return stream.Send(cophandler.HandleCopRequest(dbReader, svr.mvccStore.lockStore, req))
+	}
+	if len(req.Ranges) == 0 {
+		// The client still expects a response without any range.
+		return stream.Send(cophandler.HandleCopRequest(dbReader, svr.mvccStore.lockStore, req))
+	}
+	splitter := newCopRangeSplitter(dbReader.GetTxn(), req.Ranges, copStreamBatchKeys, isDescCopRequest(req.Data))
+	for ran := splitter.next(); ran != nil; ran = splitter.next() {
+		if err = stream.Context().Err(); err != nil {
+			return err
+		}
+		subReq := *req
+		subReq.Ranges = []*coprocessor.KeyRange{ran}
+		resp := cophandler.HandleCopRequest(dbReader, svr.mvccStore.lockStore, &subReq)
+		resp.Range = ran
+		if err = stream.Send(resp); err != nil {
+			return err
+		}
+		if resp.RegionError != nil || resp.Locked != nil || len(resp.OtherError) > 0 {
+			return nil
+		}
+	}
 	return nil
 }
 
@@ -599,6 +978,9 @@ func (svr *Server) BatchCoprocessor(req *coprocessor.BatchRequest, batchCopServe
 		if reqCtx.regErr != nil {
 			return &RegionError{err: reqCtx.regErr}
 		}
+		if err = svr.mvccStore.memLocks.checkCopRanges(&cop); err != nil {
+			return batchCopServer.Send(&coprocessor.BatchResponse{OtherError: convertToKeyError(err).String()})
+		}
 		copResponse := cophandler.HandleCopRequestWithMPPCtx(reqCtx.getDBReader(), svr.mvccStore.lockStore, &cop, nil)
 		err = batchCopServer.Send(&coprocessor.BatchResponse{Data: copResponse.Data})
 		if err != nil {
@@ -608,48 +990,41 @@ func (svr *Server) BatchCoprocessor(req *coprocessor.BatchRequest, batchCopServe
 	return nil
 }
 
-func (mrm *MockRegionManager) getMPPTaskHandler(rpcClient client.Client, meta *mpp.TaskMeta, createdIfNotExist bool, storeId uint64) (*cophandler.MPPTaskHandler, bool, error) {
-	set := mrm.getMPPTaskSet(storeId)
-	if set == nil {
-		return nil, false, errors.New("cannot find mpp task set for store")
-	}
-	set.mu.Lock()
-	defer set.mu.Unlock()
-	if handler, ok := set.taskHandlers[meta.TaskId]; ok {
-		return handler, false, nil
-	}
-	if createdIfNotExist {
-		handler := &cophandler.MPPTaskHandler{
-			TunnelSet: make(map[int64]*cophandler.ExchangerTunnel),
-			Meta:      meta,
-			RPCClient: rpcClient,
+// getMPPTaskSet returns the MPP task registry of the store, the mock region manager keeps one registry
+// for each mock store, otherwise the server only serves its own store.
+func (svr *Server) getMPPTaskSet(storeId uint64) (*MPPTaskHandlerMap, error) {
+	if mrm, ok := svr.regionManager.(*MockRegionManager); ok {
+		set := mrm.getMPPTaskSet(storeId)
+		if set == nil {
+			return nil, errors.New("cannot find mpp task set for store")
 		}
-		set.taskHandlers[meta.TaskId] = handler
-		return handler, true, nil
-	} else {
-		return nil, false, nil
+		return set, nil
+	}
+	if _, err := svr.GetStoreAddrByStoreId(storeId); err != nil {
+		return nil, errors.Trace(err)
 	}
+	return svr.mppTasks, nil
 }
 
-func (mrm *MockRegionManager) removeMPPTaskHandler(taskId int64, storeId uint64) error {
-	set := mrm.getMPPTaskSet(storeId)
-	if set == nil {
-		return errors.New("cannot find mpp task set for store")
+// localStoreInfo returns the address and id of the store served by the server.
+func (svr *Server) localStoreInfo() (string, uint64, error) {
+	storeAddr, storeId, errPb := svr.regionManager.GetStoreInfoFromCtx(&kvrpcpb.Context{})
+	if errPb != nil {
+		return "", 0, errors.New(errPb.String())
 	}
-	set.mu.Lock()
-	defer set.mu.Unlock()
-	if _, ok := set.taskHandlers[taskId]; ok {
-		delete(set.taskHandlers, taskId)
-		return nil
-	}
-	return errors.New("cannot find mpp task")
+	return storeAddr, storeId, nil
 }
 
-func (svr *Server) DispatchMPPTask(_ context.Context, _ *mpp.DispatchTaskRequest) (*mpp.DispatchTaskResponse, error) {
-	panic("todo")
+func (svr *Server) DispatchMPPTask(ctx context.Context, req *mpp.DispatchTaskRequest) (*mpp.DispatchTaskResponse, error) {
+	_, storeId, err := svr.localStoreInfo()
+	if err != nil {
+		return &mpp.DispatchTaskResponse{Error: &mpp.Error{Msg: err.Error()}}, nil
+	}
+	return svr.DispatchMPPTaskWithStoreId(ctx, req, storeId)
 }
 
-func (svr *Server) executeMPPDispatch(ctx context.Context, req *mpp.DispatchTaskRequest, storeAddr string, storeId uint64, handler *cophandler.MPPTaskHandler) error {
+func (svr *Server) executeMPPDispatch(ctx context.Context, req *mpp.DispatchTaskRequest, storeAddr string, storeId uint64, task *mppTask) error {
+	handler := task.handler
 	var reqCtx *requestCtx
 	if len(req.Regions) > 0 {
 		kvContext := &kvrpcpb.Context{
@@ -673,20 +1048,32 @@ func (svr *Server) executeMPPDispatch(ctx context.Context, req *mpp.DispatchTask
 	for _, regionMeta := range req.Regions {
 		copReq.Ranges = append(copReq.Ranges, regionMeta.Ranges...)
 	}
+	// The task reads at the start ts, the async commit transactions being prewritten in the ranges block it.
+	if err := svr.mvccStore.memLocks.checkCopRanges(copReq); err != nil {
+		if reqCtx != nil {
+			reqCtx.finish()
+		}
+		return err
+	}
 	var dbreader *dbreader.DBReader
 	if reqCtx != nil {
 		dbreader = reqCtx.getDBReader()
 	}
 	go func() {
-		resp := cophandler.HandleCopRequestWithMPPCtx(dbreader, svr.mvccStore.lockStore, copReq, &cophandler.MPPCtx{
-			RPCClient:   svr.RPCClient,
-			StoreAddr:   storeAddr,
-			TaskHandler: handler,
-		})
-		handler.Err = svr.RemoveMPPTaskHandler(req.Meta.TaskId, storeId)
-		if len(resp.OtherError) > 0 {
-			handler.Err = errors.New(resp.OtherError)
+		// The task may be cancelled before it runs, the cancel error is kept then.
+		if !task.cancelled() {
+			resp := cophandler.HandleCopRequestWithMPPCtx(dbreader, svr.mvccStore.lockStore, copReq, &cophandler.MPPCtx{
+				RPCClient:   svr.RPCClient,
+				StoreAddr:   storeAddr,
+				TaskHandler: handler,
+			})
+			if len(resp.OtherError) > 0 {
+				task.setErr(errors.New(resp.OtherError))
+			}
 		}
+		// A cancelled task has been removed from the registry.
+		_ = svr.RemoveMPPTaskHandler(req.Meta.TaskId, storeId)
+		handler.Err = task.getErr()
 		if reqCtx != nil {
 			reqCtx.finish()
 		}
@@ -696,7 +1083,7 @@ func (svr *Server) executeMPPDispatch(ctx context.Context, req *mpp.DispatchTask
 
 // func DispatchMPPTask do not have enough information(lack of target store id)
 func (svr *Server) DispatchMPPTaskWithStoreId(ctx context.Context, req *mpp.DispatchTaskRequest, storeId uint64) (*mpp.DispatchTaskResponse, error) {
-	mppHandler, err := svr.CreateMPPTaskHandler(req.Meta, storeId)
+	set, err := svr.getMPPTaskSet(storeId)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -704,98 +1091,133 @@ func (svr *Server) DispatchMPPTaskWithStoreId(ctx context.Context, req *mpp.Disp
 	if err != nil {
 		return nil, err
 	}
-	err = svr.executeMPPDispatch(ctx, req, storeAddr, storeId, mppHandler)
+	task, err := set.create(req.Meta, svr.RPCClient)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	err = svr.executeMPPDispatch(ctx, req, storeAddr, storeId, task)
 	resp := &mpp.DispatchTaskResponse{}
 	if err != nil {
+		// The task never runs, it's removed and cancelled so the connections to it don't wait forever.
+		_ = set.remove(req.Meta.TaskId)
+		task.cancel(err.Error())
 		resp.Error = &mpp.Error{Msg: err.Error()}
 	}
 	return resp, nil
 }
 
-func (svr *Server) CancelMPPTask(_ context.Context, _ *mpp.CancelTaskRequest) (*mpp.CancelTaskResponse, error) {
-	panic("todo")
+// CancelMPPTask cancels all the tasks of the query with the start ts in the meta.
+func (svr *Server) CancelMPPTask(_ context.Context, req *mpp.CancelTaskRequest) (*mpp.CancelTaskResponse, error) {
+	_, storeId, err := svr.localStoreInfo()
+	if err != nil {
+		return &mpp.CancelTaskResponse{Error: &mpp.Error{Msg: err.Error()}}, nil
+	}
+	return svr.CancelMPPTaskWithStoreId(req, storeId)
+}
+
+func (svr *Server) CancelMPPTaskWithStoreId(req *mpp.CancelTaskRequest, storeId uint64) (*mpp.CancelTaskResponse, error) {
+	resp := &mpp.CancelTaskResponse{}
+	set, err := svr.getMPPTaskSet(storeId)
+	if err != nil {
+		resp.Error = &mpp.Error{Msg: err.Error()}
+		return resp, nil
+	}
+	reason := "cancelled by client"
+	if req.Error != nil {
+		reason = req.Error.Msg
+	}
+	cnt := set.cancel(req.Meta.GetStartTs(), reason)
+	log.Info("cancel mpp tasks", zap.Uint64("startTS", req.Meta.GetStartTs()), zap.Int("count", cnt), zap.String("reason", reason))
+	return resp, nil
+}
+
+func (svr *Server) getMPPTask(taskId int64, storeId uint64) (*mppTask, error) {
+	set, err := svr.getMPPTaskSet(storeId)
+	if err != nil {
+		return nil, err
+	}
+	return set.get(taskId), nil
 }
 
 func (svr *Server) GetMPPTaskHandler(taskId int64, storeId uint64) (*cophandler.MPPTaskHandler, error) {
-	if mrm, ok := svr.regionManager.(*MockRegionManager); ok {
-		set := mrm.getMPPTaskSet(storeId)
-		if set == nil {
-			return nil, errors.New("cannot find mpp task set for store")
-		}
-		set.mu.Lock()
-		defer set.mu.Unlock()
-		if handler, ok := set.taskHandlers[taskId]; ok {
-			return handler, nil
-		}
-		return nil, nil
+	task, err := svr.getMPPTask(taskId, storeId)
+	if task == nil || err != nil {
+		return nil, err
 	}
-	return nil, errors.New("Only mock region mgr supports get mpp task")
+	return task.handler, nil
 }
 
 func (svr *Server) RemoveMPPTaskHandler(taskId int64, storeId uint64) error {
-	if mrm, ok := svr.regionManager.(*MockRegionManager); ok {
-		err := mrm.removeMPPTaskHandler(int64(taskId), storeId)
-		return errors.Trace(err)
+	set, err := svr.getMPPTaskSet(storeId)
+	if err != nil {
+		return err
 	}
-	return errors.New("Only mock region mgr supports remove mpp task")
+	return errors.Trace(set.remove(taskId))
 }
 
 func (svr *Server) CreateMPPTaskHandler(meta *mpp.TaskMeta, storeId uint64) (*cophandler.MPPTaskHandler, error) {
-	if mrm, ok := svr.regionManager.(*MockRegionManager); ok {
-		set := mrm.getMPPTaskSet(storeId)
-		if set == nil {
-			return nil, errors.New("cannot find mpp task set for store")
-		}
-		set.mu.Lock()
-		defer set.mu.Unlock()
-		if handler, ok := set.taskHandlers[meta.TaskId]; ok {
-			return handler, errors.Errorf("Task %d has been created", meta.TaskId)
-		}
-		handler := &cophandler.MPPTaskHandler{
-			TunnelSet: make(map[int64]*cophandler.ExchangerTunnel),
-			Meta:      meta,
-			RPCClient: svr.RPCClient,
-		}
-		set.taskHandlers[meta.TaskId] = handler
-		return handler, nil
+	set, err := svr.getMPPTaskSet(storeId)
+	if err != nil {
+		return nil, err
 	}
-	return nil, errors.New("Only mock region mgr supports get mpp task")
+	task, err := set.create(meta, svr.RPCClient)
+	if err != nil {
+		return nil, err
+	}
+	return task.handler, nil
 }
 
-func (svr *Server) EstablishMPPConnection(*mpp.EstablishMPPConnectionRequest, tikvpb.Tikv_EstablishMPPConnectionServer) error {
-	panic("todo")
+func (svr *Server) EstablishMPPConnection(req *mpp.EstablishMPPConnectionRequest, server tikvpb.Tikv_EstablishMPPConnectionServer) error {
+	_, storeId, err := svr.localStoreInfo()
+	if err != nil {
+		return err
+	}
+	return svr.EstablishMPPConnectionWithStoreId(req, server, storeId)
 }
 
 // func EstablishMPPConnection do not have enough information(lack of target store id)
 func (svr *Server) EstablishMPPConnectionWithStoreId(req *mpp.EstablishMPPConnectionRequest, server tikvpb.Tikv_EstablishMPPConnectionServer, storeId uint64) error {
 	var (
-		mppHandler *cophandler.MPPTaskHandler
-		err        error
+		task *mppTask
+		err  error
 	)
 	maxRetryTime := 5
 	for i := 0; i < maxRetryTime; i++ {
-		mppHandler, err = svr.GetMPPTaskHandler(req.SenderMeta.TaskId, storeId)
+		task, err = svr.getMPPTask(req.SenderMeta.TaskId, storeId)
 		if err != nil {
 			return errors.Trace(err)
 		}
-		if mppHandler == nil {
+		if task == nil {
 			time.Sleep(time.Second)
 		} else {
 			break
 		}
 	}
-	if mppHandler == nil {
+	if task == nil {
 		return errors.New("tatsk not found")
 	}
-	ctx1, cancel := context.WithCancel(context.Background())
+	ctx1, cancel := context.WithCancel(server.Context())
 	defer cancel()
-	tunnel, err := mppHandler.HandleEstablishConn(ctx1, req)
+	tunnel, err := task.establishConn(ctx1, req)
 	if err != nil {
 		return errors.Trace(err)
 	}
 	var sendError error = nil
 	for sendError == nil {
-		chunk, err := tunnel.RecvChunk()
+		var chunk *tipb.Chunk
+		select {
+		case chunk = <-tunnel.DataCh:
+		case <-task.cancelCh:
+			go drainTunnel(tunnel)
+			return server.Send(&mpp.MPPDataPacket{Error: &mpp.Error{Msg: task.getErr().Error()}})
+		case <-ctx1.Done():
+			go drainTunnel(tunnel)
+			return ctx1.Err()
+		}
+		select {
+		case err = <-tunnel.ErrCh:
+		default:
+		}
 		if err != nil {
 			sendError = server.Send(&mpp.MPPDataPacket{Error: &mpp.Error{Msg: err.Error()}})
 			break
@@ -839,9 +1261,22 @@ func (svr *Server) SplitRegion(ctx context.Context, req *kvrpcpb.SplitRegionRequ
 	return svr.regionManager.SplitRegion(req), nil
 }
 
-func (svr *Server) ReadIndex(context.Context, *kvrpcpb.ReadIndexRequest) (*kvrpcpb.ReadIndexResponse, error) {
-	// TODO:
-	return &kvrpcpb.ReadIndexResponse{}, nil
+func (svr *Server) ReadIndex(ctx context.Context, req *kvrpcpb.ReadIndexRequest) (*kvrpcpb.ReadIndexResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "ReadIndex")
+	if err != nil {
+		return &kvrpcpb.ReadIndexResponse{RegionError: &errorpb.Error{Message: err.Error()}}, nil
+	}
+	defer reqCtx.finish()
+	// Followers and learners serve read index too, so only NotLeader is ignored.
+	if reqCtx.regErr != nil && reqCtx.regErr.NotLeader == nil {
+		return &kvrpcpb.ReadIndexResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if reqCtx.regErr == nil && reqCtx.regCtx.leaderChecker == nil {
+		// Standalone and mock regions have no raft leader to check the read index, the store checks it itself.
+		locked := svr.mvccStore.OnReadIndex(&raft_cmdpb.ReadIndexRequest{StartTs: req.StartTs, KeyRanges: req.Ranges})
+		return &kvrpcpb.ReadIndexResponse{Locked: locked}, nil
+	}
+	return svr.regionManager.ReadIndex(req), nil
 }
 
 // transaction debugger commands.
@@ -892,38 +1327,80 @@ func (svr *Server) UnsafeDestroyRange(ctx context.Context, req *kvrpcpb.UnsafeDe
 // GetWaitForEntries tries to get the waitFor entries
 func (svr *Server) GetWaitForEntries(ctx context.Context,
 	req *deadlockPb.WaitForEntriesRequest) (*deadlockPb.WaitForEntriesResponse, error) {
-	// TODO
-	return &deadlockPb.WaitForEntriesResponse{}, nil
+	entries := svr.mvccStore.DeadlockDetectSvr.Detector.GetWaitForEntries()
+	return &deadlockPb.WaitForEntriesResponse{Entries: entries}, nil
+}
+
+// HandleWaitForEntries serves the waitFor entries of the local detector as JSON on the status server.
+func (svr *Server) HandleWaitForEntries(w http.ResponseWriter, _ *http.Request) {
+	resp, _ := svr.GetWaitForEntries(context.Background(), &deadlockPb.WaitForEntriesRequest{})
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp.Entries); err != nil {
+		log.Warn("write wait for entries failed", zap.Error(err))
+	}
 }
 
-// Detect will handle detection rpc from other nodes
+// HandleDeadlockHistory serves the latest deadlocks detected by the local detector as JSON on the status server.
+func (svr *Server) HandleDeadlockHistory(w http.ResponseWriter, _ *http.Request) {
+	records := svr.mvccStore.DeadlockDetectSvr.Detector.GetDeadlockHistory()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(records); err != nil {
+		log.Warn("write deadlock history failed", zap.Error(err))
+	}
+}
+
+// Detect will handle detection rpc from other nodes, the stream is closed when the local detector
+// steps down so the followers connect to the new leader.
 func (svr *Server) Detect(stream deadlockPb.Deadlock_DetectServer) error {
+	stepDownCh := svr.mvccStore.DeadlockDetectSvr.leaderStepDownCh()
+	if stepDownCh == nil {
+		log.Warn("detection requests received on non leader node")
+		return nil
+	}
+	reqCh := make(chan *deadlockPb.DeadlockRequest)
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			select {
+			case reqCh <- req:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
 	for {
-		req, err := stream.Recv()
-		if err != nil {
+		select {
+		case req := <-reqCh:
+			resp := svr.mvccStore.DeadlockDetectSvr.Detect(req)
+			if resp != nil {
+				if sendErr := stream.Send(resp); sendErr != nil {
+					log.Error("send deadlock response failed", zap.Error(sendErr))
+					return nil
+				}
+			}
+		case err := <-errCh:
 			if err == io.EOF {
-				break
+				return nil
 			}
 			return err
-		}
-		if !svr.mvccStore.DeadlockDetectSvr.IsLeader() {
-			log.Warn("detection requests received on non leader node")
-			break
-		}
-		resp := svr.mvccStore.DeadlockDetectSvr.Detect(req)
-		if resp != nil {
-			if sendErr := stream.Send(resp); sendErr != nil {
-				log.Error("send deadlock response failed", zap.Error(sendErr))
-				break
-			}
+		case <-stepDownCh:
+			log.Info("deadlock detector stepped down, close the detection stream")
+			return nil
 		}
 	}
-	return nil
 }
 
-func (svr *Server) CheckLockObserver(context.Context, *kvrpcpb.CheckLockObserverRequest) (*kvrpcpb.CheckLockObserverResponse, error) {
-	// TODO: implement Observer
-	return &kvrpcpb.CheckLockObserverResponse{IsClean: true}, nil
+func (svr *Server) CheckLockObserver(ctx context.Context, req *kvrpcpb.CheckLockObserverRequest) (*kvrpcpb.CheckLockObserverResponse, error) {
+	locks, isClean, err := svr.mvccStore.observer.Check(req.MaxTs)
+	if err != nil {
+		return &kvrpcpb.CheckLockObserverResponse{Error: err.Error()}, nil
+	}
+	return &kvrpcpb.CheckLockObserverResponse{IsClean: isClean, Locks: locks}, nil
 }
 
 func (svr *Server) PhysicalScanLock(ctx context.Context, req *kvrpcpb.PhysicalScanLockRequest) (*kvrpcpb.PhysicalScanLockResponse, error) {
@@ -932,42 +1409,138 @@ func (svr *Server) PhysicalScanLock(ctx context.Context, req *kvrpcpb.PhysicalSc
 	return resp, nil
 }
 
-func (svr *Server) RegisterLockObserver(context.Context, *kvrpcpb.RegisterLockObserverRequest) (*kvrpcpb.RegisterLockObserverResponse, error) {
-	// TODO: implement Observer
+func (svr *Server) RegisterLockObserver(ctx context.Context, req *kvrpcpb.RegisterLockObserverRequest) (*kvrpcpb.RegisterLockObserverResponse, error) {
+	if err := svr.mvccStore.observer.Register(req.MaxTs); err != nil {
+		return &kvrpcpb.RegisterLockObserverResponse{Error: err.Error()}, nil
+	}
 	return &kvrpcpb.RegisterLockObserverResponse{}, nil
 }
 
-func (svr *Server) RemoveLockObserver(context.Context, *kvrpcpb.RemoveLockObserverRequest) (*kvrpcpb.RemoveLockObserverResponse, error) {
-	// TODO: implement Observer
+func (svr *Server) RemoveLockObserver(ctx context.Context, req *kvrpcpb.RemoveLockObserverRequest) (*kvrpcpb.RemoveLockObserverResponse, error) {
+	if err := svr.mvccStore.observer.Remove(req.MaxTs); err != nil {
+		return &kvrpcpb.RemoveLockObserverResponse{Error: err.Error()}, nil
+	}
 	return &kvrpcpb.RemoveLockObserverResponse{}, nil
 }
 
-func (svr *Server) VerGet(context.Context, *kvrpcpb.VerGetRequest) (*kvrpcpb.VerGetResponse, error) {
-	panic("unimplemented")
+// Versioned KV commands.
+func (svr *Server) VerGet(ctx context.Context, req *kvrpcpb.VerGetRequest) (*kvrpcpb.VerGetResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "VerGet")
+	if err != nil {
+		return &kvrpcpb.VerGetResponse{Error: &kvrpcpb.VerError{Error: err.Error()}}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.VerGetResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if regErr := reqCtx.checkRawKeys(req.Key); regErr != nil {
+		return &kvrpcpb.VerGetResponse{RegionError: regErr}, nil
+	}
+	val, err := svr.mvccStore.VerGet(reqCtx, req.Key, req.StartVersion)
+	if err != nil {
+		return &kvrpcpb.VerGetResponse{Error: &kvrpcpb.VerError{Error: err.Error()}}, nil
+	}
+	return &kvrpcpb.VerGetResponse{Value: val}, nil
 }
 
-func (svr *Server) VerBatchGet(context.Context, *kvrpcpb.VerBatchGetRequest) (*kvrpcpb.VerBatchGetResponse, error) {
-	panic("unimplemented")
+func (svr *Server) VerBatchGet(ctx context.Context, req *kvrpcpb.VerBatchGetRequest) (*kvrpcpb.VerBatchGetResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "VerBatchGet")
+	if err != nil {
+		return &kvrpcpb.VerBatchGetResponse{Pairs: []*kvrpcpb.VerKvPair{{Error: &kvrpcpb.VerError{Error: err.Error()}}}}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.VerBatchGetResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if regErr := reqCtx.checkRawKeys(req.Key...); regErr != nil {
+		return &kvrpcpb.VerBatchGetResponse{RegionError: regErr}, nil
+	}
+	pairs, err := svr.mvccStore.VerBatchGet(reqCtx, req.Key, req.StartVersion)
+	if err != nil {
+		return &kvrpcpb.VerBatchGetResponse{Pairs: []*kvrpcpb.VerKvPair{{Error: &kvrpcpb.VerError{Error: err.Error()}}}}, nil
+	}
+	return &kvrpcpb.VerBatchGetResponse{Pairs: pairs}, nil
 }
 
-func (svr *Server) VerMut(context.Context, *kvrpcpb.VerMutRequest) (*kvrpcpb.VerMutResponse, error) {
-	panic("unimplemented")
+func (svr *Server) VerMut(ctx context.Context, req *kvrpcpb.VerMutRequest) (*kvrpcpb.VerMutResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "VerMut")
+	if err != nil {
+		return &kvrpcpb.VerMutResponse{Error: &kvrpcpb.VerError{Error: err.Error()}}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.VerMutResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if req.Mut == nil {
+		return &kvrpcpb.VerMutResponse{Error: &kvrpcpb.VerError{Error: "empty mutation"}}, nil
+	}
+	if regErr := reqCtx.checkRawKeys(req.Mut.Key); regErr != nil {
+		return &kvrpcpb.VerMutResponse{RegionError: regErr}, nil
+	}
+	err = svr.mvccStore.VerMut(reqCtx, []*kvrpcpb.VerMutation{req.Mut}, req.Version)
+	resp := &kvrpcpb.VerMutResponse{}
+	resp.Error, resp.RegionError = convertToVerError(err)
+	return resp, nil
 }
 
-func (svr *Server) VerBatchMut(context.Context, *kvrpcpb.VerBatchMutRequest) (*kvrpcpb.VerBatchMutResponse, error) {
-	panic("unimplemented")
+func (svr *Server) VerBatchMut(ctx context.Context, req *kvrpcpb.VerBatchMutRequest) (*kvrpcpb.VerBatchMutResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "VerBatchMut")
+	if err != nil {
+		return &kvrpcpb.VerBatchMutResponse{Error: &kvrpcpb.VerError{Error: err.Error()}}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.VerBatchMutResponse{RegionError: reqCtx.regErr}, nil
+	}
+	keys := make([][]byte, len(req.Muts))
+	for i, mut := range req.Muts {
+		keys[i] = mut.Key
+	}
+	if regErr := reqCtx.checkRawKeys(keys...); regErr != nil {
+		return &kvrpcpb.VerBatchMutResponse{RegionError: regErr}, nil
+	}
+	err = svr.mvccStore.VerMut(reqCtx, req.Muts, req.Version)
+	resp := &kvrpcpb.VerBatchMutResponse{}
+	resp.Error, resp.RegionError = convertToVerError(err)
+	return resp, nil
 }
 
-func (svr *Server) VerScan(context.Context, *kvrpcpb.VerScanRequest) (*kvrpcpb.VerScanResponse, error) {
-	panic("unimplemented")
+func (svr *Server) VerScan(ctx context.Context, req *kvrpcpb.VerScanRequest) (*kvrpcpb.VerScanResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "VerScan")
+	if err != nil {
+		return &kvrpcpb.VerScanResponse{Pairs: []*kvrpcpb.VerKvPair{{Error: &kvrpcpb.VerError{Error: err.Error()}}}}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.VerScanResponse{RegionError: reqCtx.regErr}, nil
+	}
+	pairs, err := svr.mvccStore.VerScan(reqCtx, req.StartKey, req.EndKey, req.Limit, req.KeyOnly, req.Reverse, req.StartVersion)
+	if err != nil {
+		return &kvrpcpb.VerScanResponse{Pairs: []*kvrpcpb.VerKvPair{{Error: &kvrpcpb.VerError{Error: err.Error()}}}}, nil
+	}
+	return &kvrpcpb.VerScanResponse{Pairs: pairs}, nil
 }
 
-func (svr *Server) VerDeleteRange(context.Context, *kvrpcpb.VerDeleteRangeRequest) (*kvrpcpb.VerDeleteRangeResponse, error) {
-	panic("unimplemented")
+func (svr *Server) VerDeleteRange(ctx context.Context, req *kvrpcpb.VerDeleteRangeRequest) (*kvrpcpb.VerDeleteRangeResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "VerDeleteRange")
+	if err != nil {
+		return &kvrpcpb.VerDeleteRangeResponse{Error: &kvrpcpb.VerError{Error: err.Error()}}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.VerDeleteRangeResponse{RegionError: reqCtx.regErr}, nil
+	}
+	err = svr.mvccStore.VerDeleteRange(reqCtx, req.StartKey, req.EndKey)
+	resp := &kvrpcpb.VerDeleteRangeResponse{}
+	resp.Error, resp.RegionError = convertToVerError(err)
+	return resp, nil
 }
 
-func (svr *Server) CheckLeader(context.Context, *kvrpcpb.CheckLeaderRequest) (*kvrpcpb.CheckLeaderResponse, error) {
-	panic("unimplemented")
+func (svr *Server) CheckLeader(ctx context.Context, req *kvrpcpb.CheckLeaderRequest) (*kvrpcpb.CheckLeaderResponse, error) {
+	return &kvrpcpb.CheckLeaderResponse{
+		Regions: svr.regionManager.CheckLeader(req.Regions),
+		Ts:      req.Ts,
+	}, nil
 }
 
 func convertToKeyError(err error) *kvrpcpb.KeyError {
@@ -1005,6 +1578,7 @@ func convertToKeyError(err error) *kvrpcpb.KeyError {
 				LockKey:         x.LockKey,
 				LockTs:          x.LockTS,
 				DeadlockKeyHash: x.DeadlockKeyHash,
+				WaitChain:       x.WaitChain,
 			},
 		}
 	case *ErrCommitExpire:
@@ -1030,6 +1604,15 @@ func convertToKeyError(err error) *kvrpcpb.KeyError {
 	}
 }
 
+// convertToCopResponse returns the lock blocking the read in Locked, so the client resolves it.
+func convertToCopResponse(err error) *coprocessor.Response {
+	keyErr := convertToKeyError(err)
+	if keyErr.Locked != nil {
+		return &coprocessor.Response{Locked: keyErr.Locked}
+	}
+	return &coprocessor.Response{OtherError: keyErr.String()}
+}
+
 func convertToPBError(err error) (*kvrpcpb.KeyError, *errorpb.Error) {
 	if regErr := extractRegionError(err); regErr != nil {
 		return nil, regErr
@@ -1037,6 +1620,24 @@ func convertToPBError(err error) (*kvrpcpb.KeyError, *errorpb.Error) {
 	return convertToKeyError(err), nil
 }
 
+func convertToRawError(err error) (string, *errorpb.Error) {
+	if err == nil {
+		return "", nil
+	}
+	if regErr := extractRegionError(err); regErr != nil {
+		return "", regErr
+	}
+	return err.Error(), nil
+}
+
+func convertToVerError(err error) (*kvrpcpb.VerError, *errorpb.Error) {
+	msg, regErr := convertToRawError(err)
+	if len(msg) == 0 {
+		return nil, regErr
+	}
+	return &kvrpcpb.VerError{Error: msg}, nil
+}
+
 func convertToPBErrors(err error) ([]*kvrpcpb.KeyError, *errorpb.Error) {
 	if err != nil {
 		if regErr := extractRegionError(err); regErr != nil {
@@ -1048,8 +1649,14 @@ func convertToPBErrors(err error) ([]*kvrpcpb.KeyError, *errorpb.Error) {
 }
 
 func extractRegionError(err error) *errorpb.Error {
-	if raftError, ok := err.(*raftstore.RaftError); ok {
-		return raftError.RequestErr
+	switch x := err.(type) {
+	case *raftstore.RaftError:
+		return x.RequestErr
+	case *ErrLockWaitQueueFull:
+		return &errorpb.Error{
+			Message:      x.Error(),
+			ServerIsBusy: &errorpb.ServerIsBusy{Reason: "lock wait queue is full"},
+		}
 	}
 	return nil
 }
@@ -0,0 +1,233 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/ngaut/unistore/tikv/dbreader"
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+// Versioned keys are stored with the VerKeyPrefix in the internal key space, every version given by the client
+// is encoded in a separate DB key, so GC never discards them and only VerDeleteRange removes them. A read at
+// a version gets the greatest version not greater than it, a delete hides the older versions.
+//
+// A version 0 in VerMut is replaced by a PD TSO. Clients that mix explicit versions with server assigned ones
+// must take the explicit versions from PD as well, otherwise the order of the versions is meaningless, e.g.
+// a small explicit version written later is hidden by any earlier TSO version.
+
+// verReader reads the versioned keys at a version.
+type verReader struct {
+	txn      *badger.Txn
+	startKey []byte
+	endKey   []byte
+	version  uint64
+}
+
+// newVerReader returns a reader of the versioned keys at the version, 0 means the latest version.
+func (req *requestCtx) newVerReader(startKey, endKey []byte, version uint64) *verReader {
+	if version == 0 {
+		version = rawReadTS
+	}
+	start, end := req.encodedRange(mvcc.KeySpaceVer, startKey, endKey)
+	txn := req.svr.mvccStore.db.NewTransaction(false)
+	txn.SetReadTS(rawReadTS)
+	return &verReader{
+		txn:      txn,
+		startKey: start,
+		endKey:   end,
+		version:  version,
+	}
+}
+
+func (r *verReader) newIterator() *badger.Iterator {
+	return dbreader.NewIterator(r.txn, false, r.startKey, r.endKey)
+}
+
+// seek returns the greatest version of the key not greater than the version of the reader, keyPrefix is encoded
+// by mvcc.EncodeVerKeyPrefix. nil is returned if there is no such version or the version is a delete.
+func (r *verReader) seek(it *badger.Iterator, keyPrefix []byte) *badger.Item {
+	it.Seek(codec.EncodeUintDesc(safeCopy(keyPrefix), r.version))
+	if !it.Valid() {
+		return nil
+	}
+	item := it.Item()
+	if !bytes.HasPrefix(item.Key(), keyPrefix) || bytes.Equal(item.UserMeta(), mvcc.VerDeleteUserMeta) {
+		return nil
+	}
+	return item
+}
+
+// iterate calls f with the visible version of every key in the range of the reader until f returns false or an error.
+func (r *verReader) iterate(reverse bool, f func(key []byte, item *badger.Item) (bool, error)) error {
+	it := dbreader.NewIterator(r.txn, reverse, r.startKey, r.endKey)
+	defer it.Close()
+	seekIt := r.newIterator()
+	defer seekIt.Close()
+	if reverse {
+		it.Seek(r.endKey)
+	} else {
+		it.Seek(r.startKey)
+	}
+	for it.Valid() {
+		encodedKey := it.Item().Key()
+		if reverse {
+			if bytes.Compare(encodedKey, r.startKey) < 0 {
+				break
+			}
+		} else if exceedEndKey(encodedKey, r.endKey) {
+			break
+		}
+		key, _, err := mvcc.DecodeVerKey(encodedKey)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		keyPrefix := mvcc.EncodeVerKeyPrefix(key)
+		if item := r.seek(seekIt, keyPrefix); item != nil {
+			if ok, err := f(key, item); !ok || err != nil {
+				return err
+			}
+		}
+		// Skip the other versions of the key.
+		if reverse {
+			it.Seek(keyPrefix)
+		} else {
+			it.Seek(kv.Key(keyPrefix).PrefixNext())
+		}
+	}
+	return nil
+}
+
+func (r *verReader) close() {
+	r.txn.Discard()
+}
+
+func newVerValue(item *badger.Item, keyOnly bool) (*kvrpcpb.VerValue, error) {
+	_, version, err := mvcc.DecodeVerKey(item.Key())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	verVal := &kvrpcpb.VerValue{Version: version}
+	if !keyOnly {
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		verVal.Value = val
+	}
+	return verVal, nil
+}
+
+// VerGet returns the value of the greatest version not greater than the version, nil means not found.
+func (store *MVCCStore) VerGet(reqCtx *requestCtx, key []byte, version uint64) (*kvrpcpb.VerValue, error) {
+	reader := reqCtx.newVerReader(nil, nil, version)
+	defer reader.close()
+	it := reader.newIterator()
+	defer it.Close()
+	item := reader.seek(it, mvcc.EncodeVerKeyPrefix(key))
+	if item == nil {
+		return nil, nil
+	}
+	return newVerValue(item, false)
+}
+
+func (store *MVCCStore) VerBatchGet(reqCtx *requestCtx, keys [][]byte, version uint64) ([]*kvrpcpb.VerKvPair, error) {
+	reader := reqCtx.newVerReader(nil, nil, version)
+	defer reader.close()
+	it := reader.newIterator()
+	defer it.Close()
+	pairs := make([]*kvrpcpb.VerKvPair, 0, len(keys))
+	for _, key := range keys {
+		item := reader.seek(it, mvcc.EncodeVerKeyPrefix(key))
+		if item == nil {
+			continue
+		}
+		verVal, err := newVerValue(item, false)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, &kvrpcpb.VerKvPair{Key: key, Value: verVal})
+	}
+	return pairs, nil
+}
+
+// VerScan scans [startKey, endKey) at the version, if reverse is true, startKey is the upper bound and endKey is the lower bound.
+func (store *MVCCStore) VerScan(reqCtx *requestCtx, startKey, endKey []byte, limit uint32, keyOnly, reverse bool, version uint64) ([]*kvrpcpb.VerKvPair, error) {
+	if limit == 0 {
+		return nil, nil
+	}
+	if reverse {
+		startKey, endKey = endKey, startKey
+	}
+	reader := reqCtx.newVerReader(startKey, endKey, version)
+	defer reader.close()
+	var pairs []*kvrpcpb.VerKvPair
+	err := reader.iterate(reverse, func(key []byte, item *badger.Item) (bool, error) {
+		verVal, err := newVerValue(item, keyOnly)
+		if err != nil {
+			return false, err
+		}
+		pairs = append(pairs, &kvrpcpb.VerKvPair{Key: key, Value: verVal})
+		return len(pairs) < int(limit), nil
+	})
+	return pairs, err
+}
+
+// VerMut applies the mutations with the version, a PD TSO is used if the version is 0.
+func (store *MVCCStore) VerMut(reqCtx *requestCtx, muts []*kvrpcpb.VerMutation, version uint64) error {
+	if len(muts) == 0 {
+		return nil
+	}
+	if version == 0 {
+		physical, logical, err := store.pdClient.GetTS(context.Background())
+		if err != nil {
+			return errors.Trace(err)
+		}
+		version = uint64(physical)<<18 + uint64(logical)
+	}
+	keys := make([][]byte, len(muts))
+	for i, mut := range muts {
+		keys[i] = mvcc.EncodeVerKey(mut.Key, version)
+	}
+	hashVals := keysToHashVals(keys...)
+	regCtx := reqCtx.regCtx
+	regCtx.AcquireLatches(hashVals)
+	defer regCtx.ReleaseLatches(hashVals)
+	batch := store.dbWriter.NewWriteBatch(0, 0, reqCtx.rpcCtx)
+	for _, mut := range muts {
+		switch mut.Op {
+		case kvrpcpb.VerOp_VerPut:
+			batch.VerPut(mut.Key, mut.Value, version)
+		case kvrpcpb.VerOp_VerDelete:
+			batch.VerDelete(mut.Key, version)
+		default:
+			return errors.Errorf("invalid versioned mutation op %v", mut.Op)
+		}
+	}
+	return store.dbWriter.Write(batch)
+}
+
+// VerDeleteRange removes all the versions of the keys in [startKey, endKey) limited in the region, the range is
+// deleted in bounded batches by the standalone writer and by a single DeleteRange command in raft mode.
+func (store *MVCCStore) VerDeleteRange(reqCtx *requestCtx, startKey, endKey []byte) error {
+	startKey, endKey = reqCtx.keyRange(startKey, endKey)
+	return store.dbWriter.DeleteRange(mvcc.KeySpaceVer, startKey, endKey, reqCtx.regCtx, reqCtx.rpcCtx)
+}
@@ -25,7 +25,12 @@ import (
 	"github.com/ngaut/unistore/tikv/mvcc"
 	"github.com/pingcap/badger"
 	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
 )
 
 const (
@@ -50,7 +55,7 @@ func (batch *writeDBBatch) set(key y.Key, val []byte, userMeta []byte) {
 	})
 }
 
-// delete is a badger level operation, only used in DeleteRange, so we don't need to set UserMeta.
+// delete is a badger level operation, only used in DeleteRange and RawDelete, so we don't need to set UserMeta.
 // Then we can tell the entry is delete if UserMeta is nil.
 func (batch *writeDBBatch) delete(key y.Key) {
 	batch.entries = append(batch.entries, &badger.Entry{
@@ -154,6 +159,14 @@ func (w writeLockWorker) run() {
 		for i := 0; i < chLen; i++ {
 			batches = append(batches, <-w.batchCh)
 		}
+		if err := w.appendWAL(batches); err != nil {
+			log.Error("append lock wal failed", zap.Error(err))
+			for _, batch := range batches {
+				batch.err = err
+				batch.wg.Done()
+			}
+			continue
+		}
 		hint := new(lockstore.Hint)
 		var delCnt, insertCnt int
 		for _, batch := range batches {
@@ -170,9 +183,27 @@ func (w writeLockWorker) run() {
 			}
 			batch.wg.Done()
 		}
+		if wal := w.writer.lockWAL; wal != nil && wal.NeedCheckpoint() {
+			if err := wal.Checkpoint(); err != nil {
+				log.Error("checkpoint lock store failed", zap.Error(err))
+			}
+		}
 	}
 }
 
+// appendWAL writes the entries of the batches to the lock wal before they are applied to the lock store.
+func (w writeLockWorker) appendWAL(batches []*writeLockBatch) error {
+	wal := w.writer.lockWAL
+	if wal == nil {
+		return nil
+	}
+	var entries []*badger.Entry
+	for _, batch := range batches {
+		entries = append(entries, batch.entries...)
+	}
+	return wal.Append(entries)
+}
+
 type dbWriter struct {
 	bundle   *mvcc.DBBundle
 	dbCh     chan<- *writeDBBatch
@@ -180,12 +211,15 @@ type dbWriter struct {
 	wg       sync.WaitGroup
 	closeCh  chan struct{}
 	latestTS uint64
+	// lockWAL makes the lock store durable, the locks are lost on restart if it is nil.
+	lockWAL *LockWAL
 }
 
-func NewDBWriter(bundle *mvcc.DBBundle) mvcc.DBWriter {
+func NewDBWriter(bundle *mvcc.DBBundle, lockWAL *LockWAL) mvcc.DBWriter {
 	return &dbWriter{
 		bundle:  bundle,
 		closeCh: make(chan struct{}, 0),
+		lockWAL: lockWAL,
 	}
 }
 
@@ -210,6 +244,11 @@ func (writer *dbWriter) Open() {
 func (writer *dbWriter) Close() {
 	close(writer.closeCh)
 	writer.wg.Wait()
+	if writer.lockWAL != nil {
+		if err := writer.lockWAL.Close(); err != nil {
+			log.Error("close lock wal failed", zap.Error(err))
+		}
+	}
 }
 
 func (writer *dbWriter) Write(batch mvcc.WriteBatch) error {
@@ -238,9 +277,11 @@ type writeBatch struct {
 	commitTS  uint64
 	dbBatch   writeDBBatch
 	lockBatch writeLockBatch
+	bundle    *mvcc.DBBundle
 }
 
 func (wb *writeBatch) Prewrite(key []byte, lock *mvcc.MvccLock) {
+	wb.bundle.LockObserver.Observe(key, lock)
 	wb.lockBatch.set(key, lock.MarshalBinary())
 }
 
@@ -273,6 +314,29 @@ func (wb *writeBatch) PessimisticRollback(key []byte) {
 	wb.lockBatch.delete(key)
 }
 
+// RawPut and RawDelete use StateTS as the version, raw keys are always read with the max version.
+func (wb *writeBatch) RawPut(key, value []byte, expireTS uint64) {
+	version := atomic.AddUint64(&wb.bundle.StateTS, 1)
+	wb.dbBatch.set(y.KeyWithTs(mvcc.EncodeRawKey(key), version), value, mvcc.NewRawUserMeta(expireTS))
+}
+
+func (wb *writeBatch) RawDelete(key []byte) {
+	version := atomic.AddUint64(&wb.bundle.StateTS, 1)
+	wb.dbBatch.delete(y.KeyWithTs(mvcc.EncodeRawKey(key), version))
+}
+
+// VerPut and VerDelete encode the version given by the client in the key and use StateTS as the badger version,
+// a delete is kept as an entry so it hides the older versions.
+func (wb *writeBatch) VerPut(key, value []byte, version uint64) {
+	ts := atomic.AddUint64(&wb.bundle.StateTS, 1)
+	wb.dbBatch.set(y.KeyWithTs(mvcc.EncodeVerKey(key, version), ts), value, mvcc.VerUserMeta)
+}
+
+func (wb *writeBatch) VerDelete(key []byte, version uint64) {
+	ts := atomic.AddUint64(&wb.bundle.StateTS, 1)
+	wb.dbBatch.set(y.KeyWithTs(mvcc.EncodeVerKey(key, version), ts), nil, mvcc.VerDeleteUserMeta)
+}
+
 func (writer *dbWriter) NewWriteBatch(startTS, commitTS uint64, ctx *kvrpcpb.Context) mvcc.WriteBatch {
 	if commitTS > 0 {
 		writer.updateLatestTS(commitTS)
@@ -282,6 +346,7 @@ func (writer *dbWriter) NewWriteBatch(startTS, commitTS uint64, ctx *kvrpcpb.Con
 	return &writeBatch{
 		startTS:  startTS,
 		commitTS: commitTS,
+		bundle:   writer.bundle,
 	}
 }
 
@@ -296,23 +361,56 @@ func (writer *dbWriter) updateLatestTS(ts uint64) {
 	}
 }
 
+// Import writes the mutations as committed values directly, there is no replica to ingest SST files on.
+func (writer *dbWriter) Import(mutations []*kvrpcpb.Mutation, commitTS uint64, _ *metapb.Region, ctx *kvrpcpb.Context) error {
+	wb := writer.NewWriteBatch(commitTS, commitTS, ctx).(*writeBatch)
+	userMeta := mvcc.NewDBUserMeta(commitTS, commitTS)
+	for _, m := range mutations {
+		switch m.Op {
+		case kvrpcpb.Op_Put, kvrpcpb.Op_Insert:
+			wb.dbBatch.set(y.KeyWithTs(m.Key, commitTS), m.Value, userMeta)
+		case kvrpcpb.Op_Del:
+			wb.dbBatch.set(y.KeyWithTs(m.Key, commitTS), nil, userMeta)
+		default:
+			return errors.Errorf("unsupported import mutation op %v", m.Op)
+		}
+	}
+	return writer.Write(wb)
+}
+
+// Ingest is not supported without raft, the SST files are only uploaded to the raft stores.
+func (writer *dbWriter) Ingest(_ []*import_sstpb.SSTMeta, _ *metapb.Region, _ *kvrpcpb.Context) error {
+	return errors.New("ingest sst is not supported without raft")
+}
+
 const delRangeBatchSize = 4096
 
-func (writer *dbWriter) DeleteRange(startKey, endKey []byte, latchHandle mvcc.LatchHandle) error {
+// DeleteRange collects and deletes the keys in bounded batches, every batch is read by a new txn and
+// deleted with the latches of its keys, so a large range is never held in memory.
+func (writer *dbWriter) DeleteRange(space mvcc.KeySpace, startKey, endKey []byte, latchHandle mvcc.LatchHandle, _ *kvrpcpb.Context) error {
+	startKey, endKey = space.EncodeRange(startKey, endKey)
 	keys := make([]y.Key, 0, delRangeBatchSize)
-	txn := writer.bundle.DB.NewTransaction(false)
-	defer txn.Discard()
-	reader := dbreader.NewDBReader(startKey, endKey, txn)
-	keys = writer.collectRangeKeys(reader.GetIter(), startKey, endKey, keys)
-	reader.Close()
-	return writer.deleteKeysInBatch(latchHandle, keys, delRangeBatchSize)
+	for {
+		txn := writer.bundle.DB.NewTransaction(false)
+		reader := dbreader.NewDBReader(startKey, endKey, txn)
+		keys = writer.collectRangeKeys(reader.GetIter(), startKey, endKey, keys[:0], delRangeBatchSize)
+		reader.Close()
+		if err := writer.deleteKeysInBatch(latchHandle, keys, delRangeBatchSize); err != nil {
+			return err
+		}
+		if len(keys) < delRangeBatchSize {
+			return nil
+		}
+		startKey = append(keys[len(keys)-1].UserKey, 0)
+	}
 }
 
-func (writer *dbWriter) collectRangeKeys(it *badger.Iterator, startKey, endKey []byte, keys []y.Key) []y.Key {
+// collectRangeKeys collects at most limit keys in the range.
+func (writer *dbWriter) collectRangeKeys(it *badger.Iterator, startKey, endKey []byte, keys []y.Key, limit int) []y.Key {
 	if len(endKey) == 0 {
 		panic("invalid end key")
 	}
-	for it.Seek(startKey); it.Valid(); it.Next() {
+	for it.Seek(startKey); it.Valid() && len(keys) < limit; it.Next() {
 		item := it.Item()
 		key := item.KeyCopy(nil)
 		if exceedEndKey(key, endKey) {
@@ -19,7 +19,9 @@ import (
 	"time"
 
 	"github.com/ngaut/unistore/config"
+	"github.com/ngaut/unistore/metrics"
 	"github.com/pingcap/kvproto/pkg/deadlock"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/log"
 	"go.uber.org/zap"
 )
@@ -32,16 +34,46 @@ var (
 	LockNoWait     = int64(-1)
 )
 
+// QueuePolicy decides which waiter on a key is woken up first when the lock is released.
+type QueuePolicy int
+
+const (
+	// QueuePolicyFIFO wakes up the waiter with the smallest start ts first.
+	QueuePolicyFIFO QueuePolicy = iota
+	// QueuePolicyPriority wakes up the waiter with the highest priority first, the waiters with the same
+	// priority are woken up in start ts order. A waiter is promoted by one priority level for every aging
+	// duration it waits.
+	QueuePolicyPriority
+)
+
+// ParseQueuePolicy parses the "wait-queue-policy" config, the unknown policy falls back to fifo.
+func ParseQueuePolicy(s string) QueuePolicy {
+	switch s {
+	case "priority":
+		return QueuePolicyPriority
+	case "fifo", "":
+	default:
+		log.Warn("unknown wait queue policy, use fifo", zap.String("policy", s))
+	}
+	return QueuePolicyFIFO
+}
+
 type Manager struct {
 	mu                  sync.Mutex
 	waitingQueues       map[uint64]*queue
 	wakeUpDelayDuration int64
+	policy              QueuePolicy
+	agingDuration       time.Duration
+	maxWaitersPerKey    int
 }
 
 func NewManager(conf *config.Config) *Manager {
 	return &Manager{
 		waitingQueues:       map[uint64]*queue{},
 		wakeUpDelayDuration: conf.PessimisticTxn.WakeUpDelayDuration,
+		policy:              ParseQueuePolicy(conf.PessimisticTxn.WaitQueuePolicy),
+		agingDuration:       time.Duration(conf.PessimisticTxn.WaitQueueAgingDuration) * time.Millisecond,
+		maxWaitersPerKey:    conf.PessimisticTxn.MaxWaitersPerKey,
 	}
 }
 
@@ -49,18 +81,46 @@ type queue struct {
 	waiters []*Waiter
 }
 
-// getReadyWaiters returns the ready waiters array, and left waiter size in this queue,
+// priorityRank maps the command priority to an order, the greater one is woken up first.
+func priorityRank(pri kvrpcpb.CommandPri) int {
+	switch pri {
+	case kvrpcpb.CommandPri_High:
+		return 2
+	case kvrpcpb.CommandPri_Low:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// waiterRank returns the order of the waiter in the priority policy, the greater one is woken up first.
+// The waiter is promoted by one level for every aging duration it has waited, so the low priority waiters
+// are woken up before the high priority ones that keep coming.
+func waiterRank(w *Waiter, aging time.Duration, now time.Time) int {
+	rank := priorityRank(w.priority)
+	if aging > 0 {
+		rank += int(now.Sub(w.waitStart) / aging)
+	}
+	return rank
+}
+
+// getNextWaiter pops the waiter to be woken up by the policy and returns it with the remain waiters,
 // it should be used under map lock protection
-func (q *queue) getOldestWaiter() (*Waiter, []*Waiter) {
-	// make the waiters in start ts order
+func (q *queue) getNextWaiter(policy QueuePolicy, aging time.Duration, now time.Time) (*Waiter, []*Waiter) {
 	sort.Slice(q.waiters, func(i, j int) bool {
-		return q.waiters[i].startTS < q.waiters[j].startTS
+		wi, wj := q.waiters[i], q.waiters[j]
+		if policy == QueuePolicyPriority {
+			if ri, rj := waiterRank(wi, aging, now), waiterRank(wj, aging, now); ri != rj {
+				return ri > rj
+			}
+		}
+		return wi.startTS < wj.startTS
 	})
-	oldestWaiter := q.waiters[0]
+	nextWaiter := q.waiters[0]
 	remainWaiter := q.waiters[1:]
 	// the remain waiters still exist in the wait queue
 	q.waiters = remainWaiter
-	return oldestWaiter, remainWaiter
+	return nextWaiter, remainWaiter
 }
 
 // removeWaiter removes the correspond waiter from pending array
@@ -75,11 +135,13 @@ func (q *queue) removeWaiter(w *Waiter) {
 }
 
 type Waiter struct {
+	waitStart           time.Time
 	deadlineTime        time.Time
 	timer               *time.Timer
 	ch                  chan WaitResult
 	wakeUpDelayDuration int64
 	startTS             uint64
+	priority            kvrpcpb.CommandPri
 	LockTS              uint64
 	KeyHash             uint64
 	CommitTs            uint64
@@ -108,6 +170,7 @@ func (w *Waiter) Wait() WaitResult {
 			if w.wakeupDelayed {
 				return WaitResult{WakeupSleepTime: WakeupDelayTimeout, CommitTS: w.CommitTs}
 			}
+			metrics.LockWaiterTimeouts.Inc()
 			return WaitResult{WakeupSleepTime: WaitTimeout}
 		case result := <-w.ch:
 			if result.WakeupSleepTime == WakeupDelayTimeout {
@@ -132,28 +195,40 @@ func (w *Waiter) DrainCh() {
 	}
 }
 
-// Wait waits on a lock until waked by others or timeout.
-func (lw *Manager) NewWaiter(startTS, lockTS, keyHash uint64, timeout time.Duration) *Waiter {
+// NewWaiter puts a waiter into the queue of the key, the waiter waits on the lock until waked by others
+// or timeout. It returns nil if the queue of the key is full, the request should fail fast without waiting
+// and let the client back off.
+func (lw *Manager) NewWaiter(startTS, lockTS, keyHash uint64, priority kvrpcpb.CommandPri, timeout time.Duration) *Waiter {
 	// allocate memory before hold the lock.
 	q := new(queue)
 	q.waiters = make([]*Waiter, 0, 8)
+	now := time.Now()
 	waiter := &Waiter{
-		deadlineTime:        time.Now().Add(timeout),
+		waitStart:           now,
+		deadlineTime:        now.Add(timeout),
 		wakeUpDelayDuration: lw.wakeUpDelayDuration,
 		timer:               time.NewTimer(timeout),
 		ch:                  make(chan WaitResult, 32),
 		startTS:             startTS,
+		priority:            priority,
 		LockTS:              lockTS,
 		KeyHash:             keyHash,
 	}
 	q.waiters = append(q.waiters, waiter)
 	lw.mu.Lock()
 	if old, ok := lw.waitingQueues[keyHash]; ok {
+		if lw.maxWaitersPerKey > 0 && len(old.waiters) >= lw.maxWaitersPerKey {
+			lw.mu.Unlock()
+			waiter.timer.Stop()
+			metrics.LockWaiterQueueFull.Inc()
+			return nil
+		}
 		old.waiters = append(old.waiters, waiter)
 	} else {
 		lw.waitingQueues[keyHash] = q
 	}
 	lw.mu.Unlock()
+	metrics.LockWaiterWaits.Inc()
 	return waiter
 }
 
@@ -161,11 +236,12 @@ func (lw *Manager) NewWaiter(startTS, lockTS, keyHash uint64, timeout time.Durat
 func (lw *Manager) WakeUp(txn, commitTS uint64, keyHashes []uint64) {
 	waiters := make([]*Waiter, 0, 8)
 	wakeUpDelayWaiters := make([]*Waiter, 0, 8)
+	now := time.Now()
 	lw.mu.Lock()
 	for _, keyHash := range keyHashes {
 		q := lw.waitingQueues[keyHash]
 		if q != nil {
-			waiter, remainWaiters := q.getOldestWaiter()
+			waiter, remainWaiters := q.getNextWaiter(lw.policy, lw.agingDuration, now)
 			waiters = append(waiters, waiter)
 			if len(remainWaiters) == 0 {
 				delete(lw.waitingQueues, keyHash)
@@ -184,6 +260,7 @@ func (lw *Manager) WakeUp(txn, commitTS uint64, keyHashes []uint64) {
 			default:
 			}
 		}
+		metrics.LockWaiterWakeUps.WithLabelValues("commit").Add(float64(len(waiters)))
 		log.S().Debug("wakeup", len(waiters), "txns blocked by txn", txn, " keyHashes=", keyHashes)
 	}
 	// wake up delay waiters, this will not remove waiter from queue
@@ -194,6 +271,7 @@ func (lw *Manager) WakeUp(txn, commitTS uint64, keyHashes []uint64) {
 			default:
 			}
 		}
+		metrics.LockWaiterWakeUps.WithLabelValues("delay").Add(float64(len(wakeUpDelayWaiters)))
 	}
 }
 
@@ -211,6 +289,20 @@ func (lw *Manager) CleanUp(w *Waiter) {
 	w.DrainCh()
 }
 
+// GetWaitForEntries returns the wait for entries of all the waiters, they are registered to the deadlock
+// detector again when its leader changes.
+func (lw *Manager) GetWaitForEntries() []deadlock.WaitForEntry {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	var entries []deadlock.WaitForEntry
+	for _, q := range lw.waitingQueues {
+		for _, w := range q.waiters {
+			entries = append(entries, deadlock.WaitForEntry{Txn: w.startTS, WaitForTxn: w.LockTS, KeyHash: w.KeyHash})
+		}
+	}
+	return entries
+}
+
 // WakeUpDetection wakes up waiters waiting for deadlock detection results
 func (lw *Manager) WakeUpForDeadlock(resp *deadlock.DeadlockResponse) {
 	var (
@@ -237,6 +329,7 @@ func (lw *Manager) WakeUpForDeadlock(resp *deadlock.DeadlockResponse) {
 	lw.mu.Unlock()
 	if waiter != nil {
 		waiter.ch <- WaitResult{DeadlockResp: resp}
+		metrics.LockWaiterWakeUps.WithLabelValues("deadlock").Inc()
 		log.S().Infof("wakeup txn=%v blocked by txn=%v because of deadlock, keyHash=%v, deadlockKeyHash=%v",
 			resp.Entry.Txn, resp.Entry.WaitForTxn, resp.Entry.KeyHash, resp.DeadlockKeyHash)
 	}
@@ -21,6 +21,7 @@ import (
 	"github.com/ngaut/unistore/config"
 	. "github.com/pingcap/check"
 	deadlockPb "github.com/pingcap/kvproto/pkg/deadlock"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/log"
 )
 
@@ -36,7 +37,7 @@ func (t *testLockwaiter) TestLockwaiterBasic(c *C) {
 	mgr := NewManager(&config.DefaultConf)
 
 	keyHash := uint64(100)
-	mgr.NewWaiter(1, 2, keyHash, 10)
+	mgr.NewWaiter(1, 2, keyHash, kvrpcpb.CommandPri_Normal, 10)
 
 	// basic check queue and waiter
 	q := mgr.waitingQueues[keyHash]
@@ -49,13 +50,13 @@ func (t *testLockwaiter) TestLockwaiterBasic(c *C) {
 	// check ready waiters
 	keysHash := make([]uint64, 0, 10)
 	keysHash = append(keysHash, keyHash)
-	rdyWaiter, _ := q.getOldestWaiter()
+	rdyWaiter, _ := q.getNextWaiter(QueuePolicyFIFO)
 	c.Assert(rdyWaiter.startTS, Equals, uint64(1))
 	c.Assert(rdyWaiter.LockTS, Equals, uint64(2))
 	c.Assert(rdyWaiter.KeyHash, Equals, uint64(100))
 
 	// basic wake up test
-	waiter = mgr.NewWaiter(3, 2, keyHash, 10)
+	waiter = mgr.NewWaiter(3, 2, keyHash, kvrpcpb.CommandPri_Normal, 10)
 	mgr.WakeUp(2, 222, keysHash)
 	res := <-waiter.ch
 	c.Assert(res.CommitTS, Equals, uint64(222))
@@ -65,7 +66,7 @@ func (t *testLockwaiter) TestLockwaiterBasic(c *C) {
 	c.Assert(q, IsNil)
 
 	// basic wake up for deadlock test
-	waiter = mgr.NewWaiter(3, 4, keyHash, 10)
+	waiter = mgr.NewWaiter(3, 4, keyHash, kvrpcpb.CommandPri_Normal, 10)
 	resp := &deadlockPb.DeadlockResponse{}
 	resp.Entry.Txn = 3
 	resp.Entry.WaitForTxn = 4
@@ -96,7 +97,7 @@ func (t *testLockwaiter) TestLockwaiterConcurrent(c *C) {
 		endWg.Add(1)
 		go func(num uint64) {
 			defer endWg.Done()
-			waiter := mgr.NewWaiter(num, waitForTxn, num*10, 100*time.Millisecond)
+			waiter := mgr.NewWaiter(num, waitForTxn, num*10, kvrpcpb.CommandPri_Normal, 100*time.Millisecond)
 			// i == numbers - 1 use CleanUp Waiter and the results will be timeout
 			if num == numbers-1 {
 				mgr.CleanUp(waiter)
@@ -138,3 +139,56 @@ func (t *testLockwaiter) TestLockwaiterConcurrent(c *C) {
 	}
 	endWg.Wait()
 }
+
+func (t *testLockwaiter) TestLockwaiterQueuePolicy(c *C) {
+	conf := config.DefaultConf
+	conf.PessimisticTxn.MaxWaitersPerKey = 3
+	mgr := NewManager(&conf)
+	c.Assert(mgr.policy, Equals, QueuePolicyFIFO)
+
+	keyHash := uint64(100)
+	low := mgr.NewWaiter(1, 10, keyHash, kvrpcpb.CommandPri_Low, time.Second)
+	normal := mgr.NewWaiter(3, 10, keyHash, kvrpcpb.CommandPri_Normal, time.Second)
+	high := mgr.NewWaiter(2, 10, keyHash, kvrpcpb.CommandPri_High, time.Second)
+	c.Assert(low, NotNil)
+	c.Assert(normal, NotNil)
+	c.Assert(high, NotNil)
+	// the queue of the key is full, the waiter is rejected
+	c.Assert(mgr.NewWaiter(4, 10, keyHash, kvrpcpb.CommandPri_High, time.Second), IsNil)
+	c.Assert(len(mgr.waitingQueues[keyHash].waiters), Equals, 3)
+
+	// fifo wakes up the smallest start ts first
+	mgr.WakeUp(10, 11, []uint64{keyHash})
+	c.Assert((<-low.ch).WakeupSleepTime, Equals, WakeUpThisWaiter)
+	c.Assert(len(mgr.waitingQueues[keyHash].waiters), Equals, 2)
+
+	// priority wakes up the highest priority first, then the smallest start ts
+	mgr.policy = QueuePolicyPriority
+	low = mgr.NewWaiter(1, 10, keyHash, kvrpcpb.CommandPri_Low, time.Second)
+	q := mgr.waitingQueues[keyHash]
+	var order []*Waiter
+	for len(q.waiters) > 0 {
+		w, _ := q.getNextWaiter(mgr.policy, mgr.agingDuration, time.Now())
+		order = append(order, w)
+	}
+	c.Assert(order, DeepEquals, []*Waiter{high, normal, low})
+
+	// the low priority waiter is promoted by the time it has waited
+	keyHash++
+	low = mgr.NewWaiter(1, 10, keyHash, kvrpcpb.CommandPri_Low, time.Second)
+	high = mgr.NewWaiter(2, 10, keyHash, kvrpcpb.CommandPri_High, time.Second)
+	low.waitStart = high.waitStart.Add(-3 * mgr.agingDuration)
+	q = mgr.waitingQueues[keyHash]
+	w, _ := q.getNextWaiter(mgr.policy, mgr.agingDuration, high.waitStart)
+	c.Assert(w, Equals, low)
+	c.Assert(q.waiters, DeepEquals, []*Waiter{high})
+	// without aging the high priority waiter is always woken up first
+	low = mgr.NewWaiter(1, 10, keyHash, kvrpcpb.CommandPri_Low, time.Second)
+	low.waitStart = high.waitStart.Add(-3 * mgr.agingDuration)
+	w, _ = q.getNextWaiter(mgr.policy, 0, high.waitStart)
+	c.Assert(w, Equals, high)
+
+	c.Assert(ParseQueuePolicy("priority"), Equals, QueuePolicyPriority)
+	c.Assert(ParseQueuePolicy("fifo"), Equals, QueuePolicyFIFO)
+	c.Assert(ParseQueuePolicy("unknown"), Equals, QueuePolicyFIFO)
+}